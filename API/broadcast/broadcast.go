@@ -0,0 +1,149 @@
+// Package broadcast fans newly ingested reports out to live subscribers
+// such as the SSE and WebSocket endpoints.
+package broadcast
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+// ErrSlowConsumer is the reason a subscription is closed when it falls so
+// far behind that its buffer fills. Publishing never blocks on subscribers.
+var ErrSlowConsumer = errors.New("subscriber too slow")
+
+// ErrClosed is the reason subscriptions are closed when the broadcaster
+// shuts down.
+var ErrClosed = errors.New("broadcaster closed")
+
+// Broadcaster delivers published reports to every subscriber and keeps the
+// most recent ones so reconnecting clients can resume where they left off.
+type Broadcaster struct {
+	mu      sync.Mutex
+	subs    map[*Subscription]struct{}
+	history []models.StormReport
+	limit   int
+	closed  bool
+}
+
+// New returns a broadcaster that remembers the last historySize reports for
+// resuming subscribers.
+func New(historySize int) *Broadcaster {
+	return &Broadcaster{subs: map[*Subscription]struct{}{}, limit: historySize}
+}
+
+// Subscription receives reports on C until it's closed, either by the
+// subscriber or by the broadcaster. Err reports why it was closed.
+type Subscription struct {
+	C <-chan models.StormReport
+
+	ch  chan models.StormReport
+	b   *Broadcaster
+	err error
+}
+
+// Publish sends report to every subscriber. Subscribers whose buffers are
+// full are dropped with ErrSlowConsumer.
+func (b *Broadcaster) Publish(report models.StormReport) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	if b.limit > 0 {
+		if len(b.history) == b.limit {
+			copy(b.history, b.history[1:])
+			b.history = b.history[:b.limit-1]
+		}
+		b.history = append(b.history, report)
+	}
+
+	for sub := range b.subs {
+		select {
+		case sub.ch <- report:
+		default:
+			b.drop(sub, ErrSlowConsumer)
+		}
+	}
+}
+
+// EventID identifies a published report for resuming: its ID and revision,
+// so each revision of a report is told apart from the others. Reports stored
+// before revisions were numbered count as revision 1.
+func EventID(report models.StormReport) string {
+	return fmt.Sprintf("%s:%d", report.ID, max(report.Revision, 1))
+}
+
+// Subscribe registers a subscriber with room for buffer pending reports.
+// When lastID is set, the reports published after the most recent one with
+// that EventID are returned for replay; found is false if lastID is no longer in
+// the history, in which case the caller should resynchronise.
+func (b *Broadcaster) Subscribe(buffer int, lastID string) (sub *Subscription, replay []models.StormReport, found bool) {
+	ch := make(chan models.StormReport, buffer)
+	sub = &Subscription{C: ch, ch: ch, b: b}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		sub.err = ErrClosed
+		close(ch)
+		return sub, nil, lastID == ""
+	}
+	b.subs[sub] = struct{}{}
+
+	if lastID == "" {
+		return sub, nil, true
+	}
+	for i := len(b.history) - 1; i >= 0; i-- {
+		if EventID(b.history[i]) == lastID {
+			replay = append(replay, b.history[i+1:]...)
+			return sub, replay, true
+		}
+	}
+	return sub, nil, false
+}
+
+// Subscribers returns the number of live subscriptions.
+func (b *Broadcaster) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// Close drops every subscriber and stops accepting reports.
+func (b *Broadcaster) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		b.drop(sub, ErrClosed)
+	}
+	b.closed = true
+}
+
+// drop must be called with b.mu held.
+func (b *Broadcaster) drop(sub *Subscription, reason error) {
+	if _, ok := b.subs[sub]; !ok {
+		return
+	}
+	delete(b.subs, sub)
+	sub.err = reason
+	close(sub.ch)
+}
+
+// Close unsubscribes. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	s.b.drop(s, nil)
+}
+
+// Err returns why the broadcaster closed the subscription, or nil if it is
+// still open or was closed by the subscriber. Read it after C is closed.
+func (s *Subscription) Err() error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	return s.err
+}
@@ -0,0 +1,67 @@
+package broadcast_test
+
+import (
+	"testing"
+
+	"github.com/jonathanface/storm-reporter/API/broadcast"
+	"github.com/jonathanface/storm-reporter/API/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroadcaster_PublishAndResume(t *testing.T) {
+	b := broadcast.New(3)
+	sub, replay, found := b.Subscribe(4, "")
+	assert.True(t, found)
+	assert.Empty(t, replay)
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		b.Publish(models.StormReport{ID: id})
+	}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		assert.Equal(t, id, (<-sub.C).ID)
+	}
+	sub.Close()
+	sub.Close()
+	assert.Equal(t, 0, b.Subscribers())
+
+	// "a" has fallen out of the three-report history.
+	resumed, replay, found := b.Subscribe(4, "b:1")
+	assert.True(t, found)
+	assert.Equal(t, []models.StormReport{{ID: "c"}, {ID: "d"}}, replay)
+	resumed.Close()
+
+	_, replay, found = b.Subscribe(4, "a:1")
+	assert.False(t, found)
+	assert.Empty(t, replay)
+
+	// Each revision of a report is its own event, so a client that saw
+	// the first resumes after it rather than after the last.
+	b.Publish(models.StormReport{ID: "d", Revision: 2})
+	b.Publish(models.StormReport{ID: "d", Revision: 3})
+	_, replay, found = b.Subscribe(4, "d:2")
+	assert.True(t, found)
+	assert.Equal(t, []models.StormReport{{ID: "d", Revision: 3}}, replay)
+}
+
+func TestBroadcaster_DropsSlowSubscriber(t *testing.T) {
+	b := broadcast.New(0)
+	slow, _, _ := b.Subscribe(1, "")
+	fast, _, _ := b.Subscribe(2, "")
+
+	b.Publish(models.StormReport{ID: "a"})
+	b.Publish(models.StormReport{ID: "b"})
+
+	assert.Equal(t, "a", (<-slow.C).ID)
+	_, open := <-slow.C
+	assert.False(t, open)
+	assert.ErrorIs(t, slow.Err(), broadcast.ErrSlowConsumer)
+
+	assert.Equal(t, "a", (<-fast.C).ID)
+	assert.Equal(t, "b", (<-fast.C).ID)
+	assert.NoError(t, fast.Err())
+
+	b.Close()
+	_, open = <-fast.C
+	assert.False(t, open)
+	assert.ErrorIs(t, fast.Err(), broadcast.ErrClosed)
+}
@@ -0,0 +1,60 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (dao *StormDAO) CreateAPIKey(key models.APIKey) error {
+	if _, err := dao.apiKeys.InsertOne(context.TODO(), key); err != nil {
+		return fmt.Errorf("failed to store API key: %w", err)
+	}
+	return nil
+}
+
+func (dao *StormDAO) ListAPIKeys() ([]models.APIKey, error) {
+	cursor, err := dao.apiKeys.Find(context.TODO(), bson.M{},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	defer cursor.Close(context.TODO())
+
+	keys := []models.APIKey{}
+	if err := cursor.All(context.TODO(), &keys); err != nil {
+		return nil, fmt.Errorf("failed to decode API keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (dao *StormDAO) GetAPIKeyByHash(hash string) (*models.APIKey, error) {
+	var key models.APIKey
+	err := dao.apiKeys.FindOne(context.TODO(), bson.M{"hash": hash}).Decode(&key)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, models.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	return &key, nil
+}
+
+func (dao *StormDAO) RevokeAPIKey(id string) error {
+	res, err := dao.apiKeys.UpdateOne(context.TODO(),
+		bson.M{"_id": id, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}})
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return models.ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (dao *StormDAO) CreateStormReport(report models.StormReport, source models.ChangeSource) (models.StormReport, error) {
+	ctx := context.TODO()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	report.ID = models.ReportID(report)
+	report.Revision, report.UpdatedAt = 1, &now
+
+	doc, err := reportDocument(report, source)
+	if err != nil {
+		return report, err
+	}
+	if err := dao.insertReport(ctx, doc); mongo.IsDuplicateKeyError(err) {
+		return report, models.ErrConflict
+	} else if err != nil {
+		return report, fmt.Errorf("failed to insert storm report: %w", err)
+	}
+
+	return report, dao.recordAudit(models.AuditEntry{
+		Action:   models.AuditCreate,
+		ReportID: report.ID,
+		After:    &report,
+	}, source)
+}
+
+func (dao *StormDAO) UpdateStormReport(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+	ctx := context.TODO()
+	result := models.UpsertResult{ID: report.ID, Report: report}
+
+	existing, err := dao.GetStormReport(ctx, report.ID)
+	if err != nil {
+		return result, err
+	}
+	if existing.Deleted {
+		return result, models.ErrNotFound
+	}
+	if existing.Revision != report.Revision {
+		return result, models.ErrStaleRevision
+	}
+	changes := models.DiffReports(*existing, report)
+	if existing.Date != report.Date {
+		changes["date"] = models.FieldChange{Old: existing.Date, New: report.Date}
+	}
+	if len(changes) == 0 {
+		return result, nil
+	}
+
+	// The update only matches the revision read above, so a change made
+	// since isn't overwritten, and the revision is only recorded once the
+	// update has been made.
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	report.Revision, report.UpdatedAt = existing.NextRevision(), &now
+	doc, err := reportDocument(report, source)
+	if err != nil {
+		return result, err
+	}
+	filter := revisionFilter(bson.M{"id": report.ID, "deleted": bson.M{"$ne": true}}, existing.Revision)
+	res, err := dao.collection.UpdateOne(ctx, filter, reportUpdate(doc, report))
+	if err != nil {
+		return result, fmt.Errorf("failed to update storm report: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		// It was deleted or changed since it was read.
+		current, err := dao.GetStormReport(ctx, report.ID)
+		if err != nil {
+			return result, err
+		}
+		if current.Deleted {
+			return result, models.ErrNotFound
+		}
+		return result, models.ErrStaleRevision
+	}
+
+	revision := models.ReportRevision{
+		ReportID:  report.ID,
+		Previous:  *existing,
+		Changes:   changes,
+		Source:    source,
+		ChangedAt: now,
+	}
+	if _, err := dao.revisions.InsertOne(ctx, revision); err != nil {
+		return result, fmt.Errorf("failed to record report revision: %w", err)
+	}
+	result.Report, result.Changed = report, true
+
+	return result, dao.recordAudit(models.AuditEntry{
+		Action:   models.AuditUpdate,
+		ReportID: report.ID,
+		Before:   existing,
+		After:    &report,
+		Changes:  changes,
+	}, source)
+}
+
+func (dao *StormDAO) DeleteStormReport(id string, source models.ChangeSource) (models.StormReport, error) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	var before models.StormReport
+	err := dao.collection.FindOneAndUpdate(context.TODO(),
+		bson.M{"id": id, "deleted": bson.M{"$ne": true}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"deleted":   true,
+			"deletedAt": now,
+			"writtenAt": "$$NOW",
+			"revision":  nextRevision,
+			"updatedAt": now,
+		}}}},
+	).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return before, models.ErrNotFound
+	}
+	if err != nil {
+		return before, fmt.Errorf("failed to delete storm report: %w", err)
+	}
+
+	after := before
+	after.Deleted, after.DeletedAt = true, &now
+	after.Revision, after.UpdatedAt = before.NextRevision(), &now
+	return after, dao.recordAudit(models.AuditEntry{
+		Action:   models.AuditDelete,
+		ReportID: id,
+		Before:   &before,
+		After:    &after,
+	}, source)
+}
+
+func (dao *StormDAO) GetAuditLog(query models.AuditQuery) ([]models.AuditEntry, error) {
+	filter := bson.M{}
+	if query.ReportID != "" {
+		filter["reportId"] = query.ReportID
+	}
+	if query.Actor != "" {
+		filter["actor"] = query.Actor
+	}
+	if query.Action != "" {
+		filter["action"] = query.Action
+	}
+	at := bson.M{}
+	if !query.Since.IsZero() {
+		at["$gte"] = query.Since
+	}
+	if !query.Until.IsZero() {
+		at["$lte"] = query.Until
+	}
+	if len(at) > 0 {
+		filter["at"] = at
+	}
+
+	// Entries written in the same millisecond fall back to insertion
+	// order, which ObjectIDs follow.
+	opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}})
+	if query.Limit > 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+	cursor, err := dao.audit.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer cursor.Close(context.TODO())
+
+	entries := []models.AuditEntry{}
+	if err := cursor.All(context.TODO(), &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode audit log: %w", err)
+	}
+	return entries, nil
+}
+
+// recordAudit stamps entry with its source and time and stores it. The
+// change it describes has already been made, so a failure here is reported
+// but not undone.
+func (dao *StormDAO) recordAudit(entry models.AuditEntry, source models.ChangeSource) error {
+	entry.Actor = source.Actor
+	entry.Reason = source.Reason
+	entry.At = time.Now().UTC()
+	if _, err := dao.audit.InsertOne(context.TODO(), entry); err != nil {
+		return fmt.Errorf("failed to record audit entry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package dao
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+// CachedStormDAO is an LRU cache of query results in front of another DAO.
+// Past days almost never change, so list, stats and search results are
+// kept until a write lands on a day their date range covers. Writes made
+// through the cache invalidate it directly; writes made elsewhere (another
+// replica, for instance) must be reported with Invalidate.
+type CachedStormDAO struct {
+	models.StormDAOInterface
+
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	// generation is bumped by every invalidation so results fetched while
+	// one happened aren't cached.
+	generation uint64
+}
+
+// forgetter is implemented by DAOs that share reads in flight, such as
+// CoalescingStormDAO. Reads started before an invalidation can't be joined
+// after it, or their results would be cached under the new generation.
+type forgetter interface {
+	Forget()
+}
+
+type cacheEntry struct {
+	key        string
+	start, end time.Time
+	value      interface{}
+}
+
+// NewCachedStormDAO wraps next with a cache holding up to size results.
+func NewCachedStormDAO(next models.StormDAOInterface, size int) *CachedStormDAO {
+	return &CachedStormDAO{
+		StormDAOInterface: next,
+		size:              size,
+		entries:           map[string]*list.Element{},
+		lru:               list.New(),
+	}
+}
+
+func (c *CachedStormDAO) GetStormReports(ctx context.Context, query models.StormQuery) ([]models.StormReport, error) {
+	normalized, err := json.Marshal(query)
+	if err != nil {
+		return c.StormDAOInterface.GetStormReports(ctx, query)
+	}
+	key := "reports|" + string(normalized)
+	if v, ok := c.get(key); ok {
+		return append([]models.StormReport(nil), v.([]models.StormReport)...), nil
+	}
+	generation := c.currentGeneration()
+	reports, err := c.StormDAOInterface.GetStormReports(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, query.Start, query.End, generation, append([]models.StormReport(nil), reports...))
+	return reports, nil
+}
+
+func (c *CachedStormDAO) GetStormStats(ctx context.Context, query models.StatsQuery) ([]models.StatsRow, error) {
+	normalized, err := json.Marshal(query)
+	if err != nil {
+		return c.StormDAOInterface.GetStormStats(ctx, query)
+	}
+	key := "stats|" + string(normalized)
+	if v, ok := c.get(key); ok {
+		return append([]models.StatsRow(nil), v.([]models.StatsRow)...), nil
+	}
+	generation := c.currentGeneration()
+	rows, err := c.StormDAOInterface.GetStormStats(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, query.Start, query.End, generation, append([]models.StatsRow(nil), rows...))
+	return rows, nil
+}
+
+func (c *CachedStormDAO) SearchStormReports(ctx context.Context, query models.StormQuery, q string) ([]models.SearchResult, error) {
+	normalized, err := json.Marshal(query)
+	if err != nil {
+		return c.StormDAOInterface.SearchStormReports(ctx, query, q)
+	}
+	key := "search|" + string(normalized) + "|" + strings.TrimSpace(q)
+	if v, ok := c.get(key); ok {
+		return append([]models.SearchResult(nil), v.([]models.SearchResult)...), nil
+	}
+	generation := c.currentGeneration()
+	results, err := c.StormDAOInterface.SearchStormReports(ctx, query, q)
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, query.Start, query.End, generation, append([]models.SearchResult(nil), results...))
+	return results, nil
+}
+
+func (c *CachedStormDAO) UpsertStormReport(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+	result, err := c.StormDAOInterface.UpsertStormReport(report, source)
+	if err == nil && (result.Created || result.Changed) {
+		c.Invalidate(result.Report)
+	}
+	return result, err
+}
+
+func (c *CachedStormDAO) WithdrawStormReport(id string, source models.ChangeSource) (models.UpsertResult, error) {
+	result, err := c.StormDAOInterface.WithdrawStormReport(id, source)
+	if err == nil && result.Changed {
+		c.Invalidate(result.Report)
+	}
+	return result, err
+}
+
+func (c *CachedStormDAO) CreateStormReport(report models.StormReport, source models.ChangeSource) (models.StormReport, error) {
+	// A write can land and still fail afterwards, recording its audit
+	// entry, so only failures known to have changed nothing are skipped.
+	created, err := c.StormDAOInterface.CreateStormReport(report, source)
+	if !errors.Is(err, models.ErrConflict) {
+		c.Invalidate(created)
+	}
+	return created, err
+}
+
+func (c *CachedStormDAO) UpdateStormReport(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+	// An update can move a report to another day, so both days are dropped.
+	previous, _ := c.StormDAOInterface.GetStormReport(context.TODO(), report.ID)
+	result, err := c.StormDAOInterface.UpdateStormReport(report, source)
+	if result.Changed {
+		if previous != nil {
+			c.Invalidate(*previous)
+		}
+		c.Invalidate(result.Report)
+	}
+	return result, err
+}
+
+func (c *CachedStormDAO) DeleteStormReport(id string, source models.ChangeSource) (models.StormReport, error) {
+	deleted, err := c.StormDAOInterface.DeleteStormReport(id, source)
+	if deleted.ID != "" {
+		c.Invalidate(deleted)
+	}
+	return deleted, err
+}
+
+func (c *CachedStormDAO) PurgeStormReports(query models.PurgeQuery, dryRun bool, source models.ChangeSource) (models.PurgeResult, error) {
+	result, err := c.StormDAOInterface.PurgeStormReports(query, dryRun, source)
+	if !dryRun {
+		c.InvalidateAll()
+	}
+	return result, err
+}
+
+// InvalidateAll empties the cache.
+func (c *CachedStormDAO) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forget()
+	c.generation++
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+}
+
+// Invalidate drops every cached result whose date range covers the report.
+func (c *CachedStormDAO) Invalidate(report models.StormReport) {
+	date, err := models.ParseReportDate(report.Date)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forget()
+	c.generation++
+	for key, el := range c.entries {
+		entry := el.Value.(*cacheEntry)
+		// A date we can't place could belong to any range.
+		if err != nil || (!date.Before(entry.start) && !date.After(entry.end)) {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// forget is called with c.mu held, so no read can take the new generation
+// and still join a read started before it.
+func (c *CachedStormDAO) forget() {
+	if f, ok := c.StormDAOInterface.(forgetter); ok {
+		f.Forget()
+	}
+}
+
+// Len returns the number of cached results.
+func (c *CachedStormDAO) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *CachedStormDAO) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+func (c *CachedStormDAO) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+func (c *CachedStormDAO) put(key string, start, end time.Time, generation uint64, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*cacheEntry).value = value
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, start: start, end: end, value: value})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,159 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrChangeStreamsUnsupported is returned by WatchReports when the server is
+// a standalone mongod, which has no oplog to stream from.
+var ErrChangeStreamsUnsupported = errors.New("change streams require a replica set")
+
+// Server error codes for change streams opened against a standalone server
+// and for resume tokens that have fallen off the oplog.
+const (
+	codeChangeStreamNotReplicaSet = 40573
+	codeChangeStreamHistoryLost   = 286
+)
+
+type streamState struct {
+	ID          string    `bson:"_id"`
+	ResumeToken bson.Raw  `bson:"resumeToken"`
+	UpdatedAt   time.Time `bson:"updatedAt"`
+}
+
+// WatchReports tails the reports collection with a change stream and calls
+// publish for every inserted or updated report until ctx is cancelled or
+// the stream fails. The resume token is persisted under consumer after
+// each event so a restarted replica picks up where it stopped.
+func (dao *StormDAO) WatchReports(ctx context.Context, consumer string, publish func(models.StormReport)) error {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+
+	var state streamState
+	err := dao.streamState.FindOne(ctx, bson.M{"_id": consumer}).Decode(&state)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("failed to load resume token: %w", err)
+	}
+	if len(state.ResumeToken) > 0 {
+		opts.SetResumeAfter(state.ResumeToken)
+	}
+
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"operationType": bson.M{"$in": bson.A{"insert", "update", "replace"}},
+	}}}}
+	stream, err := dao.collection.Watch(ctx, pipeline, opts)
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorCode(codeChangeStreamHistoryLost) {
+		// The saved position is gone; start again from now.
+		stream, err = dao.collection.Watch(ctx, pipeline, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+	}
+	if errors.As(err, &serverErr) && serverErr.HasErrorCode(codeChangeStreamNotReplicaSet) {
+		return ErrChangeStreamsUnsupported
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open change stream: %w", err)
+	}
+	defer stream.Close(context.TODO())
+
+	for stream.Next(ctx) {
+		var event struct {
+			FullDocument *models.StormReport `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			return fmt.Errorf("failed to decode change event: %w", err)
+		}
+		if event.FullDocument != nil && event.FullDocument.ID != "" {
+			publish(*event.FullDocument)
+		}
+
+		_, err := dao.streamState.UpdateOne(ctx,
+			bson.M{"_id": consumer},
+			bson.M{"$set": bson.M{"resumeToken": stream.ResumeToken(), "updatedAt": time.Now().UTC()}},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return fmt.Errorf("failed to save resume token: %w", err)
+		}
+	}
+	if err := stream.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("change stream failed: %w", err)
+	}
+	return nil
+}
+
+// pollOverlap is how far behind the latest write each poll reads again, to
+// catch writes stamped earlier but committed after the previous poll.
+const pollOverlap = 5 * time.Second
+
+// PollReports is the fallback for deployments without change streams. It
+// checks for reports written since the last poll every interval and calls
+// publish for each, until ctx is cancelled or a query fails. Only writes
+// made after polling starts, by the server's clock, are published. Each
+// poll reads again from pollOverlap behind the latest write it has seen,
+// skipping writes it has already published.
+func (dao *StormDAO) PollReports(ctx context.Context, interval time.Duration, publish func(models.StormReport)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var hello struct {
+		LocalTime time.Time `bson:"localTime"`
+	}
+	err := dao.client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return fmt.Errorf("failed to read MongoDB server time: %w", err)
+	}
+	start := hello.LocalTime.UTC()
+	since := start
+	// Writes already published, by report and time written, so the
+	// overlapping reads don't repeat them.
+	seen := map[string]time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		from := since.Add(-pollOverlap)
+		if from.Before(start) {
+			from = start
+		}
+		cursor, err := dao.collection.Find(ctx,
+			bson.M{"id": bson.M{"$exists": true}, "writtenAt": bson.M{"$gte": from}},
+			options.Find().SetSort(bson.D{{Key: "writtenAt", Value: 1}}))
+		if err != nil {
+			return fmt.Errorf("failed to poll MongoDB: %w", err)
+		}
+		var written []struct {
+			models.StormReport `bson:",inline"`
+			WrittenAt          time.Time `bson:"writtenAt"`
+		}
+		err = cursor.All(ctx, &written)
+		if err != nil {
+			return fmt.Errorf("failed to decode polled reports: %w", err)
+		}
+
+		for _, w := range written {
+			key := w.ID + "@" + w.WrittenAt.String()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = w.WrittenAt
+			if w.WrittenAt.After(since) {
+				since = w.WrittenAt
+			}
+			publish(w.StormReport)
+		}
+		for key, at := range seen {
+			if at.Before(since.Add(-pollOverlap)) {
+				delete(seen, key)
+			}
+		}
+	}
+}
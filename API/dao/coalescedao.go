@@ -0,0 +1,153 @@
+package dao
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+	"golang.org/x/sync/singleflight"
+)
+
+// CoalescingStormDAO makes concurrent identical reads share one call to the
+// DAO it wraps. Every waiter gets the leader's result or error, and gets
+// its own copy of the result slice, unless its context is done first, when
+// it gets the context's error. The shared call carries on for the others,
+// since it runs without any one caller's cancellation. Writes pass straight
+// through.
+type CoalescingStormDAO struct {
+	models.StormDAOInterface
+
+	group     singleflight.Group
+	calls     atomic.Int64
+	coalesced atomic.Int64
+
+	mu sync.Mutex
+	// inFlight counts the calls running under each key, so Forget can
+	// find them.
+	inFlight map[string]int
+}
+
+// CoalescingStats counts reads that reached the wrapped DAO and reads that
+// were answered by joining a call already in flight.
+type CoalescingStats struct {
+	Calls     int64 `json:"calls"`
+	Coalesced int64 `json:"coalesced"`
+}
+
+func NewCoalescingStormDAO(next models.StormDAOInterface) *CoalescingStormDAO {
+	return &CoalescingStormDAO{StormDAOInterface: next, inFlight: map[string]int{}}
+}
+
+func (c *CoalescingStormDAO) Stats() CoalescingStats {
+	return CoalescingStats{Calls: c.calls.Load(), Coalesced: c.coalesced.Load()}
+}
+
+func (c *CoalescingStormDAO) GetStormReports(ctx context.Context, query models.StormQuery) ([]models.StormReport, error) {
+	normalized, err := json.Marshal(query)
+	if err != nil {
+		return c.StormDAOInterface.GetStormReports(ctx, query)
+	}
+	v, shared, err := c.do(ctx, "reports|"+string(normalized), func(ctx context.Context) (interface{}, error) {
+		return c.StormDAOInterface.GetStormReports(ctx, query)
+	})
+	reports, _ := v.([]models.StormReport)
+	if shared {
+		reports = append([]models.StormReport(nil), reports...)
+	}
+	return reports, err
+}
+
+func (c *CoalescingStormDAO) GetStormStats(ctx context.Context, query models.StatsQuery) ([]models.StatsRow, error) {
+	normalized, err := json.Marshal(query)
+	if err != nil {
+		return c.StormDAOInterface.GetStormStats(ctx, query)
+	}
+	v, shared, err := c.do(ctx, "stats|"+string(normalized), func(ctx context.Context) (interface{}, error) {
+		return c.StormDAOInterface.GetStormStats(ctx, query)
+	})
+	rows, _ := v.([]models.StatsRow)
+	if shared {
+		rows = append([]models.StatsRow(nil), rows...)
+	}
+	return rows, err
+}
+
+func (c *CoalescingStormDAO) SearchStormReports(ctx context.Context, query models.StormQuery, q string) ([]models.SearchResult, error) {
+	normalized, err := json.Marshal(query)
+	if err != nil {
+		return c.StormDAOInterface.SearchStormReports(ctx, query, q)
+	}
+	v, shared, err := c.do(ctx, "search|"+string(normalized)+"|"+q, func(ctx context.Context) (interface{}, error) {
+		return c.StormDAOInterface.SearchStormReports(ctx, query, q)
+	})
+	results, _ := v.([]models.SearchResult)
+	if shared {
+		results = append([]models.SearchResult(nil), results...)
+	}
+	return results, err
+}
+
+func (c *CoalescingStormDAO) GetStormReport(ctx context.Context, id string) (*models.StormReport, error) {
+	v, shared, err := c.do(ctx, "report|"+id, func(ctx context.Context) (interface{}, error) {
+		return c.StormDAOInterface.GetStormReport(ctx, id)
+	})
+	report, _ := v.(*models.StormReport)
+	if shared && report != nil {
+		copied := *report
+		report = &copied
+	}
+	return report, err
+}
+
+func (c *CoalescingStormDAO) GetStormReportHistory(ctx context.Context, id string) ([]models.ReportRevision, error) {
+	v, shared, err := c.do(ctx, "history|"+id, func(ctx context.Context) (interface{}, error) {
+		return c.StormDAOInterface.GetStormReportHistory(ctx, id)
+	})
+	revisions, _ := v.([]models.ReportRevision)
+	if shared {
+		revisions = append([]models.ReportRevision(nil), revisions...)
+	}
+	return revisions, err
+}
+
+// Forget stops reads in flight from being joined, so a read that starts
+// after a write gets a result fetched after it too. Callers already waiting
+// on those reads still get their results. CachedStormDAO calls it whenever
+// it's invalidated.
+func (c *CoalescingStormDAO) Forget() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.inFlight {
+		c.group.Forget(key)
+	}
+}
+
+func (c *CoalescingStormDAO) do(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, bool, error) {
+	var leader atomic.Bool
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		leader.Store(true)
+		c.calls.Add(1)
+		c.mu.Lock()
+		c.inFlight[key]++
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			if c.inFlight[key]--; c.inFlight[key] == 0 {
+				delete(c.inFlight, key)
+			}
+			c.mu.Unlock()
+		}()
+		return fn(context.WithoutCancel(ctx))
+	})
+	select {
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case res := <-ch:
+		if !leader.Load() {
+			c.coalesced.Add(1)
+		}
+		return res.Val, res.Shared, res.Err
+	}
+}
@@ -0,0 +1,302 @@
+package dao_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jonathanface/storm-reporter/API/dao"
+	"github.com/jonathanface/storm-reporter/API/dao/daotest"
+	"github.com/jonathanface/storm-reporter/API/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestPostgresStormDAO(t *testing.T) {
+	url := os.Getenv("POSTGRES_TEST_URL")
+	if url == "" {
+		t.Skip("POSTGRES_TEST_URL is not set")
+	}
+	daotest.Run(t, func(t *testing.T) models.StormDAOInterface {
+		d, err := dao.NewPostgresStormDAO(url)
+		require.NoError(t, err)
+		t.Cleanup(func() { d.Disconnect() })
+		require.NoError(t, d.Migrate())
+
+		conn, err := pgx.Connect(context.Background(), url)
+		require.NoError(t, err)
+		defer conn.Close(context.Background())
+		_, err = conn.Exec(context.Background(), "TRUNCATE storm_reports, storm_report_revisions, storm_report_audit")
+		require.NoError(t, err)
+		return d
+	})
+}
+
+// mongoTestURI returns the server to run Mongo tests against, skipping
+// the test if there is none. Without MONGO_TEST_URI, a local server is used
+// if one answers.
+func mongoTestURI(t *testing.T) string {
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri != "" {
+		return uri
+	}
+	uri = "mongodb://localhost:27017"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetServerSelectionTimeout(time.Second))
+	if err == nil {
+		err = client.Ping(ctx, nil)
+		client.Disconnect(ctx)
+	}
+	if err != nil {
+		t.Skipf("MONGO_TEST_URI is not set and there is no local MongoDB: %v", err)
+	}
+	return uri
+}
+
+// newMongoDAO returns a DAO on a new database, dropped when the test ends.
+func newMongoDAO(t *testing.T, uri string) (*dao.StormDAO, *mongo.Database) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+	require.NoError(t, err)
+	db := client.Database(fmt.Sprintf("storm_reporter_test_%d", time.Now().UnixNano()))
+	d, err := dao.NewStormDAO(uri, db.Name(), "reports")
+	require.NoError(t, err)
+	require.NoError(t, d.EnsureIndexes())
+
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+		d.Disconnect()
+	})
+	return d, db
+}
+
+func TestMongoStormDAO(t *testing.T) {
+	uri := mongoTestURI(t)
+	daotest.Run(t, func(t *testing.T) models.StormDAOInterface {
+		d, _ := newMongoDAO(t, uri)
+		return d
+	})
+}
+
+func TestMongoMigrateReportDates(t *testing.T) {
+	d, db := newMongoDAO(t, mongoTestURI(t))
+	_, err := db.Collection("reports").InsertMany(context.Background(), []any{
+		bson.M{"id": "old", "date": "999999999", "time": 1200, "type": "hail"},
+		bson.M{"id": "millis", "date": "1718000000000", "time": 1200, "type": "wind"},
+		bson.M{"id": "odd", "date": "2024-12-09", "time": 1200, "type": "wind"},
+	})
+	require.NoError(t, err)
+
+	// Dates stored as strings can still be read before they're migrated.
+	got, err := d.GetStormReport(context.Background(), "old")
+	require.NoError(t, err)
+	assert.Equal(t, "999999999", got.Date)
+
+	migrator := d.Migrator("test")
+	steps, err := migrator.Migrate(context.Background(), dao.LatestMigration)
+	require.NoError(t, err)
+	assert.Equal(t, []dao.MigrationStep{{Version: 1, Name: "report_dates"}}, steps)
+	steps, err = migrator.Migrate(context.Background(), dao.LatestMigration)
+	require.NoError(t, err)
+	assert.Empty(t, steps, "applied migrations don't run again")
+	var doc bson.M
+	require.NoError(t, db.Collection("reports").FindOne(context.Background(), bson.M{"id": "millis"}).Decode(&doc))
+	assert.IsType(t, primitive.DateTime(0), doc["date"])
+
+	reports, err := d.GetStormReports(context.Background(), models.NewStormQuery(time.Unix(900000000, 0), time.Unix(1718000000, 0)))
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+	assert.Equal(t, "999999999", reports[0].Date)
+	assert.Equal(t, "1718000000", reports[1].Date)
+
+	_, err = migrator.Migrate(context.Background(), 0)
+	require.NoError(t, err)
+	require.NoError(t, db.Collection("reports").FindOne(context.Background(), bson.M{"id": "millis"}).Decode(&doc))
+	assert.Equal(t, "1718000000", doc["date"], "rolled back to second strings")
+}
+
+func TestMongoMigrator(t *testing.T) {
+	d, db := newMongoDAO(t, mongoTestURI(t))
+	ctx := context.Background()
+	var ran []string
+	step := func(name string) func(context.Context, *dao.StormDAO) error {
+		return func(context.Context, *dao.StormDAO) error {
+			ran = append(ran, name)
+			return nil
+		}
+	}
+	migrations := []dao.MongoMigration{
+		{Version: 1, Name: "one", Up: step("up 1"), Down: step("down 1")},
+		{Version: 2, Name: "two", Up: step("up 2"), Down: step("down 2")},
+		{Version: 3, Name: "three", Up: step("up 3")},
+	}
+	migrator, err := dao.NewMongoMigrator(d, "test", migrations)
+	require.NoError(t, err)
+
+	plan, err := migrator.Plan(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []dao.MigrationStep{{Version: 1, Name: "one"}, {Version: 2, Name: "two"}}, plan)
+	assert.Empty(t, ran, "planning runs nothing")
+	_, err = migrator.Apply(ctx, 2, plan[:1])
+	assert.ErrorContains(t, err, "plan again")
+	assert.Empty(t, ran, "a plan that's out of date runs nothing")
+
+	_, err = migrator.Migrate(ctx, dao.LatestMigration)
+	require.NoError(t, err)
+	_, err = migrator.Migrate(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"up 1", "up 2", "up 3"}, ran)
+
+	_, err = migrator.Plan(ctx, 1)
+	assert.ErrorContains(t, err, "can't be rolled back", "migration 3 has no down")
+
+	// An older release keeps the newer release's migrations on startup, but
+	// can't roll them back.
+	older, err := dao.NewMongoMigrator(d, "older", migrations[:2])
+	require.NoError(t, err)
+	plan, err = older.Plan(ctx, dao.LatestMigration)
+	require.NoError(t, err)
+	assert.Empty(t, plan)
+	statuses, err := older.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 3)
+	assert.True(t, statuses[2].Unknown)
+	_, err = older.Plan(ctx, 1)
+	assert.ErrorContains(t, err, "newer release")
+
+	_, err = db.Collection("reports_migrations").DeleteOne(ctx, bson.M{"_id": 3})
+	require.NoError(t, err)
+	ran = nil
+	steps, err := migrator.Migrate(ctx, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []dao.MigrationStep{{Version: 2, Name: "two", Down: true}, {Version: 1, Name: "one", Down: true}}, steps)
+	assert.Equal(t, []string{"down 2", "down 1"}, ran)
+
+	// A held lock makes other replicas wait until it's released or expires.
+	_, err = db.Collection("reports_migration_lock").InsertOne(ctx, bson.M{"_id": "migrations", "owner": "other", "expiresAt": time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	waitCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	_, err = migrator.Migrate(waitCtx, dao.LatestMigration)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = db.Collection("reports_migration_lock").DeleteOne(ctx, bson.M{"_id": "migrations"})
+	require.NoError(t, err)
+	_, err = migrator.Migrate(ctx, dao.LatestMigration)
+	require.NoError(t, err)
+	n, err := db.Collection("reports_migration_lock").CountDocuments(ctx, bson.M{})
+	require.NoError(t, err)
+	assert.Zero(t, n, "the lock is released after the run")
+}
+
+func TestNewMongoMigrator(t *testing.T) {
+	up := func(context.Context, *dao.StormDAO) error { return nil }
+	for name, migrations := range map[string][]dao.MongoMigration{
+		"zero version":   {{Version: 0, Name: "zero", Up: up}},
+		"no name":        {{Version: 1, Up: up}},
+		"no up":          {{Version: 1, Name: "one"}},
+		"out of order":   {{Version: 2, Name: "two", Up: up}, {Version: 1, Name: "one", Up: up}},
+		"repeat version": {{Version: 1, Name: "one", Up: up}, {Version: 1, Name: "again", Up: up}},
+	} {
+		_, err := dao.NewMongoMigrator(nil, "test", migrations)
+		assert.Error(t, err, name)
+	}
+	_, err := dao.NewMongoMigrator(nil, "test", []dao.MongoMigration{{Version: 1, Name: "one", Up: up}, {Version: 3, Name: "three", Up: up}})
+	assert.NoError(t, err, "versions may skip")
+}
+
+func TestSQLiteStormDAO(t *testing.T) {
+	daotest.Run(t, func(t *testing.T) models.StormDAOInterface {
+		d, err := dao.NewSQLiteStormDAO(filepath.Join(t.TempDir(), "storms.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { d.Disconnect() })
+		require.NoError(t, d.Migrate())
+		return d
+	})
+}
+
+func TestSQLiteKeysAndUsage(t *testing.T) {
+	d, err := dao.NewSQLiteStormDAO(filepath.Join(t.TempDir(), "storms.db"))
+	require.NoError(t, err)
+	defer d.Disconnect()
+	require.NoError(t, d.Migrate())
+
+	created := time.Now().UTC().Truncate(time.Millisecond)
+	key := models.APIKey{ID: "k1", Name: "ci", Hash: "abc", Scopes: []models.Scope{models.ScopeRead}, CreatedAt: created}
+	require.NoError(t, d.CreateAPIKey(key))
+	got, err := d.GetAPIKeyByHash("abc")
+	require.NoError(t, err)
+	assert.Equal(t, key, *got)
+	_, err = d.GetAPIKeyByHash("nope")
+	assert.True(t, errors.Is(err, models.ErrNotFound))
+
+	require.NoError(t, d.RevokeAPIKey("k1"))
+	assert.True(t, errors.Is(d.RevokeAPIKey("k1"), models.ErrNotFound))
+	keys, err := d.ListAPIKeys()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.NotNil(t, keys[0].RevokedAt)
+
+	today := time.Now().UTC().Format(time.DateOnly)
+	n, err := d.AddUsage("client", "export", today, 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	n, err = d.AddUsage("client", "export", today, 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+}
+
+func TestSQLiteMigrateReportDates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storms.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	schema, err := os.ReadFile("sqliteschema/001_init.sql")
+	require.NoError(t, err)
+	_, err = db.Exec(string(schema) + `
+		CREATE TABLE schema_migrations (version TEXT PRIMARY KEY, applied_at INTEGER NOT NULL);
+		INSERT INTO schema_migrations VALUES ('001_init', 0);
+		INSERT INTO storm_reports (id, date, type, lat, lon, written_at) VALUES
+			('old', '999999999', 'hail', 37.7, -97.3, 0),
+			('millis', '1718000000000', 'wind', 36.1, -95.9, 0),
+			('undated', '2024-06-10', 'hail', 37.0, -97.0, 0);`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	d, err := dao.NewSQLiteStormDAO(path)
+	require.NoError(t, err)
+	defer d.Disconnect()
+	require.NoError(t, d.Migrate())
+
+	box := models.BoundingBox{MinLat: 36, MinLon: -98, MaxLat: 38, MaxLon: -95}
+	reports, err := d.GetStormReports(context.Background(), models.NewStormQuery(time.Unix(900000000, 0), time.Unix(1718000000, 0)).
+		WithFilter(models.StormFilter{BBox: &box}))
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+	assert.Equal(t, "old", reports[0].ID)
+	assert.Equal(t, "999999999", reports[0].Date)
+	assert.Equal(t, "1718000000", reports[1].Date)
+
+	// Dates that aren't timestamps are moved aside rather than read as 0.
+	reports, err = d.GetStormReports(context.Background(), models.NewStormQuery(time.Unix(0, 0), time.Unix(1800000000, 0)).
+		WithFilter(models.StormFilter{BBox: &box}))
+	require.NoError(t, err)
+	assert.Len(t, reports, 2)
+	_, err = d.GetStormReport(context.Background(), "undated")
+	assert.True(t, errors.Is(err, models.ErrNotFound), "got %v", err)
+}
+
+func TestMemoryStormDAO(t *testing.T) {
+	daotest.Run(t, func(t *testing.T) models.StormDAOInterface {
+		return dao.NewMemoryStormDAO()
+	})
+}
@@ -0,0 +1,544 @@
+// Package daotest holds the conformance tests every storm DAO must pass, so
+// a new backend can be checked against the behaviour of the MongoDB one.
+package daotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns an empty DAO. It is called once per test, and should
+// register any cleanup with t.
+type Factory func(t *testing.T) models.StormDAOInterface
+
+var (
+	ingest = models.ChangeSource{Actor: models.ActorIngest, KafkaPartition: 0, KafkaOffset: 1}
+	admin  = models.ChangeSource{Actor: "admin", Reason: "conformance test"}
+)
+
+// Run runs every conformance test against DAOs from newDAO.
+func Run(t *testing.T, newDAO Factory) {
+	for _, test := range []struct {
+		name string
+		run  func(t *testing.T, d models.StormDAOInterface)
+	}{
+		{"Insert", testInsert},
+		{"Upsert", testUpsert},
+		{"DateBounds", testDateBounds},
+		{"DateFormats", testDateFormats},
+		{"Paging", testPaging},
+		{"Empty", testEmpty},
+		{"Filters", testFilters},
+		{"Spatial", testSpatial},
+		{"Search", testSearch},
+		{"Update", testUpdate},
+		{"Delete", testDelete},
+		{"Withdraw", testWithdraw},
+		{"Purge", testPurge},
+		{"AuditPagination", testAuditPagination},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newDAO(t))
+		})
+	}
+}
+
+// report returns a report at 12:00 on the given date.
+func report(date string, stormType models.StormType, state, county string, lat, lon float64) models.StormReport {
+	return models.StormReport{
+		Date: date, Time: 1200, Type: stormType, State: state, County: county,
+		Location: "5 N " + county, Lat: lat, Lon: lon, Comments: "trees down",
+	}
+}
+
+func upsert(t *testing.T, d models.StormDAOInterface, reports ...models.StormReport) {
+	t.Helper()
+	for _, r := range reports {
+		_, err := d.UpsertStormReport(r, ingest)
+		require.NoError(t, err)
+	}
+}
+
+func ids(reports []models.StormReport) []string {
+	ids := []string{}
+	for _, r := range reports {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+// at returns the time of a unix timestamp.
+func at(ts int64) time.Time {
+	return time.Unix(ts, 0).UTC()
+}
+
+// between returns a query for the reports dated start to end.
+func between(start, end int64) models.StormQuery {
+	return models.NewStormQuery(at(start), at(end))
+}
+
+// count returns how many visible reports dated date match filter.
+func count(t *testing.T, d models.StormDAOInterface, date int64, filter models.StormFilter) int64 {
+	t.Helper()
+	rows, err := d.GetStormStats(context.Background(), models.StatsQuery{Start: at(date), End: at(date), Filter: filter})
+	require.NoError(t, err)
+	if len(rows) == 0 {
+		return 0
+	}
+	require.Len(t, rows, 1)
+	return rows[0].Count
+}
+
+func testInsert(t *testing.T, d models.StormDAOInterface) {
+	r := report("1718000000", models.HAIL, "KS", "Sedgwick", 37.7, -97.3)
+	r.Size = 1.75
+
+	created, err := d.CreateStormReport(r, admin)
+	require.NoError(t, err)
+	assert.Equal(t, models.ReportID(r), created.ID)
+	assert.Equal(t, 1, created.Revision)
+	assert.NotNil(t, created.UpdatedAt)
+
+	got, err := d.GetStormReport(context.Background(), created.ID)
+	require.NoError(t, err)
+	want := r
+	want.ID, want.Revision, want.UpdatedAt = created.ID, 1, got.UpdatedAt
+	assert.Equal(t, want, *got)
+
+	reports, err := d.GetStormReports(context.Background(), between(1718000000, 1718000000))
+	require.NoError(t, err)
+	assert.Equal(t, []string{created.ID}, ids(reports))
+
+	_, err = d.CreateStormReport(r, admin)
+	assert.True(t, errors.Is(err, models.ErrConflict), "got %v", err)
+}
+
+func testUpsert(t *testing.T, d models.StormDAOInterface) {
+	r := report("1718000000", models.HAIL, "KS", "Sedgwick", 37.7, -97.3)
+
+	created, err := d.UpsertStormReport(r, ingest)
+	require.NoError(t, err)
+	assert.True(t, created.Created)
+	assert.Equal(t, models.ReportID(r), created.ID)
+	assert.Equal(t, 1, created.Report.Revision)
+
+	same, err := d.UpsertStormReport(r, ingest)
+	require.NoError(t, err)
+	assert.False(t, same.Created)
+	assert.False(t, same.Changed)
+
+	// A later fetch of the same report keeps the first date.
+	r.Date, r.Comments = "1718000300", "large trees down"
+	changed, err := d.UpsertStormReport(r, ingest)
+	require.NoError(t, err)
+	assert.True(t, changed.Changed)
+	assert.Equal(t, 2, changed.Report.Revision)
+
+	got, err := d.GetStormReport(context.Background(), created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "1718000000", got.Date)
+	assert.Equal(t, "large trees down", got.Comments)
+	assert.Equal(t, 2, got.Revision)
+
+	history, err := d.GetStormReportHistory(context.Background(), created.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "trees down", history[0].Previous.Comments)
+	assert.Contains(t, history[0].Changes, "comments")
+}
+
+func testDateBounds(t *testing.T, d models.StormDAOInterface) {
+	for i, date := range []string{"1718000100", "1718000200", "1718000300"} {
+		upsert(t, d, report(date, models.WIND, "TX", fmt.Sprint("County", i), 30, -97))
+	}
+
+	for _, tc := range []struct {
+		start, end int64
+		want       int
+	}{
+		{1718000100, 1718000300, 3},
+		{1718000100, 1718000200, 2},
+		{1718000200, 1718000200, 1},
+		{1718000101, 1718000299, 1},
+		{1718000000, 1718000099, 0},
+		{1718000301, 1718000400, 0},
+	} {
+		reports, err := d.GetStormReports(context.Background(), between(tc.start, tc.end))
+		require.NoError(t, err)
+		assert.Len(t, reports, tc.want, "%d to %d; both bounds are inclusive", tc.start, tc.end)
+	}
+}
+
+func testDateFormats(t *testing.T, d models.StormDAOInterface) {
+	// Dates compare as instants, not text: a nine-digit timestamp is
+	// earlier, and one in milliseconds is the same instant.
+	old := report("999999999", models.HAIL, "KS", "Sedgwick", 37.7, -97.3)
+	millis := report("1718000000000", models.HAIL, "OK", "Tulsa", 36.1, -95.9)
+	upsert(t, d, old, millis)
+
+	reports, err := d.GetStormReports(context.Background(), between(900000000, 1718000000))
+	require.NoError(t, err)
+	assert.Equal(t, []string{models.ReportID(old), models.ReportID(millis)}, ids(reports))
+	reports, err = d.GetStormReports(context.Background(), between(1000000000, 1718000000))
+	require.NoError(t, err)
+	assert.Equal(t, []string{models.ReportID(millis)}, ids(reports))
+
+	got, err := d.GetStormReport(context.Background(), models.ReportID(millis))
+	require.NoError(t, err)
+	assert.Equal(t, "1718000000", got.Date, "dates are returned in seconds")
+
+	rows, err := d.GetStormStats(context.Background(), models.StatsQuery{
+		Start: at(900000000), End: at(1718000000),
+		GroupBy: []models.StatsDimension{models.DimensionDay},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []models.StatsRow{{Day: "2001-09-09", Count: 1}, {Day: "2024-06-10", Count: 1}}, rows,
+		"the millisecond date falls on its own day, not a thousand times later")
+
+	_, err = d.CreateStormReport(report("2024-12-09", models.HAIL, "KS", "Reno", 38.0, -98.0), admin)
+	assert.Error(t, err, "dates must be unix timestamps")
+}
+
+func testPaging(t *testing.T, d models.StormDAOInterface) {
+	var want []string
+	for i := 0; i < 5; i++ {
+		r := report(fmt.Sprint(1718000000+i*60), models.WIND, "TX", fmt.Sprint("County", i), 30, -97)
+		upsert(t, d, r)
+		want = append(want, models.ReportID(r))
+	}
+	query := between(1718000000, 1718086399)
+
+	reports, err := d.GetStormReports(context.Background(), query)
+	require.NoError(t, err)
+	assert.Equal(t, want, ids(reports), "oldest first by default")
+
+	reports, err = d.GetStormReports(context.Background(), query.WithPage(2, 1))
+	require.NoError(t, err)
+	assert.Equal(t, want[1:3], ids(reports))
+
+	reports, err = d.GetStormReports(context.Background(), query.WithSort(models.SortDateDesc).WithPage(2, 0))
+	require.NoError(t, err)
+	assert.Equal(t, []string{want[4], want[3]}, ids(reports))
+
+	reports, err = d.GetStormReports(context.Background(), query.WithPage(0, 4))
+	require.NoError(t, err)
+	assert.Equal(t, want[4:], ids(reports), "no limit returns the rest")
+
+	reports, err = d.GetStormReports(context.Background(), query.WithPage(2, 10))
+	require.NoError(t, err)
+	assert.Empty(t, reports)
+
+	results, err := d.SearchStormReports(context.Background(), query.WithPage(3, 0), "trees")
+	require.NoError(t, err)
+	assert.Len(t, results, 3)
+}
+
+func testEmpty(t *testing.T, d models.StormDAOInterface) {
+	reports, err := d.GetStormReports(context.Background(), between(1718000000, 1718086399))
+	require.NoError(t, err)
+	assert.Empty(t, reports)
+
+	rows, err := d.GetStormStats(context.Background(), models.StatsQuery{Start: at(1718000000), End: at(1718086399)})
+	require.NoError(t, err)
+	assert.Empty(t, rows, "no total row when nothing matches")
+
+	results, err := d.SearchStormReports(context.Background(), between(1718000000, 1718086399), "hail")
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	reports, err = d.GetDeletedStormReports(between(1718000000, 1718086399))
+	require.NoError(t, err)
+	assert.Empty(t, reports)
+
+	history, err := d.GetStormReportHistory(context.Background(), "missing")
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	entries, err := d.GetAuditLog(models.AuditQuery{})
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	_, err = d.GetStormReport(context.Background(), "missing")
+	assert.True(t, errors.Is(err, models.ErrNotFound), "got %v", err)
+
+	result, err := d.PurgeStormReports(models.PurgeQuery{Synthetic: true, Mode: models.PurgeDelete}, true, admin)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), result.Matched)
+}
+
+func testFilters(t *testing.T, d models.StormDAOInterface) {
+	upsert(t, d,
+		report("1718000000", models.HAIL, "KS", "Sedgwick", 37.7, -97.3),
+		report("1718000000", models.HAIL, "OK", "Tulsa", 36.1, -95.9),
+		report("1718000000", models.TORNADO, "KS", "Reno", 38.0, -98.0),
+		report("1718000000", models.WIND, "KS", "Sedgwick", 37.6, -97.4),
+	)
+
+	for _, tc := range []struct {
+		filter models.StormFilter
+		want   int64
+	}{
+		{models.StormFilter{}, 4},
+		{models.StormFilter{Types: []models.StormType{models.HAIL}}, 2},
+		{models.StormFilter{Types: []models.StormType{models.HAIL, models.TORNADO}}, 3},
+		{models.StormFilter{States: []string{"KS"}}, 3},
+		{models.StormFilter{States: []string{"TX"}}, 0},
+		{models.StormFilter{Counties: []string{"Sedgwick"}}, 2},
+		{models.StormFilter{Types: []models.StormType{models.HAIL}, States: []string{"KS"}}, 1},
+	} {
+		assert.Equal(t, tc.want, count(t, d, 1718000000, tc.filter), "%+v", tc.filter)
+	}
+
+	rows, err := d.GetStormStats(context.Background(), models.StatsQuery{
+		Start: at(1718000000), End: at(1718000000),
+		GroupBy: []models.StatsDimension{models.DimensionType, models.DimensionDay},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []models.StatsRow{
+		{Type: models.HAIL, Day: "2024-06-10", Count: 2},
+		{Type: models.TORNADO, Day: "2024-06-10", Count: 1},
+		{Type: models.WIND, Day: "2024-06-10", Count: 1},
+	}, rows, "rows are ordered by group")
+
+	hour := 12
+	rows, err = d.GetStormStats(context.Background(), models.StatsQuery{
+		Start: at(1718000000), End: at(1718000000),
+		Filter:  models.StormFilter{States: []string{"OK"}},
+		GroupBy: []models.StatsDimension{models.DimensionState, models.DimensionHour},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []models.StatsRow{{State: "OK", Hour: &hour, Count: 1}}, rows)
+
+	result, err := d.PurgeStormReports(models.PurgeQuery{
+		Filter: models.StormFilter{Counties: []string{"Sedgwick"}},
+		Mode:   models.PurgeSoftDelete,
+	}, true, admin)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), result.Matched)
+}
+
+func testSpatial(t *testing.T, d models.StormDAOInterface) {
+	upsert(t, d,
+		report("1718000000", models.HAIL, "KS", "Sedgwick", 37.7, -97.3),
+		report("1718000000", models.HAIL, "KS", "Reno", 38.0, -98.0),
+		report("1718000000", models.HAIL, "OK", "Tulsa", 36.1, -95.9),
+		report("1718000000", models.HAIL, "CO", "Denver", 39.7, -104.9),
+	)
+
+	for _, tc := range []struct {
+		name string
+		box  models.BoundingBox
+		want int64
+	}{
+		{"edges are inside", models.BoundingBox{MinLat: 37.7, MinLon: -98, MaxLat: 38, MaxLon: -97.3}, 2},
+		{"just inside", models.BoundingBox{MinLat: 36, MinLon: -96, MaxLat: 36.2, MaxLon: -95.8}, 1},
+		{"just outside", models.BoundingBox{MinLat: 37.71, MinLon: -97.99, MaxLat: 37.99, MaxLon: -97.31}, 0},
+		{"everything", models.BoundingBox{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180}, 4},
+		{"point", models.BoundingBox{MinLat: 39.7, MinLon: -104.9, MaxLat: 39.7, MaxLon: -104.9}, 1},
+	} {
+		box := tc.box
+		assert.Equal(t, tc.want, count(t, d, 1718000000, models.StormFilter{BBox: &box}), tc.name)
+	}
+
+	box := models.BoundingBox{MinLat: 37, MinLon: -99, MaxLat: 39, MaxLon: -97}
+	result, err := d.PurgeStormReports(models.PurgeQuery{
+		Filter: models.StormFilter{BBox: &box, States: []string{"KS"}},
+		Mode:   models.PurgeDelete,
+	}, false, admin)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), result.Purged)
+	assert.Equal(t, int64(2), count(t, d, 1718000000, models.StormFilter{}))
+}
+
+func testSearch(t *testing.T, d models.StormDAOInterface) {
+	hail := report("1718000000", models.HAIL, "KS", "Sedgwick", 37.7, -97.3)
+	hail.Comments = "golf ball hail broke windows"
+	upsert(t, d, hail, report("1718000000", models.WIND, "OK", "Tulsa", 36.1, -95.9))
+
+	results, err := d.SearchStormReports(context.Background(), between(1718000000, 1718000000), "windows")
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, models.ReportID(hail), results[0].ID)
+
+	for q, want := range map[string][]string{
+		"windows tornado":     {models.ReportID(hail)},
+		`"golf ball" windows`: {models.ReportID(hail)},
+		`"ball golf"`:         {},
+		"down -windows":       {models.ReportID(report("1718000000", models.WIND, "OK", "Tulsa", 36.1, -95.9))},
+	} {
+		results, err := d.SearchStormReports(context.Background(), between(1718000000, 1718000000), q)
+		require.NoError(t, err)
+		got := []string{}
+		for _, r := range results {
+			got = append(got, r.ID)
+		}
+		assert.Equal(t, want, got, "words match any, phrases must appear and -words exclude; searching %s", q)
+	}
+
+	results, err = d.SearchStormReports(context.Background(), between(1718000001, 1718000100), "windows")
+	require.NoError(t, err)
+	assert.Empty(t, results, "search is limited to the date range")
+}
+
+func testUpdate(t *testing.T, d models.StormDAOInterface) {
+	created, err := d.CreateStormReport(report("1718000000", models.HAIL, "KS", "Sedgwick", 37.7, -97.3), admin)
+	require.NoError(t, err)
+
+	unchanged, err := d.UpdateStormReport(created, admin)
+	require.NoError(t, err)
+	assert.False(t, unchanged.Changed)
+
+	created.Size = 1.75
+	updated, err := d.UpdateStormReport(created, admin)
+	require.NoError(t, err)
+	assert.True(t, updated.Changed)
+	assert.Equal(t, 2, updated.Report.Revision)
+	got, err := d.GetStormReport(context.Background(), created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1.75, got.Size)
+
+	created.Size = 2
+	_, err = d.UpdateStormReport(created, admin)
+	assert.True(t, errors.Is(err, models.ErrStaleRevision), "updates from an old revision are refused; got %v", err)
+	got, err = d.GetStormReport(context.Background(), created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1.75, got.Size)
+	history, err := d.GetStormReportHistory(context.Background(), created.ID)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	missing := created
+	missing.ID = "missing"
+	_, err = d.UpdateStormReport(missing, admin)
+	assert.True(t, errors.Is(err, models.ErrNotFound), "got %v", err)
+}
+
+func testDelete(t *testing.T, d models.StormDAOInterface) {
+	created, err := d.CreateStormReport(report("1718000000", models.HAIL, "KS", "Sedgwick", 37.7, -97.3), admin)
+	require.NoError(t, err)
+
+	deleted, err := d.DeleteStormReport(created.ID, admin)
+	require.NoError(t, err)
+	assert.True(t, deleted.Deleted)
+	assert.NotNil(t, deleted.DeletedAt)
+	assert.Equal(t, 2, deleted.Revision, "deleting a report is a new revision")
+	assert.Equal(t, deleted.DeletedAt, deleted.UpdatedAt)
+	_, err = d.DeleteStormReport(created.ID, admin)
+	assert.True(t, errors.Is(err, models.ErrNotFound), "got %v", err)
+
+	reports, err := d.GetStormReports(context.Background(), between(1718000000, 1718000000))
+	require.NoError(t, err)
+	assert.Empty(t, reports)
+	got, err := d.GetStormReport(context.Background(), created.ID)
+	require.NoError(t, err)
+	assert.True(t, got.Deleted, "deleted reports can still be read by ID")
+	assert.Equal(t, 2, got.Revision)
+	reports, err = d.GetDeletedStormReports(between(1718000000, 1718000000))
+	require.NoError(t, err)
+	assert.Equal(t, []string{created.ID}, ids(reports))
+
+	_, err = d.UpdateStormReport(created, admin)
+	assert.True(t, errors.Is(err, models.ErrNotFound), "deleted reports can't be updated; got %v", err)
+
+	entries, err := d.GetAuditLog(models.AuditQuery{ReportID: created.ID})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, models.AuditDelete, entries[0].Action)
+	assert.Equal(t, models.AuditCreate, entries[1].Action)
+	assert.Equal(t, "admin", entries[0].Actor)
+	assert.Equal(t, "conformance test", entries[0].Reason)
+}
+
+func testWithdraw(t *testing.T, d models.StormDAOInterface) {
+	r := report("1718000000", models.HAIL, "KS", "Sedgwick", 37.7, -97.3)
+	created, err := d.UpsertStormReport(r, ingest)
+	require.NoError(t, err)
+
+	withdrawn, err := d.WithdrawStormReport(created.ID, ingest)
+	require.NoError(t, err)
+	assert.True(t, withdrawn.Changed)
+	reports, err := d.GetStormReports(context.Background(), between(1718000000, 1718000000))
+	require.NoError(t, err)
+	assert.Empty(t, reports)
+
+	_, err = d.WithdrawStormReport("missing", ingest)
+	assert.True(t, errors.Is(err, models.ErrNotFound), "got %v", err)
+
+	// Published again, it is reinstated.
+	upsert(t, d, r)
+	reports, err = d.GetStormReports(context.Background(), between(1718000000, 1718000000))
+	require.NoError(t, err)
+	assert.Equal(t, []string{created.ID}, ids(reports))
+}
+
+func testPurge(t *testing.T, d models.StormDAOInterface) {
+	real := report("1718000000", models.HAIL, "KS", "Sedgwick", 37.7, -97.3)
+	fake := report("1718000000", models.HAIL, "OK", "Tulsa", 36.1, -95.9)
+	fake.Synthetic = true
+	upsert(t, d, real, fake)
+
+	query := models.PurgeQuery{Synthetic: true, Mode: models.PurgeSoftDelete}
+	result, err := d.PurgeStormReports(query, true, admin)
+	require.NoError(t, err)
+	assert.Equal(t, models.PurgeResult{Matched: 1}, result, "a dry run changes nothing")
+
+	result, err = d.PurgeStormReports(query, false, admin)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), result.Purged)
+	assert.Equal(t, []string{models.ReportID(fake)}, result.IDs)
+	reports, err := d.GetStormReports(context.Background(), between(1718000000, 1718000000))
+	require.NoError(t, err)
+	assert.Equal(t, []string{models.ReportID(real)}, ids(reports))
+	purged, err := d.GetStormReport(context.Background(), models.ReportID(fake))
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged.Revision, "soft-deleting a report is a new revision")
+	assert.NotNil(t, purged.UpdatedAt)
+
+	// A hard purge also removes soft-deleted reports.
+	query.Mode = models.PurgeDelete
+	result, err = d.PurgeStormReports(query, false, admin)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), result.Purged)
+	_, err = d.GetStormReport(context.Background(), models.ReportID(fake))
+	assert.True(t, errors.Is(err, models.ErrNotFound), "got %v", err)
+
+	entries, err := d.GetAuditLog(models.AuditQuery{Action: models.AuditPurge})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, models.PurgeDelete, entries[0].Purge.Mode)
+	assert.Equal(t, int64(1), entries[0].Result.Purged)
+}
+
+func testAuditPagination(t *testing.T, d models.StormDAOInterface) {
+	for i := 0; i < 5; i++ {
+		_, err := d.CreateStormReport(report("1718000000", models.HAIL, "KS", fmt.Sprint("County", i), 37.7, -97.3), admin)
+		require.NoError(t, err)
+	}
+
+	entries, err := d.GetAuditLog(models.AuditQuery{Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "County4", entries[0].After.County, "newest first")
+	assert.Equal(t, "County3", entries[1].After.County)
+
+	// Entries written in the same millisecond share a time, so since can
+	// also return older ones.
+	since := entries[1].At
+	entries, err = d.GetAuditLog(models.AuditQuery{Action: models.AuditCreate, Since: since})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(entries), 2, "since is inclusive")
+	for _, entry := range entries {
+		assert.False(t, entry.At.Before(since))
+	}
+
+	entries, err = d.GetAuditLog(models.AuditQuery{Actor: "someone else"})
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
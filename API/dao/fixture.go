@@ -0,0 +1,115 @@
+package dao
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+// LoadFixture reads reports to seed a MemoryStormDAO from a .json file,
+// holding an array of reports as the API returns them, or a .csv file whose
+// header names the same fields.
+func LoadFixture(path string) ([]models.StormReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open fixture: %w", err)
+	}
+	defer f.Close()
+
+	var reports []models.StormReport
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.NewDecoder(f).Decode(&reports)
+	case ".csv":
+		reports, err = readFixtureCSV(f)
+	default:
+		return nil, fmt.Errorf("fixture %s must be .json or .csv", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixture %s: %w", path, err)
+	}
+	return reports, nil
+}
+
+// fixtureColumns sets a report field from a CSV column, keyed by the
+// field's JSON name.
+var fixtureColumns = map[string]func(r *models.StormReport, v string) error{
+	"id":       func(r *models.StormReport, v string) error { r.ID = v; return nil },
+	"date":     func(r *models.StormReport, v string) error { r.Date = v; return nil },
+	"fScale":   func(r *models.StormReport, v string) error { r.F_Scale = v; return nil },
+	"location": func(r *models.StormReport, v string) error { r.Location = v; return nil },
+	"county":   func(r *models.StormReport, v string) error { r.County = v; return nil },
+	"state":    func(r *models.StormReport, v string) error { r.State = v; return nil },
+	"comments": func(r *models.StormReport, v string) error { r.Comments = v; return nil },
+	"type":     func(r *models.StormReport, v string) error { r.Type = models.StormType(v); return nil },
+	"time": func(r *models.StormReport, v string) error {
+		n, err := strconv.ParseInt(v, 10, 32)
+		r.Time = int32(n)
+		return err
+	},
+	"speed": func(r *models.StormReport, v string) error {
+		n, err := strconv.ParseInt(v, 10, 32)
+		r.Speed = int32(n)
+		return err
+	},
+	"size": func(r *models.StormReport, v string) (err error) {
+		r.Size, err = strconv.ParseFloat(v, 64)
+		return err
+	},
+	"lat": func(r *models.StormReport, v string) (err error) {
+		r.Lat, err = strconv.ParseFloat(v, 64)
+		return err
+	},
+	"lon": func(r *models.StormReport, v string) (err error) {
+		r.Lon, err = strconv.ParseFloat(v, 64)
+		return err
+	},
+	"synthetic": func(r *models.StormReport, v string) (err error) {
+		r.Synthetic, err = strconv.ParseBool(v)
+		return err
+	},
+}
+
+func readFixtureCSV(r io.Reader) ([]models.StormReport, error) {
+	rows := csv.NewReader(r)
+	header, err := rows.Read()
+	if err != nil {
+		return nil, err
+	}
+	setters := make([]func(*models.StormReport, string) error, len(header))
+	for i, name := range header {
+		if setters[i] = fixtureColumns[strings.TrimSpace(name)]; setters[i] == nil {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+	}
+
+	reports := []models.StormReport{}
+	for {
+		row, err := rows.Read()
+		if errors.Is(err, io.EOF) {
+			return reports, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var report models.StormReport
+		for i, v := range row {
+			if v == "" {
+				continue
+			}
+			if err := setters[i](&report, v); err != nil {
+				line, _ := rows.FieldPos(i)
+				return nil, fmt.Errorf("line %d: invalid %s %q", line, header[i], v)
+			}
+		}
+		reports = append(reports, report)
+	}
+}
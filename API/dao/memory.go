@@ -0,0 +1,674 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+// MemoryStormDAO keeps reports in memory, for tests and demos. It filters,
+// sorts and audits as the database DAOs do, so tests can use it in place of
+// a MockStormDAO that reimplements them. Reports are indexed by date and by
+// one-degree grid cell for bounding box filters. It is safe for concurrent
+// use.
+type MemoryStormDAO struct {
+	mu        sync.RWMutex
+	reports   map[string]*memoryEntry
+	byDate    []string // report IDs ordered by date, then ID
+	grid      map[memoryCell]map[string]bool
+	revisions map[string][]models.ReportRevision
+	audit     []models.AuditEntry
+	keys      map[string]models.APIKey
+	usage     map[usageKey]int64
+	writes    uint64
+
+	usagePruner usagePruner
+}
+
+type memoryEntry struct {
+	report models.StormReport
+	// date is the report's parsed date. Seeded reports whose date can't
+	// be parsed have the zero time.
+	date time.Time
+	// write is the sequence number of the report's last write, for
+	// PollReports.
+	write uint64
+}
+
+type memoryCell struct {
+	lat, lon int
+}
+
+type usageKey struct {
+	kind, client, day string
+}
+
+func cellOf(lat, lon float64) memoryCell {
+	return memoryCell{int(math.Floor(lat)), int(math.Floor(lon))}
+}
+
+func NewMemoryStormDAO() *MemoryStormDAO {
+	return &MemoryStormDAO{
+		reports:   map[string]*memoryEntry{},
+		grid:      map[memoryCell]map[string]bool{},
+		revisions: map[string][]models.ReportRevision{},
+		keys:      map[string]models.APIKey{},
+		usage:     map[usageKey]int64{},
+	}
+}
+
+// Seed stores reports as they are, without revisions or audit entries.
+// Reports without an ID are given their stable one.
+func (d *MemoryStormDAO) Seed(reports []models.StormReport) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, report := range reports {
+		if report.ID == "" {
+			report.ID = models.ReportID(report)
+		}
+		report.Revision = max(report.Revision, 1)
+		d.store(report)
+	}
+}
+
+func (d *MemoryStormDAO) Disconnect() error {
+	return nil
+}
+
+// dateIndex returns where id, dated date, belongs in byDate.
+func (d *MemoryStormDAO) dateIndex(date time.Time, id string) int {
+	return sort.Search(len(d.byDate), func(i int) bool {
+		other := d.reports[d.byDate[i]]
+		return other.date.After(date) || (other.date.Equal(date) && other.report.ID >= id)
+	})
+}
+
+// store writes a report, keeping the indexes in step. The caller holds the
+// write lock.
+func (d *MemoryStormDAO) store(report models.StormReport) {
+	if entry, ok := d.reports[report.ID]; ok {
+		d.unindex(entry)
+	}
+	d.writes++
+	// Dates are kept in seconds, as the databases return them.
+	date, err := models.ParseReportDate(report.Date)
+	if err == nil {
+		report.Date = models.FormatReportDate(date)
+	}
+	d.reports[report.ID] = &memoryEntry{report: report, date: date, write: d.writes}
+
+	i := d.dateIndex(date, report.ID)
+	d.byDate = append(d.byDate, "")
+	copy(d.byDate[i+1:], d.byDate[i:])
+	d.byDate[i] = report.ID
+
+	cell := cellOf(report.Lat, report.Lon)
+	if d.grid[cell] == nil {
+		d.grid[cell] = map[string]bool{}
+	}
+	d.grid[cell][report.ID] = true
+}
+
+// unindex drops a stored report from the indexes, but not from reports.
+func (d *MemoryStormDAO) unindex(entry *memoryEntry) {
+	report := entry.report
+	if i := d.dateIndex(entry.date, report.ID); i < len(d.byDate) && d.byDate[i] == report.ID {
+		d.byDate = append(d.byDate[:i], d.byDate[i+1:]...)
+	}
+	delete(d.grid[cellOf(report.Lat, report.Lon)], report.ID)
+}
+
+// remove drops a report entirely. The caller holds the write lock.
+func (d *MemoryStormDAO) remove(id string) {
+	if entry, ok := d.reports[id]; ok {
+		d.unindex(entry)
+		delete(d.reports, id)
+	}
+}
+
+// find returns the reports dated start to end, either of which may be
+// zero for no bound, that pass the filter and keep, ordered by date, time
+// and ID. The caller holds the read lock.
+func (d *MemoryStormDAO) find(start, end time.Time, f models.StormFilter, keep func(models.StormReport) bool) []models.StormReport {
+	var candidates []string
+	var lo, hi memoryCell
+	if f.BBox != nil {
+		lo, hi = cellOf(f.BBox.MinLat, f.BBox.MinLon), cellOf(f.BBox.MaxLat, f.BBox.MaxLon)
+	}
+	// The grid is only worth walking when the box covers fewer cells than
+	// there are reports.
+	if f.BBox != nil && float64(hi.lat-lo.lat+1)*float64(hi.lon-lo.lon+1) < float64(len(d.reports)) {
+		for lat := lo.lat; lat <= hi.lat; lat++ {
+			for lon := lo.lon; lon <= hi.lon; lon++ {
+				for id := range d.grid[memoryCell{lat, lon}] {
+					candidates = append(candidates, id)
+				}
+			}
+		}
+	} else {
+		from, to := 0, len(d.byDate)
+		if !start.IsZero() {
+			from = sort.Search(len(d.byDate), func(i int) bool { return !d.reports[d.byDate[i]].date.Before(start) })
+		}
+		if !end.IsZero() {
+			to = sort.Search(len(d.byDate), func(i int) bool { return d.reports[d.byDate[i]].date.After(end) })
+		}
+		if from < to {
+			candidates = d.byDate[from:to]
+		}
+	}
+
+	var entries []*memoryEntry
+	for _, id := range candidates {
+		entry := d.reports[id]
+		if (!start.IsZero() && entry.date.Before(start)) || (!end.IsZero() && entry.date.After(end)) {
+			continue
+		}
+		if f.Matches(entry.report) && keep(entry.report) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !a.date.Equal(b.date) {
+			return a.date.Before(b.date)
+		}
+		if a.report.Time != b.report.Time {
+			return a.report.Time < b.report.Time
+		}
+		return a.report.ID < b.report.ID
+	})
+	reports := make([]models.StormReport, len(entries))
+	for i, entry := range entries {
+		reports[i] = entry.report
+	}
+	return reports
+}
+
+// visible keeps the reports that queries return.
+func visible(r models.StormReport) bool {
+	return !r.Deleted && !r.Withdrawn
+}
+
+func (d *MemoryStormDAO) GetStormReports(ctx context.Context, query models.StormQuery) ([]models.StormReport, error) {
+	d.mu.RLock()
+	reports := d.find(query.Start, query.End, query.Filter, visible)
+	d.mu.RUnlock()
+
+	if query.Sort == models.SortDateDesc {
+		slices.Reverse(reports)
+	}
+	from, to := query.Page(len(reports))
+	return reports[from:to], nil
+}
+
+// statsKey returns a report's value for dim, as statsGroupExpr does.
+func statsKey(r models.StormReport, dim models.StatsDimension) string {
+	switch dim {
+	case models.DimensionType:
+		return string(r.Type)
+	case models.DimensionState:
+		return r.State
+	case models.DimensionCounty:
+		return r.County
+	case models.DimensionDay:
+		date, err := models.ParseReportDate(r.Date)
+		if err != nil {
+			return ""
+		}
+		return date.Format(time.DateOnly)
+	case models.DimensionHour:
+		return strconv.Itoa(int(r.Time) / 100)
+	}
+	return ""
+}
+
+func (d *MemoryStormDAO) GetStormStats(ctx context.Context, query models.StatsQuery) ([]models.StatsRow, error) {
+	d.mu.RLock()
+	reports := d.find(query.Start, query.End, query.Filter, visible)
+	d.mu.RUnlock()
+
+	type group struct {
+		keys  []string
+		count int64
+	}
+	groups := map[string]*group{}
+	for _, r := range reports {
+		keys := make([]string, len(query.GroupBy))
+		for i, dim := range query.GroupBy {
+			keys[i] = statsKey(r, dim)
+		}
+		id := strings.Join(keys, "\x00")
+		if groups[id] == nil {
+			groups[id] = &group{keys: keys}
+		}
+		groups[id].count++
+	}
+
+	stats := []models.StatsRow{}
+	for _, g := range groups {
+		row := models.StatsRow{Count: g.count}
+		for i, dim := range query.GroupBy {
+			switch dim {
+			case models.DimensionType:
+				row.Type = models.StormType(g.keys[i])
+			case models.DimensionState:
+				row.State = g.keys[i]
+			case models.DimensionCounty:
+				row.County = g.keys[i]
+			case models.DimensionDay:
+				row.Day = g.keys[i]
+			case models.DimensionHour:
+				hour, _ := strconv.Atoi(g.keys[i])
+				row.Hour = &hour
+			}
+		}
+		stats = append(stats, row)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		for _, dim := range query.GroupBy {
+			a, b := stats[i], stats[j]
+			switch dim {
+			case models.DimensionHour:
+				if *a.Hour != *b.Hour {
+					return *a.Hour < *b.Hour
+				}
+			default:
+				if ka, kb := statsRowKey(a, dim), statsRowKey(b, dim); ka != kb {
+					return ka < kb
+				}
+			}
+		}
+		return false
+	})
+	return stats, nil
+}
+
+func statsRowKey(row models.StatsRow, dim models.StatsDimension) string {
+	switch dim {
+	case models.DimensionType:
+		return string(row.Type)
+	case models.DimensionState:
+		return row.State
+	case models.DimensionCounty:
+		return row.County
+	case models.DimensionDay:
+		return row.Day
+	}
+	return ""
+}
+
+func (d *MemoryStormDAO) SearchStormReports(ctx context.Context, query models.StormQuery, q string) ([]models.SearchResult, error) {
+	d.mu.RLock()
+	reports := d.find(query.Start, query.End, query.Filter, visible)
+	d.mu.RUnlock()
+
+	search := models.ParseSearch(q)
+	results := []models.SearchResult{}
+	for _, report := range reports {
+		if score, ok := search.Match(report); ok {
+			results = append(results, models.SearchResult{StormReport: report, Score: score, Highlights: search.Highlight(report)})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	from, to := query.Page(len(results))
+	return results[from:to], nil
+}
+
+func (d *MemoryStormDAO) GetStormReport(ctx context.Context, id string) (*models.StormReport, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	entry, ok := d.reports[id]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+	report := entry.report
+	return &report, nil
+}
+
+func (d *MemoryStormDAO) GetDeletedStormReports(query models.StormQuery) ([]models.StormReport, error) {
+	d.mu.RLock()
+	reports := d.find(query.Start, query.End, query.Filter, func(r models.StormReport) bool { return r.Deleted })
+	d.mu.RUnlock()
+
+	deletedAt := func(r models.StormReport) time.Time {
+		if r.DeletedAt == nil {
+			return time.Time{}
+		}
+		return *r.DeletedAt
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		a, b := deletedAt(reports[i]), deletedAt(reports[j])
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return reports[i].ID < reports[j].ID
+	})
+	from, to := query.Page(len(reports))
+	return reports[from:to], nil
+}
+
+func (d *MemoryStormDAO) GetStormReportHistory(ctx context.Context, id string) ([]models.ReportRevision, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]models.ReportRevision{}, d.revisions[id]...), nil
+}
+
+// revise records a revision of a report. The caller holds the write lock.
+func (d *MemoryStormDAO) revise(existing models.StormReport, changes map[string]models.FieldChange, source models.ChangeSource, now time.Time) {
+	d.revisions[existing.ID] = append(d.revisions[existing.ID], models.ReportRevision{
+		ReportID:  existing.ID,
+		Previous:  existing,
+		Changes:   changes,
+		Source:    source,
+		ChangedAt: now,
+	})
+}
+
+// recordAudit stamps entry with its source and time and stores it. The
+// caller holds the write lock.
+func (d *MemoryStormDAO) recordAudit(entry models.AuditEntry, source models.ChangeSource) {
+	entry.Actor = source.Actor
+	entry.Reason = source.Reason
+	entry.At = time.Now().UTC()
+	d.audit = append(d.audit, entry)
+}
+
+// UpsertStormReport stores an ingested report under its stable ID, as
+// StormDAO.UpsertStormReport does.
+func (d *MemoryStormDAO) UpsertStormReport(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	report.ID = models.ReportID(report)
+	entry, ok := d.reports[report.ID]
+	if !ok {
+		if _, err := models.ParseReportDate(report.Date); err != nil {
+			return models.UpsertResult{ID: report.ID, Report: report}, fmt.Errorf("failed to store storm report: %w", err)
+		}
+		report.Revision, report.UpdatedAt = 1, &now
+		d.store(report)
+		return models.UpsertResult{ID: report.ID, Report: report, Created: true}, nil
+	}
+
+	// The first date a report was seen on is kept, and re-ingesting a
+	// deleted report doesn't bring it back. A withdrawn report that SPC
+	// publishes again is reinstated.
+	existing := entry.report
+	report.Date = existing.Date
+	report.Deleted, report.DeletedAt = existing.Deleted, existing.DeletedAt
+	report.Withdrawn, report.WithdrawnAt = false, nil
+	report.Revision, report.UpdatedAt = existing.Revision, existing.UpdatedAt
+	changes := models.DiffReports(existing, report)
+	if len(changes) == 0 {
+		return models.UpsertResult{ID: report.ID, Report: report}, nil
+	}
+	d.revise(existing, changes, source, now)
+	report.Revision, report.UpdatedAt = existing.NextRevision(), &now
+	d.store(report)
+	return models.UpsertResult{ID: report.ID, Report: report, Changed: true}, nil
+}
+
+func (d *MemoryStormDAO) WithdrawStormReport(id string, source models.ChangeSource) (models.UpsertResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.reports[id]
+	if !ok {
+		return models.UpsertResult{ID: id}, models.ErrNotFound
+	}
+	existing := entry.report
+	if existing.Withdrawn {
+		return models.UpsertResult{ID: id, Report: existing}, nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	report := existing
+	report.Withdrawn, report.WithdrawnAt = true, &now
+	report.Revision, report.UpdatedAt = existing.NextRevision(), &now
+	d.revise(existing, models.DiffReports(existing, report), source, now)
+	d.store(report)
+	return models.UpsertResult{ID: id, Report: report, Changed: true}, nil
+}
+
+func (d *MemoryStormDAO) CreateStormReport(report models.StormReport, source models.ChangeSource) (models.StormReport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	report.ID = models.ReportID(report)
+	if _, ok := d.reports[report.ID]; ok {
+		return report, models.ErrConflict
+	}
+	if _, err := models.ParseReportDate(report.Date); err != nil {
+		return report, fmt.Errorf("failed to store storm report: %w", err)
+	}
+	report.Revision, report.UpdatedAt = 1, &now
+	d.store(report)
+	d.recordAudit(models.AuditEntry{
+		Action:   models.AuditCreate,
+		ReportID: report.ID,
+		After:    &report,
+	}, source)
+	return report, nil
+}
+
+func (d *MemoryStormDAO) UpdateStormReport(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result := models.UpsertResult{ID: report.ID, Report: report}
+	entry, ok := d.reports[report.ID]
+	if !ok || entry.report.Deleted {
+		return result, models.ErrNotFound
+	}
+	existing := entry.report
+	if existing.Revision != report.Revision {
+		return result, models.ErrStaleRevision
+	}
+	if _, err := models.ParseReportDate(report.Date); err != nil {
+		return result, fmt.Errorf("failed to store storm report: %w", err)
+	}
+	changes := models.DiffReports(existing, report)
+	if existing.Date != report.Date {
+		changes["date"] = models.FieldChange{Old: existing.Date, New: report.Date}
+	}
+	if len(changes) == 0 {
+		return result, nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	report.Revision, report.UpdatedAt = existing.NextRevision(), &now
+	d.revise(existing, changes, source, now)
+	d.store(report)
+	d.recordAudit(models.AuditEntry{
+		Action:   models.AuditUpdate,
+		ReportID: report.ID,
+		Before:   &existing,
+		After:    &report,
+		Changes:  changes,
+	}, source)
+	return models.UpsertResult{ID: report.ID, Report: report, Changed: true}, nil
+}
+
+func (d *MemoryStormDAO) DeleteStormReport(id string, source models.ChangeSource) (models.StormReport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.reports[id]
+	if !ok || entry.report.Deleted {
+		return models.StormReport{}, models.ErrNotFound
+	}
+	before := entry.report
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	after := before
+	after.Deleted, after.DeletedAt = true, &now
+	after.Revision, after.UpdatedAt = before.NextRevision(), &now
+	d.store(after)
+	d.recordAudit(models.AuditEntry{
+		Action:   models.AuditDelete,
+		ReportID: id,
+		Before:   &before,
+		After:    &after,
+	}, source)
+	return after, nil
+}
+
+func (d *MemoryStormDAO) PurgeStormReports(query models.PurgeQuery, dryRun bool, source models.ChangeSource) (models.PurgeResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	start, end := query.Bounds()
+	matches := d.find(start, end, query.Filter, func(r models.StormReport) bool {
+		return (!query.Synthetic || r.Synthetic) && (query.Mode == models.PurgeDelete || !r.Deleted)
+	})
+	result := models.PurgeResult{Matched: int64(len(matches))}
+	if dryRun {
+		return result, nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for _, r := range matches {
+		result.IDs = append(result.IDs, r.ID)
+		if query.Mode == models.PurgeSoftDelete {
+			r.Deleted, r.DeletedAt = true, &now
+			r.Revision, r.UpdatedAt = r.NextRevision(), &now
+			d.store(r)
+		} else {
+			d.remove(r.ID)
+		}
+	}
+	result.Purged = int64(len(matches))
+	d.recordAudit(models.AuditEntry{
+		Action: models.AuditPurge,
+		Purge:  &query,
+		Result: &result,
+	}, source)
+	return result, nil
+}
+
+func (d *MemoryStormDAO) GetAuditLog(query models.AuditQuery) ([]models.AuditEntry, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	entries := []models.AuditEntry{}
+	for i := len(d.audit) - 1; i >= 0; i-- {
+		entry := d.audit[i]
+		if (query.ReportID != "" && entry.ReportID != query.ReportID) ||
+			(query.Actor != "" && entry.Actor != query.Actor) ||
+			(query.Action != "" && entry.Action != query.Action) ||
+			(!query.Since.IsZero() && entry.At.Before(query.Since)) ||
+			(!query.Until.IsZero() && entry.At.After(query.Until)) {
+			continue
+		}
+		entries = append(entries, entry)
+		if query.Limit > 0 && len(entries) == query.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// PollReports calls publish for every report written since it started,
+// checking every interval, as StormDAO.PollReports does.
+func (d *MemoryStormDAO) PollReports(ctx context.Context, interval time.Duration, publish func(models.StormReport)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	d.mu.RLock()
+	since := d.writes
+	d.mu.RUnlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		d.mu.RLock()
+		var written []*memoryEntry
+		for _, entry := range d.reports {
+			if entry.write > since {
+				written = append(written, entry)
+			}
+		}
+		sort.Slice(written, func(i, j int) bool { return written[i].write < written[j].write })
+		var batch []models.StormReport
+		for _, entry := range written {
+			batch = append(batch, entry.report)
+			since = entry.write
+		}
+		d.mu.RUnlock()
+
+		for _, report := range batch {
+			publish(report)
+		}
+	}
+}
+
+func (d *MemoryStormDAO) CreateAPIKey(key models.APIKey) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys[key.ID] = key
+	return nil
+}
+
+func (d *MemoryStormDAO) ListAPIKeys() ([]models.APIKey, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	keys := []models.APIKey{}
+	for _, key := range d.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (d *MemoryStormDAO) GetAPIKeyByHash(hash string) (*models.APIKey, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, key := range d.keys {
+		if key.Hash == hash {
+			return &key, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (d *MemoryStormDAO) RevokeAPIKey(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key, ok := d.keys[id]
+	if !ok || key.RevokedAt != nil {
+		return models.ErrNotFound
+	}
+	now := time.Now().UTC()
+	key.RevokedAt = &now
+	d.keys[id] = key
+	return nil
+}
+
+func (d *MemoryStormDAO) AddUsage(client, kind, day string, n int64) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.usagePruner.prune(func(cutoff string) error {
+		for k := range d.usage {
+			if k.day < cutoff {
+				delete(d.usage, k)
+			}
+		}
+		return nil
+	})
+	k := usageKey{kind: kind, client: client, day: day}
+	d.usage[k] += n
+	return d.usage[k], nil
+}
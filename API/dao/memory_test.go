@@ -0,0 +1,112 @@
+package dao_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/dao"
+	"github.com/jonathanface/storm-reporter/API/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFixture(t *testing.T) {
+	fromCSV, err := dao.LoadFixture("testdata/reports.csv")
+	require.NoError(t, err)
+	fromJSON, err := dao.LoadFixture("testdata/reports.json")
+	require.NoError(t, err)
+	require.Len(t, fromCSV, 3)
+	assert.Equal(t, fromJSON, fromCSV)
+	assert.Equal(t, models.StormReport{
+		Date: "1718003600", Time: 1410, Type: models.TORNADO, F_Scale: "EF1", Location: "2 S Hutchinson",
+		County: "Reno", State: "KS", Lat: 38.03, Lon: -97.93, Comments: "brief touchdown",
+	}, fromCSV[2])
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"bad-column.csv": "date,colour\n1718000000,red\n",
+		"bad-value.csv":  "date,lat\n1718000000,north\n",
+		"reports.txt":    "",
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err := dao.LoadFixture(path)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestMemoryStormDAO_Seed(t *testing.T) {
+	reports, err := dao.LoadFixture("testdata/reports.csv")
+	require.NoError(t, err)
+	d := dao.NewMemoryStormDAO()
+	d.Seed(reports)
+
+	got, err := d.GetStormReports(context.Background(), between(1718000000, 1718003600))
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	assert.Equal(t, models.ReportID(reports[0]), got[0].ID)
+	assert.Equal(t, int32(1410), got[2].Time, "ordered by date, then time")
+
+	result, err := d.UpsertStormReport(reports[0], models.ChangeSource{Actor: models.ActorIngest})
+	require.NoError(t, err)
+	assert.False(t, result.Created, "seeded reports keep their stable ID")
+	assert.False(t, result.Changed)
+}
+
+func TestMemoryStormDAO_BBox(t *testing.T) {
+	d := dao.NewMemoryStormDAO()
+	var reports []models.StormReport
+	for lat := 30; lat < 40; lat++ {
+		for lon := -100; lon < -90; lon++ {
+			reports = append(reports, models.StormReport{
+				Date: "1718000000", Type: models.HAIL, Location: fmt.Sprint(lat, lon),
+				Lat: float64(lat) + 0.5, Lon: float64(lon) + 0.5,
+			})
+		}
+	}
+	d.Seed(reports)
+
+	// Small boxes are answered from the grid, large ones by scanning; both
+	// include the box's edges.
+	for _, tc := range []struct {
+		box  models.BoundingBox
+		want int64
+	}{
+		{models.BoundingBox{MinLat: 35.5, MinLon: -95.5, MaxLat: 36.5, MaxLon: -94.5}, 4},
+		{models.BoundingBox{MinLat: -90, MinLon: -180, MaxLat: 36.5, MaxLon: -94.5}, 7 * 6},
+	} {
+		rows, err := d.GetStormStats(context.Background(), models.StatsQuery{Start: time.Unix(1718000000, 0), End: time.Unix(1718000000, 0), Filter: models.StormFilter{BBox: &tc.box}})
+		require.NoError(t, err)
+		require.Len(t, rows, 1)
+		assert.Equal(t, tc.want, rows[0].Count, "%+v", tc.box)
+	}
+}
+
+func TestMemoryStormDAO_Concurrent(t *testing.T) {
+	d := dao.NewMemoryStormDAO()
+	source := models.ChangeSource{Actor: models.ActorIngest}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				report := models.StormReport{Date: "1718000000", Type: models.WIND, Location: fmt.Sprint(i, "-", j)}
+				_, err := d.UpsertStormReport(report, source)
+				assert.NoError(t, err)
+				_, err = d.GetStormReports(context.Background(), between(1718000000, 1718000000))
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	reports, err := d.GetStormReports(context.Background(), between(1718000000, 1718000000))
+	require.NoError(t, err)
+	assert.Len(t, reports, 400)
+}
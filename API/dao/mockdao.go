@@ -1,15 +1,109 @@
 package dao
 
-import "github.com/jonathanface/storm-reporter/API/models"
+import (
+	"context"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
 
 type MockStormDAO struct {
-	MockGetStormReports func(start string, end string) ([]models.StormReport, error)
+	MockGetStormReports        func(query models.StormQuery) ([]models.StormReport, error)
+	MockGetStormStats          func(query models.StatsQuery) ([]models.StatsRow, error)
+	MockSearchStormReports     func(query models.StormQuery, q string) ([]models.SearchResult, error)
+	MockGetStormReport         func(id string) (*models.StormReport, error)
+	MockGetDeletedStormReports func(query models.StormQuery) ([]models.StormReport, error)
+	MockGetStormReportHistory  func(id string) ([]models.ReportRevision, error)
+	MockCreateStormReport      func(report models.StormReport, source models.ChangeSource) (models.StormReport, error)
+	MockUpdateStormReport      func(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error)
+	MockDeleteStormReport      func(id string, source models.ChangeSource) (models.StormReport, error)
+	MockGetAuditLog            func(query models.AuditQuery) ([]models.AuditEntry, error)
+	MockPurgeStormReports      func(query models.PurgeQuery, dryRun bool, source models.ChangeSource) (models.PurgeResult, error)
+	MockUpsertStormReport      func(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error)
+	MockWithdrawStormReport    func(id string, source models.ChangeSource) (models.UpsertResult, error)
 }
 
-func (m *MockStormDAO) GetStormReports(start string, end string) ([]models.StormReport, error) {
-	return m.MockGetStormReports(start, end)
+func (m *MockStormDAO) GetStormReports(ctx context.Context, query models.StormQuery) ([]models.StormReport, error) {
+	return m.MockGetStormReports(query)
+}
+
+func (m *MockStormDAO) GetStormStats(ctx context.Context, query models.StatsQuery) ([]models.StatsRow, error) {
+	return m.MockGetStormStats(query)
+}
+
+func (m *MockStormDAO) SearchStormReports(ctx context.Context, query models.StormQuery, q string) ([]models.SearchResult, error) {
+	return m.MockSearchStormReports(query, q)
+}
+
+func (m *MockStormDAO) GetStormReport(ctx context.Context, id string) (*models.StormReport, error) {
+	return m.MockGetStormReport(id)
+}
+
+func (m *MockStormDAO) GetDeletedStormReports(query models.StormQuery) ([]models.StormReport, error) {
+	return m.MockGetDeletedStormReports(query)
+}
+
+func (m *MockStormDAO) GetStormReportHistory(ctx context.Context, id string) ([]models.ReportRevision, error) {
+	return m.MockGetStormReportHistory(id)
+}
+
+func (m *MockStormDAO) CreateStormReport(report models.StormReport, source models.ChangeSource) (models.StormReport, error) {
+	return m.MockCreateStormReport(report, source)
+}
+
+func (m *MockStormDAO) UpdateStormReport(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+	return m.MockUpdateStormReport(report, source)
+}
+
+func (m *MockStormDAO) DeleteStormReport(id string, source models.ChangeSource) (models.StormReport, error) {
+	return m.MockDeleteStormReport(id, source)
+}
+
+func (m *MockStormDAO) GetAuditLog(query models.AuditQuery) ([]models.AuditEntry, error) {
+	return m.MockGetAuditLog(query)
+}
+
+func (m *MockStormDAO) PurgeStormReports(query models.PurgeQuery, dryRun bool, source models.ChangeSource) (models.PurgeResult, error) {
+	return m.MockPurgeStormReports(query, dryRun, source)
+}
+
+func (m *MockStormDAO) UpsertStormReport(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+	return m.MockUpsertStormReport(report, source)
+}
+
+func (m *MockStormDAO) WithdrawStormReport(id string, source models.ChangeSource) (models.UpsertResult, error) {
+	return m.MockWithdrawStormReport(id, source)
 }
 
 func (m *MockStormDAO) Disconnect() error {
 	return nil
 }
+
+type MockAPIKeyStore struct {
+	MockCreateAPIKey    func(key models.APIKey) error
+	MockListAPIKeys     func() ([]models.APIKey, error)
+	MockGetAPIKeyByHash func(hash string) (*models.APIKey, error)
+	MockRevokeAPIKey    func(id string) error
+}
+
+func (m *MockAPIKeyStore) CreateAPIKey(key models.APIKey) error {
+	return m.MockCreateAPIKey(key)
+}
+
+func (m *MockAPIKeyStore) ListAPIKeys() ([]models.APIKey, error) {
+	return m.MockListAPIKeys()
+}
+
+func (m *MockAPIKeyStore) GetAPIKeyByHash(hash string) (*models.APIKey, error) {
+	return m.MockGetAPIKeyByHash(hash)
+}
+
+func (m *MockAPIKeyStore) RevokeAPIKey(id string) error {
+	return m.MockRevokeAPIKey(id)
+}
+
+type MockUsageStore struct {
+	MockAddUsage func(client, kind, day string, n int64) (int64, error)
+}
+
+func (m *MockUsageStore) AddUsage(client, kind, day string, n int64) (int64, error) {
+	return m.MockAddUsage(client, kind, day, n)
+}
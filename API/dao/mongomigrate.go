@@ -0,0 +1,324 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoMigration is one versioned change to how documents are stored. Up
+// applies it and Down reverts it. Both must be safe to run again, since a
+// migration interrupted partway is run again from the start.
+type MongoMigration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, dao *StormDAO) error
+	// Down is nil if the migration can't be rolled back.
+	Down func(ctx context.Context, dao *StormDAO) error
+}
+
+// mongoMigrations are the migrations the API runs, in version order. New
+// ones go at the end with the next version; released ones never change.
+var mongoMigrations = []MongoMigration{
+	{Version: 1, Name: "report_dates", Up: migrateReportDates, Down: unmigrateReportDates},
+}
+
+// LatestMigration targets every known migration, without rolling any back.
+const LatestMigration = -1
+
+// MigrationStatus is a known or recorded migration and when it was applied,
+// if it has been.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	// Unknown is set for applied migrations this binary doesn't have, left
+	// by a newer release.
+	Unknown bool
+}
+
+// MigrationStep is a migration to apply or, if Down is set, roll back.
+type MigrationStep struct {
+	Version int
+	Name    string
+	Down    bool
+}
+
+func (s MigrationStep) String() string {
+	if s.Down {
+		return fmt.Sprintf("roll back %d_%s", s.Version, s.Name)
+	}
+	return fmt.Sprintf("apply %d_%s", s.Version, s.Name)
+}
+
+const (
+	migrationLockID  = "migrations"
+	migrationLockTTL = time.Minute
+	// migrationLockRetry is how often a replica waiting for the lock tries
+	// again.
+	migrationLockRetry = 2 * time.Second
+)
+
+// MongoMigrator runs migrations against a StormDAO's database, recording
+// those applied in the <collection>_migrations collection. Runs hold a lock
+// in <collection>_migration_lock, so when several replicas start at once
+// one migrates and the others wait for it.
+type MongoMigrator struct {
+	dao        *StormDAO
+	owner      string
+	migrations []MongoMigration
+}
+
+// NewMongoMigrator returns a migrator for the given migrations, which must
+// have distinct positive versions in ascending order. owner names this
+// process in the lock.
+func NewMongoMigrator(dao *StormDAO, owner string, migrations []MongoMigration) (*MongoMigrator, error) {
+	for i, m := range migrations {
+		if m.Version <= 0 || m.Name == "" || m.Up == nil {
+			return nil, fmt.Errorf("migration %d needs a positive version, a name and an up function", m.Version)
+		}
+		if i > 0 && m.Version <= migrations[i-1].Version {
+			return nil, fmt.Errorf("migration %d_%s is out of order", m.Version, m.Name)
+		}
+	}
+	return &MongoMigrator{dao: dao, owner: owner, migrations: migrations}, nil
+}
+
+// Migrator returns a migrator for the API's own migrations.
+func (dao *StormDAO) Migrator(owner string) *MongoMigrator {
+	return &MongoMigrator{dao: dao, owner: owner, migrations: mongoMigrations}
+}
+
+// Status lists the known migrations in version order, along with any
+// applied ones this binary doesn't know.
+func (m *MongoMigrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []MigrationStatus
+	known := make(map[int]bool)
+	for _, mig := range m.migrations {
+		known[mig.Version] = true
+		status := MigrationStatus{Version: mig.Version, Name: mig.Name}
+		if record, ok := applied[mig.Version]; ok {
+			status.AppliedAt = &record.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	for version, record := range applied {
+		if !known[version] {
+			statuses = append(statuses, MigrationStatus{Version: version, Name: record.Name, AppliedAt: &record.AppliedAt, Unknown: true})
+		}
+	}
+	slices.SortFunc(statuses, func(a, b MigrationStatus) int { return a.Version - b.Version })
+	return statuses, nil
+}
+
+// Plan returns the steps Migrate would take to reach target: rolling back
+// the applied migrations above it, newest first, then applying the pending
+// ones up to it, oldest first. LatestMigration targets them all.
+func (m *MongoMigrator) Plan(ctx context.Context, target int) ([]MigrationStep, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.plan(applied, target)
+}
+
+func (m *MongoMigrator) plan(applied map[int]migrationRecord, target int) ([]MigrationStep, error) {
+	if target == LatestMigration {
+		// Migrations left by a newer release are kept; it may still be
+		// running alongside this one.
+		target = math.MaxInt
+	}
+	if target < 0 {
+		return nil, fmt.Errorf("invalid migration target %d", target)
+	}
+	var steps []MigrationStep
+	for version, record := range applied {
+		if version > target && m.find(version) == nil {
+			return nil, fmt.Errorf("migration %d_%s was applied by a newer release and can't be rolled back by this one", version, record.Name)
+		}
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.Version]; ok && mig.Version > target {
+			if mig.Down == nil {
+				return nil, fmt.Errorf("migration %d_%s can't be rolled back", mig.Version, mig.Name)
+			}
+			steps = append(steps, MigrationStep{Version: mig.Version, Name: mig.Name, Down: true})
+		}
+	}
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; !ok && mig.Version <= target {
+			steps = append(steps, MigrationStep{Version: mig.Version, Name: mig.Name})
+		}
+	}
+	return steps, nil
+}
+
+func (m *MongoMigrator) find(version int) *MongoMigration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
+
+// Migrate brings the database to target, as planned by Plan, and returns the
+// steps it took. It waits for any other replica's run to finish first, then
+// plans again, so a replica that waited usually has nothing left to do. A
+// failed step stops the run; the steps before it stay done.
+func (m *MongoMigrator) Migrate(ctx context.Context, target int) ([]MigrationStep, error) {
+	return m.migrate(ctx, target, nil)
+}
+
+// Apply is Migrate for steps already returned by Plan: once it holds the
+// lock, it takes them only if they are still the plan, so another replica
+// migrating in between can't change what runs.
+func (m *MongoMigrator) Apply(ctx context.Context, target int, planned []MigrationStep) ([]MigrationStep, error) {
+	return m.migrate(ctx, target, func(steps []MigrationStep) error {
+		if !slices.Equal(steps, planned) {
+			return errors.New("the migrations changed since they were planned; plan again")
+		}
+		return nil
+	})
+}
+
+func (m *MongoMigrator) migrate(ctx context.Context, target int, check func([]MigrationStep) error) ([]MigrationStep, error) {
+	ctx, unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := m.plan(applied, target)
+	if err != nil {
+		return nil, err
+	}
+	if check != nil {
+		if err := check(steps); err != nil {
+			return nil, err
+		}
+	}
+	for i, step := range steps {
+		// The context is cancelled if the lock is lost.
+		if ctx.Err() != nil {
+			return steps[:i], context.Cause(ctx)
+		}
+		mig := m.find(step.Version)
+		if step.Down {
+			err = mig.Down(ctx, m.dao)
+			if err == nil {
+				_, err = m.dao.migrations.DeleteOne(ctx, bson.M{"_id": step.Version})
+			}
+		} else {
+			err = mig.Up(ctx, m.dao)
+			if err == nil {
+				_, err = m.dao.migrations.InsertOne(ctx, migrationRecord{Version: step.Version, Name: step.Name, AppliedAt: time.Now().UTC()})
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				err = context.Cause(ctx)
+			}
+			return steps[:i], fmt.Errorf("failed to %s: %w", step, err)
+		}
+	}
+	return steps, nil
+}
+
+type migrationRecord struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+func (m *MongoMigrator) applied(ctx context.Context) (map[int]migrationRecord, error) {
+	cursor, err := m.dao.migrations.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+	var records []migrationRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+	applied := make(map[int]migrationRecord, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// lock takes the migration lock, waiting while another replica holds it,
+// and keeps it renewed until the returned function releases it. Expiry is
+// by the server's clock, so replicas with skewed clocks agree on it, and a
+// lock left by a replica that died expires after migrationLockTTL. The
+// returned context is cancelled if a renewal fails or finds the lock taken,
+// so a replica that may have lost the lock stops migrating.
+func (m *MongoMigrator) lock(ctx context.Context) (context.Context, func(), error) {
+	expiresAt := bson.M{"$add": bson.A{"$$NOW", migrationLockTTL.Milliseconds()}}
+	for {
+		_, err := m.dao.migrationLock.UpdateOne(ctx,
+			bson.M{"_id": migrationLockID, "$expr": bson.M{"$lt": bson.A{"$expiresAt", "$$NOW"}}},
+			mongo.Pipeline{{{Key: "$set", Value: bson.M{"owner": m.owner, "lockedAt": "$$NOW", "expiresAt": expiresAt}}}},
+			options.Update().SetUpsert(true))
+		if err == nil {
+			break
+		}
+		// An unexpired lock doesn't match, so the upsert collides with it.
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, nil, fmt.Errorf("failed to take migration lock: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(migrationLockRetry):
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(migrationLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			res, err := m.dao.migrationLock.UpdateOne(ctx,
+				bson.M{"_id": migrationLockID, "owner": m.owner},
+				mongo.Pipeline{{{Key: "$set", Value: bson.M{"expiresAt": expiresAt}}}})
+			if err == nil && res.MatchedCount == 0 {
+				err = errors.New("another replica holds it")
+			}
+			if err != nil {
+				cancel(fmt.Errorf("lost migration lock: %w", err))
+				return
+			}
+		}
+	}()
+	return ctx, func() {
+		close(done)
+		<-stopped
+		cancel(nil)
+		m.dao.migrationLock.DeleteOne(context.TODO(), bson.M{"_id": migrationLockID, "owner": m.owner})
+	}, nil
+}
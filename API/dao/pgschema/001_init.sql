@@ -0,0 +1,77 @@
+CREATE EXTENSION IF NOT EXISTS postgis;
+
+-- Dates are unix timestamps stored as text and compared bytewise, as in
+-- MongoDB.
+CREATE TABLE storm_reports (
+    id              text PRIMARY KEY,
+    date            text COLLATE "C" NOT NULL,
+    time            integer NOT NULL DEFAULT 0,
+    size            double precision NOT NULL DEFAULT 0,
+    f_scale         text NOT NULL DEFAULT '',
+    speed           integer NOT NULL DEFAULT 0,
+    location        text NOT NULL DEFAULT '',
+    county          text NOT NULL DEFAULT '',
+    state           text NOT NULL DEFAULT '',
+    lat             double precision NOT NULL DEFAULT 0,
+    lon             double precision NOT NULL DEFAULT 0,
+    comments        text NOT NULL DEFAULT '',
+    type            text NOT NULL,
+    synthetic       boolean NOT NULL DEFAULT false,
+    deleted         boolean NOT NULL DEFAULT false,
+    deleted_at      timestamptz,
+    withdrawn       boolean NOT NULL DEFAULT false,
+    withdrawn_at    timestamptz,
+    revision        integer NOT NULL DEFAULT 1,
+    updated_at      timestamptz,
+    written_at      timestamptz NOT NULL DEFAULT now(),
+    kafka_partition integer,
+    kafka_offset    bigint,
+    geom            geometry(Point, 4326) GENERATED ALWAYS AS (ST_SetSRID(ST_MakePoint(lon, lat), 4326)) STORED
+);
+CREATE INDEX storm_reports_date_idx ON storm_reports (date);
+CREATE INDEX storm_reports_geom_idx ON storm_reports USING gist (geom);
+CREATE INDEX storm_reports_written_at_idx ON storm_reports (written_at);
+
+CREATE TABLE storm_report_revisions (
+    seq        bigserial PRIMARY KEY,
+    report_id  text NOT NULL,
+    previous   jsonb NOT NULL,
+    changes    jsonb NOT NULL,
+    source     jsonb NOT NULL,
+    changed_at timestamptz NOT NULL
+);
+CREATE INDEX storm_report_revisions_report_idx ON storm_report_revisions (report_id, changed_at);
+
+CREATE TABLE storm_report_audit (
+    seq       bigserial PRIMARY KEY,
+    action    text NOT NULL,
+    report_id text,
+    actor     text NOT NULL,
+    reason    text NOT NULL,
+    before    jsonb,
+    after     jsonb,
+    changes   jsonb,
+    purge     jsonb,
+    result    jsonb,
+    at        timestamptz NOT NULL
+);
+CREATE INDEX storm_report_audit_report_idx ON storm_report_audit (report_id, at DESC);
+CREATE INDEX storm_report_audit_at_idx ON storm_report_audit (at DESC);
+
+CREATE TABLE api_keys (
+    id         text PRIMARY KEY,
+    name       text NOT NULL,
+    hash       text NOT NULL UNIQUE,
+    scopes     text[] NOT NULL,
+    created_at timestamptz NOT NULL,
+    revoked_at timestamptz
+);
+
+CREATE TABLE usage (
+    kind   text NOT NULL,
+    client text NOT NULL,
+    day    date NOT NULL,
+    count  bigint NOT NULL,
+    PRIMARY KEY (kind, client, day)
+);
+CREATE INDEX usage_day_idx ON usage (day);
@@ -0,0 +1,14 @@
+-- Report dates become timestamps, so they compare as instants rather than
+-- as text. The producer has published both seconds and milliseconds.
+--
+-- Dates that aren't unix timestamps can't be converted, and MongoDB leaves
+-- them as they are. The API never accepted them, so those reports are moved
+-- to storm_reports_undated, for fixing by hand, rather than guessed at.
+CREATE TABLE storm_reports_undated AS SELECT * FROM storm_reports WHERE date !~ '^[0-9]+$';
+DELETE FROM storm_reports WHERE date !~ '^[0-9]+$';
+
+ALTER TABLE storm_reports ALTER COLUMN date TYPE timestamptz USING
+    CASE WHEN date::bigint > 100000000000 THEN to_timestamp(date::bigint / 1000.0) ELSE to_timestamp(date::bigint) END;
+
+DROP INDEX storm_reports_date_idx;
+CREATE INDEX storm_reports_date_idx ON storm_reports (date, time, id);
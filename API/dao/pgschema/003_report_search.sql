@@ -0,0 +1,5 @@
+-- Text search over comments, location and county, stemmed and without stop
+-- words as MongoDB's text index does.
+ALTER TABLE storm_reports ADD COLUMN search tsvector GENERATED ALWAYS AS
+    (to_tsvector('english', comments || ' ' || location || ' ' || county)) STORED;
+CREATE INDEX storm_reports_search_idx ON storm_reports USING gin (search);
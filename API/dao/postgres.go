@@ -0,0 +1,1049 @@
+package dao
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+// pgSchema holds the schema migrations, applied in file name order.
+//
+//go:embed pgschema/*.sql
+var pgSchema embed.FS
+
+// pgMigrationLock is the advisory lock held while migrating, so replicas
+// starting together don't apply the same migration twice.
+const pgMigrationLock = 7414052
+
+// pgUniqueViolation is the SQLSTATE of a duplicate key.
+const pgUniqueViolation = "23505"
+
+// PostgresStormDAO stores reports in PostgreSQL, with a PostGIS point per
+// report for spatial filters. Queries behave as StormDAO's do. Unlike the
+// MongoDB DAO, each write and its revision or audit entry are made in one
+// transaction.
+type PostgresStormDAO struct {
+	pool        *pgxpool.Pool
+	usagePruner usagePruner
+}
+
+// pgQuerier is satisfied by both the pool and a transaction.
+type pgQuerier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func NewPostgresStormDAO(url string) (*PostgresStormDAO, error) {
+	pool, err := pgxpool.New(context.TODO(), url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	if err := pool.Ping(context.TODO()); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	return &PostgresStormDAO{pool: pool}, nil
+}
+
+// Migrate applies the embedded schema migrations that haven't been applied
+// yet, each in its own transaction.
+func (dao *PostgresStormDAO) Migrate() error {
+	ctx := context.TODO()
+	conn, err := dao.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", pgMigrationLock); err != nil {
+		return fmt.Errorf("failed to take migration lock: %w", err)
+	}
+	defer conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", pgMigrationLock)
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    text PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	names, err := fs.Glob(pgSchema, "pgschema/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		version := strings.TrimSuffix(path.Base(name), ".sql")
+		var applied bool
+		err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", version).Scan(&applied)
+		if err != nil {
+			return fmt.Errorf("failed to read schema_migrations: %w", err)
+		}
+		if applied {
+			continue
+		}
+		script, err := pgSchema.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			// Without arguments the script is sent as a simple query, so
+			// it may hold several statements.
+			if _, err := tx.Exec(ctx, string(script)); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func (dao *PostgresStormDAO) Disconnect() error {
+	dao.pool.Close()
+	return nil
+}
+
+const pgReportColumns = "id, date, time, size, f_scale, speed, location, county, state, lat, lon, comments, type, " +
+	"synthetic, deleted, deleted_at, withdrawn, withdrawn_at, revision, updated_at"
+
+const pgInsertReport = `INSERT INTO storm_reports (` + pgReportColumns + `, written_at, kafka_partition, kafka_offset)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, clock_timestamp(), $21, $22)`
+
+// pgUpsertReport replaces every column but the Kafka position, which is
+// only replaced by ingested writes.
+const pgUpsertReport = pgInsertReport + ` ON CONFLICT (id) DO UPDATE SET
+	date = EXCLUDED.date, time = EXCLUDED.time, size = EXCLUDED.size, f_scale = EXCLUDED.f_scale,
+	speed = EXCLUDED.speed, location = EXCLUDED.location, county = EXCLUDED.county, state = EXCLUDED.state,
+	lat = EXCLUDED.lat, lon = EXCLUDED.lon, comments = EXCLUDED.comments, type = EXCLUDED.type,
+	synthetic = EXCLUDED.synthetic, deleted = EXCLUDED.deleted, deleted_at = EXCLUDED.deleted_at,
+	withdrawn = EXCLUDED.withdrawn, withdrawn_at = EXCLUDED.withdrawn_at, revision = EXCLUDED.revision,
+	updated_at = EXCLUDED.updated_at, written_at = EXCLUDED.written_at,
+	kafka_partition = COALESCE(EXCLUDED.kafka_partition, storm_reports.kafka_partition),
+	kafka_offset = COALESCE(EXCLUDED.kafka_offset, storm_reports.kafka_offset)`
+
+// writePgReport stores report with sql, pgInsertReport or pgUpsertReport,
+// recording when it was written, by the server's clock, and, for ingested
+// reports, the Kafka position it was written from.
+func writePgReport(ctx context.Context, q pgQuerier, sql string, report models.StormReport, source models.ChangeSource) error {
+	args, err := pgReportArgs(report, source)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(ctx, sql, args...)
+	return err
+}
+
+// pgReportArgs returns the arguments pgInsertReport takes for report.
+func pgReportArgs(report models.StormReport, source models.ChangeSource) ([]any, error) {
+	date, err := models.ParseReportDate(report.Date)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode storm report: %w", err)
+	}
+	var partition, offset any
+	if source.Actor == models.ActorIngest {
+		partition, offset = source.KafkaPartition, source.KafkaOffset
+	}
+	revision := max(report.Revision, 1)
+	return []any{
+		report.ID, date, report.Time, report.Size, report.F_Scale, report.Speed, report.Location,
+		report.County, report.State, report.Lat, report.Lon, report.Comments, string(report.Type),
+		report.Synthetic, report.Deleted, report.DeletedAt, report.Withdrawn, report.WithdrawnAt,
+		revision, report.UpdatedAt, partition, offset,
+	}, nil
+}
+
+// scanPgReport reads the pgReportColumns of a row, then any extra columns
+// into extra.
+func scanPgReport(row pgx.Row, extra ...any) (models.StormReport, error) {
+	var r models.StormReport
+	var stormType string
+	var date time.Time
+	dest := []any{&r.ID, &date, &r.Time, &r.Size, &r.F_Scale, &r.Speed, &r.Location, &r.County, &r.State,
+		&r.Lat, &r.Lon, &r.Comments, &stormType, &r.Synthetic, &r.Deleted, &r.DeletedAt, &r.Withdrawn,
+		&r.WithdrawnAt, &r.Revision, &r.UpdatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return r, err
+	}
+	r.Date, r.Type = models.FormatReportDate(date), models.StormType(stormType)
+	r.DeletedAt, r.WithdrawnAt, r.UpdatedAt = utcTime(r.DeletedAt), utcTime(r.WithdrawnAt), utcTime(r.UpdatedAt)
+	return r, nil
+}
+
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+	return &u
+}
+
+func (dao *PostgresStormDAO) queryReports(ctx context.Context, sql string, args ...any) ([]models.StormReport, error) {
+	rows, err := dao.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query PostgreSQL: %w", err)
+	}
+	defer rows.Close()
+
+	reports := []models.StormReport{}
+	for rows.Next() {
+		report, err := scanPgReport(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode storm report: %w", err)
+		}
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query PostgreSQL: %w", err)
+	}
+	return reports, nil
+}
+
+// getPgReport returns a report by ID, locking its row for the rest of the
+// transaction when forUpdate is set.
+func getPgReport(ctx context.Context, q pgQuerier, id string, forUpdate bool) (models.StormReport, error) {
+	sql := "SELECT " + pgReportColumns + " FROM storm_reports WHERE id = $1"
+	if forUpdate {
+		sql += " FOR UPDATE"
+	}
+	report, err := scanPgReport(q.QueryRow(ctx, sql, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return report, models.ErrNotFound
+	}
+	if err != nil {
+		return report, fmt.Errorf("failed to query PostgreSQL: %w", err)
+	}
+	return report, nil
+}
+
+// pgWhere builds a WHERE clause and its arguments.
+type pgWhere struct {
+	conds []string
+	args  []any
+}
+
+// arg adds an argument and returns its placeholder.
+func (w *pgWhere) arg(v any) string {
+	w.args = append(w.args, v)
+	return "$" + strconv.Itoa(len(w.args))
+}
+
+func (w *pgWhere) add(cond string) {
+	w.conds = append(w.conds, cond)
+}
+
+func (w *pgWhere) String() string {
+	if len(w.conds) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(w.conds, " AND ")
+}
+
+func (w *pgWhere) addFilter(f models.StormFilter) {
+	if len(f.Types) > 0 {
+		types := make([]string, len(f.Types))
+		for i, t := range f.Types {
+			types[i] = string(t)
+		}
+		w.add("type = ANY(" + w.arg(types) + ")")
+	}
+	if len(f.States) > 0 {
+		w.add("state = ANY(" + w.arg(f.States) + ")")
+	}
+	if len(f.Counties) > 0 {
+		w.add("county = ANY(" + w.arg(f.Counties) + ")")
+	}
+	if f.BBox != nil {
+		// && matches points on the box's edges, as Mongo's $gte/$lte do.
+		w.add(fmt.Sprintf("geom && ST_MakeEnvelope(%s, %s, %s, %s, 4326)",
+			w.arg(f.BBox.MinLon), w.arg(f.BBox.MinLat), w.arg(f.BBox.MaxLon), w.arg(f.BBox.MaxLat)))
+	}
+}
+
+// pgFilter is buildFilter for PostgreSQL.
+func pgFilter(query models.StormQuery) *pgWhere {
+	w := &pgWhere{}
+	w.add("date >= " + w.arg(query.Start))
+	w.add("date <= " + w.arg(query.End))
+	w.add("NOT deleted")
+	w.add("NOT withdrawn")
+	w.addFilter(query.Filter)
+	return w
+}
+
+// page returns the LIMIT and OFFSET clauses for the page a query asks
+// for.
+func (w *pgWhere) page(query models.StormQuery) string {
+	var clause string
+	if query.Limit > 0 {
+		clause += " LIMIT " + w.arg(query.Limit)
+	}
+	if query.Offset > 0 {
+		clause += " OFFSET " + w.arg(query.Offset)
+	}
+	return clause
+}
+
+func (dao *PostgresStormDAO) GetStormReports(ctx context.Context, query models.StormQuery) ([]models.StormReport, error) {
+	w := pgFilter(query)
+	order := "date, time, id"
+	if query.Sort == models.SortDateDesc {
+		order = "date DESC, time DESC, id DESC"
+	}
+	sql := "SELECT " + pgReportColumns + " FROM storm_reports WHERE " + w.String() + " ORDER BY " + order + w.page(query)
+	return dao.queryReports(ctx, sql, w.args...)
+}
+
+// pgStatsExpr is statsGroupExpr for PostgreSQL.
+func pgStatsExpr(dim models.StatsDimension) string {
+	switch dim {
+	case models.DimensionDay:
+		return `to_char(date AT TIME ZONE 'UTC', 'YYYY-MM-DD')`
+	case models.DimensionHour:
+		return "time / 100"
+	case models.DimensionType, models.DimensionState, models.DimensionCounty:
+		return string(dim)
+	}
+	return "NULL"
+}
+
+func (dao *PostgresStormDAO) GetStormStats(ctx context.Context, query models.StatsQuery) ([]models.StatsRow, error) {
+	w := pgFilter(query.Range())
+	var exprs, order []string
+	for _, dim := range query.GroupBy {
+		expr := pgStatsExpr(dim)
+		exprs = append(exprs, expr)
+		if dim == models.DimensionHour {
+			order = append(order, expr)
+		} else {
+			// Sort bytewise, as Mongo does.
+			order = append(order, expr+` COLLATE "C"`)
+		}
+	}
+	sql := "SELECT " + strings.Join(append(exprs, "count(*)"), ", ") + " FROM storm_reports WHERE " + w.String()
+	if len(exprs) > 0 {
+		sql += " GROUP BY " + strings.Join(exprs, ", ") + " ORDER BY " + strings.Join(order, ", ")
+	} else {
+		// Mongo returns no total row when nothing matches.
+		sql += " HAVING count(*) > 0"
+	}
+
+	rows, err := dao.pool.Query(ctx, sql, w.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate storm stats: %w", err)
+	}
+	defer rows.Close()
+
+	stats := []models.StatsRow{}
+	for rows.Next() {
+		var row models.StatsRow
+		var stormType string
+		var hour int
+		dest := make([]any, 0, len(query.GroupBy)+1)
+		for _, dim := range query.GroupBy {
+			switch dim {
+			case models.DimensionType:
+				dest = append(dest, &stormType)
+			case models.DimensionState:
+				dest = append(dest, &row.State)
+			case models.DimensionCounty:
+				dest = append(dest, &row.County)
+			case models.DimensionDay:
+				dest = append(dest, &row.Day)
+			case models.DimensionHour:
+				dest = append(dest, &hour)
+			}
+		}
+		if err := rows.Scan(append(dest, &row.Count)...); err != nil {
+			return nil, fmt.Errorf("failed to decode storm stats: %w", err)
+		}
+		row.Type = models.StormType(stormType)
+		for _, dim := range query.GroupBy {
+			if dim == models.DimensionHour {
+				row.Hour = &hour
+			}
+		}
+		stats = append(stats, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to aggregate storm stats: %w", err)
+	}
+	return stats, nil
+}
+
+// SearchStormReports matches reports against the search column, ranked by
+// ts_rank. Words match any and phrases must all appear, as on MongoDB, so
+// the words and the rest of the search are parsed into separate tsqueries
+// and combined, since websearch_to_tsquery alone would need all the words.
+func (dao *PostgresStormDAO) SearchStormReports(ctx context.Context, query models.StormQuery, q string) ([]models.SearchResult, error) {
+	search := models.ParseSearch(q)
+	var rest []string
+	for _, p := range search.Phrases {
+		rest = append(rest, `"`+p+`"`)
+	}
+	for _, e := range search.Excluded {
+		rest = append(rest, `-"`+e+`"`)
+	}
+
+	w := pgFilter(query)
+	tsquery := fmt.Sprintf("(websearch_to_tsquery('english', %s) && websearch_to_tsquery('english', %s))",
+		w.arg(strings.Join(search.Terms, " or ")), w.arg(strings.Join(rest, " ")))
+	w.add("search @@ " + tsquery)
+	sql := "SELECT " + pgReportColumns + ", ts_rank(search, " + tsquery + ") AS score FROM storm_reports WHERE " +
+		w.String() + " ORDER BY score DESC, date, time, id" + w.page(query)
+	rows, err := dao.pool.Query(ctx, sql, w.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search PostgreSQL: %w", err)
+	}
+	defer rows.Close()
+
+	results := []models.SearchResult{}
+	for rows.Next() {
+		var score float64
+		report, err := scanPgReport(rows, &score)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode search results: %w", err)
+		}
+		results = append(results, models.SearchResult{StormReport: report, Score: score, Highlights: search.Highlight(report)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to search PostgreSQL: %w", err)
+	}
+	return results, nil
+}
+
+func (dao *PostgresStormDAO) GetStormReport(ctx context.Context, id string) (*models.StormReport, error) {
+	report, err := getPgReport(ctx, dao.pool, id, false)
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func (dao *PostgresStormDAO) GetDeletedStormReports(query models.StormQuery) ([]models.StormReport, error) {
+	w := &pgWhere{}
+	w.add("date >= " + w.arg(query.Start))
+	w.add("date <= " + w.arg(query.End))
+	w.add("deleted")
+	w.addFilter(query.Filter)
+	sql := "SELECT " + pgReportColumns + " FROM storm_reports WHERE " + w.String() + " ORDER BY deleted_at DESC, id" + w.page(query)
+	return dao.queryReports(context.TODO(), sql, w.args...)
+}
+
+func (dao *PostgresStormDAO) GetStormReportHistory(ctx context.Context, id string) ([]models.ReportRevision, error) {
+	rows, err := dao.pool.Query(ctx,
+		"SELECT previous, changes, source, changed_at FROM storm_report_revisions WHERE report_id = $1 ORDER BY changed_at, seq", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query report revisions: %w", err)
+	}
+	defer rows.Close()
+
+	revisions := []models.ReportRevision{}
+	for rows.Next() {
+		revision := models.ReportRevision{ReportID: id}
+		var previous, changes, source []byte
+		if err := rows.Scan(&previous, &changes, &source, &revision.ChangedAt); err != nil {
+			return nil, fmt.Errorf("failed to decode report revisions: %w", err)
+		}
+		revision.ChangedAt = revision.ChangedAt.UTC()
+		for _, field := range []struct {
+			data []byte
+			v    any
+		}{{previous, &revision.Previous}, {changes, &revision.Changes}, {source, &revision.Source}} {
+			if err := json.Unmarshal(field.data, field.v); err != nil {
+				return nil, fmt.Errorf("failed to decode report revisions: %w", err)
+			}
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query report revisions: %w", err)
+	}
+	return revisions, nil
+}
+
+func insertPgRevision(ctx context.Context, q pgQuerier, revision models.ReportRevision) error {
+	previous, err := json.Marshal(revision.Previous)
+	if err != nil {
+		return fmt.Errorf("failed to encode report revision: %w", err)
+	}
+	changes, err := json.Marshal(revision.Changes)
+	if err != nil {
+		return fmt.Errorf("failed to encode report revision: %w", err)
+	}
+	source, err := json.Marshal(revision.Source)
+	if err != nil {
+		return fmt.Errorf("failed to encode report revision: %w", err)
+	}
+	_, err = q.Exec(ctx,
+		"INSERT INTO storm_report_revisions (report_id, previous, changes, source, changed_at) VALUES ($1, $2, $3, $4, $5)",
+		revision.ReportID, previous, changes, source, revision.ChangedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record report revision: %w", err)
+	}
+	return nil
+}
+
+// UpsertStormReport stores an ingested report under its stable ID, as
+// StormDAO.UpsertStormReport does.
+func (dao *PostgresStormDAO) UpsertStormReport(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+	ctx := context.TODO()
+	report.ID = models.ReportID(report)
+	result := models.UpsertResult{ID: report.ID, Report: report}
+
+	err := pgx.BeginFunc(ctx, dao.pool, func(tx pgx.Tx) error {
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		// A new report is inserted outright. Otherwise the row is there to
+		// lock, even if a concurrent write only just inserted it, and is
+		// updated under the lock.
+		created := report
+		created.Revision, created.UpdatedAt = 1, &now
+		args, err := pgReportArgs(created, source)
+		if err != nil {
+			return err
+		}
+		var id string
+		err = tx.QueryRow(ctx, pgInsertReport+" ON CONFLICT (id) DO NOTHING RETURNING id", args...).Scan(&id)
+		if err == nil {
+			result.Report, result.Created = created, true
+			return nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		existing, err := getPgReport(ctx, tx, report.ID, true)
+		if err != nil {
+			return err
+		}
+
+		// The first date a report was seen on is kept, and re-ingesting a
+		// deleted report doesn't bring it back. A withdrawn report that SPC
+		// publishes again is reinstated.
+		report.Date = existing.Date
+		report.Deleted, report.DeletedAt = existing.Deleted, existing.DeletedAt
+		report.Withdrawn, report.WithdrawnAt = false, nil
+		report.Revision, report.UpdatedAt = existing.Revision, existing.UpdatedAt
+		result.Report = report
+		changes := models.DiffReports(existing, report)
+		if len(changes) == 0 {
+			return nil
+		}
+		err = insertPgRevision(ctx, tx, models.ReportRevision{
+			ReportID:  report.ID,
+			Previous:  existing,
+			Changes:   changes,
+			Source:    source,
+			ChangedAt: now,
+		})
+		if err != nil {
+			return err
+		}
+		report.Revision, report.UpdatedAt = existing.NextRevision(), &now
+		result.Report, result.Changed = report, true
+		return writePgReport(ctx, tx, pgUpsertReport, report, source)
+	})
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return result, fmt.Errorf("failed to upsert storm report: %w", err)
+	}
+	return result, err
+}
+
+// WithdrawStormReport marks a report withdrawn, recording a revision as for
+// any other change.
+func (dao *PostgresStormDAO) WithdrawStormReport(id string, source models.ChangeSource) (models.UpsertResult, error) {
+	ctx := context.TODO()
+	result := models.UpsertResult{ID: id}
+
+	err := pgx.BeginFunc(ctx, dao.pool, func(tx pgx.Tx) error {
+		existing, err := getPgReport(ctx, tx, id, true)
+		if err != nil {
+			return err
+		}
+		result.Report = existing
+		if existing.Withdrawn {
+			return nil
+		}
+
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		report := existing
+		report.Withdrawn, report.WithdrawnAt = true, &now
+		report.Revision, report.UpdatedAt = existing.NextRevision(), &now
+		err = insertPgRevision(ctx, tx, models.ReportRevision{
+			ReportID:  id,
+			Previous:  existing,
+			Changes:   models.DiffReports(existing, report),
+			Source:    source,
+			ChangedAt: now,
+		})
+		if err != nil {
+			return err
+		}
+		if err := writePgReport(ctx, tx, pgUpsertReport, report, source); err != nil {
+			return fmt.Errorf("failed to withdraw storm report: %w", err)
+		}
+		result.Report, result.Changed = report, true
+		return nil
+	})
+	return result, err
+}
+
+func (dao *PostgresStormDAO) CreateStormReport(report models.StormReport, source models.ChangeSource) (models.StormReport, error) {
+	ctx := context.TODO()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	report.ID = models.ReportID(report)
+	report.Revision, report.UpdatedAt = 1, &now
+
+	err := pgx.BeginFunc(ctx, dao.pool, func(tx pgx.Tx) error {
+		if err := writePgReport(ctx, tx, pgInsertReport, report, source); err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+				return models.ErrConflict
+			}
+			return fmt.Errorf("failed to insert storm report: %w", err)
+		}
+		return recordPgAudit(ctx, tx, models.AuditEntry{
+			Action:   models.AuditCreate,
+			ReportID: report.ID,
+			After:    &report,
+		}, source)
+	})
+	return report, err
+}
+
+func (dao *PostgresStormDAO) UpdateStormReport(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+	ctx := context.TODO()
+	result := models.UpsertResult{ID: report.ID, Report: report}
+
+	err := pgx.BeginFunc(ctx, dao.pool, func(tx pgx.Tx) error {
+		existing, err := getPgReport(ctx, tx, report.ID, true)
+		if err != nil {
+			return err
+		}
+		if existing.Deleted {
+			return models.ErrNotFound
+		}
+		if existing.Revision != report.Revision {
+			return models.ErrStaleRevision
+		}
+		changes := models.DiffReports(existing, report)
+		if existing.Date != report.Date {
+			changes["date"] = models.FieldChange{Old: existing.Date, New: report.Date}
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		report.Revision, report.UpdatedAt = existing.NextRevision(), &now
+		err = insertPgRevision(ctx, tx, models.ReportRevision{
+			ReportID:  report.ID,
+			Previous:  existing,
+			Changes:   changes,
+			Source:    source,
+			ChangedAt: now,
+		})
+		if err != nil {
+			return err
+		}
+		if err := writePgReport(ctx, tx, pgUpsertReport, report, source); err != nil {
+			return fmt.Errorf("failed to update storm report: %w", err)
+		}
+		result.Report, result.Changed = report, true
+		return recordPgAudit(ctx, tx, models.AuditEntry{
+			Action:   models.AuditUpdate,
+			ReportID: report.ID,
+			Before:   &existing,
+			After:    &report,
+			Changes:  changes,
+		}, source)
+	})
+	if err != nil {
+		result.Changed = false
+	}
+	return result, err
+}
+
+func (dao *PostgresStormDAO) DeleteStormReport(id string, source models.ChangeSource) (models.StormReport, error) {
+	ctx := context.TODO()
+	var after models.StormReport
+
+	err := pgx.BeginFunc(ctx, dao.pool, func(tx pgx.Tx) error {
+		before, err := getPgReport(ctx, tx, id, true)
+		if err != nil {
+			return err
+		}
+		if before.Deleted {
+			return models.ErrNotFound
+		}
+
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		_, err = tx.Exec(ctx, "UPDATE storm_reports SET deleted = true, deleted_at = $2, written_at = clock_timestamp(), revision = revision + 1, updated_at = $2 WHERE id = $1", id, now)
+		if err != nil {
+			return fmt.Errorf("failed to delete storm report: %w", err)
+		}
+		after = before
+		after.Deleted, after.DeletedAt = true, &now
+		after.Revision, after.UpdatedAt = before.NextRevision(), &now
+		return recordPgAudit(ctx, tx, models.AuditEntry{
+			Action:   models.AuditDelete,
+			ReportID: id,
+			Before:   &before,
+			After:    &after,
+		}, source)
+	})
+	if err != nil {
+		return models.StormReport{}, err
+	}
+	return after, nil
+}
+
+// pgPurgeFilter is purgeFilter for PostgreSQL.
+func pgPurgeFilter(query models.PurgeQuery) *pgWhere {
+	w := &pgWhere{}
+	start, end := query.Bounds()
+	if !start.IsZero() {
+		w.add("date >= " + w.arg(start))
+	}
+	if !end.IsZero() {
+		w.add("date <= " + w.arg(end))
+	}
+	w.addFilter(query.Filter)
+	if query.Synthetic {
+		w.add("synthetic")
+	}
+	if query.Mode != models.PurgeDelete {
+		w.add("NOT deleted")
+	}
+	return w
+}
+
+func (dao *PostgresStormDAO) PurgeStormReports(query models.PurgeQuery, dryRun bool, source models.ChangeSource) (models.PurgeResult, error) {
+	ctx := context.TODO()
+	var result models.PurgeResult
+	w := pgPurgeFilter(query)
+
+	err := pgx.BeginFunc(ctx, dao.pool, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, "SELECT count(*) FROM storm_reports WHERE "+w.String(), w.args...).Scan(&result.Matched); err != nil {
+			return fmt.Errorf("failed to count storm reports: %w", err)
+		}
+		if dryRun {
+			return nil
+		}
+
+		// IDs are gathered first so deletions can be passed on.
+		rows, err := tx.Query(ctx, "SELECT id FROM storm_reports WHERE "+w.String(), w.args...)
+		if err != nil {
+			return fmt.Errorf("failed to query storm reports: %w", err)
+		}
+		result.IDs, err = pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fmt.Errorf("failed to query storm reports: %w", err)
+		}
+
+		var tag pgconn.CommandTag
+		if query.Mode == models.PurgeSoftDelete {
+			where := w.String()
+			now := w.arg(time.Now().UTC().Truncate(time.Millisecond))
+			tag, err = tx.Exec(ctx, "UPDATE storm_reports SET deleted = true, deleted_at = "+now+", written_at = clock_timestamp(), revision = revision + 1, updated_at = "+now+" WHERE "+where, w.args...)
+			if err != nil {
+				return fmt.Errorf("failed to soft-delete storm reports: %w", err)
+			}
+		} else {
+			tag, err = tx.Exec(ctx, "DELETE FROM storm_reports WHERE "+w.String(), w.args...)
+			if err != nil {
+				return fmt.Errorf("failed to delete storm reports: %w", err)
+			}
+		}
+		result.Purged = tag.RowsAffected()
+
+		return recordPgAudit(ctx, tx, models.AuditEntry{
+			Action: models.AuditPurge,
+			Purge:  &query,
+			Result: &result,
+		}, source)
+	})
+	return result, err
+}
+
+func (dao *PostgresStormDAO) GetAuditLog(query models.AuditQuery) ([]models.AuditEntry, error) {
+	w := &pgWhere{}
+	if query.ReportID != "" {
+		w.add("report_id = " + w.arg(query.ReportID))
+	}
+	if query.Actor != "" {
+		w.add("actor = " + w.arg(query.Actor))
+	}
+	if query.Action != "" {
+		w.add("action = " + w.arg(string(query.Action)))
+	}
+	if !query.Since.IsZero() {
+		w.add("at >= " + w.arg(query.Since))
+	}
+	if !query.Until.IsZero() {
+		w.add("at <= " + w.arg(query.Until))
+	}
+	sql := "SELECT action, report_id, actor, reason, before, after, changes, purge, result, at FROM storm_report_audit WHERE " +
+		w.String() + " ORDER BY at DESC, seq DESC"
+	if query.Limit > 0 {
+		sql += " LIMIT " + w.arg(query.Limit)
+	}
+
+	rows, err := dao.pool.Query(context.TODO(), sql, w.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		var entry models.AuditEntry
+		var action string
+		var reportID *string
+		var before, after, changes, purge, result []byte
+		if err := rows.Scan(&action, &reportID, &entry.Actor, &entry.Reason, &before, &after, &changes, &purge, &result, &entry.At); err != nil {
+			return nil, fmt.Errorf("failed to decode audit log: %w", err)
+		}
+		entry.Action, entry.At = models.AuditAction(action), entry.At.UTC()
+		if reportID != nil {
+			entry.ReportID = *reportID
+		}
+		for _, field := range []struct {
+			data []byte
+			v    any
+		}{{before, &entry.Before}, {after, &entry.After}, {changes, &entry.Changes}, {purge, &entry.Purge}, {result, &entry.Result}} {
+			if field.data == nil {
+				continue
+			}
+			if err := json.Unmarshal(field.data, field.v); err != nil {
+				return nil, fmt.Errorf("failed to decode audit log: %w", err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	return entries, nil
+}
+
+// recordPgAudit stamps entry with its source and time and stores it as
+// part of the change's transaction.
+func recordPgAudit(ctx context.Context, q pgQuerier, entry models.AuditEntry, source models.ChangeSource) error {
+	entry.Actor = source.Actor
+	entry.Reason = source.Reason
+	entry.At = time.Now().UTC()
+
+	var reportID any
+	if entry.ReportID != "" {
+		reportID = entry.ReportID
+	}
+	values := []any{entry.Before, entry.After, entry.Changes, entry.Purge, entry.Result}
+	for i, v := range values {
+		data, err := jsonColumn(v)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit entry: %w", err)
+		}
+		// pgx stores a nil slice as NULL.
+		values[i] = data
+	}
+	_, err := q.Exec(ctx,
+		`INSERT INTO storm_report_audit (action, report_id, actor, reason, before, after, changes, purge, result, at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		string(entry.Action), reportID, entry.Actor, entry.Reason, values[0], values[1], values[2], values[3], values[4], entry.At)
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry: %w", err)
+	}
+	return nil
+}
+
+// jsonColumn encodes v for a JSON column, or returns nil, for NULL, when v
+// is a nil pointer or map.
+func jsonColumn(v any) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || ((rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Map) && rv.IsNil()) {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// PollReports calls publish for every report written since it started, by
+// the server's clock, checking every interval and reading pollOverlap
+// again, as StormDAO.PollReports does.
+func (dao *PostgresStormDAO) PollReports(ctx context.Context, interval time.Duration, publish func(models.StormReport)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var start time.Time
+	if err := dao.pool.QueryRow(ctx, "SELECT clock_timestamp()").Scan(&start); err != nil {
+		return fmt.Errorf("failed to read PostgreSQL server time: %w", err)
+	}
+	since := start
+	// Writes already published, by report and time written, so the
+	// overlapping reads don't repeat them.
+	seen := map[string]time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		from := since.Add(-pollOverlap)
+		if from.Before(start) {
+			from = start
+		}
+		rows, err := dao.pool.Query(ctx,
+			"SELECT "+pgReportColumns+", written_at FROM storm_reports WHERE written_at >= $1 ORDER BY written_at", from)
+		if err != nil {
+			return fmt.Errorf("failed to poll PostgreSQL: %w", err)
+		}
+		for rows.Next() {
+			var writtenAt time.Time
+			report, err := scanPgReport(rows, &writtenAt)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to decode polled reports: %w", err)
+			}
+			key := report.ID + "@" + writtenAt.String()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = writtenAt
+			if writtenAt.After(since) {
+				since = writtenAt
+			}
+			publish(report)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to poll PostgreSQL: %w", err)
+		}
+		for key, at := range seen {
+			if at.Before(since.Add(-pollOverlap)) {
+				delete(seen, key)
+			}
+		}
+	}
+}
+
+func (dao *PostgresStormDAO) CreateAPIKey(key models.APIKey) error {
+	_, err := dao.pool.Exec(context.TODO(),
+		"INSERT INTO api_keys (id, name, hash, scopes, created_at, revoked_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		key.ID, key.Name, key.Hash, scopeStrings(key.Scopes), key.CreatedAt, key.RevokedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store API key: %w", err)
+	}
+	return nil
+}
+
+func (dao *PostgresStormDAO) ListAPIKeys() ([]models.APIKey, error) {
+	rows, err := dao.pool.Query(context.TODO(),
+		"SELECT id, name, hash, scopes, created_at, revoked_at FROM api_keys ORDER BY created_at")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		key, err := scanPgAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (dao *PostgresStormDAO) GetAPIKeyByHash(hash string) (*models.APIKey, error) {
+	key, err := scanPgAPIKey(dao.pool.QueryRow(context.TODO(),
+		"SELECT id, name, hash, scopes, created_at, revoked_at FROM api_keys WHERE hash = $1", hash))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, models.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (dao *PostgresStormDAO) RevokeAPIKey(id string) error {
+	tag, err := dao.pool.Exec(context.TODO(),
+		"UPDATE api_keys SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL", id, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrNotFound
+	}
+	return nil
+}
+
+func scanPgAPIKey(row pgx.Row) (models.APIKey, error) {
+	var key models.APIKey
+	var scopes []string
+	err := row.Scan(&key.ID, &key.Name, &key.Hash, &scopes, &key.CreatedAt, &key.RevokedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return key, err
+	}
+	if err != nil {
+		return key, fmt.Errorf("failed to decode API key: %w", err)
+	}
+	for _, s := range scopes {
+		key.Scopes = append(key.Scopes, models.Scope(s))
+	}
+	key.CreatedAt, key.RevokedAt = key.CreatedAt.UTC(), utcTime(key.RevokedAt)
+	return key, nil
+}
+
+func scopeStrings(scopes []models.Scope) []string {
+	s := make([]string, len(scopes))
+	for i, scope := range scopes {
+		s[i] = string(scope)
+	}
+	return s
+}
+
+func (dao *PostgresStormDAO) AddUsage(client, kind, day string, n int64) (int64, error) {
+	ctx := context.TODO()
+	err := dao.usagePruner.prune(func(cutoff string) error {
+		_, err := dao.pool.Exec(ctx, "DELETE FROM usage WHERE day < $1::date", cutoff)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune usage: %w", err)
+	}
+
+	var count int64
+	err = dao.pool.QueryRow(ctx,
+		`INSERT INTO usage (kind, client, day, count) VALUES ($1, $2, $3::date, $4)
+		ON CONFLICT (kind, client, day) DO UPDATE SET count = usage.count + EXCLUDED.count
+		RETURNING count`,
+		kind, client, day, n).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record usage: %w", err)
+	}
+	return count, nil
+}
@@ -0,0 +1,93 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func (dao *StormDAO) PurgeStormReports(query models.PurgeQuery, dryRun bool, source models.ChangeSource) (models.PurgeResult, error) {
+	ctx := context.TODO()
+	var result models.PurgeResult
+
+	filter := purgeFilter(query)
+	matched, err := dao.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return result, fmt.Errorf("failed to count storm reports: %w", err)
+	}
+	result.Matched = matched
+	if dryRun {
+		return result, nil
+	}
+
+	// IDs are gathered first so deletions can be passed on. Reports stored
+	// before IDs existed have none to pass.
+	ids, err := dao.collection.Distinct(ctx, "id", filter)
+	if err != nil {
+		return result, fmt.Errorf("failed to query storm reports: %w", err)
+	}
+	for _, id := range ids {
+		if s, ok := id.(string); ok && s != "" {
+			result.IDs = append(result.IDs, s)
+		}
+	}
+
+	if query.Mode == models.PurgeSoftDelete {
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		res, err := dao.collection.UpdateMany(ctx, filter, mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"deleted":   true,
+			"deletedAt": now,
+			"writtenAt": "$$NOW",
+			"revision":  nextRevision,
+			"updatedAt": now,
+		}}}})
+		if err != nil {
+			return result, fmt.Errorf("failed to soft-delete storm reports: %w", err)
+		}
+		result.Purged = res.ModifiedCount
+	} else {
+		res, err := dao.collection.DeleteMany(ctx, filter)
+		if err != nil {
+			return result, fmt.Errorf("failed to delete storm reports: %w", err)
+		}
+		result.Purged = res.DeletedCount
+	}
+
+	return result, dao.recordAudit(models.AuditEntry{
+		Action: models.AuditPurge,
+		Purge:  &query,
+		Result: &result,
+	}, source)
+}
+
+// purgeFilter is buildFilter with optional date bounds, matching withdrawn
+// reports too. A hard delete also removes reports that were already
+// soft-deleted.
+func purgeFilter(query models.PurgeQuery) bson.M {
+	filter := buildFilter(models.StormQuery{Filter: query.Filter})
+	delete(filter, "withdrawn")
+	date := bson.M{}
+	start, end := query.Bounds()
+	if !start.IsZero() {
+		date["$gte"] = start
+	}
+	if !end.IsZero() {
+		date["$lte"] = end
+	}
+	if len(date) > 0 {
+		filter["date"] = date
+	} else {
+		delete(filter, "date")
+	}
+	if query.Synthetic {
+		filter["synthetic"] = true
+	}
+	if query.Mode == models.PurgeDelete {
+		delete(filter, "deleted")
+	}
+	return filter
+}
@@ -0,0 +1,75 @@
+package dao
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// reportRegistry decodes the BSON dates reports are stored with into the
+// unix-second strings StormReport carries. Dates stored before then, and
+// those in revisions and the audit log, are strings and decode as before.
+var reportRegistry = newReportRegistry()
+
+func newReportRegistry() *bsoncodec.Registry {
+	registry := bson.NewRegistry()
+	tString := reflect.TypeOf("")
+	decodeString, _ := registry.LookupDecoder(tString)
+	registry.RegisterTypeDecoder(tString, bsoncodec.ValueDecoderFunc(
+		func(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+			if vr.Type() != bsontype.DateTime {
+				return decodeString.DecodeValue(dc, vr, val)
+			}
+			ms, err := vr.ReadDateTime()
+			if err != nil {
+				return err
+			}
+			val.SetString(models.FormatReportDate(time.UnixMilli(ms)))
+			return nil
+		}))
+	return registry
+}
+
+// decodeReport decodes a stored report document with reportRegistry.
+func decodeReport(raw bson.Raw) (models.StormReport, error) {
+	var report models.StormReport
+	dec, err := bson.NewDecoder(bsonrw.NewBSONDocumentReader(raw))
+	if err != nil {
+		return report, err
+	}
+	dec.SetRegistry(reportRegistry)
+	err = dec.Decode(&report)
+	return report, err
+}
+
+// migrateReportDates converts the report dates stored as unix timestamp
+// strings, as they were before they were stored as BSON dates. Dates that
+// aren't timestamps are left alone.
+func migrateReportDates(ctx context.Context, dao *StormDAO) error {
+	ts := bson.M{"$toLong": "$date"}
+	_, err := dao.collection.UpdateMany(ctx,
+		bson.M{"date": bson.M{"$type": "string", "$regex": "^[0-9]+$"}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"date": bson.M{"$toDate": bson.M{"$cond": bson.A{
+			// The producer has published both seconds and milliseconds.
+			bson.M{"$gt": bson.A{ts, 1e11}}, ts, bson.M{"$multiply": bson.A{ts, 1000}},
+		}}}}}}})
+	return err
+}
+
+// unmigrateReportDates stores report dates as unix-second strings again,
+// for binaries from before migrateReportDates.
+func unmigrateReportDates(ctx context.Context, dao *StormDAO) error {
+	_, err := dao.collection.UpdateMany(ctx,
+		bson.M{"date": bson.M{"$type": "date"}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"date": bson.M{"$toString": bson.M{
+			"$toLong": bson.M{"$divide": bson.A{bson.M{"$toLong": "$date"}, 1000}},
+		}}}}}})
+	return err
+}
@@ -0,0 +1,1009 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema holds the schema migrations, applied in file name order.
+//
+//go:embed sqliteschema/*.sql
+var sqliteSchema embed.FS
+
+// SQLiteStormDAO stores reports in a single SQLite file, for running the
+// API on one machine without MongoDB or Kafka. Spatial filters use an
+// R-tree of report locations. Queries behave as StormDAO's do.
+//
+// SQLite allows one writer at a time, so the DAO uses a single connection
+// and its calls are serialized.
+type SQLiteStormDAO struct {
+	db          *sql.DB
+	usagePruner usagePruner
+}
+
+// sqliteQuerier is satisfied by both the database and a transaction.
+type sqliteQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqliteScanner is satisfied by both *sql.Row and *sql.Rows.
+type sqliteScanner interface {
+	Scan(dest ...any) error
+}
+
+// NewSQLiteStormDAO opens, or creates, the database file at path.
+func NewSQLiteStormDAO(path string) (*SQLiteStormDAO, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database %s: %w", path, err)
+	}
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open SQLite database %s: %w", path, err)
+	}
+	return &SQLiteStormDAO{db: db}, nil
+}
+
+// Migrate applies the embedded schema migrations that haven't been applied
+// yet, each in its own transaction.
+func (dao *SQLiteStormDAO) Migrate() error {
+	ctx := context.TODO()
+	_, err := dao.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    TEXT PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	names, err := fs.Glob(sqliteSchema, "sqliteschema/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		version := strings.TrimSuffix(path.Base(name), ".sql")
+		var applied bool
+		err := dao.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = ?)", version).Scan(&applied)
+		if err != nil {
+			return fmt.Errorf("failed to read schema_migrations: %w", err)
+		}
+		if applied {
+			continue
+		}
+		script, err := sqliteSchema.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		err = dao.inTx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)",
+				version, time.Now().UnixMilli())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func (dao *SQLiteStormDAO) Disconnect() error {
+	return dao.db.Close()
+}
+
+// inTx runs fn in a transaction, committing it if fn succeeds.
+func (dao *SQLiteStormDAO) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := dao.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// sqliteMillis converts a time to the unix milliseconds stored for it, or
+// nil for NULL.
+func sqliteMillis(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UnixMilli()
+}
+
+func sqliteTime(ms sql.NullInt64) *time.Time {
+	if !ms.Valid {
+		return nil
+	}
+	t := time.UnixMilli(ms.Int64).UTC()
+	return &t
+}
+
+const sqliteReportColumns = "id, date, time, size, f_scale, speed, location, county, state, lat, lon, comments, type, " +
+	"synthetic, deleted, deleted_at, withdrawn, withdrawn_at, revision, updated_at"
+
+const sqliteInsertReport = `INSERT INTO storm_reports (` + sqliteReportColumns + `, written_at, kafka_partition, kafka_offset)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// sqliteUpsertReport replaces every column but the Kafka position, which
+// is only replaced by ingested writes.
+const sqliteUpsertReport = sqliteInsertReport + ` ON CONFLICT (id) DO UPDATE SET
+	date = excluded.date, time = excluded.time, size = excluded.size, f_scale = excluded.f_scale,
+	speed = excluded.speed, location = excluded.location, county = excluded.county, state = excluded.state,
+	lat = excluded.lat, lon = excluded.lon, comments = excluded.comments, type = excluded.type,
+	synthetic = excluded.synthetic, deleted = excluded.deleted, deleted_at = excluded.deleted_at,
+	withdrawn = excluded.withdrawn, withdrawn_at = excluded.withdrawn_at, revision = excluded.revision,
+	updated_at = excluded.updated_at, written_at = excluded.written_at,
+	kafka_partition = COALESCE(excluded.kafka_partition, storm_reports.kafka_partition),
+	kafka_offset = COALESCE(excluded.kafka_offset, storm_reports.kafka_offset)`
+
+// writeSQLiteReport stores report with query, which is built on
+// sqliteInsertReport, recording when it was written and, for ingested
+// reports, the Kafka position it was written from.
+func writeSQLiteReport(ctx context.Context, q sqliteQuerier, query string, report models.StormReport, source models.ChangeSource, now time.Time) (sql.Result, error) {
+	date, err := models.ParseReportDate(report.Date)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode storm report: %w", err)
+	}
+	var partition, offset any
+	if source.Actor == models.ActorIngest {
+		partition, offset = source.KafkaPartition, source.KafkaOffset
+	}
+	return q.ExecContext(ctx, query,
+		report.ID, date.UnixMilli(), report.Time, report.Size, report.F_Scale, report.Speed, report.Location,
+		report.County, report.State, report.Lat, report.Lon, report.Comments, string(report.Type),
+		report.Synthetic, report.Deleted, sqliteMillis(report.DeletedAt), report.Withdrawn,
+		sqliteMillis(report.WithdrawnAt), max(report.Revision, 1), sqliteMillis(report.UpdatedAt),
+		now.UnixMilli(), partition, offset)
+}
+
+// scanSQLiteReport reads the sqliteReportColumns of a row, then any extra
+// columns into extra.
+func scanSQLiteReport(row sqliteScanner, extra ...any) (models.StormReport, error) {
+	var r models.StormReport
+	var stormType string
+	var date int64
+	var deletedAt, withdrawnAt, updatedAt sql.NullInt64
+	dest := []any{&r.ID, &date, &r.Time, &r.Size, &r.F_Scale, &r.Speed, &r.Location, &r.County, &r.State,
+		&r.Lat, &r.Lon, &r.Comments, &stormType, &r.Synthetic, &r.Deleted, &deletedAt, &r.Withdrawn,
+		&withdrawnAt, &r.Revision, &updatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return r, err
+	}
+	r.Date, r.Type = models.FormatReportDate(time.UnixMilli(date)), models.StormType(stormType)
+	r.DeletedAt, r.WithdrawnAt, r.UpdatedAt = sqliteTime(deletedAt), sqliteTime(withdrawnAt), sqliteTime(updatedAt)
+	return r, nil
+}
+
+func (dao *SQLiteStormDAO) queryReports(ctx context.Context, query string, args ...any) ([]models.StormReport, error) {
+	rows, err := dao.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query SQLite: %w", err)
+	}
+	defer rows.Close()
+
+	reports := []models.StormReport{}
+	for rows.Next() {
+		report, err := scanSQLiteReport(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode storm report: %w", err)
+		}
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query SQLite: %w", err)
+	}
+	return reports, nil
+}
+
+func getSQLiteReport(ctx context.Context, q sqliteQuerier, id string) (models.StormReport, error) {
+	report, err := scanSQLiteReport(q.QueryRowContext(ctx, "SELECT "+sqliteReportColumns+" FROM storm_reports WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return report, models.ErrNotFound
+	}
+	if err != nil {
+		return report, fmt.Errorf("failed to query SQLite: %w", err)
+	}
+	return report, nil
+}
+
+// sqliteWhere builds a WHERE clause and its arguments.
+type sqliteWhere struct {
+	conds []string
+	args  []any
+}
+
+func (w *sqliteWhere) add(cond string, args ...any) {
+	w.conds = append(w.conds, cond)
+	w.args = append(w.args, args...)
+}
+
+// in adds a condition that column is one of values.
+func (w *sqliteWhere) in(column string, values []string) {
+	args := make([]any, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	w.add(column+" IN (?"+strings.Repeat(", ?", len(values)-1)+")", args...)
+}
+
+func (w *sqliteWhere) String() string {
+	if len(w.conds) == 0 {
+		return "1"
+	}
+	return strings.Join(w.conds, " AND ")
+}
+
+func (w *sqliteWhere) addFilter(f models.StormFilter) {
+	if len(f.Types) > 0 {
+		types := make([]string, len(f.Types))
+		for i, t := range f.Types {
+			types[i] = string(t)
+		}
+		w.in("type", types)
+	}
+	if len(f.States) > 0 {
+		w.in("state", f.States)
+	}
+	if len(f.Counties) > 0 {
+		w.in("county", f.Counties)
+	}
+	if b := f.BBox; b != nil {
+		// The R-tree holds 32-bit floats rounded outward, so the reports
+		// it finds are checked against their exact location too.
+		w.add("rowid IN (SELECT id FROM storm_reports_rtree WHERE max_lon >= ? AND min_lon <= ? AND max_lat >= ? AND min_lat <= ?)",
+			b.MinLon, b.MaxLon, b.MinLat, b.MaxLat)
+		w.add("lon BETWEEN ? AND ? AND lat BETWEEN ? AND ?", b.MinLon, b.MaxLon, b.MinLat, b.MaxLat)
+	}
+}
+
+// sqliteFilter is buildFilter for SQLite.
+func sqliteFilter(query models.StormQuery) *sqliteWhere {
+	w := &sqliteWhere{}
+	w.add("date >= ? AND date <= ?", query.Start.UnixMilli(), query.End.UnixMilli())
+	w.add("NOT deleted")
+	w.add("NOT withdrawn")
+	w.addFilter(query.Filter)
+	return w
+}
+
+// sqlitePage returns the LIMIT clause for the page a query asks for.
+func sqlitePage(query models.StormQuery) string {
+	limit := -1
+	if query.Limit > 0 {
+		limit = query.Limit
+	}
+	return fmt.Sprintf(" LIMIT %d OFFSET %d", limit, query.Offset)
+}
+
+func (dao *SQLiteStormDAO) GetStormReports(ctx context.Context, query models.StormQuery) ([]models.StormReport, error) {
+	w := sqliteFilter(query)
+	order := "date, time, id"
+	if query.Sort == models.SortDateDesc {
+		order = "date DESC, time DESC, id DESC"
+	}
+	return dao.queryReports(ctx,
+		"SELECT "+sqliteReportColumns+" FROM storm_reports WHERE "+w.String()+" ORDER BY "+order+sqlitePage(query), w.args...)
+}
+
+// sqliteStatsExpr is statsGroupExpr for SQLite.
+func sqliteStatsExpr(dim models.StatsDimension) string {
+	switch dim {
+	case models.DimensionDay:
+		return "strftime('%Y-%m-%d', date / 1000, 'unixepoch')"
+	case models.DimensionHour:
+		return "time / 100"
+	case models.DimensionType, models.DimensionState, models.DimensionCounty:
+		return string(dim)
+	}
+	return "NULL"
+}
+
+func (dao *SQLiteStormDAO) GetStormStats(ctx context.Context, query models.StatsQuery) ([]models.StatsRow, error) {
+	w := sqliteFilter(query.Range())
+	var exprs []string
+	for _, dim := range query.GroupBy {
+		exprs = append(exprs, sqliteStatsExpr(dim))
+	}
+	q := "SELECT " + strings.Join(append(exprs, "count(*)"), ", ") + " FROM storm_reports WHERE " + w.String()
+	if len(exprs) > 0 {
+		q += " GROUP BY " + strings.Join(exprs, ", ") + " ORDER BY " + strings.Join(exprs, ", ")
+	} else {
+		// Mongo returns no total row when nothing matches.
+		q += " HAVING count(*) > 0"
+	}
+
+	rows, err := dao.db.QueryContext(ctx, q, w.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate storm stats: %w", err)
+	}
+	defer rows.Close()
+
+	stats := []models.StatsRow{}
+	for rows.Next() {
+		var row models.StatsRow
+		var stormType string
+		var hour int
+		dest := make([]any, 0, len(query.GroupBy)+1)
+		for _, dim := range query.GroupBy {
+			switch dim {
+			case models.DimensionType:
+				dest = append(dest, &stormType)
+			case models.DimensionState:
+				dest = append(dest, &row.State)
+			case models.DimensionCounty:
+				dest = append(dest, &row.County)
+			case models.DimensionDay:
+				dest = append(dest, &row.Day)
+			case models.DimensionHour:
+				dest = append(dest, &hour)
+			}
+		}
+		if err := rows.Scan(append(dest, &row.Count)...); err != nil {
+			return nil, fmt.Errorf("failed to decode storm stats: %w", err)
+		}
+		row.Type = models.StormType(stormType)
+		for _, dim := range query.GroupBy {
+			if dim == models.DimensionHour {
+				row.Hour = &hour
+			}
+		}
+		stats = append(stats, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to aggregate storm stats: %w", err)
+	}
+	return stats, nil
+}
+
+// SearchStormReports reads every report in range and keeps those
+// models.SearchQuery.Match accepts, ordered by its score, as
+// PostgresStormDAO does. Results and scores differ from StormDAO's.
+func (dao *SQLiteStormDAO) SearchStormReports(ctx context.Context, query models.StormQuery, q string) ([]models.SearchResult, error) {
+	reports, err := dao.GetStormReports(ctx, query.WithSort(models.SortDate).WithPage(0, 0))
+	if err != nil {
+		return nil, err
+	}
+	search := models.ParseSearch(q)
+	results := []models.SearchResult{}
+	for _, report := range reports {
+		if score, ok := search.Match(report); ok {
+			results = append(results, models.SearchResult{StormReport: report, Score: score, Highlights: search.Highlight(report)})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	from, to := query.Page(len(results))
+	return results[from:to], nil
+}
+
+func (dao *SQLiteStormDAO) GetStormReport(ctx context.Context, id string) (*models.StormReport, error) {
+	report, err := getSQLiteReport(ctx, dao.db, id)
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func (dao *SQLiteStormDAO) GetDeletedStormReports(query models.StormQuery) ([]models.StormReport, error) {
+	w := &sqliteWhere{}
+	w.add("date >= ? AND date <= ?", query.Start.UnixMilli(), query.End.UnixMilli())
+	w.add("deleted")
+	w.addFilter(query.Filter)
+	return dao.queryReports(context.TODO(),
+		"SELECT "+sqliteReportColumns+" FROM storm_reports WHERE "+w.String()+" ORDER BY deleted_at DESC, id"+sqlitePage(query), w.args...)
+}
+
+func (dao *SQLiteStormDAO) GetStormReportHistory(ctx context.Context, id string) ([]models.ReportRevision, error) {
+	rows, err := dao.db.QueryContext(ctx,
+		"SELECT previous, changes, source, changed_at FROM storm_report_revisions WHERE report_id = ? ORDER BY changed_at, seq", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query report revisions: %w", err)
+	}
+	defer rows.Close()
+
+	revisions := []models.ReportRevision{}
+	for rows.Next() {
+		revision := models.ReportRevision{ReportID: id}
+		var previous, changes, source string
+		var changedAt int64
+		if err := rows.Scan(&previous, &changes, &source, &changedAt); err != nil {
+			return nil, fmt.Errorf("failed to decode report revisions: %w", err)
+		}
+		revision.ChangedAt = time.UnixMilli(changedAt).UTC()
+		for _, field := range []struct {
+			data string
+			v    any
+		}{{previous, &revision.Previous}, {changes, &revision.Changes}, {source, &revision.Source}} {
+			if err := json.Unmarshal([]byte(field.data), field.v); err != nil {
+				return nil, fmt.Errorf("failed to decode report revisions: %w", err)
+			}
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query report revisions: %w", err)
+	}
+	return revisions, nil
+}
+
+func insertSQLiteRevision(ctx context.Context, q sqliteQuerier, revision models.ReportRevision) error {
+	previous, err := json.Marshal(revision.Previous)
+	if err != nil {
+		return fmt.Errorf("failed to encode report revision: %w", err)
+	}
+	changes, err := json.Marshal(revision.Changes)
+	if err != nil {
+		return fmt.Errorf("failed to encode report revision: %w", err)
+	}
+	source, err := json.Marshal(revision.Source)
+	if err != nil {
+		return fmt.Errorf("failed to encode report revision: %w", err)
+	}
+	_, err = q.ExecContext(ctx,
+		"INSERT INTO storm_report_revisions (report_id, previous, changes, source, changed_at) VALUES (?, ?, ?, ?, ?)",
+		revision.ReportID, string(previous), string(changes), string(source), revision.ChangedAt.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to record report revision: %w", err)
+	}
+	return nil
+}
+
+// UpsertStormReport stores an ingested report under its stable ID, as
+// StormDAO.UpsertStormReport does.
+func (dao *SQLiteStormDAO) UpsertStormReport(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+	ctx := context.TODO()
+	report.ID = models.ReportID(report)
+	result := models.UpsertResult{ID: report.ID, Report: report}
+
+	err := dao.inTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		existing, err := getSQLiteReport(ctx, tx, report.ID)
+		if errors.Is(err, models.ErrNotFound) {
+			report.Revision, report.UpdatedAt = 1, &now
+			result.Report, result.Created = report, true
+			_, err := writeSQLiteReport(ctx, tx, sqliteUpsertReport, report, source, now)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		// The first date a report was seen on is kept, and re-ingesting a
+		// deleted report doesn't bring it back. A withdrawn report that SPC
+		// publishes again is reinstated.
+		report.Date = existing.Date
+		report.Deleted, report.DeletedAt = existing.Deleted, existing.DeletedAt
+		report.Withdrawn, report.WithdrawnAt = false, nil
+		report.Revision, report.UpdatedAt = existing.Revision, existing.UpdatedAt
+		result.Report = report
+		changes := models.DiffReports(existing, report)
+		if len(changes) == 0 {
+			return nil
+		}
+		err = insertSQLiteRevision(ctx, tx, models.ReportRevision{
+			ReportID:  report.ID,
+			Previous:  existing,
+			Changes:   changes,
+			Source:    source,
+			ChangedAt: now,
+		})
+		if err != nil {
+			return err
+		}
+		report.Revision, report.UpdatedAt = existing.NextRevision(), &now
+		result.Report, result.Changed = report, true
+		_, err = writeSQLiteReport(ctx, tx, sqliteUpsertReport, report, source, now)
+		return err
+	})
+	if err != nil {
+		result.Created, result.Changed = false, false
+		return result, fmt.Errorf("failed to upsert storm report: %w", err)
+	}
+	return result, nil
+}
+
+// WithdrawStormReport marks a report withdrawn, recording a revision as for
+// any other change.
+func (dao *SQLiteStormDAO) WithdrawStormReport(id string, source models.ChangeSource) (models.UpsertResult, error) {
+	ctx := context.TODO()
+	result := models.UpsertResult{ID: id}
+
+	err := dao.inTx(ctx, func(tx *sql.Tx) error {
+		existing, err := getSQLiteReport(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		result.Report = existing
+		if existing.Withdrawn {
+			return nil
+		}
+
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		report := existing
+		report.Withdrawn, report.WithdrawnAt = true, &now
+		report.Revision, report.UpdatedAt = existing.NextRevision(), &now
+		err = insertSQLiteRevision(ctx, tx, models.ReportRevision{
+			ReportID:  id,
+			Previous:  existing,
+			Changes:   models.DiffReports(existing, report),
+			Source:    source,
+			ChangedAt: now,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := writeSQLiteReport(ctx, tx, sqliteUpsertReport, report, source, now); err != nil {
+			return fmt.Errorf("failed to withdraw storm report: %w", err)
+		}
+		result.Report, result.Changed = report, true
+		return nil
+	})
+	if err != nil {
+		result.Changed = false
+	}
+	return result, err
+}
+
+func (dao *SQLiteStormDAO) CreateStormReport(report models.StormReport, source models.ChangeSource) (models.StormReport, error) {
+	ctx := context.TODO()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	report.ID = models.ReportID(report)
+	report.Revision, report.UpdatedAt = 1, &now
+
+	err := dao.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := writeSQLiteReport(ctx, tx, sqliteInsertReport+" ON CONFLICT (id) DO NOTHING", report, source, now)
+		if err != nil {
+			return fmt.Errorf("failed to insert storm report: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return models.ErrConflict
+		}
+		return recordSQLiteAudit(ctx, tx, models.AuditEntry{
+			Action:   models.AuditCreate,
+			ReportID: report.ID,
+			After:    &report,
+		}, source)
+	})
+	return report, err
+}
+
+func (dao *SQLiteStormDAO) UpdateStormReport(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+	ctx := context.TODO()
+	result := models.UpsertResult{ID: report.ID, Report: report}
+
+	err := dao.inTx(ctx, func(tx *sql.Tx) error {
+		existing, err := getSQLiteReport(ctx, tx, report.ID)
+		if err != nil {
+			return err
+		}
+		if existing.Deleted {
+			return models.ErrNotFound
+		}
+		if existing.Revision != report.Revision {
+			return models.ErrStaleRevision
+		}
+		changes := models.DiffReports(existing, report)
+		if existing.Date != report.Date {
+			changes["date"] = models.FieldChange{Old: existing.Date, New: report.Date}
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		report.Revision, report.UpdatedAt = existing.NextRevision(), &now
+		err = insertSQLiteRevision(ctx, tx, models.ReportRevision{
+			ReportID:  report.ID,
+			Previous:  existing,
+			Changes:   changes,
+			Source:    source,
+			ChangedAt: now,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := writeSQLiteReport(ctx, tx, sqliteUpsertReport, report, source, now); err != nil {
+			return fmt.Errorf("failed to update storm report: %w", err)
+		}
+		result.Report, result.Changed = report, true
+		return recordSQLiteAudit(ctx, tx, models.AuditEntry{
+			Action:   models.AuditUpdate,
+			ReportID: report.ID,
+			Before:   &existing,
+			After:    &report,
+			Changes:  changes,
+		}, source)
+	})
+	if err != nil {
+		result.Changed = false
+	}
+	return result, err
+}
+
+func (dao *SQLiteStormDAO) DeleteStormReport(id string, source models.ChangeSource) (models.StormReport, error) {
+	ctx := context.TODO()
+	var after models.StormReport
+
+	err := dao.inTx(ctx, func(tx *sql.Tx) error {
+		before, err := getSQLiteReport(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if before.Deleted {
+			return models.ErrNotFound
+		}
+
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		_, err = tx.ExecContext(ctx, "UPDATE storm_reports SET deleted = 1, deleted_at = ?, written_at = ?, revision = revision + 1, updated_at = ? WHERE id = ?",
+			now.UnixMilli(), now.UnixMilli(), now.UnixMilli(), id)
+		if err != nil {
+			return fmt.Errorf("failed to delete storm report: %w", err)
+		}
+		after = before
+		after.Deleted, after.DeletedAt = true, &now
+		after.Revision, after.UpdatedAt = before.NextRevision(), &now
+		return recordSQLiteAudit(ctx, tx, models.AuditEntry{
+			Action:   models.AuditDelete,
+			ReportID: id,
+			Before:   &before,
+			After:    &after,
+		}, source)
+	})
+	if err != nil {
+		return models.StormReport{}, err
+	}
+	return after, nil
+}
+
+// sqlitePurgeFilter is purgeFilter for SQLite.
+func sqlitePurgeFilter(query models.PurgeQuery) *sqliteWhere {
+	w := &sqliteWhere{}
+	start, end := query.Bounds()
+	if !start.IsZero() {
+		w.add("date >= ?", start.UnixMilli())
+	}
+	if !end.IsZero() {
+		w.add("date <= ?", end.UnixMilli())
+	}
+	w.addFilter(query.Filter)
+	if query.Synthetic {
+		w.add("synthetic")
+	}
+	if query.Mode != models.PurgeDelete {
+		w.add("NOT deleted")
+	}
+	return w
+}
+
+func (dao *SQLiteStormDAO) PurgeStormReports(query models.PurgeQuery, dryRun bool, source models.ChangeSource) (models.PurgeResult, error) {
+	ctx := context.TODO()
+	var result models.PurgeResult
+	w := sqlitePurgeFilter(query)
+
+	err := dao.inTx(ctx, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, "SELECT count(*) FROM storm_reports WHERE "+w.String(), w.args...).Scan(&result.Matched); err != nil {
+			return fmt.Errorf("failed to count storm reports: %w", err)
+		}
+		if dryRun {
+			return nil
+		}
+
+		// IDs are gathered first so deletions can be passed on.
+		rows, err := tx.QueryContext(ctx, "SELECT id FROM storm_reports WHERE "+w.String(), w.args...)
+		if err != nil {
+			return fmt.Errorf("failed to query storm reports: %w", err)
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to query storm reports: %w", err)
+			}
+			result.IDs = append(result.IDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to query storm reports: %w", err)
+		}
+
+		var res sql.Result
+		if query.Mode == models.PurgeSoftDelete {
+			now := time.Now().UnixMilli()
+			res, err = tx.ExecContext(ctx, "UPDATE storm_reports SET deleted = 1, deleted_at = ?, written_at = ?, revision = revision + 1, updated_at = ? WHERE "+w.String(),
+				append([]any{now, now, now}, w.args...)...)
+			if err != nil {
+				return fmt.Errorf("failed to soft-delete storm reports: %w", err)
+			}
+		} else {
+			res, err = tx.ExecContext(ctx, "DELETE FROM storm_reports WHERE "+w.String(), w.args...)
+			if err != nil {
+				return fmt.Errorf("failed to delete storm reports: %w", err)
+			}
+		}
+		if result.Purged, err = res.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to purge storm reports: %w", err)
+		}
+
+		return recordSQLiteAudit(ctx, tx, models.AuditEntry{
+			Action: models.AuditPurge,
+			Purge:  &query,
+			Result: &result,
+		}, source)
+	})
+	return result, err
+}
+
+func (dao *SQLiteStormDAO) GetAuditLog(query models.AuditQuery) ([]models.AuditEntry, error) {
+	w := &sqliteWhere{}
+	if query.ReportID != "" {
+		w.add("report_id = ?", query.ReportID)
+	}
+	if query.Actor != "" {
+		w.add("actor = ?", query.Actor)
+	}
+	if query.Action != "" {
+		w.add("action = ?", string(query.Action))
+	}
+	if !query.Since.IsZero() {
+		w.add("at >= ?", query.Since.UnixMilli())
+	}
+	if !query.Until.IsZero() {
+		w.add("at <= ?", query.Until.UnixMilli())
+	}
+	q := "SELECT action, report_id, actor, reason, before, after, changes, purge, result, at FROM storm_report_audit WHERE " +
+		w.String() + " ORDER BY at DESC, seq DESC"
+	args := w.args
+	if query.Limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, query.Limit)
+	}
+
+	rows, err := dao.db.QueryContext(context.TODO(), q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		var entry models.AuditEntry
+		var action string
+		var reportID, before, after, changes, purge, result sql.NullString
+		var at int64
+		if err := rows.Scan(&action, &reportID, &entry.Actor, &entry.Reason, &before, &after, &changes, &purge, &result, &at); err != nil {
+			return nil, fmt.Errorf("failed to decode audit log: %w", err)
+		}
+		entry.Action, entry.ReportID, entry.At = models.AuditAction(action), reportID.String, time.UnixMilli(at).UTC()
+		for _, field := range []struct {
+			data sql.NullString
+			v    any
+		}{{before, &entry.Before}, {after, &entry.After}, {changes, &entry.Changes}, {purge, &entry.Purge}, {result, &entry.Result}} {
+			if !field.data.Valid {
+				continue
+			}
+			if err := json.Unmarshal([]byte(field.data.String), field.v); err != nil {
+				return nil, fmt.Errorf("failed to decode audit log: %w", err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	return entries, nil
+}
+
+// recordSQLiteAudit stamps entry with its source and time and stores it as
+// part of the change's transaction.
+func recordSQLiteAudit(ctx context.Context, q sqliteQuerier, entry models.AuditEntry, source models.ChangeSource) error {
+	entry.Actor = source.Actor
+	entry.Reason = source.Reason
+	entry.At = time.Now().UTC().Truncate(time.Millisecond)
+
+	var reportID any
+	if entry.ReportID != "" {
+		reportID = entry.ReportID
+	}
+	values := []any{entry.Before, entry.After, entry.Changes, entry.Purge, entry.Result}
+	for i, v := range values {
+		data, err := jsonColumn(v)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit entry: %w", err)
+		}
+		if data != nil {
+			values[i] = string(data)
+		} else {
+			values[i] = nil
+		}
+	}
+	_, err := q.ExecContext(ctx,
+		`INSERT INTO storm_report_audit (action, report_id, actor, reason, before, after, changes, purge, result, at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		string(entry.Action), reportID, entry.Actor, entry.Reason, values[0], values[1], values[2], values[3], values[4],
+		entry.At.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry: %w", err)
+	}
+	return nil
+}
+
+// PollReports calls publish for every report written since it started,
+// checking every interval, as StormDAO.PollReports does.
+func (dao *SQLiteStormDAO) PollReports(ctx context.Context, interval time.Duration, publish func(models.StormReport)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	since := time.Now().UnixMilli()
+	// Reports already published at exactly the since timestamp, so the
+	// inclusive query below doesn't repeat them.
+	seen := map[string]bool{}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		rows, err := dao.db.QueryContext(ctx,
+			"SELECT "+sqliteReportColumns+", written_at FROM storm_reports WHERE written_at >= ? ORDER BY written_at", since)
+		if err != nil {
+			return fmt.Errorf("failed to poll SQLite: %w", err)
+		}
+		// Reports are collected first, since publishing may query the
+		// DAO and it has only one connection.
+		type written struct {
+			report models.StormReport
+			at     int64
+		}
+		var batch []written
+		for rows.Next() {
+			var w written
+			if w.report, err = scanSQLiteReport(rows, &w.at); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to decode polled reports: %w", err)
+			}
+			batch = append(batch, w)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to poll SQLite: %w", err)
+		}
+
+		for _, w := range batch {
+			key := fmt.Sprintf("%s@%d", w.report.ID, w.at)
+			if w.at == since && seen[key] {
+				continue
+			}
+			if w.at > since {
+				since = w.at
+				seen = map[string]bool{}
+			}
+			seen[key] = true
+			publish(w.report)
+		}
+	}
+}
+
+func (dao *SQLiteStormDAO) CreateAPIKey(key models.APIKey) error {
+	scopes, err := json.Marshal(scopeStrings(key.Scopes))
+	if err != nil {
+		return fmt.Errorf("failed to store API key: %w", err)
+	}
+	_, err = dao.db.ExecContext(context.TODO(),
+		"INSERT INTO api_keys (id, name, hash, scopes, created_at, revoked_at) VALUES (?, ?, ?, ?, ?, ?)",
+		key.ID, key.Name, key.Hash, string(scopes), key.CreatedAt.UnixMilli(), sqliteMillis(key.RevokedAt))
+	if err != nil {
+		return fmt.Errorf("failed to store API key: %w", err)
+	}
+	return nil
+}
+
+func (dao *SQLiteStormDAO) ListAPIKeys() ([]models.APIKey, error) {
+	rows, err := dao.db.QueryContext(context.TODO(),
+		"SELECT id, name, hash, scopes, created_at, revoked_at FROM api_keys ORDER BY created_at")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		key, err := scanSQLiteAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (dao *SQLiteStormDAO) GetAPIKeyByHash(hash string) (*models.APIKey, error) {
+	key, err := scanSQLiteAPIKey(dao.db.QueryRowContext(context.TODO(),
+		"SELECT id, name, hash, scopes, created_at, revoked_at FROM api_keys WHERE hash = ?", hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, models.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (dao *SQLiteStormDAO) RevokeAPIKey(id string) error {
+	res, err := dao.db.ExecContext(context.TODO(),
+		"UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UnixMilli(), id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return models.ErrNotFound
+	}
+	return nil
+}
+
+func scanSQLiteAPIKey(row sqliteScanner) (models.APIKey, error) {
+	var key models.APIKey
+	var scopes string
+	var createdAt int64
+	var revokedAt sql.NullInt64
+	err := row.Scan(&key.ID, &key.Name, &key.Hash, &scopes, &createdAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return key, err
+	}
+	if err != nil {
+		return key, fmt.Errorf("failed to decode API key: %w", err)
+	}
+	if err := json.Unmarshal([]byte(scopes), &key.Scopes); err != nil {
+		return key, fmt.Errorf("failed to decode API key: %w", err)
+	}
+	key.CreatedAt, key.RevokedAt = time.UnixMilli(createdAt).UTC(), sqliteTime(revokedAt)
+	return key, nil
+}
+
+func (dao *SQLiteStormDAO) AddUsage(client, kind, day string, n int64) (int64, error) {
+	ctx := context.TODO()
+	err := dao.usagePruner.prune(func(cutoff string) error {
+		_, err := dao.db.ExecContext(ctx, "DELETE FROM usage WHERE day < ?", cutoff)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune usage: %w", err)
+	}
+
+	var count int64
+	err = dao.db.QueryRowContext(ctx,
+		`INSERT INTO usage (kind, client, day, count) VALUES (?, ?, ?, ?)
+		ON CONFLICT (kind, client, day) DO UPDATE SET count = count + excluded.count
+		RETURNING count`,
+		kind, client, day, n).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record usage: %w", err)
+	}
+	return count, nil
+}
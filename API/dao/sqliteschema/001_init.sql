@@ -0,0 +1,88 @@
+-- Dates are unix timestamps stored as text and compared bytewise, as in
+-- MongoDB. Other times are unix milliseconds.
+CREATE TABLE storm_reports (
+    id              TEXT PRIMARY KEY,
+    date            TEXT NOT NULL,
+    time            INTEGER NOT NULL DEFAULT 0,
+    size            REAL NOT NULL DEFAULT 0,
+    f_scale         TEXT NOT NULL DEFAULT '',
+    speed           INTEGER NOT NULL DEFAULT 0,
+    location        TEXT NOT NULL DEFAULT '',
+    county          TEXT NOT NULL DEFAULT '',
+    state           TEXT NOT NULL DEFAULT '',
+    lat             REAL NOT NULL DEFAULT 0,
+    lon             REAL NOT NULL DEFAULT 0,
+    comments        TEXT NOT NULL DEFAULT '',
+    type            TEXT NOT NULL,
+    synthetic       INTEGER NOT NULL DEFAULT 0,
+    deleted         INTEGER NOT NULL DEFAULT 0,
+    deleted_at      INTEGER,
+    withdrawn       INTEGER NOT NULL DEFAULT 0,
+    withdrawn_at    INTEGER,
+    revision        INTEGER NOT NULL DEFAULT 1,
+    updated_at      INTEGER,
+    written_at      INTEGER NOT NULL,
+    kafka_partition INTEGER,
+    kafka_offset    INTEGER
+);
+CREATE INDEX storm_reports_date_idx ON storm_reports (date);
+CREATE INDEX storm_reports_written_at_idx ON storm_reports (written_at);
+
+-- Each report's point, keyed by its rowid, for bounding box filters.
+CREATE VIRTUAL TABLE storm_reports_rtree USING rtree (id, min_lon, max_lon, min_lat, max_lat);
+
+CREATE TRIGGER storm_reports_rtree_insert AFTER INSERT ON storm_reports BEGIN
+    INSERT INTO storm_reports_rtree VALUES (new.rowid, new.lon, new.lon, new.lat, new.lat);
+END;
+CREATE TRIGGER storm_reports_rtree_update AFTER UPDATE OF lat, lon ON storm_reports BEGIN
+    UPDATE storm_reports_rtree
+    SET min_lon = new.lon, max_lon = new.lon, min_lat = new.lat, max_lat = new.lat
+    WHERE id = new.rowid;
+END;
+CREATE TRIGGER storm_reports_rtree_delete AFTER DELETE ON storm_reports BEGIN
+    DELETE FROM storm_reports_rtree WHERE id = old.rowid;
+END;
+
+CREATE TABLE storm_report_revisions (
+    seq        INTEGER PRIMARY KEY,
+    report_id  TEXT NOT NULL,
+    previous   TEXT NOT NULL,
+    changes    TEXT NOT NULL,
+    source     TEXT NOT NULL,
+    changed_at INTEGER NOT NULL
+);
+CREATE INDEX storm_report_revisions_report_idx ON storm_report_revisions (report_id, changed_at);
+
+CREATE TABLE storm_report_audit (
+    seq       INTEGER PRIMARY KEY,
+    action    TEXT NOT NULL,
+    report_id TEXT,
+    actor     TEXT NOT NULL,
+    reason    TEXT NOT NULL,
+    before    TEXT,
+    after     TEXT,
+    changes   TEXT,
+    purge     TEXT,
+    result    TEXT,
+    at        INTEGER NOT NULL
+);
+CREATE INDEX storm_report_audit_report_idx ON storm_report_audit (report_id, at);
+CREATE INDEX storm_report_audit_at_idx ON storm_report_audit (at);
+
+CREATE TABLE api_keys (
+    id         TEXT PRIMARY KEY,
+    name       TEXT NOT NULL,
+    hash       TEXT NOT NULL UNIQUE,
+    scopes     TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    revoked_at INTEGER
+);
+
+CREATE TABLE usage (
+    kind   TEXT NOT NULL,
+    client TEXT NOT NULL,
+    day    TEXT NOT NULL,
+    count  INTEGER NOT NULL,
+    PRIMARY KEY (kind, client, day)
+);
+CREATE INDEX usage_day_idx ON usage (day);
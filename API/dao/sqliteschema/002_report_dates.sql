@@ -0,0 +1,66 @@
+-- Report dates become unix milliseconds, like the other times, so they
+-- compare as numbers. SQLite can't change a column's type, so the table is
+-- rebuilt, keeping rowids so the R-tree still points at the right reports.
+CREATE TABLE storm_reports_new (
+    id              TEXT PRIMARY KEY,
+    date            INTEGER NOT NULL,
+    time            INTEGER NOT NULL DEFAULT 0,
+    size            REAL NOT NULL DEFAULT 0,
+    f_scale         TEXT NOT NULL DEFAULT '',
+    speed           INTEGER NOT NULL DEFAULT 0,
+    location        TEXT NOT NULL DEFAULT '',
+    county          TEXT NOT NULL DEFAULT '',
+    state           TEXT NOT NULL DEFAULT '',
+    lat             REAL NOT NULL DEFAULT 0,
+    lon             REAL NOT NULL DEFAULT 0,
+    comments        TEXT NOT NULL DEFAULT '',
+    type            TEXT NOT NULL,
+    synthetic       INTEGER NOT NULL DEFAULT 0,
+    deleted         INTEGER NOT NULL DEFAULT 0,
+    deleted_at      INTEGER,
+    withdrawn       INTEGER NOT NULL DEFAULT 0,
+    withdrawn_at    INTEGER,
+    revision        INTEGER NOT NULL DEFAULT 1,
+    updated_at      INTEGER,
+    written_at      INTEGER NOT NULL,
+    kafka_partition INTEGER,
+    kafka_offset    INTEGER
+);
+
+-- Dates that aren't unix timestamps can't be converted, and MongoDB leaves
+-- them as they are. The API never accepted them, so those reports are moved
+-- to storm_reports_undated, for fixing by hand, rather than cast to 0.
+CREATE TABLE storm_reports_undated AS SELECT * FROM storm_reports WHERE date = '' OR date GLOB '*[^0-9]*';
+
+-- The producer has published both seconds and milliseconds.
+INSERT INTO storm_reports_new (rowid, id, date, time, size, f_scale, speed, location, county, state, lat, lon,
+    comments, type, synthetic, deleted, deleted_at, withdrawn, withdrawn_at, revision, updated_at, written_at,
+    kafka_partition, kafka_offset)
+SELECT rowid, id,
+    CASE WHEN CAST(date AS INTEGER) > 100000000000 THEN CAST(date AS INTEGER) ELSE CAST(date AS INTEGER) * 1000 END,
+    time, size, f_scale, speed, location, county, state, lat, lon, comments, type, synthetic, deleted,
+    deleted_at, withdrawn, withdrawn_at, revision, updated_at, written_at, kafka_partition, kafka_offset
+FROM storm_reports
+WHERE date <> '' AND date NOT GLOB '*[^0-9]*';
+DELETE FROM storm_reports_rtree WHERE id NOT IN (SELECT rowid FROM storm_reports_new);
+
+DROP TRIGGER storm_reports_rtree_insert;
+DROP TRIGGER storm_reports_rtree_update;
+DROP TRIGGER storm_reports_rtree_delete;
+DROP TABLE storm_reports;
+ALTER TABLE storm_reports_new RENAME TO storm_reports;
+
+CREATE INDEX storm_reports_date_idx ON storm_reports (date, time, id);
+CREATE INDEX storm_reports_written_at_idx ON storm_reports (written_at);
+
+CREATE TRIGGER storm_reports_rtree_insert AFTER INSERT ON storm_reports BEGIN
+    INSERT INTO storm_reports_rtree VALUES (new.rowid, new.lon, new.lon, new.lat, new.lat);
+END;
+CREATE TRIGGER storm_reports_rtree_update AFTER UPDATE OF lat, lon ON storm_reports BEGIN
+    UPDATE storm_reports_rtree
+    SET min_lon = new.lon, max_lon = new.lon, min_lat = new.lat, max_lat = new.lat
+    WHERE id = new.rowid;
+END;
+CREATE TRIGGER storm_reports_rtree_delete AFTER DELETE ON storm_reports BEGIN
+    DELETE FROM storm_reports_rtree WHERE id = old.rowid;
+END;
@@ -2,7 +2,9 @@ package dao
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/jonathanface/storm-reporter/API/models"
 	"go.mongodb.org/mongo-driver/bson"
@@ -13,41 +15,506 @@ import (
 type StormDAO struct {
 	client     *mongo.Client
 	collection *mongo.Collection
+	revisions  *mongo.Collection
+	// streamState holds change stream resume tokens per API replica.
+	streamState *mongo.Collection
+	apiKeys     *mongo.Collection
+	usage       *mongo.Collection
+	audit       *mongo.Collection
+	// migrations records the applied MongoMigrations, and migrationLock
+	// holds the lock taken to run them.
+	migrations    *mongo.Collection
+	migrationLock *mongo.Collection
 }
 
 func NewStormDAO(uri, dbName, collName string) (*StormDAO, error) {
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(uri))
+	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(uri).SetRegistry(reportRegistry))
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
 	}
 
-	collection := client.Database(dbName).Collection(collName)
-	return &StormDAO{client: client, collection: collection}, nil
+	db := client.Database(dbName)
+	return &StormDAO{
+		client:        client,
+		collection:    db.Collection(collName),
+		revisions:     db.Collection(collName + "_revisions"),
+		streamState:   db.Collection(collName + "_stream_state"),
+		apiKeys:       db.Collection("api_keys"),
+		usage:         db.Collection("usage"),
+		audit:         db.Collection(collName + "_audit"),
+		migrations:    db.Collection(collName + "_migrations"),
+		migrationLock: db.Collection(collName + "_migration_lock"),
+	}, nil
+}
+
+// EnsureIndexes creates the indexes the DAO relies on. Documents written
+// before reports had IDs are excluded from the unique ID index.
+func (dao *StormDAO) EnsureIndexes() error {
+	_, err := dao.collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"id": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create report ID index: %w", err)
+	}
+	_, err = dao.collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "comments", Value: "text"}, {Key: "location", Value: "text"}, {Key: "county", Value: "text"}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create text index: %w", err)
+	}
+	_, err = dao.collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "date", Value: 1}, {Key: "time", Value: 1}, {Key: "id", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create date index: %w", err)
+	}
+	_, err = dao.collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "writtenAt", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create writtenAt index: %w", err)
+	}
+	_, err = dao.apiKeys.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create API key index: %w", err)
+	}
+	_, err = dao.revisions.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "reportId", Value: 1}, {Key: "changedAt", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create revisions index: %w", err)
+	}
+	_, err = dao.usage.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expireAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create usage index: %w", err)
+	}
+	_, err = dao.audit.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "reportId", Value: 1}, {Key: "at", Value: -1}}},
+		{Keys: bson.D{{Key: "at", Value: -1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create audit indexes: %w", err)
+	}
+	return nil
 }
 
 func (d *StormDAO) Disconnect() error {
 	return d.client.Disconnect(context.TODO())
 }
 
-func (dao *StormDAO) GetStormReports(startOfDay, endOfDay string) ([]models.StormReport, error) {
+func (dao *StormDAO) GetStormReports(ctx context.Context, query models.StormQuery) ([]models.StormReport, error) {
+	order := 1
+	if query.Sort == models.SortDateDesc {
+		order = -1
+	}
+	opts := pageOptions(query).SetSort(bson.D{{Key: "date", Value: order}, {Key: "time", Value: order}, {Key: "id", Value: order}})
+
+	cursor, err := dao.collection.Find(ctx, buildFilter(query), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query MongoDB: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var reports []models.StormReport
+	if err := cursor.All(ctx, &reports); err != nil {
+		return nil, fmt.Errorf("failed to decode storm reports: %w", err)
+	}
+
+	return reports, nil
+}
+
+func (dao *StormDAO) GetStormStats(ctx context.Context, query models.StatsQuery) ([]models.StatsRow, error) {
+	group := bson.D{}
+	project := bson.D{{Key: "_id", Value: 0}, {Key: "count", Value: 1}}
+	for _, dim := range query.GroupBy {
+		group = append(group, bson.E{Key: string(dim), Value: statsGroupExpr(dim)})
+		project = append(project, bson.E{Key: string(dim), Value: "$_id." + string(dim)})
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: buildFilter(query.Range())}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: group},
+			{Key: "count", Value: bson.M{"$sum": 1}},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		{{Key: "$project", Value: project}},
+	}
 
+	cursor, err := dao.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate storm stats: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	rows := []models.StatsRow{}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, fmt.Errorf("failed to decode storm stats: %w", err)
+	}
+	return rows, nil
+}
+
+// SearchStormReports runs a $text search over comments, location and county,
+// ordered by Mongo's text score. $text matches whole words after stemming
+// and drops stop words, so it finds different reports than the substring
+// matcher the other DAOs use. Snippets are highlighted with that matcher,
+// so a stemmed match may come back without a highlight.
+func (dao *StormDAO) SearchStormReports(ctx context.Context, query models.StormQuery, q string) ([]models.SearchResult, error) {
+	filter := buildFilter(query)
+	filter["$text"] = bson.M{"$search": q}
+	score := bson.M{"$meta": "textScore"}
+
+	cursor, err := dao.collection.Find(ctx, filter,
+		pageOptions(query).SetProjection(bson.M{"score": score}).SetSort(bson.M{"score": score}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search MongoDB: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var results []models.SearchResult
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to decode search results: %w", err)
+	}
+	search := models.ParseSearch(q)
+	for i := range results {
+		results[i].Highlights = search.Highlight(results[i].StormReport)
+	}
+	return results, nil
+}
+
+// buildFilter translates a query's date range and filter into a Mongo
+// query. Soft-deleted and withdrawn reports are left out.
+func buildFilter(query models.StormQuery) bson.M {
+	f := query.Filter
 	filter := bson.M{
 		"date": bson.M{
-			"$gte": startOfDay,
-			"$lte": endOfDay,
+			"$gte": query.Start,
+			"$lte": query.End,
 		},
+		"deleted":   bson.M{"$ne": true},
+		"withdrawn": bson.M{"$ne": true},
+	}
+	if len(f.Types) > 0 {
+		filter["type"] = bson.M{"$in": f.Types}
+	}
+	if len(f.States) > 0 {
+		filter["state"] = bson.M{"$in": f.States}
+	}
+	if len(f.Counties) > 0 {
+		filter["county"] = bson.M{"$in": f.Counties}
 	}
+	if f.BBox != nil {
+		filter["lat"] = bson.M{"$gte": f.BBox.MinLat, "$lte": f.BBox.MaxLat}
+		filter["lon"] = bson.M{"$gte": f.BBox.MinLon, "$lte": f.BBox.MaxLon}
+	}
+	return filter
+}
+
+// pageOptions skips and limits a find to the page a query asks for.
+func pageOptions(query models.StormQuery) *options.FindOptions {
+	opts := options.Find()
+	if query.Offset > 0 {
+		opts.SetSkip(int64(query.Offset))
+	}
+	if query.Limit > 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+	return opts
+}
+
+// statsGroupExpr returns the aggregation expression a dimension groups on.
+// Times are stored as HHMM integers.
+func statsGroupExpr(dim models.StatsDimension) interface{} {
+	switch dim {
+	case models.DimensionDay:
+		return bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$date"}}
+	case models.DimensionHour:
+		return bson.M{"$toInt": bson.M{"$floor": bson.M{"$divide": bson.A{"$time", 100}}}}
+	default:
+		return "$" + string(dim)
+	}
+}
+
+func (dao *StormDAO) GetStormReport(ctx context.Context, id string) (*models.StormReport, error) {
+	var report models.StormReport
+	err := dao.collection.FindOne(ctx, bson.M{"id": id}).Decode(&report)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, models.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query MongoDB: %w", err)
+	}
+	return &report, nil
+}
+
+func (dao *StormDAO) GetDeletedStormReports(query models.StormQuery) ([]models.StormReport, error) {
+	filter := buildFilter(query)
+	filter["deleted"] = true
+	delete(filter, "withdrawn")
 
-	cursor, err := dao.collection.Find(context.TODO(), filter)
+	cursor, err := dao.collection.Find(context.TODO(), filter,
+		pageOptions(query).SetSort(bson.D{{Key: "deletedAt", Value: -1}, {Key: "id", Value: 1}}))
 	if err != nil {
 		return nil, fmt.Errorf("failed to query MongoDB: %w", err)
 	}
 	defer cursor.Close(context.TODO())
 
-	var reports []models.StormReport
+	reports := []models.StormReport{}
 	if err := cursor.All(context.TODO(), &reports); err != nil {
 		return nil, fmt.Errorf("failed to decode storm reports: %w", err)
 	}
-
 	return reports, nil
 }
+
+func (dao *StormDAO) GetStormReportHistory(ctx context.Context, id string) ([]models.ReportRevision, error) {
+	cursor, err := dao.revisions.Find(ctx, bson.M{"reportId": id},
+		options.Find().SetSort(bson.D{{Key: "changedAt", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query report revisions: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	revisions := []models.ReportRevision{}
+	if err := cursor.All(ctx, &revisions); err != nil {
+		return nil, fmt.Errorf("failed to decode report revisions: %w", err)
+	}
+	return revisions, nil
+}
+
+// UpsertStormReport stores an ingested report under its stable ID. When an
+// existing report has different field values, the stored version is copied
+// to the revisions collection along with the change source, and the
+// report's revision number goes up. The write only succeeds while the
+// report is still at the revision read, so concurrent writes are retried
+// rather than lost.
+func (dao *StormDAO) UpsertStormReport(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+	report.ID = models.ReportID(report)
+	for attempt := 1; ; attempt++ {
+		result, err := dao.upsertStormReport(report, source)
+		if !errors.Is(err, models.ErrStaleRevision) || attempt == reportWriteAttempts {
+			return result, err
+		}
+	}
+}
+
+func (dao *StormDAO) upsertStormReport(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+	ctx := context.TODO()
+	result := models.UpsertResult{ID: report.ID, Report: report}
+
+	// Reports stored before IDs existed are matched on the old natural key
+	// and pick up their ID on this write.
+	lookup := bson.M{"$or": bson.A{
+		bson.M{"id": report.ID},
+		bson.M{
+			"id":       bson.M{"$exists": false},
+			"time":     report.Time,
+			"type":     report.Type,
+			"location": report.Location,
+			"lat":      report.Lat,
+			"lon":      report.Lon,
+		},
+	}}
+
+	var raw bson.Raw
+	err := dao.collection.FindOne(ctx, lookup).Decode(&raw)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return result, fmt.Errorf("failed to query MongoDB: %w", err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		report.Revision, report.UpdatedAt = 1, &now
+		doc, err := reportDocument(report, source)
+		if err != nil {
+			return result, err
+		}
+		// A duplicate means another write stored the report first.
+		if err := dao.insertReport(ctx, doc); mongo.IsDuplicateKeyError(err) {
+			return result, models.ErrStaleRevision
+		} else if err != nil {
+			return result, fmt.Errorf("failed to insert storm report: %w", err)
+		}
+		result.Report, result.Created = report, true
+		return result, nil
+	}
+
+	existing, err := decodeReport(raw)
+	if err != nil {
+		return result, fmt.Errorf("failed to decode storm report: %w", err)
+	}
+	// The first date a report was seen on is kept, and re-ingesting a
+	// deleted report doesn't bring it back. A withdrawn report that SPC
+	// publishes again is reinstated.
+	report.Date = existing.Date
+	report.Deleted, report.DeletedAt = existing.Deleted, existing.DeletedAt
+	report.Withdrawn, report.WithdrawnAt = false, nil
+	report.Revision, report.UpdatedAt = existing.Revision, existing.UpdatedAt
+	changes := models.DiffReports(existing, report)
+	if len(changes) == 0 && existing.ID == report.ID {
+		result.Report = report
+		return result, nil
+	}
+	if len(changes) > 0 {
+		report.Revision, report.UpdatedAt = existing.NextRevision(), &now
+	}
+
+	doc, err := reportDocument(report, source)
+	if err != nil {
+		return result, err
+	}
+	filter := revisionFilter(bson.M{"_id": raw.Lookup("_id")}, existing.Revision)
+	res, err := dao.collection.UpdateOne(ctx, filter, reportUpdate(doc, report))
+	if err != nil {
+		return result, fmt.Errorf("failed to upsert storm report: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return result, models.ErrStaleRevision
+	}
+	result.Report = report
+
+	if len(changes) > 0 {
+		existing.ID = report.ID
+		revision := models.ReportRevision{
+			ReportID:  report.ID,
+			Previous:  existing,
+			Changes:   changes,
+			Source:    source,
+			ChangedAt: now,
+		}
+		if _, err := dao.revisions.InsertOne(ctx, revision); err != nil {
+			return result, fmt.Errorf("failed to record report revision: %w", err)
+		}
+		result.Changed = true
+	}
+	return result, nil
+}
+
+// WithdrawStormReport marks a report withdrawn, copying the version it
+// replaces to the revisions collection as for any other change. Like
+// UpsertStormReport, it tries again if the report changes in between.
+func (dao *StormDAO) WithdrawStormReport(id string, source models.ChangeSource) (models.UpsertResult, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := dao.withdrawStormReport(id, source)
+		if !errors.Is(err, models.ErrStaleRevision) || attempt == reportWriteAttempts {
+			return result, err
+		}
+	}
+}
+
+func (dao *StormDAO) withdrawStormReport(id string, source models.ChangeSource) (models.UpsertResult, error) {
+	ctx := context.TODO()
+	result := models.UpsertResult{ID: id}
+
+	existing, err := dao.GetStormReport(ctx, id)
+	if err != nil {
+		return result, err
+	}
+	result.Report = *existing
+	if existing.Withdrawn {
+		return result, nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	report := *existing
+	report.Withdrawn, report.WithdrawnAt = true, &now
+	report.Revision, report.UpdatedAt = existing.NextRevision(), &now
+	doc, err := reportDocument(report, source)
+	if err != nil {
+		return result, err
+	}
+	res, err := dao.collection.UpdateOne(ctx, revisionFilter(bson.M{"id": id}, existing.Revision), reportUpdate(doc, report))
+	if err != nil {
+		return result, fmt.Errorf("failed to withdraw storm report: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return result, models.ErrStaleRevision
+	}
+
+	revision := models.ReportRevision{
+		ReportID:  id,
+		Previous:  *existing,
+		Changes:   models.DiffReports(*existing, report),
+		Source:    source,
+		ChangedAt: now,
+	}
+	if _, err := dao.revisions.InsertOne(ctx, revision); err != nil {
+		return result, fmt.Errorf("failed to record report revision: %w", err)
+	}
+	result.Report = report
+	result.Changed = true
+	return result, nil
+}
+
+// reportDocument flattens a report into the stored document, which keeps
+// its date as a BSON date and also records the Kafka position it was last
+// written from. insertReport and reportUpdate stamp when it was written.
+func reportDocument(report models.StormReport, source models.ChangeSource) (bson.M, error) {
+	data, err := bson.Marshal(report)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode storm report: %w", err)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to encode storm report: %w", err)
+	}
+	if doc["date"], err = models.ParseReportDate(report.Date); err != nil {
+		return nil, fmt.Errorf("failed to encode storm report: %w", err)
+	}
+	if source.Actor == models.ActorIngest {
+		doc["kafkaPartition"] = source.KafkaPartition
+		doc["kafkaOffset"] = source.KafkaOffset
+	}
+	return doc, nil
+}
+
+// revisionFilter narrows filter to reports still at the given revision.
+// Reports stored before revisions were numbered have none.
+func revisionFilter(filter bson.M, revision int) bson.M {
+	if revision == 0 {
+		filter["revision"] = bson.M{"$exists": false}
+	} else {
+		filter["revision"] = revision
+	}
+	return filter
+}
+
+// nextRevision computes a stored report's next revision number in an
+// update pipeline, as StormReport.NextRevision does.
+var nextRevision = bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$revision", 1}}, 1}}
+
+// reportWriteAttempts is how many times an ingested change is read and
+// written again when another write gets to the report first.
+const reportWriteAttempts = 5
+
+// reportUpdate replaces a stored report with doc. The withdrawal fields are
+// left out of doc when unset, so they are removed explicitly. writtenAt is
+// set by the server's clock, which the live update poller reads from.
+func reportUpdate(doc bson.M, report models.StormReport) bson.M {
+	update := bson.M{"$set": doc, "$currentDate": bson.M{"writtenAt": true}}
+	if !report.Withdrawn {
+		update["$unset"] = bson.M{"withdrawn": "", "withdrawnAt": ""}
+	}
+	return update
+}
+
+// insertReport stores doc as a new report, stamped with the server's clock
+// as reportUpdate stamps updates. Stored reports always have a date, so the
+// filter never matches and the upsert inserts; a report with the same ID
+// fails on the unique index with a duplicate key error.
+func (dao *StormDAO) insertReport(ctx context.Context, doc bson.M) error {
+	_, err := dao.collection.UpdateOne(ctx,
+		bson.M{"id": doc["id"], "date": bson.M{"$exists": false}},
+		mongo.Pipeline{{{Key: "$replaceWith", Value: bson.M{"$mergeObjects": bson.A{
+			"$$ROOT", bson.M{"$literal": doc}, bson.M{"writtenAt": "$$NOW"},
+		}}}}},
+		options.Update().SetUpsert(true))
+	return err
+}
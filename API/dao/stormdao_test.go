@@ -2,7 +2,12 @@ package dao_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/jonathanface/storm-reporter/API/dao"
 	"github.com/jonathanface/storm-reporter/API/models"
@@ -13,27 +18,232 @@ type MockMongoCollection struct{}
 
 func (m *MockMongoCollection) Find(ctx context.Context, filter interface{}) ([]models.StormReport, error) {
 	return []models.StormReport{
-		{Date: "2024-12-09", Location: "Test City", Type: "tornado"},
+		{Date: "1733702400", Location: "Test City", Type: "tornado"},
 	}, nil
 }
 
+// between returns a query for the reports dated start to end.
+func between(start, end int64) models.StormQuery {
+	return models.NewStormQuery(time.Unix(start, 0).UTC(), time.Unix(end, 0).UTC())
+}
+
 func TestGetStormReports(t *testing.T) {
 	mockDAO := &dao.MockStormDAO{
-		MockGetStormReports: func(start string, end string) ([]models.StormReport, error) {
+		MockGetStormReports: func(query models.StormQuery) ([]models.StormReport, error) {
 			return []models.StormReport{
-				{Date: "2024-12-09", Location: "Test City", Type: "tornado"},
+				{Date: "1733702400", Location: "Test City", Type: "tornado"},
 			}, nil
 		},
 	}
 
-	startDate := "1733773445"
-	endDate := "1733777109"
-
-	reports, err := mockDAO.GetStormReports(startDate, endDate)
+	reports, err := mockDAO.GetStormReports(context.Background(), between(1733773445, 1733777109))
 
 	assert.NoError(t, err, "Expected no error")
 	assert.Len(t, reports, 1, "Expected one report")
-	assert.Equal(t, "2024-12-09", reports[0].Date)
+	assert.Equal(t, "1733702400", reports[0].Date)
 	assert.Equal(t, "Test City", reports[0].Location)
 	assert.Equal(t, "tornado", string(reports[0].Type))
 }
+
+func TestCachedStormDAO(t *testing.T) {
+	calls := 0
+	mockDAO := &dao.MockStormDAO{
+		MockGetStormReports: func(query models.StormQuery) ([]models.StormReport, error) {
+			calls++
+			return []models.StormReport{{ID: "a", Date: models.FormatReportDate(query.Start)}}, nil
+		},
+		MockUpsertStormReport: func(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+			return models.UpsertResult{ID: report.ID, Report: report, Changed: true}, nil
+		},
+	}
+	cached := dao.NewCachedStormDAO(mockDAO, 2)
+
+	reports, err := cached.GetStormReports(context.Background(), between(1733702400, 1733788799))
+	assert.NoError(t, err)
+	reports[0].ID = "mutated by caller"
+	reports, _ = cached.GetStormReports(context.Background(), between(1733702400, 1733788799))
+	assert.Equal(t, 1, calls, "Expected the second query to be served from cache")
+	assert.Equal(t, "a", reports[0].ID)
+
+	// A write to another day leaves the entry alone; one to the same day,
+	// even in milliseconds, drops it.
+	cached.Invalidate(models.StormReport{Date: "1733875200"})
+	cached.GetStormReports(context.Background(), between(1733702400, 1733788799))
+	assert.Equal(t, 1, calls)
+	_, err = cached.UpsertStormReport(models.StormReport{Date: "1733780000000"}, models.ChangeSource{})
+	assert.NoError(t, err)
+	cached.GetStormReports(context.Background(), between(1733702400, 1733788799))
+	assert.Equal(t, 2, calls)
+
+	// So does withdrawing a report on that day.
+	mockDAO.MockWithdrawStormReport = func(id string, source models.ChangeSource) (models.UpsertResult, error) {
+		return models.UpsertResult{ID: id, Report: models.StormReport{ID: id, Date: "1733780000", Withdrawn: true}, Changed: true}, nil
+	}
+	_, err = cached.WithdrawStormReport("a", models.ChangeSource{Actor: models.ActorIngest})
+	assert.NoError(t, err)
+	cached.GetStormReports(context.Background(), between(1733702400, 1733788799))
+	assert.Equal(t, 3, calls)
+
+	// The least recently used entry is evicted past the size limit.
+	cached.GetStormReports(context.Background(), between(1733788800, 1733875199))
+	cached.GetStormReports(context.Background(), between(1733875200, 1733961599))
+	assert.Equal(t, 2, cached.Len())
+	cached.GetStormReports(context.Background(), between(1733702400, 1733788799))
+	assert.Equal(t, 6, calls)
+}
+
+func TestCachedStormDAO_InvalidatesReadsInFlight(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var version atomic.Int32
+	mockDAO := &dao.MockStormDAO{
+		MockGetStormReports: func(query models.StormQuery) ([]models.StormReport, error) {
+			// The result is read before blocking, as a query would be.
+			report := models.StormReport{ID: "a", Comments: fmt.Sprint("version ", version.Load())}
+			started <- struct{}{}
+			<-release
+			return []models.StormReport{report}, nil
+		},
+		MockUpsertStormReport: func(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+			version.Add(1)
+			return models.UpsertResult{ID: report.ID, Report: report, Changed: true}, nil
+		},
+	}
+	cached := dao.NewCachedStormDAO(dao.NewCoalescingStormDAO(mockDAO), 10)
+	query := between(1733702400, 1733788799)
+
+	// A leader reads version 0 and is held; a write lands, and a reader
+	// arriving after it must not join the leader's call.
+	leader := make(chan []models.StormReport)
+	go func() {
+		reports, _ := cached.GetStormReports(context.Background(), query)
+		leader <- reports
+	}()
+	<-started
+	_, err := cached.UpsertStormReport(models.StormReport{ID: "a", Date: "1733702400"}, models.ChangeSource{})
+	assert.NoError(t, err)
+	waiter := make(chan []models.StormReport)
+	go func() {
+		reports, _ := cached.GetStormReports(context.Background(), query)
+		waiter <- reports
+	}()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the reader after the write to start its own call")
+	}
+	close(release)
+
+	assert.Equal(t, "version 0", (<-leader)[0].Comments)
+	assert.Equal(t, "version 1", (<-waiter)[0].Comments)
+	reports, err := cached.GetStormReports(context.Background(), query)
+	assert.NoError(t, err)
+	assert.Equal(t, "version 1", reports[0].Comments, "Expected the cache not to serve the result read before the write")
+}
+
+func TestCoalescingStormDAO(t *testing.T) {
+	var release atomic.Pointer[chan struct{}]
+	var failWith atomic.Pointer[error]
+	var backendCalls atomic.Int32
+	mockDAO := &dao.MockStormDAO{
+		MockGetStormReports: func(query models.StormQuery) ([]models.StormReport, error) {
+			backendCalls.Add(1)
+			<-*release.Load()
+			if err := failWith.Load(); err != nil {
+				return nil, *err
+			}
+			return []models.StormReport{{ID: "a"}}, nil
+		},
+	}
+	coalescing := dao.NewCoalescingStormDAO(mockDAO)
+
+	// round starts n identical queries while the backend is held, releases
+	// it once they've had time to join the in-flight call and collects what
+	// each caller got.
+	round := func(n int, failure error) ([][]models.StormReport, []error) {
+		ch := make(chan struct{})
+		release.Store(&ch)
+		failWith.Store(nil)
+		if failure != nil {
+			failWith.Store(&failure)
+		}
+		backendCalls.Store(0)
+		before := coalescing.Stats()
+
+		reports := make([][]models.StormReport, n)
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				reports[i], errs[i] = coalescing.GetStormReports(context.Background(), between(1733702400, 1733788799))
+			}(i)
+		}
+		for backendCalls.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(ch)
+		wg.Wait()
+
+		after := coalescing.Stats()
+		calls, coalesced := after.Calls-before.Calls, after.Coalesced-before.Coalesced
+		assert.Equal(t, int64(backendCalls.Load()), calls)
+		assert.Equal(t, int64(n), calls+coalesced)
+		if n > 1 {
+			assert.Positive(t, coalesced, "Expected concurrent queries to be coalesced")
+		}
+		return reports, errs
+	}
+
+	reports, errs := round(5, nil)
+	for i := range reports {
+		assert.NoError(t, errs[i])
+		assert.Equal(t, "a", reports[i][0].ID)
+	}
+	reports[0][0].ID = "mutated"
+	assert.Equal(t, "a", reports[1][0].ID, "Expected each waiter to get its own slice")
+
+	failure := errors.New("connection reset")
+	_, errs = round(4, failure)
+	for _, err := range errs {
+		assert.ErrorIs(t, err, failure)
+	}
+
+	// A failed call isn't remembered; the next query goes to the backend.
+	reports, errs = round(1, nil)
+	assert.NoError(t, errs[0])
+	assert.Len(t, reports[0], 1)
+
+	// A waiter that gives up returns at once; the others still get the
+	// leader's result, even when the one giving up is the leader.
+	ch := make(chan struct{})
+	release.Store(&ch)
+	backendCalls.Store(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := coalescing.GetStormReports(ctx, between(1733702400, 1733788799))
+		cancelled <- err
+	}()
+	for backendCalls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	results := make(chan []models.StormReport, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			reports, err := coalescing.GetStormReports(context.Background(), between(1733702400, 1733788799))
+			assert.NoError(t, err)
+			results <- reports
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+	close(ch)
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, "a", (<-results)[0].ID)
+	}
+	assert.Equal(t, int32(1), backendCalls.Load())
+}
@@ -0,0 +1,61 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// usageRetention is how long daily usage counts are kept after their day.
+const usageRetention = 7 * 24 * time.Hour
+
+// usagePruner drops usage counts past the retention, in place of Mongo's TTL
+// index, at most once a day rather than on every request.
+type usagePruner struct {
+	mu   sync.Mutex
+	last string // the day counts were last pruned
+}
+
+// prune calls drop with the oldest day to keep, unless it already succeeded
+// today.
+func (p *usagePruner) prune(drop func(cutoff string) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now().UTC()
+	today := now.Format(time.DateOnly)
+	if p.last == today {
+		return nil
+	}
+	if err := drop(now.Add(-usageRetention).Format(time.DateOnly)); err != nil {
+		return err
+	}
+	p.last = today
+	return nil
+}
+
+func (dao *StormDAO) AddUsage(client, kind, day string, n int64) (int64, error) {
+	expireAt := time.Now().UTC().Add(usageRetention)
+	if d, err := time.Parse(time.DateOnly, day); err == nil {
+		expireAt = d.Add(usageRetention)
+	}
+
+	var doc struct {
+		Count int64 `bson:"count"`
+	}
+	err := dao.usage.FindOneAndUpdate(context.TODO(),
+		bson.M{"_id": kind + "|" + client + "|" + day},
+		bson.M{
+			"$inc":         bson.M{"count": n},
+			"$setOnInsert": bson.M{"client": client, "kind": kind, "day": day, "expireAt": expireAt},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record usage: %w", err)
+	}
+	return doc.Count, nil
+}
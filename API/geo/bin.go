@@ -0,0 +1,108 @@
+// Package geo holds the spatial helpers used to summarise storm reports
+// for map clients.
+package geo
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+// Bin groups reports into cells of the given shape. For grid cells cellSize
+// is the side length in degrees; for hex cells it is the flat-to-flat width
+// in degrees. Cells are returned ordered by ID.
+func Bin(reports []models.StormReport, shape models.CellShape, cellSize float64) (models.Heatmap, error) {
+	if cellSize <= 0 || math.IsNaN(cellSize) || math.IsInf(cellSize, 0) {
+		return models.Heatmap{}, fmt.Errorf("cell size must be positive")
+	}
+
+	var locate func(lat, lon float64) (string, float64, float64, [][2]float64)
+	switch shape {
+	case models.CellGrid:
+		locate = func(lat, lon float64) (string, float64, float64, [][2]float64) {
+			return gridCell(lat, lon, cellSize)
+		}
+	case models.CellHex:
+		locate = func(lat, lon float64) (string, float64, float64, [][2]float64) {
+			return hexCell(lat, lon, cellSize)
+		}
+	default:
+		return models.Heatmap{}, fmt.Errorf("unknown cell shape %q", shape)
+	}
+
+	cells := map[string]*models.HeatmapCell{}
+	for _, report := range reports {
+		id, lat, lon, boundary := locate(report.Lat, report.Lon)
+		cell, ok := cells[id]
+		if !ok {
+			cell = &models.HeatmapCell{
+				ID:       id,
+				Lat:      lat,
+				Lon:      lon,
+				Boundary: boundary,
+				Counts:   map[models.StormType]int{},
+			}
+			cells[id] = cell
+		}
+		cell.Counts[report.Type]++
+		cell.Total++
+		if s := report.Severity(); s > cell.MaxSeverity {
+			cell.MaxSeverity = s
+		}
+	}
+
+	heatmap := models.Heatmap{Shape: shape, CellSize: cellSize, Cells: make([]models.HeatmapCell, 0, len(cells))}
+	for _, cell := range cells {
+		heatmap.Cells = append(heatmap.Cells, *cell)
+	}
+	sort.Slice(heatmap.Cells, func(i, j int) bool { return heatmap.Cells[i].ID < heatmap.Cells[j].ID })
+	return heatmap, nil
+}
+
+func gridCell(lat, lon, size float64) (string, float64, float64, [][2]float64) {
+	row := math.Floor(lat / size)
+	col := math.Floor(lon / size)
+	minLat, minLon := row*size, col*size
+	maxLat, maxLon := minLat+size, minLon+size
+	boundary := [][2]float64{
+		{minLon, minLat}, {maxLon, minLat}, {maxLon, maxLat}, {minLon, maxLat}, {minLon, minLat},
+	}
+	return fmt.Sprintf("g:%d:%d", int64(row), int64(col)), minLat + size/2, minLon + size/2, boundary
+}
+
+// hexCell places a point on a pointy-top axial hex grid laid over plain
+// lat/lon degrees, with lon as x and lat as y.
+func hexCell(lat, lon, width float64) (string, float64, float64, [][2]float64) {
+	radius := width / math.Sqrt(3)
+
+	q := (math.Sqrt(3)/3*lon - lat/3) / radius
+	r := (2.0 / 3 * lat) / radius
+	qi, ri := hexRound(q, r)
+
+	cx := radius * math.Sqrt(3) * (float64(qi) + float64(ri)/2)
+	cy := radius * 1.5 * float64(ri)
+
+	boundary := make([][2]float64, 0, 7)
+	for i := 0; i < 6; i++ {
+		angle := math.Pi / 180 * float64(60*i-30)
+		boundary = append(boundary, [2]float64{cx + radius*math.Cos(angle), cy + radius*math.Sin(angle)})
+	}
+	boundary = append(boundary, boundary[0])
+	return fmt.Sprintf("h:%d:%d", qi, ri), cy, cx, boundary
+}
+
+// hexRound snaps fractional axial coordinates to the nearest hex using cube
+// coordinate rounding.
+func hexRound(q, r float64) (int64, int64) {
+	s := -q - r
+	rq, rr, rs := math.Round(q), math.Round(r), math.Round(s)
+	dq, dr, ds := math.Abs(rq-q), math.Abs(rr-r), math.Abs(rs-s)
+	if dq > dr && dq > ds {
+		rq = -rr - rs
+	} else if dr > ds {
+		rr = -rq - rs
+	}
+	return int64(rq), int64(rr)
+}
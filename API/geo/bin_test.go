@@ -0,0 +1,102 @@
+package geo_test
+
+import (
+	"testing"
+
+	"github.com/jonathanface/storm-reporter/API/geo"
+	"github.com/jonathanface/storm-reporter/API/models"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/stretchr/testify/assert"
+)
+
+var binReports = []models.StormReport{
+	{Lat: 35.2, Lon: -97.4, Type: models.TORNADO, F_Scale: "EF3"},
+	{Lat: 35.7, Lon: -97.9, Type: models.HAIL, Size: 175},
+	{Lat: 35.9, Lon: -97.1, Type: models.HAIL, Size: 1.0},
+	{Lat: 41.5, Lon: -90.2, Type: models.WIND, Speed: 70},
+}
+
+func TestBin_Grid(t *testing.T) {
+	heatmap, err := geo.Bin(binReports, models.CellGrid, 1)
+	assert.NoError(t, err)
+	assert.Len(t, heatmap.Cells, 2)
+
+	var okCell models.HeatmapCell
+	for _, c := range heatmap.Cells {
+		if c.Total == 3 {
+			okCell = c
+		}
+	}
+	assert.Equal(t, "g:35:-98", okCell.ID)
+	assert.Equal(t, 1, okCell.Counts[models.TORNADO])
+	assert.Equal(t, 2, okCell.Counts[models.HAIL])
+	assert.Equal(t, 3, okCell.MaxSeverity)
+	assert.InDelta(t, 35.5, okCell.Lat, 1e-9)
+	assert.InDelta(t, -97.5, okCell.Lon, 1e-9)
+	assert.Len(t, okCell.Boundary, 5)
+}
+
+func TestBin_Hex(t *testing.T) {
+	heatmap, err := geo.Bin(binReports, models.CellHex, 2)
+	assert.NoError(t, err)
+
+	total := 0
+	for _, c := range heatmap.Cells {
+		total += c.Total
+		assert.Len(t, c.Boundary, 7)
+		assert.Equal(t, c.Boundary[0], c.Boundary[6])
+	}
+	assert.Equal(t, len(binReports), total)
+
+	// A point at a cell's center must land back in that cell.
+	for _, c := range heatmap.Cells {
+		again, err := geo.Bin([]models.StormReport{{Lat: c.Lat, Lon: c.Lon}}, models.CellHex, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, c.ID, again.Cells[0].ID)
+	}
+}
+
+func TestBin_Invalid(t *testing.T) {
+	_, err := geo.Bin(binReports, models.CellShape("triangle"), 1)
+	assert.Error(t, err)
+	_, err = geo.Bin(binReports, models.CellGrid, 0)
+	assert.Error(t, err)
+}
+
+func TestEncodeTile(t *testing.T) {
+	tile, err := geo.ParseTile(4, 3, 6)
+	assert.NoError(t, err)
+	bounds := geo.TileBounds(tile)
+	assert.True(t, bounds.Contains(35.2, -97.4))
+
+	data, err := geo.EncodeTile(binReports, tile)
+	assert.NoError(t, err)
+	layers, err := mvt.Unmarshal(data)
+	assert.NoError(t, err)
+	assert.Len(t, layers, 1)
+	assert.Equal(t, geo.TileLayer, layers[0].Name)
+
+	// At low zoom the three Oklahoma reports are merged into clusters and
+	// the Illinois report falls outside the tile.
+	total, clustered := 0, false
+	for _, f := range layers[0].Features {
+		total += int(f.Properties["point_count"].(float64))
+		clustered = clustered || f.Properties["cluster"] == true
+	}
+	assert.Equal(t, 3, total)
+	assert.True(t, clustered)
+	assert.Less(t, len(layers[0].Features), 3)
+
+	tile, err = geo.ParseTile(12, 939, 1619)
+	assert.NoError(t, err)
+	data, err = geo.EncodeTile(binReports, tile)
+	assert.NoError(t, err)
+	layers, err = mvt.Unmarshal(data)
+	assert.NoError(t, err)
+	assert.Len(t, layers[0].Features, 1)
+	assert.Equal(t, "tornado", layers[0].Features[0].Properties["type"])
+	assert.NotContains(t, layers[0].Features[0].Properties, "cluster")
+
+	_, err = geo.ParseTile(2, 4, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,141 @@
+package geo
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+)
+
+const (
+	// TileLayer is the name of the MVT layer reports are written to.
+	TileLayer = "reports"
+	// MaxTileZoom is the deepest zoom level tiles are served for.
+	MaxTileZoom = 22
+	// ClusterMaxZoom is the last zoom level at which nearby reports are
+	// merged into cluster features; deeper tiles carry every report.
+	ClusterMaxZoom = 7
+
+	tileExtent = 4096
+	// clusterCell is the clustering grid size in tile extent units, i.e.
+	// 256 of 4096 gives a 16x16 grid per tile.
+	clusterCell = 256
+)
+
+// ParseTile validates z/x/y web-mercator tile coordinates.
+func ParseTile(z, x, y uint32) (maptile.Tile, error) {
+	if z > MaxTileZoom {
+		return maptile.Tile{}, fmt.Errorf("zoom must be between 0 and %d", MaxTileZoom)
+	}
+	if max := uint32(1) << z; x >= max || y >= max {
+		return maptile.Tile{}, fmt.Errorf("tile %d/%d/%d is out of range", z, x, y)
+	}
+	return maptile.New(x, y, maptile.Zoom(z)), nil
+}
+
+// TileBounds returns the lat/lon box covered by a tile.
+func TileBounds(tile maptile.Tile) models.BoundingBox {
+	b := tile.Bound()
+	return models.BoundingBox{MinLat: b.Min.Lat(), MinLon: b.Min.Lon(), MaxLat: b.Max.Lat(), MaxLon: b.Max.Lon()}
+}
+
+// TileQueryBounds returns the box to fetch a tile's reports from: its
+// bounds widened by one clustering cell on each side, so reports on the
+// edge aren't lost to rounding between degrees and tile coordinates.
+func TileQueryBounds(tile maptile.Tile) models.BoundingBox {
+	b := TileBounds(tile)
+	bufLat := (b.MaxLat - b.MinLat) * clusterCell / tileExtent
+	bufLon := (b.MaxLon - b.MinLon) * clusterCell / tileExtent
+	return models.BoundingBox{
+		MinLat: max(b.MinLat-bufLat, -90),
+		MinLon: max(b.MinLon-bufLon, -180),
+		MaxLat: min(b.MaxLat+bufLat, 90),
+		MaxLon: min(b.MaxLon+bufLon, 180),
+	}
+}
+
+// EncodeTile writes the reports that fall inside the tile as MVT point
+// features. Each feature carries type, severity, time, location and state;
+// at zooms up to ClusterMaxZoom nearby reports are merged into a single
+// feature with cluster=true, a point_count, per-type counts and the
+// maximum severity of its members.
+func EncodeTile(reports []models.StormReport, tile maptile.Tile) ([]byte, error) {
+	bounds := TileBounds(tile)
+	inside := make([]models.StormReport, 0, len(reports))
+	for _, r := range reports {
+		if bounds.Contains(r.Lat, r.Lon) {
+			inside = append(inside, r)
+		}
+	}
+
+	fc := geojson.NewFeatureCollection()
+	if tile.Z <= ClusterMaxZoom {
+		for _, c := range clusterReports(inside, tile) {
+			fc.Append(c)
+		}
+	} else {
+		for _, r := range inside {
+			f := geojson.NewFeature(orb.Point{r.Lon, r.Lat})
+			f.Properties["type"] = string(r.Type)
+			f.Properties["severity"] = r.Severity()
+			f.Properties["time"] = int(r.Time)
+			f.Properties["location"] = r.Location
+			f.Properties["state"] = r.State
+			fc.Append(f)
+		}
+	}
+
+	layers := mvt.NewLayers(map[string]*geojson.FeatureCollection{TileLayer: fc})
+	layers.ProjectToTile(tile)
+	return mvt.Marshal(layers)
+}
+
+type cluster struct {
+	sumLat, sumLon float64
+	counts         map[models.StormType]int
+	total          int
+	maxSeverity    int
+}
+
+func clusterReports(reports []models.StormReport, tile maptile.Tile) []*geojson.Feature {
+	cells := map[[2]int]*cluster{}
+	order := [][2]int{}
+	for _, r := range reports {
+		frac := maptile.Fraction(orb.Point{r.Lon, r.Lat}, tile.Z)
+		key := [2]int{
+			int(math.Floor((frac.X() - float64(tile.X)) * tileExtent / clusterCell)),
+			int(math.Floor((frac.Y() - float64(tile.Y)) * tileExtent / clusterCell)),
+		}
+		c, ok := cells[key]
+		if !ok {
+			c = &cluster{counts: map[models.StormType]int{}}
+			cells[key] = c
+			order = append(order, key)
+		}
+		c.sumLat += r.Lat
+		c.sumLon += r.Lon
+		c.counts[r.Type]++
+		c.total++
+		if s := r.Severity(); s > c.maxSeverity {
+			c.maxSeverity = s
+		}
+	}
+
+	features := make([]*geojson.Feature, 0, len(order))
+	for _, key := range order {
+		c := cells[key]
+		f := geojson.NewFeature(orb.Point{c.sumLon / float64(c.total), c.sumLat / float64(c.total)})
+		f.Properties["cluster"] = c.total > 1
+		f.Properties["point_count"] = c.total
+		f.Properties["severity"] = c.maxSeverity
+		for _, t := range []models.StormType{models.TORNADO, models.HAIL, models.WIND} {
+			f.Properties[string(t)] = c.counts[t]
+		}
+		features = append(features, f)
+	}
+	return features
+}
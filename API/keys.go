@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+const keysUsage = `usage:
+  api-service keys create -name <name> -scopes read,export,stream,admin
+  api-service keys list
+  api-service keys revoke <id>`
+
+// runKeysCommand manages API keys from the command line.
+func runKeysCommand(store models.APIKeyStore, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("keys create", flag.ContinueOnError)
+		flags.SetOutput(out)
+		name := flags.String("name", "", "who or what the key is for")
+		scopeList := flags.String("scopes", string(models.ScopeRead), "comma-separated scopes")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *name == "" {
+			return errors.New("keys create: -name is required")
+		}
+		var scopes []models.Scope
+		for _, s := range splitList(*scopeList) {
+			scope, err := models.ParseScope(s)
+			if err != nil {
+				return fmt.Errorf("keys create: %w", err)
+			}
+			scopes = append(scopes, scope)
+		}
+		if len(scopes) == 0 {
+			return errors.New("keys create: at least one scope is required")
+		}
+
+		plaintext, key, err := models.NewAPIKey(*name, scopes)
+		if err != nil {
+			return err
+		}
+		if err := store.CreateAPIKey(key); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Created key %s for %q with scopes %v.\n", key.ID, key.Name, key.Scopes)
+		fmt.Fprintf(out, "Store it now; it can't be shown again:\n%s\n", plaintext)
+		return nil
+
+	case "list":
+		keys, err := store.ListAPIKeys()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tCREATED\tREVOKED")
+		for _, key := range keys {
+			revoked := "-"
+			if key.RevokedAt != nil {
+				revoked = key.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%v\t%s\t%s\n", key.ID, key.Name, key.Scopes, key.CreatedAt.Format(time.RFC3339), revoked)
+		}
+		return tw.Flush()
+
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(keysUsage)
+		}
+		if err := store.RevokeAPIKey(args[1]); errors.Is(err, models.ErrNotFound) {
+			return fmt.Errorf("keys revoke: no active key with id %q", args[1])
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Revoked key %s.\n", args[1])
+		return nil
+	}
+	return errors.New(keysUsage)
+}
+
+func splitList(s string) []string {
+	var parts []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
@@ -3,19 +3,22 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/IBM/sarama"
+	"github.com/jonathanface/storm-reporter/API/broadcast"
 	"github.com/jonathanface/storm-reporter/API/dao"
 	"github.com/jonathanface/storm-reporter/API/middleware"
+	"github.com/jonathanface/storm-reporter/API/models"
 	"github.com/jonathanface/storm-reporter/API/routes"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
@@ -24,9 +27,48 @@ var (
 	mongoURI     = os.Getenv("MONGO_URI")
 	mongoDBName  = os.Getenv("MONGO_DB")
 	mongoColl    = os.Getenv("MONGO_COLL")
+	// liveUpdates selects how live endpoints learn about new reports:
+	// "changestream", "poll", "local" (this process's ingestion only) or
+	// "auto", which uses a change stream and falls back to polling.
+	liveUpdates = os.Getenv("LIVE_UPDATES")
+	// streamName keys this replica's change stream resume token. It must
+	// outlive restarts and differ between replicas; it defaults to
+	// "api-service" for a single replica.
+	streamName = os.Getenv("STREAM_NAME")
+	// authMethods is a comma-separated list of accepted credentials
+	// ("apikey", "jwt"); when empty, the API is open.
+	authMethods = os.Getenv("AUTH_METHODS")
+	// Bearer tokens are checked against JWT_JWKS, a file path or URL, and
+	// must carry JWT_ISSUER and JWT_AUDIENCE. Roles are read from
+	// JWT_ROLES_CLAIM and mapped to scopes by JWT_ROLE_SCOPES
+	// ("viewer=read;analyst=read,export,stream").
+	jwtJWKS       = os.Getenv("JWT_JWKS")
+	jwtIssuer     = os.Getenv("JWT_ISSUER")
+	jwtAudience   = os.Getenv("JWT_AUDIENCE")
+	jwtRolesClaim = os.Getenv("JWT_ROLES_CLAIM")
+	jwtRoleScopes = os.Getenv("JWT_ROLE_SCOPES")
+	// rateLimits sets a token bucket per client for each route class
+	// ("list=10/s:20;export=2/m;stream=1/s:5"); classes left out are
+	// unlimited. exportQuota caps each client's exports per UTC day.
+	rateLimits        = os.Getenv("RATE_LIMITS")
+	rateLimitIPHeader = os.Getenv("RATE_LIMIT_IP_HEADER")
+	// trustedProxies lists the addresses RATE_LIMIT_IP_HEADER is read from
+	// ("10.0.0.0/8,192.168.1.5").
+	trustedProxies = os.Getenv("RATE_LIMIT_TRUSTED_PROXIES")
+	exportQuota    = os.Getenv("EXPORT_DAILY_QUOTA")
 )
 
-func consumeFromKafka(messagesColl *mongo.Collection) {
+const (
+	// streamHistory is how many recent reports live clients can resume from.
+	streamHistory = 1000
+	pollInterval  = 2 * time.Second
+	// cacheSize is how many query results are kept in memory.
+	cacheSize = 512
+)
+
+// consumeFromKafka upserts processed reports. When publish is set, new or
+// changed reports are also handed to it directly.
+func consumeFromKafka(stormDAO models.StormDAOInterface, publish func(models.StormReport)) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Recovered from panic in consumeFromKafka: %v", r)
@@ -55,80 +97,291 @@ func consumeFromKafka(messagesColl *mongo.Collection) {
 	if err != nil {
 		log.Printf("Error creating partition consumer: %v. Retrying in 5 seconds...", err)
 		time.Sleep(5 * time.Second)
-		go consumeFromKafka(messagesColl) // Retry by restarting the consumer
+		go consumeFromKafka(stormDAO, publish) // Retry by restarting the consumer
 		return
 	}
 	defer partitionConsumer.Close()
 
 	fmt.Println("Consuming messages from Kafka...")
 	for msg := range partitionConsumer.Messages() {
+		if len(msg.Value) == 0 && len(msg.Key) > 0 {
+			if err := applyTombstone(stormDAO, msg); err != nil {
+				log.Print(err)
+			}
+			continue
+		}
+		if isRetraction(msg) {
+			if err := applyRetraction(stormDAO, msg); err != nil {
+				log.Print(err)
+			}
+			continue
+		}
 		fmt.Printf("Received message: %s\n", string(msg.Value))
-		var message bson.M
-		if err := json.Unmarshal(msg.Value, &message); err != nil {
+		var report models.StormReport
+		if err := json.Unmarshal(msg.Value, &report); err != nil {
 			log.Printf("Error unmarshaling message: %v", err)
 			continue
 		}
-		message["kafkaPartition"] = msg.Partition
-		message["kafkaOffset"] = msg.Offset
-
-		// Create filter for upsert
-		filter := bson.M{
-			"time":     message["time"],
-			"type":     message["type"],
-			"location": message["location"],
-			"lat":      message["lat"],
-			"lon":      message["lon"],
-		}
-
-		// Perform upsert operation
-		results, err := messagesColl.UpdateOne(
-			context.TODO(),
-			filter,
-			bson.M{"$set": message},
-			options.Update().SetUpsert(true),
-		)
+
+		result, err := stormDAO.UpsertStormReport(report, models.ChangeSource{
+			Actor:          models.ActorIngest,
+			KafkaPartition: msg.Partition,
+			KafkaOffset:    msg.Offset,
+		})
 		if err != nil {
 			log.Printf("Error inserting/updating message into MongoDB: %v", err)
 			continue
 		}
 
-		if results.UpsertedCount > 0 {
-			fmt.Printf("Message written to MongoDB: %v\n", message)
+		if publish != nil && (result.Created || result.Changed) {
+			publish(result.Report)
+		}
+
+		switch {
+		case result.Created:
+			fmt.Printf("Message written to MongoDB: %s\n", result.ID)
+		case result.Changed:
+			fmt.Printf("Message revised in MongoDB: %s\n", result.ID)
+		default:
+			fmt.Printf("Message already exists in MongoDB: %s\n", result.ID)
+		}
+	}
+}
+
+// feedLiveUpdates hands every report written to storage, by any API
+// replica, to publish.
+func feedLiveUpdates(store storageBackend, publish func(models.StormReport), mode string) {
+	consumer := streamName
+	if consumer == "" {
+		consumer = "api-service"
+	}
+	var err error
+	watcher, canWatch := store.(reportWatcher)
+	if !canWatch && mode == "auto" {
+		mode = "poll"
+	}
+	for {
+		if mode == "poll" {
+			err = store.PollReports(context.Background(), pollInterval, publish)
 		} else {
-			fmt.Printf("Message already exists in MongoDB: %v\n", message)
+			err = watcher.WatchReports(context.Background(), consumer, publish)
+			if errors.Is(err, dao.ErrChangeStreamsUnsupported) && mode != "changestream" {
+				log.Println("MongoDB change streams unavailable; polling for live updates instead")
+				mode = "poll"
+				continue
+			}
 		}
+		log.Printf("Live update feed stopped: %v. Retrying in 5 seconds...", err)
+		time.Sleep(5 * time.Second)
 	}
 }
 
-func main() {
-	if kafkaBrokers == "" || mongoURI == "" || mongoDBName == "" || mongoColl == "" {
-		log.Fatal("Environment variables KAFKA_BROKERS, MONGO_URI, MONGO_DB, and MONGO_COLL must be set")
+func loadJWTConfig() middleware.JWTConfig {
+	if jwtJWKS == "" || jwtIssuer == "" || jwtAudience == "" {
+		log.Fatal("Environment variables JWT_JWKS, JWT_ISSUER, and JWT_AUDIENCE must be set for jwt authentication")
+	}
+	keys, err := middleware.LoadJWKS(jwtJWKS)
+	if err != nil {
+		log.Fatalf("Failed to load JWKS: %v", err)
 	}
+	cfg := middleware.JWTConfig{
+		Keys:       keys,
+		Issuer:     jwtIssuer,
+		Audience:   jwtAudience,
+		RolesClaim: jwtRolesClaim,
+		Leeway:     time.Minute,
+	}
+	if jwtRoleScopes != "" {
+		if cfg.RoleScopes, err = middleware.ParseRoleScopes(jwtRoleScopes); err != nil {
+			log.Fatalf("Invalid JWT_ROLE_SCOPES: %v", err)
+		}
+	}
+	return cfg
+}
 
-	// Initialize MongoDB
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(mongoURI))
+// runCommand runs one of the api-service maintenance commands instead of
+// the server.
+func runCommand(name string, args []string) {
+	daoInstance, err := openStorage(name)
 	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
+		log.Fatalf("Failed to initialize DAO: %v", err)
 	}
-	defer client.Disconnect(context.TODO())
+	defer daoInstance.Disconnect()
 
-	messagesColl := client.Database(mongoDBName).Collection(mongoColl)
-	fmt.Printf("Connected to MongoDB collection: %s\n", mongoColl)
+	switch name {
+	case "keys":
+		err = runKeysCommand(daoInstance, args, os.Stdout)
+	case "purge":
+		err = runPurgeCommand(daoInstance, args, os.Stdout)
+	case "migrate":
+		mongoDAO, ok := daoInstance.(*dao.StormDAO)
+		if !ok {
+			err = errors.New("migrate: only MongoDB storage has migrations to run; the SQL backends migrate on startup")
+			break
+		}
+		err = runMigrateCommand(mongoDAO.Migrator(migrationOwner()), args, os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		daoInstance.Disconnect()
+		os.Exit(1)
+	}
+}
 
-	// Start Kafka consumer in a goroutine
-	go consumeFromKafka(messagesColl)
+func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "keys" || os.Args[1] == "purge" || os.Args[1] == "migrate") {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	// With SQLite or in-memory storage the API can run standalone, serving
+	// the reports already stored.
+	standalone := kafkaBrokers == "" && (storage == "sqlite" || storage == "memory")
+	if kafkaBrokers == "" && !standalone {
+		log.Fatal("Environment variable KAFKA_BROKERS must be set")
+	}
+	switch liveUpdates {
+	case "":
+		liveUpdates = "auto"
+	case "auto", "changestream", "poll", "local":
+	default:
+		log.Fatalf("LIVE_UPDATES must be one of auto, changestream, poll or local; got %q", liveUpdates)
+	}
+	if liveUpdates == "changestream" && storage != "" && storage != "mongo" {
+		log.Fatal("LIVE_UPDATES=changestream requires MongoDB storage")
+	}
 
 	// Initialize DAO
-	daoInstance, err := dao.NewStormDAO(mongoURI, mongoDBName, mongoColl)
+	daoInstance, err := openStorage("")
 	if err != nil {
 		log.Fatalf("Failed to initialize DAO: %v", err)
 	}
 	defer daoInstance.Disconnect()
 
+	// Writes through the cache invalidate it; writes seen on the live
+	// update feed may come from other replicas, so they invalidate too.
+	// Cache misses for the same query share one storage call.
+	coalescingDAO := dao.NewCoalescingStormDAO(daoInstance)
+	expvar.Publish("coalescing", expvar.Func(func() any { return coalescingDAO.Stats() }))
+	cachedDAO := dao.NewCachedStormDAO(coalescingDAO, cacheSize)
+	broadcaster := broadcast.New(streamHistory)
+	defer broadcaster.Close()
+
+	// Deletions made through the API are passed on to the processed topic.
+	var routesDAO models.StormDAOInterface = cachedDAO
+	if !standalone {
+		tombstones := newTombstoneDAO(cachedDAO, topic, func() (sarama.SyncProducer, error) {
+			config := sarama.NewConfig()
+			config.Producer.Return.Successes = true
+			return sarama.NewSyncProducer([]string{kafkaBrokers}, config)
+		})
+		defer tombstones.Close()
+		routesDAO = tombstones
+	}
+
+	// Start Kafka consumer in a goroutine
+	fromFeed := func(report models.StormReport) {
+		cachedDAO.Invalidate(report)
+		if !report.Deleted && !report.Withdrawn {
+			broadcaster.Publish(report)
+		}
+	}
+	switch {
+	case standalone:
+		// Polling still publishes admin writes and, with SQLite, writes
+		// by other processes sharing the file.
+		log.Println("KAFKA_BROKERS is not set; serving stored reports without ingestion")
+		go feedLiveUpdates(daoInstance, fromFeed, "poll")
+	case liveUpdates == "local":
+		go consumeFromKafka(cachedDAO, broadcaster.Publish)
+	default:
+		go consumeFromKafka(cachedDAO, nil)
+		go feedLiveUpdates(daoInstance, fromFeed, liveUpdates)
+	}
+
+	// Every route requires a scope once authentication is configured
+	var authenticators []middleware.Authenticator
+	for _, method := range strings.Split(authMethods, ",") {
+		switch strings.TrimSpace(method) {
+		case "":
+		case "apikey":
+			authenticators = append(authenticators, middleware.APIKeyAuthenticator(daoInstance))
+		case "jwt":
+			authenticators = append(authenticators, middleware.BearerAuthenticator(loadJWTConfig()))
+		default:
+			log.Fatalf("Unknown AUTH_METHODS entry %q", method)
+		}
+	}
+	authorize := func(scope models.Scope) func(http.HandlerFunc) http.HandlerFunc {
+		if len(authenticators) == 0 {
+			return func(next http.HandlerFunc) http.HandlerFunc { return next }
+		}
+		return middleware.RequireScope(middleware.FirstOf(authenticators...), scope)
+	}
+
+	// Requests are then limited per client by route class
+	limits, err := middleware.ParseRateLimits(rateLimits)
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMITS: %v", err)
+	}
+	middleware.ClientIPHeader = rateLimitIPHeader
+	if middleware.TrustedProxies, err = middleware.ParseTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_TRUSTED_PROXIES: %v", err)
+	}
+	if rateLimitIPHeader != "" && len(middleware.TrustedProxies) == 0 {
+		log.Fatal("RATE_LIMIT_IP_HEADER requires RATE_LIMIT_TRUSTED_PROXIES")
+	}
+	limit := func(class string) func(http.HandlerFunc) http.HandlerFunc {
+		if l, ok := limits[class]; ok {
+			return middleware.RateLimited(middleware.NewRateLimiter(l))
+		}
+		return func(next http.HandlerFunc) http.HandlerFunc { return next }
+	}
+	quota := func(next http.HandlerFunc) http.HandlerFunc { return next }
+	if exportQuota != "" {
+		n, err := strconv.ParseInt(exportQuota, 10, 64)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid EXPORT_DAILY_QUOTA %q", exportQuota)
+		}
+		quota = middleware.DailyQuota(daoInstance, "export", n)
+	}
+	listLimit, exportLimit, streamLimit := limit("list"), limit("export"), limit("stream")
+	read := func(next http.HandlerFunc) http.HandlerFunc { return authorize(models.ScopeRead)(listLimit(next)) }
+	export := func(next http.HandlerFunc) http.HandlerFunc {
+		return authorize(models.ScopeExport)(exportLimit(quota(next)))
+	}
+	// Browsers can't set headers on EventSource and WebSocket requests, so
+	// the stream routes also take a token in the query string.
+	stream := func(next http.HandlerFunc) http.HandlerFunc {
+		return middleware.AllowQueryToken(authorize(models.ScopeStream)(streamLimit(next)))
+	}
+	admin := authorize(models.ScopeAdmin)
+
 	// Setup routes with middleware
 	mux := http.NewServeMux()
-	middlewareContext := middleware.WithDAOContext(daoInstance)
-	mux.Handle("/messages", middlewareContext(routes.GetMessagesHandler))
+	middlewareContext := middleware.WithDAOContext(routesDAO)
+	broadcasterContext := middleware.WithBroadcasterContext(broadcaster)
+	mux.Handle("/messages", read(middlewareContext(routes.GetMessagesHandler)))
+	mux.Handle("/messages/stream", stream(broadcasterContext(routes.StreamMessagesHandler)))
+	mux.Handle("/ws", stream(broadcasterContext(routes.SubscribeHandler)))
+	mux.Handle("/export", export(middlewareContext(routes.GetExportHandler)))
+	mux.Handle("/stats", read(middlewareContext(routes.GetStatsHandler)))
+	mux.Handle("/heatmap", read(middlewareContext(routes.GetHeatmapHandler)))
+	mux.Handle("/tiles/{z}/{x}/{y}", read(middlewareContext(routes.GetTileHandler)))
+	mux.Handle("GET /reports/{id}", read(middlewareContext(routes.GetReportHandler)))
+	if len(authenticators) > 0 {
+		// Changes are attributed to whoever made them, so there are no
+		// anonymous admin routes.
+		mux.Handle("POST /reports", admin(middlewareContext(routes.CreateReportHandler)))
+		mux.Handle("POST /reports/purge", admin(middlewareContext(routes.PurgeReportsHandler)))
+		mux.Handle("PATCH /reports/{id}", admin(middlewareContext(routes.PatchReportHandler)))
+		mux.Handle("DELETE /reports/{id}", admin(middlewareContext(routes.DeleteReportHandler)))
+		mux.Handle("GET /reports/deleted", admin(middlewareContext(routes.GetDeletedReportsHandler)))
+		mux.Handle("GET /audit", admin(middlewareContext(routes.GetAuditHandler)))
+	} else {
+		log.Println("AUTH_METHODS is unset; admin routes are disabled")
+	}
+	mux.Handle("/debug/vars", admin(expvar.Handler().ServeHTTP))
 
 	// Start HTTP server
 	port := os.Getenv("API_PORT")
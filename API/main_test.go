@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/jonathanface/storm-reporter/API/dao"
+	"github.com/jonathanface/storm-reporter/API/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTombstoneDAO(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	defer producer.Close()
+	var keys []string
+	for i := 0; i < 3; i++ {
+		producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+			key, _ := msg.Key.Encode()
+			keys = append(keys, string(key))
+			assert.Equal(t, "processed", msg.Topic)
+			assert.Nil(t, msg.Value, "tombstones have no value")
+			return nil
+		})
+	}
+
+	mockDAO := &dao.MockStormDAO{
+		MockDeleteStormReport: func(id string, source models.ChangeSource) (models.StormReport, error) {
+			if id == "missing" {
+				return models.StormReport{}, models.ErrNotFound
+			}
+			return models.StormReport{ID: id, Deleted: true}, nil
+		},
+		MockPurgeStormReports: func(query models.PurgeQuery, dryRun bool, source models.ChangeSource) (models.PurgeResult, error) {
+			if dryRun {
+				return models.PurgeResult{Matched: 2}, nil
+			}
+			return models.PurgeResult{Matched: 2, Purged: 2, IDs: []string{"b", "c"}}, nil
+		},
+	}
+	producers := 0
+	tombstones := newTombstoneDAO(mockDAO, "processed", func() (sarama.SyncProducer, error) {
+		producers++
+		return producer, nil
+	})
+
+	_, err := tombstones.DeleteStormReport("a", models.ChangeSource{Actor: "admin"})
+	assert.NoError(t, err)
+	_, err = tombstones.DeleteStormReport("missing", models.ChangeSource{Actor: "admin"})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = tombstones.PurgeStormReports(models.PurgeQuery{Synthetic: true}, true, models.ChangeSource{})
+	assert.NoError(t, err)
+	_, err = tombstones.PurgeStormReports(models.PurgeQuery{Synthetic: true}, false, models.ChangeSource{Actor: "admin"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+	assert.Equal(t, 1, producers, "the producer is made once, on first use")
+}
+
+func TestApplyTombstone(t *testing.T) {
+	var gotID string
+	var gotSource models.ChangeSource
+	mockDAO := &dao.MockStormDAO{
+		MockDeleteStormReport: func(id string, source models.ChangeSource) (models.StormReport, error) {
+			gotID, gotSource = id, source
+			switch id {
+			case "gone":
+				return models.StormReport{}, models.ErrNotFound
+			case "broken":
+				return models.StormReport{}, errors.New("mongo unavailable")
+			}
+			return models.StormReport{ID: id, Deleted: true}, nil
+		},
+	}
+
+	err := applyTombstone(mockDAO, &sarama.ConsumerMessage{Key: []byte("abc"), Partition: 0, Offset: 42})
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", gotID)
+	assert.Equal(t, models.ChangeSource{Actor: models.ActorIngest, Reason: "tombstone", KafkaOffset: 42}, gotSource)
+
+	assert.NoError(t, applyTombstone(mockDAO, &sarama.ConsumerMessage{Key: []byte("gone")}), "already deleted")
+	assert.Error(t, applyTombstone(mockDAO, &sarama.ConsumerMessage{Key: []byte("broken")}))
+}
+
+func TestApplyRetraction(t *testing.T) {
+	var gotID string
+	var gotSource models.ChangeSource
+	mockDAO := &dao.MockStormDAO{
+		MockWithdrawStormReport: func(id string, source models.ChangeSource) (models.UpsertResult, error) {
+			gotID, gotSource = id, source
+			if id == "unknown" {
+				return models.UpsertResult{}, models.ErrNotFound
+			}
+			return models.UpsertResult{ID: id, Changed: true}, nil
+		},
+	}
+	retraction := func(value string) *sarama.ConsumerMessage {
+		return &sarama.ConsumerMessage{
+			Key:     []byte("abc"),
+			Value:   []byte(value),
+			Headers: []*sarama.RecordHeader{{Key: []byte("event"), Value: []byte("retraction")}},
+			Offset:  7,
+		}
+	}
+
+	msg := retraction(`{"id":"abc","type":"hail","day":"2024-12-09","snapshotId":"hail-1733773195000"}`)
+	assert.True(t, isRetraction(msg))
+	assert.False(t, isRetraction(&sarama.ConsumerMessage{Value: []byte(`{"id":"abc"}`)}))
+	assert.NoError(t, applyRetraction(mockDAO, msg))
+	assert.Equal(t, "abc", gotID)
+	assert.Equal(t, models.ChangeSource{Actor: models.ActorIngest, Reason: "missing from snapshot hail-1733773195000", KafkaOffset: 7}, gotSource)
+
+	assert.NoError(t, applyRetraction(mockDAO, retraction(`{"id":"unknown"}`)), "never stored")
+	assert.Error(t, applyRetraction(mockDAO, retraction(`not json`)))
+}
+
+// fakeMigrations plans like dao.MongoMigrator over versions 1 to 3, of
+// which applied are done.
+type fakeMigrations struct {
+	applied []int
+	ran     []int
+}
+
+func (f *fakeMigrations) Status(ctx context.Context) ([]dao.MigrationStatus, error) {
+	var statuses []dao.MigrationStatus
+	for v := 1; v <= 3; v++ {
+		status := dao.MigrationStatus{Version: v, Name: fmt.Sprint("m", v)}
+		if slices.Contains(f.applied, v) {
+			status.AppliedAt = &time.Time{}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (f *fakeMigrations) Plan(ctx context.Context, target int) ([]dao.MigrationStep, error) {
+	if target == dao.LatestMigration {
+		target = 3
+	}
+	var steps []dao.MigrationStep
+	for v := 3; v >= 1; v-- {
+		if slices.Contains(f.applied, v) && v > target {
+			steps = append(steps, dao.MigrationStep{Version: v, Name: fmt.Sprint("m", v), Down: true})
+		}
+	}
+	for v := 1; v <= target; v++ {
+		if !slices.Contains(f.applied, v) {
+			steps = append(steps, dao.MigrationStep{Version: v, Name: fmt.Sprint("m", v)})
+		}
+	}
+	return steps, nil
+}
+
+func (f *fakeMigrations) Apply(ctx context.Context, target int, planned []dao.MigrationStep) ([]dao.MigrationStep, error) {
+	steps, _ := f.Plan(ctx, target)
+	if !slices.Equal(steps, planned) {
+		return nil, errors.New("the migrations changed since they were planned")
+	}
+	for _, step := range steps {
+		f.ran = append(f.ran, step.Version)
+	}
+	return steps, nil
+}
+
+func TestRunMigrateCommand(t *testing.T) {
+	var out bytes.Buffer
+	runner := &fakeMigrations{applied: []int{1}}
+	require.NoError(t, runMigrateCommand(runner, []string{"plan"}, &out))
+	assert.Equal(t, "Would apply 2_m2\nWould apply 3_m3\n", out.String())
+	assert.Empty(t, runner.ran)
+
+	out.Reset()
+	require.NoError(t, runMigrateCommand(runner, []string{"apply", "-to", "2"}, &out))
+	assert.Equal(t, "Did apply 2_m2\n", out.String())
+
+	runner = &fakeMigrations{applied: []int{1, 2}}
+	require.NoError(t, runMigrateCommand(runner, []string{"rollback"}, &out))
+	assert.Equal(t, []int{2}, runner.ran, "rollback undoes the latest migration")
+	runner.ran = nil
+	require.NoError(t, runMigrateCommand(runner, []string{"rollback", "-to", "0"}, &out))
+	assert.Equal(t, []int{2, 1}, runner.ran)
+
+	assert.ErrorContains(t, runMigrateCommand(runner, []string{"apply", "-to", "1"}, &out), "use rollback")
+	assert.ErrorContains(t, runMigrateCommand(runner, []string{"rollback", "-to", "3"}, &out), "use apply")
+	assert.ErrorContains(t, runMigrateCommand(&fakeMigrations{}, []string{"rollback"}, &out), "no migrations")
+	runner.ran = nil
+	for _, to := range []string{"-1", "-2"} {
+		assert.ErrorContains(t, runMigrateCommand(runner, []string{"apply", "-to", to}, &out), "must not be negative")
+	}
+	assert.Empty(t, runner.ran)
+	assert.Error(t, runMigrateCommand(runner, []string{"redo"}, &out))
+}
@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+const principalKey contextKey = "principal"
+
+// ErrNoCredentials is returned by an Authenticator when the request carries
+// none of the credentials it understands.
+var ErrNoCredentials = errors.New("no credentials")
+
+// ErrAuthUnavailable is wrapped by an Authenticator when credentials can't
+// be checked at all, e.g. because the key store is down.
+var ErrAuthUnavailable = errors.New("authentication unavailable")
+
+// Authenticator identifies the caller of a request. It returns
+// ErrNoCredentials when the request has nothing for it to check, an error
+// wrapping ErrAuthUnavailable when it can't check them, and any other error
+// when the credentials it found are invalid.
+type Authenticator func(r *http.Request) (*models.Principal, error)
+
+// APIKeyAuthenticator checks the X-API-Key header against the store. Keys
+// aren't read from the query string, which ends up in access logs.
+func APIKeyAuthenticator(store models.APIKeyStore) Authenticator {
+	return func(r *http.Request) (*models.Principal, error) {
+		plaintext := r.Header.Get("X-API-Key")
+		if plaintext == "" {
+			return nil, ErrNoCredentials
+		}
+		key, err := store.GetAPIKeyByHash(models.HashAPIKey(plaintext))
+		if errors.Is(err, models.ErrNotFound) || (err == nil && key.RevokedAt != nil) {
+			return nil, errors.New("invalid or revoked API key")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to look up API key: %w", ErrAuthUnavailable, err)
+		}
+		return &models.Principal{Subject: key.Name, KeyID: key.ID, Scopes: key.Scopes}, nil
+	}
+}
+
+// FirstOf tries each authenticator in turn, moving on only when one finds
+// no credentials.
+func FirstOf(authenticators ...Authenticator) Authenticator {
+	return func(r *http.Request) (*models.Principal, error) {
+		for _, auth := range authenticators {
+			principal, err := auth(r)
+			if !errors.Is(err, ErrNoCredentials) {
+				return principal, err
+			}
+		}
+		return nil, ErrNoCredentials
+	}
+}
+
+// RequireScope rejects requests whose caller can't be authenticated or
+// lacks scope, and puts the caller's Principal in the request context.
+// When credentials can't be checked it answers 503 and logs why, without
+// telling the caller.
+func RequireScope(auth Authenticator, scope models.Scope) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			principal, err := auth(r)
+			if errors.Is(err, ErrNoCredentials) {
+				w.Header().Set("WWW-Authenticate", challenge(r))
+				WriteError(w, http.StatusUnauthorized, "missing_credentials", "This endpoint requires an API key or bearer token")
+				return
+			}
+			if errors.Is(err, ErrAuthUnavailable) {
+				log.Printf("Failed to authenticate request: %v", err)
+				WriteError(w, http.StatusServiceUnavailable, "auth_unavailable", "Credentials can't be checked right now; try again later")
+				return
+			}
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", challenge(r))
+				WriteError(w, http.StatusUnauthorized, "invalid_credentials", err.Error())
+				return
+			}
+			if !principal.HasScope(scope) {
+				WriteError(w, http.StatusForbidden, "insufficient_scope", "This endpoint requires the '"+string(scope)+"' scope")
+				return
+			}
+			ctx := context.WithValue(r.Context(), principalKey, principal)
+			next(w, r.WithContext(ctx))
+		}
+	}
+}
+
+func challenge(r *http.Request) string {
+	if bearerToken(r) != "" {
+		return `Bearer realm="storm-reporter", error="invalid_token"`
+	}
+	return `ApiKey realm="storm-reporter"`
+}
+
+// GetPrincipal returns the authenticated caller, or nil when the route
+// isn't behind RequireScope.
+func GetPrincipal(ctx context.Context) *models.Principal {
+	principal, _ := ctx.Value(principalKey).(*models.Principal)
+	return principal
+}
+
+type errorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// WriteError writes a JSON error of the form
+// {"error": {"code": "...", "message": "..."}}.
+func WriteError(w http.ResponseWriter, status int, code, message string) {
+	var body errorBody
+	body.Error.Code = code
+	body.Error.Message = strings.TrimSpace(message)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
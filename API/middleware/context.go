@@ -4,15 +4,19 @@ import (
 	"context"
 	"net/http"
 
+	"github.com/jonathanface/storm-reporter/API/broadcast"
 	"github.com/jonathanface/storm-reporter/API/models"
 )
 
 type contextKey string
 
-const daoKey contextKey = "dao"
+const (
+	daoKey         contextKey = "dao"
+	broadcasterKey contextKey = "broadcaster"
+)
 
 func WithDAOContext(dao models.StormDAOInterface) func(http.HandlerFunc) http.HandlerFunc {
-	// Normally would put some kind of auth here, but for now just return a middleware that sets the DAO in the context
+	// Authentication lives in RequireScope; this only sets the DAO in the context
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
 			ctx := context.WithValue(r.Context(), daoKey, dao)
@@ -28,3 +32,22 @@ func GetDAO(ctx context.Context) models.StormDAOInterface {
 	}
 	return dao
 }
+
+// WithBroadcasterContext makes the live report broadcaster available to the
+// streaming handlers.
+func WithBroadcasterContext(b *broadcast.Broadcaster) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), broadcasterKey, b)
+			next(w, r.WithContext(ctx))
+		}
+	}
+}
+
+func GetBroadcaster(ctx context.Context) *broadcast.Broadcaster {
+	b, ok := ctx.Value(broadcasterKey).(*broadcast.Broadcaster)
+	if !ok {
+		panic("Broadcaster not found in context")
+	}
+	return b
+}
@@ -1,21 +1,29 @@
 package middleware_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/jonathanface/storm-reporter/API/dao"
 	"github.com/jonathanface/storm-reporter/API/middleware"
+	"github.com/jonathanface/storm-reporter/API/middleware/jwttest"
 	"github.com/jonathanface/storm-reporter/API/models"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestWithDAOContext(t *testing.T) {
 	mockDAO := &dao.MockStormDAO{
-		MockGetStormReports: func(start string, end string) ([]models.StormReport, error) {
+		MockGetStormReports: func(query models.StormQuery) ([]models.StormReport, error) {
 			return []models.StormReport{
-				{Date: "2024-12-09", Location: "Test City", Type: "tornado"},
+				{Date: "1733702400", Location: "Test City", Type: "tornado"},
 			}, nil
 		},
 	}
@@ -25,7 +33,7 @@ func TestWithDAOContext(t *testing.T) {
 
 	handler := middleware.WithDAOContext(mockDAO)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		dao := middleware.GetDAO(r.Context())
-		reports, err := dao.GetStormReports("2024-12-09", "2024-12-09")
+		reports, err := dao.GetStormReports(context.Background(), models.DayQuery(time.Unix(1733702400, 0)))
 		assert.NoError(t, err)
 		assert.Equal(t, 1, len(reports))
 		assert.Equal(t, "Test City", reports[0].Location)
@@ -36,3 +44,365 @@ func TestWithDAOContext(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, w.Code, "Response code should be 200")
 }
+
+func TestRequireScope(t *testing.T) {
+	revokedAt := time.Now()
+	keys := map[string]*models.APIKey{
+		models.HashAPIKey("reader"):  {ID: "r1", Name: "reader", Scopes: []models.Scope{models.ScopeRead}},
+		models.HashAPIKey("admin"):   {ID: "a1", Name: "admin", Scopes: []models.Scope{models.ScopeAdmin}},
+		models.HashAPIKey("revoked"): {ID: "x1", Name: "revoked", Scopes: []models.Scope{models.ScopeRead}, RevokedAt: &revokedAt},
+	}
+	store := &dao.MockAPIKeyStore{
+		MockGetAPIKeyByHash: func(hash string) (*models.APIKey, error) {
+			if key, ok := keys[hash]; ok {
+				return key, nil
+			}
+			if hash == models.HashAPIKey("outage") {
+				return nil, errors.New("dial tcp 10.0.0.3:27017: connection refused")
+			}
+			return nil, models.ErrNotFound
+		},
+	}
+
+	var principal *models.Principal
+	handler := middleware.RequireScope(middleware.APIKeyAuthenticator(store), models.ScopeStream)(func(w http.ResponseWriter, r *http.Request) {
+		principal = middleware.GetPrincipal(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		key    string
+		status int
+		code   string
+	}{
+		{"missing", "/messages/stream", "", http.StatusUnauthorized, "missing_credentials"},
+		{"unknown", "/messages/stream", "nope", http.StatusUnauthorized, "invalid_credentials"},
+		{"revoked", "/messages/stream", "revoked", http.StatusUnauthorized, "invalid_credentials"},
+		{"insufficient", "/messages/stream", "reader", http.StatusForbidden, "insufficient_scope"},
+		{"admin header", "/messages/stream", "admin", http.StatusOK, ""},
+		{"query ignored", "/messages/stream?api_key=admin", "", http.StatusUnauthorized, "missing_credentials"},
+		{"store down", "/messages/stream", "outage", http.StatusServiceUnavailable, "auth_unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal = nil
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.key != "" {
+				req.Header.Set("X-API-Key", tt.key)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.status, w.Code)
+			if tt.status == http.StatusOK {
+				if assert.NotNil(t, principal) {
+					assert.Equal(t, "a1", principal.KeyID)
+				}
+				return
+			}
+			var body struct {
+				Error struct {
+					Code    string `json:"code"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+			assert.Equal(t, tt.code, body.Error.Code)
+			assert.NotContains(t, body.Error.Message, "10.0.0.3", "Expected store errors not to reach the caller")
+			assert.Nil(t, principal)
+		})
+	}
+}
+
+func TestBearerAuthenticator(t *testing.T) {
+	issuer, err := jwttest.NewIssuer("https://sso.example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer issuer.Close()
+	other, err := jwttest.NewIssuer("https://sso.example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer other.Close()
+
+	keys, err := middleware.LoadJWKS(issuer.JWKSURL())
+	if !assert.NoError(t, err) {
+		return
+	}
+	roleScopes, err := middleware.ParseRoleScopes("viewer=read; analyst=read,export,stream")
+	if !assert.NoError(t, err) {
+		return
+	}
+	auth := middleware.BearerAuthenticator(middleware.JWTConfig{
+		Keys:       keys,
+		Issuer:     "https://sso.example.com",
+		Audience:   "storm-reporter",
+		RolesClaim: "realm_access.roles",
+		RoleScopes: roleScopes,
+	})
+
+	sign := func(issuer *jwttest.Issuer, claims jwt.MapClaims) string {
+		base := jwt.MapClaims{"sub": "alice", "aud": "storm-reporter", "realm_access": map[string]interface{}{"roles": []string{"analyst", "unmapped"}}}
+		for k, v := range claims {
+			base[k] = v
+		}
+		token, err := issuer.Token(base)
+		assert.NoError(t, err)
+		return token
+	}
+	authenticate := func(token string) (*models.Principal, error) {
+		req := httptest.NewRequest(http.MethodGet, "/messages", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return auth(req)
+	}
+
+	principal, err := authenticate(sign(issuer, nil))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", principal.Subject)
+		assert.Equal(t, []string{"analyst", "unmapped"}, principal.Roles)
+		assert.Equal(t, []models.Scope{models.ScopeRead, models.ScopeExport, models.ScopeStream}, principal.Scopes)
+	}
+
+	// Tokens are only read from the query string on routes that allow it.
+	req := httptest.NewRequest(http.MethodGet, "/messages?access_token="+sign(issuer, nil), nil)
+	_, err = auth(req)
+	assert.ErrorIs(t, err, middleware.ErrNoCredentials, "query parameter token")
+	middleware.AllowQueryToken(func(w http.ResponseWriter, r *http.Request) {
+		_, err = auth(r)
+	})(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/messages/stream?access_token="+sign(issuer, nil), nil))
+	assert.NoError(t, err, "query parameter token on a stream route")
+
+	_, err = auth(httptest.NewRequest(http.MethodGet, "/messages", nil))
+	assert.ErrorIs(t, err, middleware.ErrNoCredentials)
+
+	// other's first key shares issuer's kid, test-1, so its token has a bad
+	// signature; after rotating, it signs with test-2, which issuer lacks.
+	badSignature := sign(other, nil)
+	assert.NoError(t, other.Rotate())
+	unknownKey := sign(other, nil)
+	_, err = authenticate(unknownKey)
+	assert.ErrorContains(t, err, `unknown signing key "test-2"`)
+	for name, token := range map[string]string{
+		"expired":       sign(issuer, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}),
+		"no expiry":     sign(issuer, jwt.MapClaims{"exp": nil}),
+		"wrong issuer":  sign(issuer, jwt.MapClaims{"iss": "https://evil.example.com"}),
+		"wrong aud":     sign(issuer, jwt.MapClaims{"aud": "someone-else"}),
+		"bad signature": badSignature,
+		"unknown key":   unknownKey,
+		"garbage":       "not.a.token",
+	} {
+		_, err := authenticate(token)
+		assert.Error(t, err, name)
+		assert.NotErrorIs(t, err, middleware.ErrNoCredentials, name)
+	}
+
+	// Rotated keys are picked up by refetching the JWKS.
+	refresh := middleware.JWKSRefreshInterval
+	middleware.JWKSRefreshInterval = 0
+	defer func() { middleware.JWKSRefreshInterval = refresh }()
+	assert.NoError(t, issuer.Rotate())
+	_, err = authenticate(sign(issuer, nil))
+	assert.NoError(t, err, "rotated key")
+
+	// A bearer token that fails is reported as such, even with API keys
+	// configured first.
+	handler := middleware.RequireScope(middleware.FirstOf(middleware.APIKeyAuthenticator(&dao.MockAPIKeyStore{}), auth), models.ScopeAdmin)(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	for token, status := range map[string]int{sign(issuer, nil): http.StatusForbidden, "bogus": http.StatusUnauthorized} {
+		req := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, status, w.Code)
+		if status == http.StatusUnauthorized {
+			assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer")
+		}
+	}
+}
+
+func TestJWKS_Refresh(t *testing.T) {
+	issuer, err := jwttest.NewIssuer("https://sso.example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer issuer.Close()
+	var fetches atomic.Int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write(issuer.JWKS())
+	}))
+	defer server.Close()
+
+	refresh := middleware.JWKSRefreshInterval
+	middleware.JWKSRefreshInterval = 50 * time.Millisecond
+	defer func() { middleware.JWKSRefreshInterval = refresh }()
+	keys, err := middleware.LoadJWKS(server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Unknown keys don't refetch until the interval has passed, and then
+	// concurrent lookups share one fetch.
+	_, err = keys.Key("forged")
+	assert.ErrorContains(t, err, "unknown signing key")
+	assert.Equal(t, int32(1), fetches.Load())
+	time.Sleep(60 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys.Key("forged")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), fetches.Load())
+
+	// A failed fetch counts too, and is reported as unavailable rather
+	// than as a bad key.
+	time.Sleep(60 * time.Millisecond)
+	failing.Store(true)
+	_, err = keys.Key("forged")
+	assert.ErrorIs(t, err, middleware.ErrAuthUnavailable)
+	_, err = keys.Key("forged")
+	assert.ErrorContains(t, err, "unknown signing key")
+	assert.Equal(t, int32(3), fetches.Load())
+}
+
+func TestRateLimited(t *testing.T) {
+	limits, err := middleware.ParseRateLimits("list=2/h; export=10/s:1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, middleware.RateLimit{Rate: 2.0 / 3600, Burst: 2}, limits["list"])
+	assert.Equal(t, middleware.RateLimit{Rate: 10, Burst: 1}, limits["export"])
+	for _, bad := range []string{"list", "list=2", "list=0/s", "list=2/d", "list=2/s:x"} {
+		_, err := middleware.ParseRateLimits(bad)
+		assert.Error(t, err, bad)
+	}
+
+	handler := middleware.RateLimited(middleware.NewRateLimiter(limits["list"]))(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/messages", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for i, remaining := range []string{"1", "0"} {
+		w := request("10.0.0.1:1234")
+		assert.Equal(t, http.StatusOK, w.Code, "request %d", i)
+		assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, remaining, w.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "2;w=3600", w.Header().Get("RateLimit-Policy"))
+	}
+	w := request("10.0.0.1:5678")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1800", w.Header().Get("Retry-After"))
+	assert.Equal(t, "3600", w.Header().Get("RateLimit-Reset"))
+	assert.Contains(t, w.Body.String(), `"rate_limited"`)
+
+	// Other clients have their own buckets.
+	assert.Equal(t, http.StatusOK, request("10.0.0.2:1234").Code)
+}
+
+func TestClientID(t *testing.T) {
+	header, proxies := middleware.ClientIPHeader, middleware.TrustedProxies
+	t.Cleanup(func() { middleware.ClientIPHeader, middleware.TrustedProxies = header, proxies })
+	var err error
+	middleware.ClientIPHeader = "X-Real-IP"
+	middleware.TrustedProxies, err = middleware.ParseTrustedProxies("172.16.0.0/12, 10.0.0.5")
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, bad := range []string{"proxy", "10.0.0.0/40"} {
+		_, err := middleware.ParseTrustedProxies(bad)
+		assert.Error(t, err, bad)
+	}
+
+	client := func(remoteAddr string) string {
+		req := httptest.NewRequest(http.MethodGet, "/messages", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Real-IP", "203.0.113.7")
+		return middleware.ClientID(req)
+	}
+	assert.Equal(t, "ip:203.0.113.7", client("172.18.0.3:5000"), "from a trusted proxy")
+	assert.Equal(t, "ip:203.0.113.7", client("10.0.0.5:5000"))
+	assert.Equal(t, "ip:198.51.100.1", client("198.51.100.1:5000"), "the header is ignored from anyone else")
+}
+
+func TestDailyQuota(t *testing.T) {
+	usage := map[string]int64{}
+	store := &dao.MockUsageStore{
+		MockAddUsage: func(client, kind, day string, n int64) (int64, error) {
+			assert.Equal(t, "export", kind)
+			assert.Equal(t, time.Now().UTC().Format(time.DateOnly), day)
+			usage[client] += n
+			return usage[client], nil
+		},
+	}
+	handler := middleware.DailyQuota(store, "export", 2)(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	keys := &dao.MockAPIKeyStore{
+		MockGetAPIKeyByHash: func(hash string) (*models.APIKey, error) {
+			return &models.APIKey{ID: "k1", Scopes: []models.Scope{models.ScopeExport}}, nil
+		},
+	}
+	authed := middleware.RequireScope(middleware.APIKeyAuthenticator(keys), models.ScopeExport)(handler)
+
+	// Failed requests aren't counted.
+	req := httptest.NewRequest(http.MethodGet, "/export?format=bad", nil)
+	req.Header.Set("X-API-Key", "any")
+	authed.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Zero(t, usage["key:k1"])
+
+	for i, remaining := range []string{"1", "0"} {
+		req := httptest.NewRequest(http.MethodGet, "/export", nil)
+		req.Header.Set("X-API-Key", "any")
+		w := httptest.NewRecorder()
+		authed.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, "export %d", i)
+		assert.Equal(t, remaining, w.Header().Get("X-Quota-Remaining"))
+	}
+	req = httptest.NewRequest(http.MethodGet, "/export", nil)
+	req.Header.Set("X-API-Key", "any")
+	w := httptest.NewRecorder()
+	authed.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"quota_exceeded"`)
+	assert.Equal(t, int64(2), usage["key:k1"])
+
+	// Anonymous callers are counted by address.
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/export", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(1), usage["ip:192.0.2.1"])
+
+	// Without the store the quota can't be enforced, so nothing is served.
+	store.MockAddUsage = func(client, kind, day string, n int64) (int64, error) {
+		return 0, errors.New("connection refused")
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/export", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"quota_unavailable"`)
+}
@@ -0,0 +1,218 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// JWKSRefreshInterval limits how often a JWKS URL is refetched when a token
+// names a key we don't have, so forged key IDs can't hammer the issuer. It
+// counts from the last attempt, whether or not it succeeded.
+var JWKSRefreshInterval = time.Minute
+
+// JWKS is a set of public keys for verifying token signatures, loaded from
+// a JSON Web Key Set file or URL. URL-backed sets are refetched when a token
+// is signed with a key they don't contain, which picks up key rotation.
+type JWKS struct {
+	source string
+	client *http.Client
+
+	// refreshes makes concurrent lookups of unknown keys share one fetch.
+	refreshes singleflight.Group
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	attemptedAt time.Time
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS reads a key set from source, an http(s) URL or a file path.
+func LoadJWKS(source string) (*JWKS, error) {
+	set := &JWKS{source: source, client: &http.Client{Timeout: 10 * time.Second}, attemptedAt: time.Now()}
+	if err := set.refresh(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// ParseJWKS builds a fixed key set from a JWKS document.
+func ParseJWKS(data []byte) (*JWKS, error) {
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return &JWKS{keys: keys}, nil
+}
+
+// Key returns the public key with the given key ID. An unknown ID refetches
+// a URL-backed set at most once per JWKSRefreshInterval; if that fails the
+// error wraps ErrAuthUnavailable.
+func (s *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	key, ok := s.keys[kid]
+	stale := s.isURL() && time.Since(s.attemptedAt) >= JWKSRefreshInterval
+	s.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if stale {
+		_, err, _ := s.refreshes.Do("", func() (interface{}, error) {
+			// Another lookup may have refetched since this one checked.
+			s.mu.Lock()
+			if time.Since(s.attemptedAt) < JWKSRefreshInterval {
+				s.mu.Unlock()
+				return nil, nil
+			}
+			s.attemptedAt = time.Now()
+			s.mu.Unlock()
+			return nil, s.refresh()
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrAuthUnavailable, err)
+		}
+		s.mu.Lock()
+		key, ok = s.keys[kid]
+		s.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (s *JWKS) isURL() bool {
+	return strings.HasPrefix(s.source, "http://") || strings.HasPrefix(s.source, "https://")
+}
+
+func (s *JWKS) refresh() error {
+	var data []byte
+	var err error
+	if s.isURL() {
+		data, err = s.fetch()
+	} else {
+		data, err = os.ReadFile(s.source)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load JWKS from %s: %w", s.source, err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("failed to load JWKS from %s: %w", s.source, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	return nil
+}
+
+func (s *JWKS) fetch() ([]byte, error) {
+	resp, err := s.client.Get(s.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range doc.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no signing keys")
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
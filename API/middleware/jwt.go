@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+// DefaultRoleScopes maps roles named after scopes to those scopes.
+var DefaultRoleScopes = map[string][]models.Scope{
+	"read":   {models.ScopeRead},
+	"export": {models.ScopeExport},
+	"stream": {models.ScopeStream},
+	"admin":  {models.ScopeAdmin},
+}
+
+// JWTConfig describes which bearer tokens to accept.
+type JWTConfig struct {
+	Keys     *JWKS
+	Issuer   string
+	Audience string
+	// RolesClaim is the claim holding the caller's roles, as a list or a
+	// space-separated string. Dots reach into nested objects, as in
+	// Keycloak's "realm_access.roles". Defaults to "roles".
+	RolesClaim string
+	// RoleScopes grants scopes to roles; roles it doesn't list grant
+	// nothing. Defaults to DefaultRoleScopes.
+	RoleScopes map[string][]models.Scope
+	// Leeway allows for clock skew when checking exp and nbf.
+	Leeway time.Duration
+}
+
+// BearerAuthenticator accepts signed JWTs from the Authorization header,
+// or from an access_token query parameter on routes behind AllowQueryToken.
+func BearerAuthenticator(cfg JWTConfig) Authenticator {
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "roles"
+	}
+	if cfg.RoleScopes == nil {
+		cfg.RoleScopes = DefaultRoleScopes
+	}
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(cfg.Issuer),
+		jwt.WithAudience(cfg.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.Leeway),
+	)
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return cfg.Keys.Key(kid)
+	}
+
+	return func(r *http.Request) (*models.Principal, error) {
+		raw := bearerToken(r)
+		if raw == "" {
+			return nil, ErrNoCredentials
+		}
+		claims := jwt.MapClaims{}
+		if _, err := parser.ParseWithClaims(raw, claims, keyFunc); err != nil {
+			return nil, fmt.Errorf("invalid bearer token: %w", err)
+		}
+
+		subject, _ := claims.GetSubject()
+		principal := &models.Principal{Subject: subject, Roles: claimStrings(lookupClaim(claims, cfg.RolesClaim))}
+		seen := map[models.Scope]bool{}
+		for _, role := range principal.Roles {
+			for _, scope := range cfg.RoleScopes[role] {
+				if !seen[scope] {
+					seen[scope] = true
+					principal.Scopes = append(principal.Scopes, scope)
+				}
+			}
+		}
+		return principal, nil
+	}
+}
+
+// ParseRoleScopes reads a role mapping of the form
+// "viewer=read;analyst=read,export,stream".
+func ParseRoleScopes(s string) (map[string][]models.Scope, error) {
+	mapping := map[string][]models.Scope{}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		role, scopes, ok := strings.Cut(entry, "=")
+		role = strings.TrimSpace(role)
+		if !ok || role == "" {
+			return nil, fmt.Errorf("invalid role mapping %q", entry)
+		}
+		for _, s := range strings.Split(scopes, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			scope, err := models.ParseScope(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid role mapping %q: %w", entry, err)
+			}
+			mapping[role] = append(mapping[role], scope)
+		}
+	}
+	if len(mapping) == 0 {
+		return nil, errors.New("role mapping is empty")
+	}
+	return mapping, nil
+}
+
+const queryTokenKey contextKey = "queryToken"
+
+// AllowQueryToken lets requests to next carry their bearer token in an
+// access_token query parameter. It's for the SSE and WebSocket routes,
+// whose browser clients can't set headers; elsewhere tokens are only read
+// from the Authorization header, as query strings end up in access logs.
+func AllowQueryToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r.WithContext(context.WithValue(r.Context(), queryTokenKey, true)))
+	}
+}
+
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if allowed, _ := r.Context().Value(queryTokenKey).(bool); allowed {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+func lookupClaim(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = obj[part]
+	}
+	return value
+}
+
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
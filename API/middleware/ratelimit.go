@@ -0,0 +1,277 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+// ClientIPHeader names a header set by a trusted proxy, such as X-Real-IP,
+// that holds the client's address. For lists like X-Forwarded-For the last
+// entry, the one the proxy added, is used. The header is only read from
+// requests whose connection comes from one of TrustedProxies; otherwise,
+// and when ClientIPHeader is empty, the connection's remote address is used.
+var (
+	ClientIPHeader = ""
+	TrustedProxies []*net.IPNet
+)
+
+// ParseTrustedProxies reads a comma-separated list of addresses and CIDR
+// ranges, such as "10.0.0.0/8,192.168.1.5".
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// RateLimit is a token bucket: clients may make Burst requests at once and
+// regain Rate requests per second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimits reads per-class limits of the form
+// "list=10/s:20;export=2/m;stream=30/h:5". Rates are per second, minute or
+// hour; the burst after the colon defaults to the rate's count.
+func ParseRateLimits(s string) (map[string]RateLimit, error) {
+	limits := map[string]RateLimit{}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		class, spec, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(class) == "" {
+			return nil, fmt.Errorf("invalid rate limit %q", entry)
+		}
+		rate, burst, hasBurst := strings.Cut(spec, ":")
+		count, unit, ok := strings.Cut(rate, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q: expected count/unit", entry)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid rate limit %q: bad count", entry)
+		}
+		var per time.Duration
+		switch strings.TrimSpace(unit) {
+		case "s":
+			per = time.Second
+		case "m":
+			per = time.Minute
+		case "h":
+			per = time.Hour
+		default:
+			return nil, fmt.Errorf("invalid rate limit %q: unit must be s, m or h", entry)
+		}
+		limit := RateLimit{Rate: float64(n) / per.Seconds(), Burst: n}
+		if hasBurst {
+			if limit.Burst, err = strconv.Atoi(strings.TrimSpace(burst)); err != nil || limit.Burst <= 0 {
+				return nil, fmt.Errorf("invalid rate limit %q: bad burst", entry)
+			}
+		}
+		limits[strings.TrimSpace(class)] = limit
+	}
+	return limits, nil
+}
+
+// RateLimiter keeps a token bucket per client.
+type RateLimiter struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{limit: limit, buckets: map[string]*bucket{}, lastSweep: time.Now()}
+}
+
+// allow takes a token from the client's bucket. It returns the tokens left,
+// how long until the bucket is full again and, when no token was available,
+// how long until one is.
+func (l *RateLimiter) allow(client string, now time.Time) (remaining int, reset, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := float64(l.limit.Burst)
+	refill := time.Duration(burst / l.limit.Rate * float64(time.Second))
+	if now.Sub(l.lastSweep) > refill {
+		// Buckets that have refilled are indistinguishable from new ones.
+		for key, b := range l.buckets {
+			if now.Sub(b.last) > refill {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		retryAfter = time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	} else {
+		b.tokens--
+	}
+	reset = time.Duration((burst - b.tokens) / l.limit.Rate * float64(time.Second))
+	return int(b.tokens), reset, retryAfter
+}
+
+// RateLimited rejects requests from clients that have run out of tokens
+// with 429 Too Many Requests. Clients are told where they stand with
+// RateLimit-* headers on every response. Put it behind RequireScope so
+// clients are told apart by key rather than address.
+func RateLimited(l *RateLimiter) func(http.HandlerFunc) http.HandlerFunc {
+	policy := fmt.Sprintf("%d;w=%d", l.limit.Burst, ceilSeconds(time.Duration(float64(l.limit.Burst)/l.limit.Rate*float64(time.Second))))
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			remaining, reset, retryAfter := l.allow(ClientID(r), time.Now())
+			w.Header().Set("RateLimit-Policy", policy)
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(l.limit.Burst))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+			if retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+				WriteError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests; retry after the time in Retry-After")
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// DailyQuota allows each client limit successful requests of kind per UTC
+// day, counted in store. Each request reserves its place in the count
+// before the handler runs, so concurrent requests can't overrun the quota,
+// and gives it back if it's refused or the handler answers with a status of
+// 400 or above, so failed requests are free. Clients are told where they
+// stand with X-Quota-* headers. If the store can't be reached the request
+// is refused with 503, since the quota can't be enforced.
+func DailyQuota(store models.UsageStore, kind string, limit int64) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now().UTC()
+			client, day := ClientID(r), now.Format(time.DateOnly)
+			used, err := store.AddUsage(client, kind, day, 1)
+			if err != nil {
+				log.Printf("Failed to check %s quota: %v", kind, err)
+				WriteError(w, http.StatusServiceUnavailable, "quota_unavailable", fmt.Sprintf("The %s quota can't be checked; try again later", kind))
+				return
+			}
+			refund := func() {
+				if _, err := store.AddUsage(client, kind, day, -1); err != nil {
+					log.Printf("Failed to refund %s usage: %v", kind, err)
+				}
+			}
+			midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+			w.Header().Set("X-Quota-Limit", strconv.FormatInt(limit, 10))
+			w.Header().Set("X-Quota-Remaining", strconv.FormatInt(max(limit-used, 0), 10))
+			w.Header().Set("X-Quota-Reset", strconv.Itoa(ceilSeconds(midnight.Sub(now))))
+			if used > limit {
+				refund()
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(midnight.Sub(now))))
+				WriteError(w, http.StatusTooManyRequests, "quota_exceeded", fmt.Sprintf("Daily %s quota of %d used up", kind, limit))
+				return
+			}
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next(sw, r)
+			if sw.status >= http.StatusBadRequest {
+				refund()
+			}
+		}
+	}
+}
+
+// statusWriter remembers the status a handler responded with.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ClientID identifies who a request counts against: the API key or token
+// subject when the caller is authenticated, otherwise their address.
+func ClientID(r *http.Request) string {
+	if principal := GetPrincipal(r.Context()); principal != nil {
+		if principal.KeyID != "" {
+			return "key:" + principal.KeyID
+		}
+		return "sub:" + principal.Subject
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ClientIPHeader != "" && trustedProxy(host) {
+		addrs := strings.Split(r.Header.Get(ClientIPHeader), ",")
+		if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+			return "ip:" + ip
+		}
+	}
+	return "ip:" + host
+}
+
+func trustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	for _, network := range TrustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
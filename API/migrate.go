@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/dao"
+)
+
+const migrateUsage = `usage:
+  api-service migrate status
+  api-service migrate plan [-to <version>]
+  api-service migrate apply [-to <version>]
+  api-service migrate rollback [-to <version>]`
+
+// migrationRunner is the part of dao.MongoMigrator the migrate command uses.
+type migrationRunner interface {
+	Status(ctx context.Context) ([]dao.MigrationStatus, error)
+	Plan(ctx context.Context, target int) ([]dao.MigrationStep, error)
+	Apply(ctx context.Context, target int, planned []dao.MigrationStep) ([]dao.MigrationStep, error)
+}
+
+// runMigrateCommand lists, plans, applies and rolls back the MongoDB
+// migrations. apply targets the latest migration and rollback the one
+// before the latest applied, unless -to says otherwise.
+func runMigrateCommand(runner migrationRunner, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	ctx := context.TODO()
+
+	if args[0] == "status" {
+		statuses, err := runner.Status(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := "-"
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.Format(time.RFC3339)
+			}
+			if status.Unknown {
+				applied += " (unknown to this release)"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return tw.Flush()
+	}
+
+	if args[0] != "plan" && args[0] != "apply" && args[0] != "rollback" {
+		return errors.New(migrateUsage)
+	}
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	to := flags.Int("to", 0, "version to migrate to, by default the latest or, for rollback, the one before the latest applied; 0 rolls back every migration")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	toSet := false
+	flags.Visit(func(f *flag.Flag) { toSet = toSet || f.Name == "to" })
+	target := dao.LatestMigration
+	if toSet {
+		if *to < 0 {
+			return fmt.Errorf("migrate %s: -to must not be negative", args[0])
+		}
+		target = *to
+	} else if args[0] == "rollback" {
+		var err error
+		if target, err = previousVersion(ctx, runner); err != nil {
+			return err
+		}
+	}
+
+	steps, err := runner.Plan(ctx, target)
+	if err != nil {
+		return fmt.Errorf("migrate %s: %w", args[0], err)
+	}
+	for _, step := range steps {
+		if args[0] == "apply" && step.Down {
+			return fmt.Errorf("migrate apply: reaching version %d would %s; use rollback", target, step)
+		}
+		if args[0] == "rollback" && !step.Down {
+			return fmt.Errorf("migrate rollback: reaching version %d would %s; use apply", target, step)
+		}
+	}
+	if len(steps) == 0 {
+		fmt.Fprintln(out, "Nothing to migrate.")
+		return nil
+	}
+	if args[0] == "plan" {
+		for _, step := range steps {
+			fmt.Fprintf(out, "Would %s\n", step)
+		}
+		return nil
+	}
+
+	// Only the steps checked above are taken, even if another replica
+	// migrates first.
+	steps, err = runner.Apply(ctx, target, steps)
+	for _, step := range steps {
+		fmt.Fprintf(out, "Did %s\n", step)
+	}
+	return err
+}
+
+// previousVersion returns the version just below the latest applied
+// migration this release knows, the target that rolls that one back.
+func previousVersion(ctx context.Context, runner migrationRunner) (int, error) {
+	statuses, err := runner.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var applied []int
+	for _, status := range statuses {
+		if status.AppliedAt != nil && !status.Unknown {
+			applied = append(applied, status.Version)
+		}
+	}
+	if len(applied) == 0 {
+		return 0, errors.New("migrate rollback: no migrations have been applied")
+	}
+	if len(applied) == 1 {
+		return 0, nil
+	}
+	return applied[len(applied)-2], nil
+}
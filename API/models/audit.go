@@ -0,0 +1,57 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrConflict is returned by DAOs when creating a report that already exists.
+var ErrConflict = errors.New("already exists")
+
+// ErrStaleRevision is returned by DAOs when updating a report from a
+// revision that is no longer the stored one.
+var ErrStaleRevision = errors.New("changed since it was read")
+
+type AuditAction string
+
+const (
+	AuditCreate AuditAction = "create"
+	AuditUpdate AuditAction = "update"
+	AuditDelete AuditAction = "delete"
+	AuditPurge  AuditAction = "purge"
+)
+
+func ParseAuditAction(s string) (AuditAction, error) {
+	switch action := AuditAction(s); action {
+	case AuditCreate, AuditUpdate, AuditDelete, AuditPurge:
+		return action, nil
+	}
+	return "", errors.New("must be create, update, delete or purge")
+}
+
+// AuditEntry records an administrative change to a report: who made it,
+// when and why, and the report before and after. Purges touch many reports,
+// so they record the query and its result instead.
+type AuditEntry struct {
+	Action   AuditAction            `json:"action" bson:"action"`
+	ReportID string                 `json:"reportId,omitempty" bson:"reportId,omitempty"`
+	Actor    string                 `json:"actor" bson:"actor"`
+	Reason   string                 `json:"reason" bson:"reason"`
+	Before   *StormReport           `json:"before,omitempty" bson:"before,omitempty"`
+	After    *StormReport           `json:"after,omitempty" bson:"after,omitempty"`
+	Changes  map[string]FieldChange `json:"changes,omitempty" bson:"changes,omitempty"`
+	Purge    *PurgeQuery            `json:"purge,omitempty" bson:"purge,omitempty"`
+	Result   *PurgeResult           `json:"result,omitempty" bson:"result,omitempty"`
+	At       time.Time              `json:"at" bson:"at"`
+}
+
+// AuditQuery selects audit entries. Zero fields match everything; entries
+// come back newest first, at most Limit of them.
+type AuditQuery struct {
+	ReportID string
+	Actor    string
+	Action   AuditAction
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Scope string
+
+const (
+	ScopeRead   Scope = "read"
+	ScopeExport Scope = "export"
+	ScopeStream Scope = "stream"
+	// ScopeAdmin grants every other scope.
+	ScopeAdmin Scope = "admin"
+)
+
+func ParseScope(s string) (Scope, error) {
+	switch scope := Scope(s); scope {
+	case ScopeRead, ScopeExport, ScopeStream, ScopeAdmin:
+		return scope, nil
+	}
+	return "", fmt.Errorf("unknown scope %q", s)
+}
+
+// Principal is an authenticated caller.
+type Principal struct {
+	Subject string `json:"subject"`
+	KeyID   string `json:"keyId,omitempty"`
+	// Roles are the roles a bearer token claimed; Scopes are what they grant.
+	Roles  []string `json:"roles,omitempty"`
+	Scopes []Scope  `json:"scopes"`
+}
+
+func (p *Principal) HasScope(scope Scope) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKey is a stored API key. Only a hash of the secret is kept; the
+// plaintext key is shown once, when it's created.
+type APIKey struct {
+	ID        string     `json:"id" bson:"_id"`
+	Name      string     `json:"name" bson:"name"`
+	Hash      string     `json:"-" bson:"hash"`
+	Scopes    []Scope    `json:"scopes" bson:"scopes"`
+	CreatedAt time.Time  `json:"createdAt" bson:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+}
+
+type APIKeyStore interface {
+	CreateAPIKey(key APIKey) error
+	ListAPIKeys() ([]APIKey, error)
+	// GetAPIKeyByHash returns ErrNotFound for unknown hashes.
+	GetAPIKeyByHash(hash string) (*APIKey, error)
+	// RevokeAPIKey returns ErrNotFound for unknown or already revoked IDs.
+	RevokeAPIKey(id string) error
+}
+
+const apiKeyPrefix = "sr"
+
+// NewAPIKey generates a key of the form sr_<id>_<secret>. The returned
+// APIKey holds the hash to store; the plaintext string goes to the user.
+func NewAPIKey(name string, scopes []Scope) (string, APIKey, error) {
+	id := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", APIKey{}, fmt.Errorf("failed to generate API key: %w", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, fmt.Errorf("failed to generate API key: %w", err)
+	}
+	key := APIKey{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	plaintext := strings.Join([]string{apiKeyPrefix, key.ID, base64.RawURLEncoding.EncodeToString(secret)}, "_")
+	key.Hash = HashAPIKey(plaintext)
+	return plaintext, key, nil
+}
+
+// HashAPIKey hashes a plaintext key for storage and lookup. Keys carry 256
+// bits of randomness, so a fast hash is enough.
+func HashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
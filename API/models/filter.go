@@ -0,0 +1,91 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BoundingBox is a lat/lon rectangle used for spatial filtering.
+type BoundingBox struct {
+	MinLat float64 `json:"minLat"`
+	MinLon float64 `json:"minLon"`
+	MaxLat float64 `json:"maxLat"`
+	MaxLon float64 `json:"maxLon"`
+}
+
+func (b BoundingBox) Contains(lat, lon float64) bool {
+	return lat >= b.MinLat && lat <= b.MaxLat && lon >= b.MinLon && lon <= b.MaxLon
+}
+
+// Intersect returns the part of b that is also inside other, and false if
+// they don't overlap.
+func (b BoundingBox) Intersect(other BoundingBox) (BoundingBox, bool) {
+	out := BoundingBox{
+		MinLat: max(b.MinLat, other.MinLat),
+		MinLon: max(b.MinLon, other.MinLon),
+		MaxLat: min(b.MaxLat, other.MaxLat),
+		MaxLon: min(b.MaxLon, other.MaxLon),
+	}
+	return out, out.MinLat <= out.MaxLat && out.MinLon <= out.MaxLon
+}
+
+// StormFilter narrows a report query. Empty fields match everything.
+type StormFilter struct {
+	Types    []StormType  `json:"types,omitempty"`
+	States   []string     `json:"states,omitempty"`
+	Counties []string     `json:"counties,omitempty"`
+	BBox     *BoundingBox `json:"bbox,omitempty"`
+}
+
+func (f StormFilter) IsEmpty() bool {
+	return len(f.Types) == 0 && len(f.States) == 0 && len(f.Counties) == 0 && f.BBox == nil
+}
+
+// Validate checks the filter's storm types and bounding box.
+func (f StormFilter) Validate() error {
+	for _, t := range f.Types {
+		if t != TORNADO && t != HAIL && t != WIND {
+			return fmt.Errorf("unknown storm type %q", t)
+		}
+	}
+	if b := f.BBox; b != nil && (b.MinLat > b.MaxLat || b.MinLon > b.MaxLon) {
+		return errors.New("bounding box min exceeds max")
+	}
+	return nil
+}
+
+// Matches reports whether a single report satisfies the filter. DAOs that
+// can't push filters down to their backend use this to filter in memory.
+func (f StormFilter) Matches(report StormReport) bool {
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if t == report.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.States) > 0 && !contains(f.States, report.State) {
+		return false
+	}
+	if len(f.Counties) > 0 && !contains(f.Counties, report.County) {
+		return false
+	}
+	if f.BBox != nil && !f.BBox.Contains(report.Lat, report.Lon) {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package models
+
+type CellShape string
+
+const (
+	CellGrid CellShape = "grid"
+	CellHex  CellShape = "hex"
+)
+
+// HeatmapCell summarises the reports that fall into one bin. Boundary is a
+// closed ring of [lon, lat] pairs so it can be dropped into GeoJSON.
+type HeatmapCell struct {
+	ID          string            `json:"id"`
+	Lat         float64           `json:"lat"`
+	Lon         float64           `json:"lon"`
+	Boundary    [][2]float64      `json:"boundary"`
+	Counts      map[StormType]int `json:"counts"`
+	Total       int               `json:"total"`
+	MaxSeverity int               `json:"maxSeverity"`
+}
+
+type Heatmap struct {
+	Shape    CellShape     `json:"shape"`
+	CellSize float64       `json:"cellSize"`
+	Cells    []HeatmapCell `json:"cells"`
+}
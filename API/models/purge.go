@@ -0,0 +1,106 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PurgeMode string
+
+const (
+	PurgeDelete PurgeMode = "delete"
+	// PurgeSoftDelete marks reports deleted but keeps them.
+	PurgeSoftDelete PurgeMode = "soft"
+)
+
+// PurgeTokenTTL is how long a dry run's confirmation token stays valid.
+const PurgeTokenTTL = 10 * time.Minute
+
+// PurgeQuery selects reports to purge in bulk. Start and End are optional
+// unix-second bounds; Synthetic limits the purge to generated reports.
+type PurgeQuery struct {
+	Start     string      `json:"start,omitempty" bson:"start,omitempty"`
+	End       string      `json:"end,omitempty" bson:"end,omitempty"`
+	Filter    StormFilter `json:"filter" bson:"filter"`
+	Synthetic bool        `json:"synthetic,omitempty" bson:"synthetic,omitempty"`
+	Mode      PurgeMode   `json:"mode" bson:"mode"`
+}
+
+// PurgeResult reports how many reports a purge matched and, unless it was
+// a dry run, how many it removed and their IDs.
+type PurgeResult struct {
+	Matched int64    `json:"matched" bson:"matched"`
+	Purged  int64    `json:"purged" bson:"purged"`
+	IDs     []string `json:"-" bson:"-"`
+}
+
+// Validate rejects purges that would match every report or use an unknown
+// mode or storm type.
+func (q PurgeQuery) Validate() error {
+	if q.Mode != PurgeDelete && q.Mode != PurgeSoftDelete {
+		return errors.New("'mode' must be delete or soft")
+	}
+	if err := q.Filter.Validate(); err != nil {
+		return err
+	}
+	for name, bound := range map[string]string{"start": q.Start, "end": q.End} {
+		if bound == "" {
+			continue
+		}
+		if _, err := strconv.ParseInt(bound, 10, 64); err != nil {
+			return fmt.Errorf("'%s' must be a unix timestamp", name)
+		}
+	}
+	if q.Start == "" && q.End == "" && q.Filter.IsEmpty() && !q.Synthetic {
+		return errors.New("a purge needs a date range, filter or 'synthetic'")
+	}
+	return nil
+}
+
+// Bounds returns the purge's date bounds. A bound that wasn't given is the
+// zero time.
+func (q PurgeQuery) Bounds() (start, end time.Time) {
+	if q.Start != "" {
+		start, _ = ParseReportDate(q.Start)
+	}
+	if q.End != "" {
+		end, _ = ParseReportDate(q.End)
+	}
+	return start, end
+}
+
+// PurgeToken confirms a purge after a dry run. It binds the query and the
+// number of reports it matched, so the purge is refused if either has
+// changed since the caller looked, and it expires after PurgeTokenTTL. It
+// guards against mistakes rather than attackers: anyone allowed to purge
+// can already do so.
+func PurgeToken(q PurgeQuery, matched int64, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	canonical, _ := json.Marshal(q)
+	sum := sha256.Sum256([]byte(string(canonical) + "|" + strconv.FormatInt(matched, 10) + "|" + exp))
+	return exp + "." + hex.EncodeToString(sum[:16])
+}
+
+// CheckPurgeToken verifies a token from PurgeToken against the query and
+// the number of reports it matches now.
+func CheckPurgeToken(q PurgeQuery, matched int64, token string, now time.Time) error {
+	exp, _, ok := strings.Cut(token, ".")
+	ts, err := strconv.ParseInt(exp, 10, 64)
+	if !ok || err != nil {
+		return errors.New("malformed confirmation token")
+	}
+	expires := time.Unix(ts, 0)
+	if now.After(expires) {
+		return errors.New("confirmation token has expired; run the dry run again")
+	}
+	if PurgeToken(q, matched, expires) != token {
+		return fmt.Errorf("confirmation token doesn't match this purge, which now matches %d reports; run the dry run again", matched)
+	}
+	return nil
+}
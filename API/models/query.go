@@ -0,0 +1,121 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// SortOrder orders the reports a StormQuery returns.
+type SortOrder string
+
+const (
+	// SortDate orders reports by date, then time and ID. It is the default.
+	SortDate SortOrder = "date"
+	// SortDateDesc orders reports newest first.
+	SortDateDesc SortOrder = "-date"
+)
+
+func ParseSortOrder(s string) (SortOrder, error) {
+	switch o := SortOrder(s); o {
+	case SortDate, SortDateDesc:
+		return o, nil
+	}
+	return "", fmt.Errorf("unknown sort order %q", s)
+}
+
+// MaxQueryLimit caps the page size a StormQuery may ask for.
+const MaxQueryLimit = 10000
+
+// StormQuery selects reports between two instants, both inclusive,
+// narrowed by a filter and optionally paged. A zero Limit returns every
+// match. Build one with NewStormQuery and check it with Validate before
+// passing it to a DAO.
+type StormQuery struct {
+	Start  time.Time   `json:"start"`
+	End    time.Time   `json:"end"`
+	Filter StormFilter `json:"filter"`
+	Sort   SortOrder   `json:"sort,omitempty"`
+	Limit  int         `json:"limit,omitempty"`
+	Offset int         `json:"offset,omitempty"`
+}
+
+// NewStormQuery returns a query for the reports dated from start to end.
+func NewStormQuery(start, end time.Time) StormQuery {
+	return StormQuery{Start: start, End: end}
+}
+
+// DayQuery returns a query for the 24 hours from start.
+func DayQuery(start time.Time) StormQuery {
+	return NewStormQuery(start, start.Add(24*time.Hour-time.Second))
+}
+
+func (q StormQuery) WithFilter(filter StormFilter) StormQuery {
+	q.Filter = filter
+	return q
+}
+
+func (q StormQuery) WithSort(order SortOrder) StormQuery {
+	q.Sort = order
+	return q
+}
+
+func (q StormQuery) WithPage(limit, offset int) StormQuery {
+	q.Limit, q.Offset = limit, offset
+	return q
+}
+
+// Validate rejects queries with missing or reversed bounds, unknown storm
+// types or sort orders, inverted bounding boxes and bad paging.
+func (q StormQuery) Validate() error {
+	if q.Start.IsZero() || q.End.IsZero() {
+		return errors.New("query must have start and end dates")
+	}
+	if q.End.Before(q.Start) {
+		return errors.New("'end' must not be before 'start'")
+	}
+	if err := q.Filter.Validate(); err != nil {
+		return err
+	}
+	if q.Sort != "" {
+		if _, err := ParseSortOrder(string(q.Sort)); err != nil {
+			return err
+		}
+	}
+	if q.Limit < 0 || q.Limit > MaxQueryLimit {
+		return fmt.Errorf("'limit' must be between 0 and %d", MaxQueryLimit)
+	}
+	if q.Offset < 0 {
+		return errors.New("'offset' must not be negative")
+	}
+	return nil
+}
+
+// Page returns the slice bounds of the requested page of n results.
+func (q StormQuery) Page(n int) (from, to int) {
+	from, to = min(q.Offset, n), n
+	if q.Limit > 0 {
+		to = min(from+q.Limit, n)
+	}
+	return from, to
+}
+
+// ParseReportDate reads the unix timestamp in a report's date. The producer
+// has published both seconds and milliseconds.
+func ParseReportDate(date string) (time.Time, error) {
+	ts, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("report date %q is not a unix timestamp", date)
+	}
+	if ts > 1e11 {
+		return time.UnixMilli(ts).UTC(), nil
+	}
+	return time.Unix(ts, 0).UTC(), nil
+}
+
+// FormatReportDate writes a report date as unix seconds, as the API
+// returns it.
+func FormatReportDate(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
@@ -0,0 +1,74 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStormQuery_Validate(t *testing.T) {
+	start := time.Unix(1733702400, 0)
+	day := models.DayQuery(start)
+	assert.NoError(t, day.Validate())
+	assert.Equal(t, time.Unix(1733788799, 0), day.End)
+
+	box := models.BoundingBox{MinLat: 40, MaxLat: 30}
+	for name, q := range map[string]models.StormQuery{
+		"no bounds":    {},
+		"reversed":     models.NewStormQuery(start, start.Add(-time.Second)),
+		"unknown type": day.WithFilter(models.StormFilter{Types: []models.StormType{"flood"}}),
+		"inverted box": day.WithFilter(models.StormFilter{BBox: &box}),
+		"unknown sort": day.WithSort("size"),
+		"negative":     day.WithPage(-1, 0),
+		"too large":    day.WithPage(models.MaxQueryLimit+1, 0),
+		"bad offset":   day.WithPage(10, -10),
+	} {
+		assert.Error(t, q.Validate(), name)
+	}
+}
+
+func TestStatsQuery_Validate(t *testing.T) {
+	start := time.Unix(1733702400, 0)
+	q := models.StatsQuery{Start: start, End: start.Add(time.Hour), GroupBy: []models.StatsDimension{models.DimensionDay}}
+	assert.NoError(t, q.Validate())
+
+	for name, change := range map[string]func(*models.StatsQuery){
+		"reversed":      func(q *models.StatsQuery) { q.End = start.Add(-time.Second) },
+		"unknown type":  func(q *models.StatsQuery) { q.Filter.Types = []models.StormType{"flood"} },
+		"unknown group": func(q *models.StatsQuery) { q.GroupBy = append(q.GroupBy, "week") },
+	} {
+		invalid := q
+		change(&invalid)
+		assert.Error(t, invalid.Validate(), name)
+	}
+}
+
+func TestStormQuery_Page(t *testing.T) {
+	q := models.StormQuery{}
+	for _, tc := range []struct {
+		limit, offset, n, from, to int
+	}{
+		{0, 0, 5, 0, 5},
+		{2, 0, 5, 0, 2},
+		{2, 4, 5, 4, 5},
+		{0, 3, 5, 3, 5},
+		{2, 9, 5, 5, 5},
+	} {
+		from, to := q.WithPage(tc.limit, tc.offset).Page(tc.n)
+		assert.Equal(t, [2]int{tc.from, tc.to}, [2]int{from, to}, "%+v", tc)
+	}
+}
+
+func TestParseReportDate(t *testing.T) {
+	seconds, err := models.ParseReportDate("1733773195")
+	assert.NoError(t, err)
+	millis, err := models.ParseReportDate("1733773195000")
+	assert.NoError(t, err)
+	assert.True(t, seconds.Equal(millis))
+	assert.Equal(t, "1733773195", models.FormatReportDate(millis))
+
+	_, err = models.ParseReportDate("2024-12-09")
+	assert.Error(t, err)
+}
@@ -0,0 +1,117 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by DAOs when a report doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// ReportID derives a stable identifier for a report from the fields SPC
+// doesn't revise: the convective day, type, time and named location. Coordinates
+// and comments are deliberately left out so corrections to them update the
+// same report instead of creating a new one.
+func ReportID(r StormReport) string {
+	key := strings.Join([]string{
+		convectiveDay(r.Date, r.Time),
+		string(r.Type),
+		strconv.Itoa(int(r.Time)),
+		strings.ToUpper(strings.TrimSpace(r.State)),
+		strings.ToUpper(strings.TrimSpace(r.County)),
+		strings.ToUpper(strings.TrimSpace(r.Location)),
+	}, "|")
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:12])
+}
+
+// convectiveDay returns the SPC convective day, which runs from 12Z to 12Z,
+// of a report at hhmm UTC fetched at the unix timestamp in date. The date is
+// when the producer fetched the day's file, so the same report fetched
+// either side of 00Z belongs to the same day. Reports are never later than
+// their fetch, which tells a file fetched just after 12Z apart from the
+// next day's.
+func convectiveDay(date string, hhmm int32) string {
+	fetched, err := ParseReportDate(date)
+	if err != nil {
+		return date
+	}
+	day := fetched.Add(-12 * time.Hour).Truncate(24 * time.Hour)
+	at := day.Add(time.Duration(hhmm/100)*time.Hour + time.Duration(hhmm%100)*time.Minute)
+	if hhmm < 1200 {
+		at = at.Add(24 * time.Hour)
+	}
+	if at.After(fetched) {
+		day = day.AddDate(0, 0, -1)
+	}
+	return day.Format("2006-01-02")
+}
+
+// ActorIngest identifies writes made by the Kafka ingestion loop.
+const ActorIngest = "ingest"
+
+// ChangeSource records who or what caused a write to a report.
+type ChangeSource struct {
+	Actor          string `json:"actor" bson:"actor"`
+	Reason         string `json:"reason,omitempty" bson:"reason,omitempty"`
+	KafkaPartition int32  `json:"kafkaPartition,omitempty" bson:"kafkaPartition,omitempty"`
+	KafkaOffset    int64  `json:"kafkaOffset,omitempty" bson:"kafkaOffset,omitempty"`
+}
+
+// FieldChange is the before and after value of one report field.
+type FieldChange struct {
+	Old interface{} `json:"old" bson:"old"`
+	New interface{} `json:"new" bson:"new"`
+}
+
+// ReportRevision captures a report as it was before an update changed it.
+type ReportRevision struct {
+	ReportID  string                 `json:"reportId" bson:"reportId"`
+	Previous  StormReport            `json:"previous" bson:"previous"`
+	Changes   map[string]FieldChange `json:"changes" bson:"changes"`
+	Source    ChangeSource           `json:"source" bson:"source"`
+	ChangedAt time.Time              `json:"changedAt" bson:"changedAt"`
+}
+
+// UpsertResult describes what an upsert did to the stored report. Report is
+// the report as stored after the write.
+type UpsertResult struct {
+	ID      string
+	Report  StormReport
+	Created bool
+	Changed bool
+}
+
+// DiffReports lists the fields that differ between two versions of a
+// report, keyed by their JSON name. The ID and date aren't compared: the
+// date is stamped by the producer on every fetch, so it only identifies the
+// day a report belongs to. Nor are the revision number and update time,
+// which describe the version rather than the report.
+func DiffReports(old, new StormReport) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		switch name {
+		case "id", "date", "revision", "updatedAt", "-":
+			continue
+		}
+		a, b := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if !reflect.DeepEqual(a, b) {
+			changes[name] = FieldChange{Old: a, New: b}
+		}
+	}
+	return changes
+}
+
+// NextRevision returns the number of the revision following r. Reports
+// stored before revisions were numbered count as revision 1.
+func (r StormReport) NextRevision() int {
+	return max(r.Revision, 1) + 1
+}
@@ -0,0 +1,137 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportID(t *testing.T) {
+	original := models.StormReport{Date: "1733773195", Time: 1200, Type: models.HAIL, Location: "Boston", County: "Suffolk", State: "MA", Lat: 42.3, Lon: -71.0}
+
+	revised := original
+	revised.Date = "1733780000000" // same day, published in milliseconds
+	revised.Lat = 42.31
+	revised.Comments = "corrected"
+	assert.Equal(t, models.ReportID(original), models.ReportID(revised))
+
+	nextDay := original
+	nextDay.Date = "1733859595"
+	assert.NotEqual(t, models.ReportID(original), models.ReportID(nextDay))
+
+	// SPC days run from 12Z to 12Z, so a report fetched either side of
+	// 00Z keeps its ID.
+	late := models.StormReport{Date: "1733787000", Time: 2330, Type: models.WIND, Location: "Plano", State: "TX"} // fetched 2024-12-09 23:30Z
+	refetched := late
+	refetched.Date = "1733790600" // 2024-12-10 00:30Z
+	assert.Equal(t, models.ReportID(late), models.ReportID(refetched))
+	early := late
+	early.Time = 300
+	early.Date = "1733801400" // 2024-12-10 03:30Z
+	refetched = early
+	refetched.Date = "1733828400" // 2024-12-10 11:00Z
+	assert.Equal(t, models.ReportID(early), models.ReportID(refetched))
+
+	// Just after 12Z the previous day's file may still be served. Its
+	// reports aren't in the future, so they stay on their day, while the
+	// new day's reports start a new one.
+	refetched = late
+	refetched.Date = "1733832120" // 2024-12-10 12:02Z
+	assert.Equal(t, models.ReportID(late), models.ReportID(refetched))
+	noon := late
+	noon.Time = 1201
+	refetched = noon
+	refetched.Date = "1733832120"
+	assert.NotEqual(t, models.ReportID(noon), models.ReportID(refetched))
+}
+
+// reportIDVectors pins report IDs. The ETL's tests hold the same table, as
+// the API and the ETL must give a report the same ID; change both together.
+var reportIDVectors = []struct {
+	date                    string
+	time                    int32
+	stormType               models.StormType
+	location, county, state string
+	id                      string
+}{
+	{"1733773195", 1200, models.HAIL, "Boston", "Suffolk", "MA", "5f3e83d4087ffeddefbb96e8"},
+	{"1733773195000", 1200, models.HAIL, " boston", "SUFFOLK", "ma", "5f3e83d4087ffeddefbb96e8"}, // milliseconds, untidy case
+	{"1733787000", 2330, models.WIND, "Plano", "", "TX", "85bd67abc63f7076e04b4774"},             // 2024-12-09 23:30Z
+	{"1733790600000", 2330, models.WIND, "Plano", "", "TX", "85bd67abc63f7076e04b4774"},          // refetched after 00Z
+	{"1733832120", 2330, models.WIND, "Plano", "", "TX", "85bd67abc63f7076e04b4774"},             // refetched after 12Z
+	{"1733832120", 1205, models.HAIL, "Plano", "", "TX", "730ddc515edce40d5144589b"},             // the new day's file
+	{"1733801400", 300, models.TORNADO, "Moore", "Cleveland", "OK", "32cb883fc954ca4ad26bd5f1"},
+	{"not-a-date", 1200, models.HAIL, "Boston", "", "MA", "b382220fac2d94c8bb975b3e"},
+}
+
+func TestReportIDVectors(t *testing.T) {
+	for _, v := range reportIDVectors {
+		report := models.StormReport{Date: v.date, Time: v.time, Type: v.stormType, Location: v.location, County: v.county, State: v.state}
+		assert.Equal(t, v.id, models.ReportID(report), "%+v", v)
+	}
+}
+
+func TestDiffReports(t *testing.T) {
+	old := models.StormReport{ID: "a", Date: "1", Lat: 42.3, Comments: "hail"}
+	new := models.StormReport{ID: "b", Date: "2", Lat: 42.4, Comments: "hail"}
+
+	changes := models.DiffReports(old, new)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, models.FieldChange{Old: 42.3, New: 42.4}, changes["lat"])
+
+	// A new revision of the same report isn't a change in itself.
+	now := time.Now()
+	new = old
+	new.Revision, new.UpdatedAt = 2, &now
+	assert.Empty(t, models.DiffReports(old, new))
+}
+
+func TestNextRevision(t *testing.T) {
+	assert.Equal(t, 2, models.StormReport{}.NextRevision(), "unnumbered reports are revision 1")
+	assert.Equal(t, 2, models.StormReport{Revision: 1}.NextRevision())
+	assert.Equal(t, 5, models.StormReport{Revision: 4}.NextRevision())
+}
+
+func TestSearchQuery(t *testing.T) {
+	query := models.ParseSearch(`roof "power lines" -tree -"no damage"`)
+	assert.Equal(t, []string{"roof"}, query.Terms)
+	assert.Equal(t, []string{"power lines"}, query.Phrases)
+	assert.Equal(t, []string{"tree", "no damage"}, query.Excluded)
+
+	match := models.StormReport{Comments: "Roof blown off. Power lines down on Main St.", Location: "Roofton"}
+	score, ok := query.Match(match)
+	assert.True(t, ok)
+	assert.Equal(t, float64(4), score)
+
+	_, ok = query.Match(models.StormReport{Comments: "Roof damage, power lines and a tree down"})
+	assert.False(t, ok)
+	_, ok = query.Match(models.StormReport{Comments: "Roof damage"})
+	assert.False(t, ok)
+
+	highlights := query.Highlight(match)
+	assert.Equal(t, "<mark>Roof</mark> blown off. <mark>Power lines</mark> down on Main St.", highlights["comments"])
+	assert.Equal(t, "<mark>Roof</mark>ton", highlights["location"])
+	assert.NotContains(t, highlights, "county")
+
+	// Report text is escaped; only the marks are markup.
+	highlights = query.Highlight(models.StormReport{Comments: `<img src=x onerror=alert(1)> roof & "power lines" <script>`})
+	assert.Equal(t, "&lt;img src=x onerror=alert(1)&gt; <mark>roof</mark> &amp; &#34;<mark>power lines</mark>&#34; &lt;script&gt;", highlights["comments"])
+}
+
+func TestPurgeToken(t *testing.T) {
+	query := models.PurgeQuery{Synthetic: true, Mode: models.PurgeDelete}
+	assert.NoError(t, query.Validate())
+	assert.Error(t, models.PurgeQuery{Mode: models.PurgeDelete}.Validate(), "empty query")
+	assert.Error(t, models.PurgeQuery{Synthetic: true, Mode: "shred"}.Validate(), "bad mode")
+	assert.Error(t, models.PurgeQuery{Start: "yesterday", Mode: models.PurgeSoftDelete}.Validate(), "bad start")
+
+	now := time.Now()
+	token := models.PurgeToken(query, 12, now.Add(models.PurgeTokenTTL))
+	assert.NoError(t, models.CheckPurgeToken(query, 12, token, now))
+	assert.Error(t, models.CheckPurgeToken(query, 13, token, now), "count changed")
+	assert.Error(t, models.CheckPurgeToken(models.PurgeQuery{Synthetic: true, Mode: models.PurgeSoftDelete}, 12, token, now), "query changed")
+	assert.Error(t, models.CheckPurgeToken(query, 12, token, now.Add(models.PurgeTokenTTL+time.Second)), "expired")
+	assert.Error(t, models.CheckPurgeToken(query, 12, "garbage", now))
+}
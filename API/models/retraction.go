@@ -0,0 +1,17 @@
+package models
+
+// EventHeader is the Kafka header that marks processed-topic messages that
+// aren't reports. Its value is the event type.
+const EventHeader = "event"
+
+// RetractionEvent is the event type of a Retraction.
+const RetractionEvent = "retraction"
+
+// Retraction is sent by the ETL, keyed by report ID, when a report drops
+// out of SPC's daily file for its type.
+type Retraction struct {
+	ID         string    `json:"id"`
+	Type       StormType `json:"type"`
+	Day        string    `json:"day"`
+	SnapshotID string    `json:"snapshotId"`
+}
@@ -0,0 +1,190 @@
+package models
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SearchResult is a report matched by a text search, with its relevance
+// score and highlighted snippets keyed by field name.
+type SearchResult struct {
+	StormReport `bson:",inline"`
+	Score       float64           `json:"score" bson:"score"`
+	Highlights  map[string]string `json:"highlights,omitempty" bson:"-"`
+}
+
+// SearchQuery is a parsed text search using the same syntax as Mongo's
+// $text operator: bare words match any, "quoted phrases" must all appear
+// and -prefixed words or phrases exclude a report.
+type SearchQuery struct {
+	Terms    []string
+	Phrases  []string
+	Excluded []string
+}
+
+// SearchFields are the report fields covered by text search.
+var SearchFields = []string{"comments", "location", "county"}
+
+const (
+	highlightOpen  = "<mark>"
+	highlightClose = "</mark>"
+	snippetRadius  = 40
+)
+
+func ParseSearch(q string) SearchQuery {
+	var query SearchQuery
+	for q = strings.TrimSpace(q); q != ""; q = strings.TrimSpace(q) {
+		negate := false
+		if q[0] == '-' {
+			negate = true
+			q = q[1:]
+		}
+		var token string
+		phrase := strings.HasPrefix(q, `"`)
+		if phrase {
+			end := strings.Index(q[1:], `"`)
+			if end < 0 {
+				token, q = q[1:], ""
+			} else {
+				token, q = q[1:end+1], q[end+2:]
+			}
+		} else if end := strings.IndexFunc(q, unicode.IsSpace); end >= 0 {
+			token, q = q[:end], q[end:]
+		} else {
+			token, q = q, ""
+		}
+
+		token = strings.ToLower(strings.TrimSpace(token))
+		switch {
+		case token == "":
+		case negate:
+			query.Excluded = append(query.Excluded, token)
+		case phrase:
+			query.Phrases = append(query.Phrases, token)
+		default:
+			query.Terms = append(query.Terms, token)
+		}
+	}
+	return query
+}
+
+func (q SearchQuery) IsEmpty() bool {
+	return len(q.Terms) == 0 && len(q.Phrases) == 0
+}
+
+// Match is the naive search used by DAOs without a text index. It
+// reports whether the report matches and a score counting term and phrase
+// occurrences, with phrases weighted double.
+func (q SearchQuery) Match(report StormReport) (float64, bool) {
+	text := strings.ToLower(strings.Join(searchText(report), " "))
+	for _, ex := range q.Excluded {
+		if strings.Contains(text, ex) {
+			return 0, false
+		}
+	}
+	score := 0.0
+	for _, p := range q.Phrases {
+		n := strings.Count(text, p)
+		if n == 0 {
+			return 0, false
+		}
+		score += 2 * float64(n)
+	}
+	termHit := len(q.Terms) == 0
+	for _, t := range q.Terms {
+		if n := strings.Count(text, t); n > 0 {
+			termHit = true
+			score += float64(n)
+		}
+	}
+	if !termHit {
+		return 0, false
+	}
+	return score, true
+}
+
+// Highlight returns a snippet for every searched field that contains a
+// term or phrase, with the matches wrapped in <mark> tags.
+func (q SearchQuery) Highlight(report StormReport) map[string]string {
+	needles := append(append([]string{}, q.Phrases...), q.Terms...)
+	highlights := map[string]string{}
+	for i, text := range searchText(report) {
+		if snippet, ok := highlight(text, needles); ok {
+			highlights[SearchFields[i]] = snippet
+		}
+	}
+	return highlights
+}
+
+func searchText(report StormReport) []string {
+	return []string{report.Comments, report.Location, report.County}
+}
+
+func highlight(text string, needles []string) (string, bool) {
+	// Lower-case ASCII only so byte offsets line up with the original text.
+	lower := strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, text)
+	type span struct{ start, end int }
+	var spans []span
+	for _, n := range needles {
+		for from := 0; ; {
+			i := strings.Index(lower[from:], n)
+			if i < 0 {
+				break
+			}
+			spans = append(spans, span{from + i, from + i + len(n)})
+			from += i + len(n)
+		}
+	}
+	if len(spans) == 0 {
+		return "", false
+	}
+
+	// Overlapping and adjacent matches are merged into one marked run.
+	marked := make([]bool, len(text))
+	for _, s := range spans {
+		for i := s.start; i < s.end; i++ {
+			marked[i] = true
+		}
+	}
+	first, last := len(text), 0
+	for _, s := range spans {
+		first = min(first, s.start)
+		last = max(last, s.end)
+	}
+	from, to := max(0, first-snippetRadius), min(len(text), last+snippetRadius)
+	for from > 0 && !utf8.RuneStart(text[from]) {
+		from--
+	}
+	for to < len(text) && !utf8.RuneStart(text[to]) {
+		to++
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	// The text is escaped, as clients render highlights as markup.
+	for i := from; i < to; {
+		j := i
+		for j < to && marked[j] == marked[i] {
+			j++
+		}
+		if marked[i] {
+			b.WriteString(highlightOpen + html.EscapeString(text[i:j]) + highlightClose)
+		} else {
+			b.WriteString(html.EscapeString(text[i:j]))
+		}
+		i = j
+	}
+	if to < len(text) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Severity rates a report on a 0-5 scale so reports of different types can
+// be compared. Tornadoes use their (E)F rating, hail its diameter and wind
+// its measured speed. Reports with unknown magnitude rate 0.
+func (r StormReport) Severity() int {
+	switch r.Type {
+	case TORNADO:
+		scale := strings.TrimLeft(strings.ToUpper(r.F_Scale), "EF")
+		if v, err := strconv.Atoi(scale); err == nil && v >= 0 && v <= 5 {
+			return v
+		}
+	case HAIL:
+		size := r.Size
+		// SPC publishes hail size in hundredths of an inch
+		if size > 10 {
+			size /= 100
+		}
+		return bucket(size, []float64{1, 1.75, 2, 3, 4})
+	case WIND:
+		return bucket(float64(r.Speed), []float64{58, 65, 75, 90, 100})
+	}
+	return 0
+}
+
+func bucket(v float64, thresholds []float64) int {
+	level := 0
+	for _, t := range thresholds {
+		if v >= t {
+			level++
+		}
+	}
+	return level
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+type StatsDimension string
+
+const (
+	DimensionType   StatsDimension = "type"
+	DimensionState  StatsDimension = "state"
+	DimensionCounty StatsDimension = "county"
+	DimensionDay    StatsDimension = "day"
+	DimensionHour   StatsDimension = "hour"
+)
+
+func ParseStatsDimension(s string) (StatsDimension, error) {
+	switch d := StatsDimension(s); d {
+	case DimensionType, DimensionState, DimensionCounty, DimensionDay, DimensionHour:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown stats dimension %q", s)
+}
+
+// StatsQuery asks for report counts over a date range, grouped by any
+// combination of dimensions. An empty GroupBy yields a single total row.
+type StatsQuery struct {
+	Start   time.Time
+	End     time.Time
+	Filter  StormFilter
+	GroupBy []StatsDimension
+}
+
+// Range returns the reports a stats query counts, as a StormQuery.
+func (q StatsQuery) Range() StormQuery {
+	return NewStormQuery(q.Start, q.End).WithFilter(q.Filter)
+}
+
+// Validate checks the range and filter as StormQuery.Validate does, and
+// the dimensions grouped on.
+func (q StatsQuery) Validate() error {
+	if err := q.Range().Validate(); err != nil {
+		return err
+	}
+	for _, d := range q.GroupBy {
+		if _, err := ParseStatsDimension(string(d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StatsRow is one group of a stats result. Only the dimensions that were
+// grouped on are populated. Day is formatted YYYY-MM-DD in UTC and Hour is
+// taken from the report time (0-23).
+type StatsRow struct {
+	Type   StormType `json:"type,omitempty" bson:"type,omitempty"`
+	State  string    `json:"state,omitempty" bson:"state,omitempty"`
+	County string    `json:"county,omitempty" bson:"county,omitempty"`
+	Day    string    `json:"day,omitempty" bson:"day,omitempty"`
+	Hour   *int      `json:"hour,omitempty" bson:"hour,omitempty"`
+	Count  int64     `json:"count" bson:"count"`
+}
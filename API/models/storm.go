@@ -1,5 +1,10 @@
 package models
 
+import (
+	"context"
+	"time"
+)
+
 type StormType string
 
 const (
@@ -9,6 +14,7 @@ const (
 )
 
 type StormReport struct {
+	ID       string    `json:"id" bson:"id"`
 	Date     string    `json:"date" bson:"date"`
 	Time     int32     `json:"time" bson:"time"`
 	Size     float64   `json:"size" bson:"size"`
@@ -21,9 +27,56 @@ type StormReport struct {
 	Lon      float64   `json:"lon" bson:"lon"`
 	Comments string    `json:"comments" bson:"comments"`
 	Type     StormType `json:"type" bson:"type"`
+	// Synthetic marks reports made up by the producer's generator.
+	Synthetic bool `json:"synthetic,omitempty" bson:"synthetic,omitempty"`
+	// Revision counts the versions of a report, starting at 1, and
+	// UpdatedAt is when the current one was stored.
+	Revision  int        `json:"revision,omitempty" bson:"revision,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+	// Deleted reports are kept, so re-ingesting them doesn't bring them
+	// back, but are left out of queries.
+	Deleted   bool       `json:"deleted,omitempty" bson:"deleted,omitempty"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	// Withdrawn reports have been dropped from SPC's data. They are left
+	// out of queries until they reappear.
+	Withdrawn   bool       `json:"withdrawn,omitempty" bson:"withdrawn,omitempty"`
+	WithdrawnAt *time.Time `json:"withdrawnAt,omitempty" bson:"withdrawnAt,omitempty"`
 }
 
 type StormDAOInterface interface {
-	GetStormReports(start string, end string) ([]StormReport, error)
+	// GetStormReports returns the reports a query selects, in its sort
+	// order.
+	GetStormReports(ctx context.Context, query StormQuery) ([]StormReport, error)
+	GetStormStats(ctx context.Context, query StatsQuery) ([]StatsRow, error)
+	// SearchStormReports returns the reports a query selects that match a
+	// text search, ordered by relevance. The query's sort order is unused.
+	SearchStormReports(ctx context.Context, query StormQuery, q string) ([]SearchResult, error)
+	// GetStormReport returns a report by ID, including deleted reports.
+	GetStormReport(ctx context.Context, id string) (*StormReport, error)
+	// GetDeletedStormReports returns the deleted reports a query selects,
+	// most recently deleted first.
+	GetDeletedStormReports(query StormQuery) ([]StormReport, error)
+	GetStormReportHistory(ctx context.Context, id string) ([]ReportRevision, error)
+	// CreateStormReport stores a new report under its derived ID and returns
+	// it as stored, or ErrConflict if the ID is taken.
+	CreateStormReport(report StormReport, source ChangeSource) (StormReport, error)
+	// UpdateStormReport replaces the report with the same ID, or returns
+	// ErrNotFound. The report's Revision must be the stored one, or it
+	// returns ErrStaleRevision rather than overwrite a change it didn't see.
+	UpdateStormReport(report StormReport, source ChangeSource) (UpsertResult, error)
+	// DeleteStormReport marks a report deleted and returns it, or returns
+	// ErrNotFound if there's no such report or it's already deleted.
+	DeleteStormReport(id string, source ChangeSource) (StormReport, error)
+	GetAuditLog(query AuditQuery) ([]AuditEntry, error)
+	// PurgeStormReports counts the reports a purge matches and, unless
+	// dryRun is set, deletes or soft-deletes them and records the purge in
+	// the audit log.
+	PurgeStormReports(query PurgeQuery, dryRun bool, source ChangeSource) (PurgeResult, error)
+	// UpsertStormReport stores an ingested report. A withdrawn report that
+	// is ingested again is no longer withdrawn.
+	UpsertStormReport(report StormReport, source ChangeSource) (UpsertResult, error)
+	// WithdrawStormReport marks a report withdrawn, or returns ErrNotFound.
+	// Withdrawing a withdrawn report changes nothing.
+	WithdrawStormReport(id string, source ChangeSource) (UpsertResult, error)
 	Disconnect() error
 }
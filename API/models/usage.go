@@ -0,0 +1,9 @@
+package models
+
+// UsageStore counts what each client has used of a metered resource per
+// UTC day, so quotas hold across restarts and replicas.
+type UsageStore interface {
+	// AddUsage adds n to the client's count of kind on day (YYYY-MM-DD)
+	// and returns the new total.
+	AddUsage(client, kind, day string, n int64) (int64, error)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+// runPurgeCommand deletes or soft-deletes reports in bulk. Without -confirm
+// or -yes it only reports how many reports match, along with the token that
+// confirms the purge.
+func runPurgeCommand(dao models.StormDAOInterface, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	flags.SetOutput(out)
+	var query models.PurgeQuery
+	flags.BoolVar(&query.Synthetic, "synthetic", false, "only reports made up by the generator")
+	flags.StringVar(&query.Start, "start", "", "unix timestamp of the earliest report date")
+	flags.StringVar(&query.End, "end", "", "unix timestamp of the latest report date")
+	types := flags.String("type", "", "comma-separated storm types")
+	states := flags.String("state", "", "comma-separated states")
+	counties := flags.String("county", "", "comma-separated counties")
+	mode := flags.String("mode", string(models.PurgeSoftDelete), "delete or soft")
+	reason := flags.String("reason", "", "why the reports are being purged")
+	confirm := flags.String("confirm", "", "confirmation token from a dry run")
+	yes := flags.Bool("yes", false, "purge without a separate dry run")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query.Mode = models.PurgeMode(*mode)
+	for _, t := range splitList(*types) {
+		query.Filter.Types = append(query.Filter.Types, models.StormType(strings.ToLower(t)))
+	}
+	for _, s := range splitList(*states) {
+		query.Filter.States = append(query.Filter.States, strings.ToUpper(s))
+	}
+	query.Filter.Counties = splitList(*counties)
+	if err := query.Validate(); err != nil {
+		return fmt.Errorf("purge: %v", err)
+	}
+
+	count, err := dao.PurgeStormReports(query, true, models.ChangeSource{})
+	if err != nil {
+		return err
+	}
+	token := models.PurgeToken(query, count.Matched, time.Now().Add(models.PurgeTokenTTL))
+	if *confirm == "" && !*yes {
+		fmt.Fprintf(out, "%d reports match. To %s them, run again with -reason and:\n  -confirm %s\n", count.Matched, verb(query.Mode), token)
+		return nil
+	}
+	if *confirm != "" {
+		token = *confirm
+	}
+
+	if strings.TrimSpace(*reason) == "" {
+		return errors.New("purge: -reason is required")
+	}
+	if err := models.CheckPurgeToken(query, count.Matched, token, time.Now()); err != nil {
+		return fmt.Errorf("purge: %w", err)
+	}
+	result, err := dao.PurgeStormReports(query, false, models.ChangeSource{Actor: "cli", Reason: *reason})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Matched %d reports; %s %d.\n", result.Matched, verb(query.Mode)+"d", result.Purged)
+	return nil
+}
+
+func verb(mode models.PurgeMode) string {
+	if mode == models.PurgeSoftDelete {
+		return "soft-delete"
+	}
+	return "delete"
+}
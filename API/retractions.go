@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/IBM/sarama"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+// isRetraction reports whether a processed-topic message is a retraction
+// rather than a report.
+func isRetraction(msg *sarama.ConsumerMessage) bool {
+	for _, header := range msg.Headers {
+		if string(header.Key) == models.EventHeader {
+			return string(header.Value) == models.RetractionEvent
+		}
+	}
+	return false
+}
+
+// applyRetraction marks withdrawn the report the ETL found missing from
+// SPC's latest data. Retractions for reports never stored are ignored.
+func applyRetraction(stormDAO models.StormDAOInterface, msg *sarama.ConsumerMessage) error {
+	var retraction models.Retraction
+	if err := json.Unmarshal(msg.Value, &retraction); err != nil {
+		return fmt.Errorf("failed to decode retraction: %w", err)
+	}
+	if retraction.ID == "" {
+		retraction.ID = string(msg.Key)
+	}
+	result, err := stormDAO.WithdrawStormReport(retraction.ID, models.ChangeSource{
+		Actor:          models.ActorIngest,
+		Reason:         "missing from snapshot " + retraction.SnapshotID,
+		KafkaPartition: msg.Partition,
+		KafkaOffset:    msg.Offset,
+	})
+	if errors.Is(err, models.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply retraction for %s: %w", retraction.ID, err)
+	}
+	if result.Changed {
+		fmt.Printf("Message withdrawn in MongoDB: %s\n", retraction.ID)
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/middleware"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+type createReportRequest struct {
+	Report models.StormReport `json:"report"`
+	Reason string             `json:"reason"`
+}
+
+type purgeRequest struct {
+	models.PurgeQuery
+	DryRun            bool   `json:"dryRun"`
+	ConfirmationToken string `json:"confirmationToken"`
+	Reason            string `json:"reason"`
+}
+
+type purgeDryRunResponse struct {
+	Matched           int64     `json:"matched"`
+	ConfirmationToken string    `json:"confirmationToken"`
+	ExpiresAt         time.Time `json:"expiresAt"`
+}
+
+type patchReportRequest struct {
+	Changes  json.RawMessage `json:"changes"`
+	Reason   string          `json:"reason"`
+	Revision *int            `json:"revision"`
+}
+
+// unpatchableFields are the report fields only the DAO sets, by their JSON
+// names, with what to say when a patch tries to set them.
+var unpatchableFields = map[string]string{
+	"deleted":     "reports are deleted with DELETE /reports/{id}",
+	"deletedAt":   "reports are deleted with DELETE /reports/{id}",
+	"revision":    "the expected revision goes next to 'changes', not in it",
+	"updatedAt":   "'updatedAt' is set when the report is stored",
+	"withdrawn":   "withdrawals follow SPC's data and can't be patched",
+	"withdrawnAt": "withdrawals follow SPC's data and can't be patched",
+	"synthetic":   "'synthetic' is set by the producer and can't be patched",
+}
+
+// CreateReportHandler adds a report that ingestion missed. The body is
+// {"report": {...}, "reason": "..."}; the ID is derived from the report.
+func CreateReportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	dao := middleware.GetDAO(r.Context())
+
+	var body createReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateReport(body.Report); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid report: %v", err), http.StatusBadRequest)
+		return
+	}
+	source, err := changeSource(r, body.Reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := dao.CreateStormReport(body.Report, source)
+	if errors.Is(err, models.ErrConflict) {
+		http.Error(w, fmt.Sprintf("A storm report with id %s already exists", report.ID), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create storm report: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/reports/"+report.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
+
+// PatchReportHandler corrects fields of a report. The body is
+// {"changes": {...}, "reason": "...", "revision": n}, where changes holds
+// the fields to set, by their JSON names, and revision is the one the
+// client last read; the patch is refused with 409 if the report has moved
+// on since.
+func PatchReportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	dao := middleware.GetDAO(r.Context())
+	id := r.PathValue("id")
+
+	var body patchReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(body.Changes) == 0 {
+		http.Error(w, "Invalid request body: 'changes' is required", http.StatusBadRequest)
+		return
+	}
+	if body.Revision == nil {
+		http.Error(w, "Invalid request body: 'revision' is required", http.StatusBadRequest)
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body.Changes, &fields); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid 'changes': %v", err), http.StatusBadRequest)
+		return
+	}
+	for name := range fields {
+		if reason, ok := unpatchableFields[name]; ok {
+			http.Error(w, fmt.Sprintf("Invalid 'changes': %s", reason), http.StatusBadRequest)
+			return
+		}
+	}
+	source, err := changeSource(r, body.Reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := dao.GetStormReport(r.Context(), id)
+	if err == nil && report.Deleted {
+		err = models.ErrNotFound
+	}
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, "No storm report found with the given id", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to retrieve storm report: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// Reports stored before revisions were numbered count as revision 1.
+	// The update below only applies to the revision read here, so one that
+	// lands in between is caught too.
+	if max(report.Revision, 1) != *body.Revision {
+		http.Error(w, fmt.Sprintf("The storm report is at revision %d, not %d; fetch it and try again", max(report.Revision, 1), *body.Revision), http.StatusConflict)
+		return
+	}
+
+	// Decoding over the stored report leaves fields the patch omits alone.
+	patched := *report
+	decoder := json.NewDecoder(bytes.NewReader(body.Changes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patched); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid 'changes': %v", err), http.StatusBadRequest)
+		return
+	}
+	if patched.ID != id {
+		http.Error(w, "Invalid 'changes': a report's id can't be changed", http.StatusBadRequest)
+		return
+	}
+	if models.ReportID(patched) != models.ReportID(*report) {
+		http.Error(w, "Invalid 'changes': the date, type, time, state, county and location identify a report and can't be changed; delete it and create a new one instead", http.StatusBadRequest)
+		return
+	}
+	if err := validateReport(patched); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid report: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	result, err := dao.UpdateStormReport(patched, source)
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, "No storm report found with the given id", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, models.ErrStaleRevision) {
+		http.Error(w, "The storm report changed while it was being updated; try again", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update storm report: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(result.Report)
+}
+
+// DeleteReportHandler soft-deletes a report. The reason is given in the
+// 'reason' query parameter.
+func DeleteReportHandler(w http.ResponseWriter, r *http.Request) {
+	dao := middleware.GetDAO(r.Context())
+	id := r.PathValue("id")
+
+	source, err := changeSource(r, r.URL.Query().Get("reason"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = dao.DeleteStormReport(id, source)
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, "No storm report found with the given id", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete storm report: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeReportsHandler deletes or soft-deletes every report matching a
+// query. A dry run ("dryRun": true) returns the number of matching reports
+// and a confirmation token; the purge itself must send the same query with
+// that token and a reason, and is refused if the match count has changed.
+func PurgeReportsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	dao := middleware.GetDAO(r.Context())
+
+	var body purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	query := body.PurgeQuery
+	if query.Mode == "" {
+		query.Mode = models.PurgeSoftDelete
+	}
+	for i, state := range query.Filter.States {
+		query.Filter.States[i] = strings.ToUpper(state)
+	}
+	if err := query.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid purge: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var source models.ChangeSource
+	if !body.DryRun {
+		var err error
+		if source, err = changeSource(r, body.Reason); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.ConfirmationToken == "" {
+			http.Error(w, "A 'confirmationToken' from a dry run is required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	count, err := dao.PurgeStormReports(query, true, source)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to count storm reports: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if body.DryRun {
+		expires := time.Now().Add(models.PurgeTokenTTL).Truncate(time.Second)
+		json.NewEncoder(w).Encode(purgeDryRunResponse{
+			Matched:           count.Matched,
+			ConfirmationToken: models.PurgeToken(query, count.Matched, expires),
+			ExpiresAt:         expires.UTC(),
+		})
+		return
+	}
+	if err := models.CheckPurgeToken(query, count.Matched, body.ConfirmationToken, time.Now()); err != nil {
+		http.Error(w, fmt.Sprintf("Purge not confirmed: %v", err), http.StatusConflict)
+		return
+	}
+
+	result, err := dao.PurgeStormReports(query, false, source)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to purge storm reports: %v", err), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// GetAuditHandler returns administrative changes, newest first, filtered by
+// 'reportId', 'actor', 'action' and a 'since'/'until' range of unix
+// timestamps.
+func GetAuditHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	dao := middleware.GetDAO(r.Context())
+	params := r.URL.Query()
+
+	query := models.AuditQuery{
+		ReportID: params.Get("reportId"),
+		Actor:    params.Get("actor"),
+		Limit:    defaultAuditLimit,
+	}
+	if a := params.Get("action"); a != "" {
+		action, err := models.ParseAuditAction(a)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid 'action' query parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		query.Action = action
+	}
+	for name, bound := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if v := params.Get(name); v != "" {
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid '%s' query parameter", name), http.StatusBadRequest)
+				return
+			}
+			*bound = time.Unix(ts, 0).UTC()
+		}
+	}
+	if l := params.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			http.Error(w, fmt.Sprintf("Invalid 'limit' query parameter: must be 1-%d", maxAuditLimit), http.StatusBadRequest)
+			return
+		}
+		query.Limit = limit
+	}
+
+	entries, err := dao.GetAuditLog(query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to retrieve audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, entries)
+}
+
+// changeSource attributes an administrative change to the authenticated
+// caller. Every such change must say why it was made.
+func changeSource(r *http.Request, reason string) (models.ChangeSource, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return models.ChangeSource{}, errors.New("a 'reason' for the change is required")
+	}
+	actor := "anonymous"
+	if principal := middleware.GetPrincipal(r.Context()); principal != nil {
+		actor = principal.Subject
+	}
+	return models.ChangeSource{Actor: actor, Reason: reason}, nil
+}
+
+func validateReport(report models.StormReport) error {
+	switch report.Type {
+	case models.TORNADO, models.HAIL, models.WIND:
+	default:
+		return fmt.Errorf("'type' must be tornado, hail or wind")
+	}
+	if _, err := strconv.ParseInt(report.Date, 10, 64); err != nil {
+		return fmt.Errorf("'date' must be a unix timestamp")
+	}
+	if report.Time < 0 || report.Time > 2359 || report.Time%100 > 59 {
+		return fmt.Errorf("'time' must be HHMM")
+	}
+	if strings.TrimSpace(report.State) == "" {
+		return fmt.Errorf("'state' is required")
+	}
+	if report.Lat < -90 || report.Lat > 90 || report.Lon < -180 || report.Lon > 180 {
+		return fmt.Errorf("'lat' and 'lon' must be valid coordinates")
+	}
+	return nil
+}
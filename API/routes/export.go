@@ -0,0 +1,83 @@
+package routes
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jonathanface/storm-reporter/API/middleware"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+var exportColumns = []string{"id", "date", "time", "type", "size", "fScale", "speed", "location", "county", "state", "lat", "lon", "comments"}
+
+// GetExportHandler downloads the reports in a start/end range, narrowed by
+// the shared filters, as CSV (the default) or, with format=ndjson, as one
+// JSON report per line.
+func GetExportHandler(w http.ResponseWriter, r *http.Request) {
+	dao := middleware.GetDAO(r.Context())
+	params := r.URL.Query()
+
+	query, err := parseStormQuery(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query, err = parsePage(params, query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := params.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		http.Error(w, "Invalid 'format' query parameter: must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	reports, err := dao.GetStormReports(r.Context(), query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to retrieve storm reports: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("storm-reports-%d-%d.%s", query.Start.Unix(), query.End.Unix(), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for _, report := range reports {
+			enc.Encode(report)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	cw.Write(exportColumns)
+	for _, report := range reports {
+		cw.Write(exportRow(report))
+	}
+	cw.Flush()
+}
+
+func exportRow(report models.StormReport) []string {
+	return []string{
+		report.ID,
+		report.Date,
+		fmt.Sprintf("%04d", report.Time),
+		string(report.Type),
+		strconv.FormatFloat(report.Size, 'f', -1, 64),
+		report.F_Scale,
+		strconv.Itoa(int(report.Speed)),
+		report.Location,
+		report.County,
+		report.State,
+		strconv.FormatFloat(report.Lat, 'f', -1, 64),
+		strconv.FormatFloat(report.Lon, 'f', -1, 64),
+		report.Comments,
+	}
+}
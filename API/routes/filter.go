@@ -0,0 +1,124 @@
+package routes
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+// parseFilter reads the shared type/state/county/bbox query parameters.
+// Each accepts a comma-separated list; bbox is minLon,minLat,maxLon,maxLat.
+// Only the syntax is checked here; StormFilter.Validate checks the values.
+func parseFilter(query url.Values) (models.StormFilter, error) {
+	var filter models.StormFilter
+
+	for _, t := range splitParam(query.Get("type")) {
+		filter.Types = append(filter.Types, models.StormType(strings.ToLower(t)))
+	}
+	for _, s := range splitParam(query.Get("state")) {
+		filter.States = append(filter.States, strings.ToUpper(s))
+	}
+	filter.Counties = splitParam(query.Get("county"))
+
+	if bbox := query.Get("bbox"); bbox != "" {
+		parts := strings.Split(bbox, ",")
+		if len(parts) != 4 {
+			return filter, fmt.Errorf("invalid 'bbox' query parameter: expected minLon,minLat,maxLon,maxLat")
+		}
+		var coords [4]float64
+		for i, p := range parts {
+			v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return filter, fmt.Errorf("invalid 'bbox' query parameter: %v", err)
+			}
+			coords[i] = v
+		}
+		filter.BBox = &models.BoundingBox{MinLon: coords[0], MinLat: coords[1], MaxLon: coords[2], MaxLat: coords[3]}
+	}
+	return filter, nil
+}
+
+// parseDateRange reads 'start' and 'end' unix timestamps, defaulting to the
+// current day. The end bound is inclusive.
+func parseDateRange(query url.Values) (time.Time, time.Time, error) {
+	now := time.Now()
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).Unix()
+	end := start + 86400 - 1
+
+	var err error
+	if s := query.Get("start"); s != "" {
+		if start, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid 'start' query parameter")
+		}
+		if query.Get("end") == "" {
+			end = start + 86400 - 1
+		}
+	}
+	if e := query.Get("end"); e != "" {
+		if end, err = strconv.ParseInt(e, 10, 64); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid 'end' query parameter")
+		}
+	}
+	return time.Unix(start, 0).UTC(), time.Unix(end, 0).UTC(), nil
+}
+
+// parseStormQuery reads the date range and filter parameters into a query
+// and validates it.
+func parseStormQuery(query url.Values) (models.StormQuery, error) {
+	start, end, err := parseDateRange(query)
+	if err != nil {
+		return models.StormQuery{}, err
+	}
+	filter, err := parseFilter(query)
+	if err != nil {
+		return models.StormQuery{}, err
+	}
+	q := models.NewStormQuery(start, end).WithFilter(filter)
+	if err := q.Validate(); err != nil {
+		return q, fmt.Errorf("invalid query: %v", err)
+	}
+	return q, nil
+}
+
+// parsePage reads the 'limit', 'offset' and 'sort' query parameters into q
+// and validates the result.
+func parsePage(query url.Values, q models.StormQuery) (models.StormQuery, error) {
+	var limit, offset int
+	var err error
+	if s := query.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil {
+			return q, fmt.Errorf("invalid 'limit' query parameter")
+		}
+	}
+	if s := query.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil {
+			return q, fmt.Errorf("invalid 'offset' query parameter")
+		}
+	}
+	q = q.WithPage(limit, offset)
+	if s := query.Get("sort"); s != "" {
+		order, err := models.ParseSortOrder(s)
+		if err != nil {
+			return q, fmt.Errorf("invalid 'sort' query parameter: %v", err)
+		}
+		q = q.WithSort(order)
+	}
+	if err := q.Validate(); err != nil {
+		return q, fmt.Errorf("invalid query: %v", err)
+	}
+	return q, nil
+}
+
+func splitParam(value string) []string {
+	var out []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
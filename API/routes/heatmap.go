@@ -0,0 +1,62 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jonathanface/storm-reporter/API/geo"
+	"github.com/jonathanface/storm-reporter/API/middleware"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+const (
+	defaultCellSize = 1.0
+	minCellSize     = 0.01
+	maxCellSize     = 20.0
+)
+
+// GetHeatmapHandler bins the reports in a start/end window into grid or hex
+// cells so clients can render density instead of individual markers.
+func GetHeatmapHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	dao := middleware.GetDAO(r.Context())
+	params := r.URL.Query()
+
+	query, err := parseStormQuery(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	shape := models.CellGrid
+	if s := params.Get("shape"); s != "" {
+		shape = models.CellShape(s)
+	}
+	if shape != models.CellGrid && shape != models.CellHex {
+		http.Error(w, "Invalid 'shape' query parameter: must be grid or hex", http.StatusBadRequest)
+		return
+	}
+	cellSize := defaultCellSize
+	if s := params.Get("cellSize"); s != "" {
+		cellSize, err = strconv.ParseFloat(s, 64)
+		if err != nil || cellSize < minCellSize || cellSize > maxCellSize {
+			http.Error(w, fmt.Sprintf("Invalid 'cellSize' query parameter: must be between %v and %v degrees", minCellSize, maxCellSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	reports, err := dao.GetStormReports(r.Context(), query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to retrieve storm reports: %v", err), http.StatusInternalServerError)
+		return
+	}
+	heatmap, err := geo.Bin(reports, shape, cellSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, heatmap)
+}
@@ -0,0 +1,78 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jonathanface/storm-reporter/API/middleware"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+type reportResponse struct {
+	Report    *models.StormReport     `json:"report"`
+	Revisions []models.ReportRevision `json:"revisions"`
+}
+
+// GetReportHandler returns a single report by ID along with the prior
+// versions recorded whenever an update changed it, oldest first. Deleted
+// reports are only shown to admins.
+func GetReportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	dao := middleware.GetDAO(r.Context())
+	id := r.PathValue("id")
+
+	report, err := dao.GetStormReport(r.Context(), id)
+	if err == nil && report.Deleted && !isAdmin(r) {
+		err = models.ErrNotFound
+	}
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, "No storm report found with the given id", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to retrieve storm report: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	revisions, err := dao.GetStormReportHistory(r.Context(), id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to retrieve storm report history: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, reportResponse{Report: report, Revisions: revisions})
+}
+
+// GetDeletedReportsHandler lists the reports deleted from a start/end range
+// of report dates, narrowed by the usual filters and paged, most recently
+// deleted first.
+func GetDeletedReportsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	dao := middleware.GetDAO(r.Context())
+
+	params := r.URL.Query()
+	query, err := parseStormQuery(params)
+	if err == nil {
+		query, err = parsePage(params, query)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reports, err := dao.GetDeletedStormReports(query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to retrieve deleted storm reports: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, reports)
+}
+
+func isAdmin(r *http.Request) bool {
+	principal := middleware.GetPrincipal(r.Context())
+	return principal != nil && principal.HasScope(models.ScopeAdmin)
+}
@@ -1,13 +1,13 @@
 package routes
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/jonathanface/storm-reporter/API/middleware"
+	"github.com/jonathanface/storm-reporter/API/models"
 )
 
 func GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
@@ -33,12 +33,23 @@ func GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Println("time", unixTimestamp)
 
-	startOfDay := unixTimestamp
-	endOfDay := unixTimestamp + 86400 - 1
-	startStr := strconv.FormatInt(startOfDay, 10)
-	endStr := strconv.FormatInt(endOfDay, 10)
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query, err := parsePage(r.URL.Query(), models.DayQuery(time.Unix(unixTimestamp, 0).UTC()).WithFilter(filter))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	reports, err := dao.GetStormReports(startStr, endStr)
+	if q := r.URL.Query().Get("q"); q != "" {
+		searchMessages(w, r, dao, query, q)
+		return
+	}
+
+	reports, err := dao.GetStormReports(r.Context(), query)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to retrieve storm reports: %v", err), http.StatusInternalServerError)
 		return
@@ -49,5 +60,27 @@ func GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	json.NewEncoder(w).Encode(reports)
+	writeJSON(w, r, reports)
+}
+
+// searchMessages answers a /messages request carrying a 'q' text search,
+// returning matches ordered by relevance with highlighted snippets.
+func searchMessages(w http.ResponseWriter, r *http.Request, dao models.StormDAOInterface, query models.StormQuery, q string) {
+	if models.ParseSearch(q).IsEmpty() {
+		http.Error(w, "Invalid 'q' query parameter: must include a word or phrase to match", http.StatusBadRequest)
+		return
+	}
+
+	matched, err := dao.SearchStormReports(r.Context(), query, q)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to search storm reports: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if len(matched) == 0 {
+		http.Error(w, "No storm reports found for the given date", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, r, matched)
 }
@@ -1,12 +1,18 @@
 package routes_test
 
 import (
+	"bufio"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/jonathanface/storm-reporter/API/broadcast"
 	"github.com/jonathanface/storm-reporter/API/dao"
+	"github.com/jonathanface/storm-reporter/API/geo"
 	"github.com/jonathanface/storm-reporter/API/middleware"
 	"github.com/jonathanface/storm-reporter/API/models"
 	"github.com/jonathanface/storm-reporter/API/routes"
@@ -14,9 +20,9 @@ import (
 
 func TestGetMessagesHandler(t *testing.T) {
 	mockDAO := &dao.MockStormDAO{
-		MockGetStormReports: func(start string, end string) ([]models.StormReport, error) {
+		MockGetStormReports: func(query models.StormQuery) ([]models.StormReport, error) {
 			return []models.StormReport{
-				{Date: "2024-12-09", Location: "Test City", Type: "tornado"},
+				{Date: "1733775461", Location: "Test City", Type: "tornado"},
 			}, nil
 		},
 	}
@@ -45,3 +51,813 @@ func TestGetMessagesHandler(t *testing.T) {
 		t.Errorf("Unexpected response: %v", reports)
 	}
 }
+
+func TestGetMessagesHandler_Filter(t *testing.T) {
+	mockDAO := &dao.MockStormDAO{
+		MockGetStormReports: func(query models.StormQuery) ([]models.StormReport, error) {
+			return matching(query,
+				models.StormReport{Location: "Test City", State: "TX", Type: "tornado"},
+				models.StormReport{Location: "Other City", State: "OK", Type: "hail"},
+			), nil
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/messages?date=1733775461&type=hail&state=ok", nil)
+	rr := httptest.NewRecorder()
+	middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.GetMessagesHandler)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", rr.Code)
+	}
+	var reports []models.StormReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &reports); err != nil {
+		t.Fatalf("Could not parse response: %v", err)
+	}
+	if len(reports) != 1 || reports[0].Location != "Other City" {
+		t.Errorf("Unexpected response: %v", reports)
+	}
+}
+
+func TestGetMessagesHandler_Page(t *testing.T) {
+	var got models.StormQuery
+	mockDAO := &dao.MockStormDAO{
+		MockGetStormReports: func(query models.StormQuery) ([]models.StormReport, error) {
+			got = query
+			return []models.StormReport{{Location: "Test City", Type: "tornado"}}, nil
+		},
+	}
+	handler := middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.GetMessagesHandler))
+
+	req := httptest.NewRequest("GET", "/messages?date=1733702400&limit=20&offset=40&sort=-date", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", rr.Code)
+	}
+	if got.Start.Unix() != 1733702400 || got.End.Unix() != 1733788799 {
+		t.Errorf("Unexpected range: %v - %v", got.Start, got.End)
+	}
+	if got.Limit != 20 || got.Offset != 40 || got.Sort != models.SortDateDesc {
+		t.Errorf("Unexpected page: %+v", got)
+	}
+
+	for _, params := range []string{"limit=-1", "limit=many", "offset=-5", "sort=size"} {
+		req := httptest.NewRequest("GET", "/messages?date=1733702400&"+params, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request for %s; got %v", params, rr.Code)
+		}
+	}
+}
+
+func TestGetStatsHandler(t *testing.T) {
+	var got models.StatsQuery
+	mockDAO := &dao.MockStormDAO{
+		MockGetStormStats: func(query models.StatsQuery) ([]models.StatsRow, error) {
+			got = query
+			return []models.StatsRow{{Type: models.HAIL, State: "TX", Count: 4}}, nil
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/stats?start=1733702400&end=1734307199&groupBy=type,state&type=hail", nil)
+	rr := httptest.NewRecorder()
+	middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.GetStatsHandler)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", rr.Code)
+	}
+	if got.Start.Unix() != 1733702400 || got.End.Unix() != 1734307199 {
+		t.Errorf("Unexpected range: %v - %v", got.Start, got.End)
+	}
+	if len(got.GroupBy) != 2 || got.GroupBy[0] != models.DimensionType || got.GroupBy[1] != models.DimensionState {
+		t.Errorf("Unexpected groupBy: %v", got.GroupBy)
+	}
+	if len(got.Filter.Types) != 1 || got.Filter.Types[0] != models.HAIL {
+		t.Errorf("Unexpected filter: %+v", got.Filter)
+	}
+	if rr.Body.String() != "[{\"type\":\"hail\",\"state\":\"TX\",\"count\":4}]\n" {
+		t.Errorf("Unexpected response: %s", rr.Body.String())
+	}
+
+	for _, target := range []string{
+		"/stats?groupBy=month",
+		"/stats?type=flood",
+		"/stats?bbox=-90,40,-100,30",
+		"/stats?start=1733702400&end=1733702399",
+	} {
+		req = httptest.NewRequest("GET", target, nil)
+		rr = httptest.NewRecorder()
+		middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.GetStatsHandler)).ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request for %s; got %v", target, rr.Code)
+		}
+	}
+}
+
+func TestGetExportHandler(t *testing.T) {
+	mockDAO := &dao.MockStormDAO{
+		MockGetStormReports: func(query models.StormQuery) ([]models.StormReport, error) {
+			return matching(query,
+				models.StormReport{ID: "a1", Date: "1733702400", Time: 905, Type: models.HAIL, Size: 175, Location: "Amarillo", County: "Potter", State: "TX", Lat: 35.2, Lon: -101.8, Comments: "Hail, \"golf ball\" sized"},
+				models.StormReport{ID: "b2", Date: "1733702400", Time: 1200, Type: models.WIND, Speed: 70, State: "OK"},
+			), nil
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/export?start=1733702400&state=TX", nil)
+	rr := httptest.NewRecorder()
+	middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.GetExportHandler)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("Unexpected Content-Type: %s", ct)
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != `attachment; filename="storm-reports-1733702400-1733788799.csv"` {
+		t.Errorf("Unexpected Content-Disposition: %s", cd)
+	}
+	want := "id,date,time,type,size,fScale,speed,location,county,state,lat,lon,comments\n" +
+		"a1,1733702400,0905,hail,175,,0,Amarillo,Potter,TX,35.2,-101.8,\"Hail, \"\"golf ball\"\" sized\"\n"
+	if rr.Body.String() != want {
+		t.Errorf("Unexpected CSV:\n%s", rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/export?start=1733702400&format=ndjson", nil)
+	rr = httptest.NewRecorder()
+	middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.GetExportHandler)).ServeHTTP(rr, req)
+	if lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n"); len(lines) != 2 {
+		t.Errorf("Expected 2 NDJSON lines; got %d", len(lines))
+	}
+
+	req = httptest.NewRequest("GET", "/export?format=xml", nil)
+	rr = httptest.NewRecorder()
+	middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.GetExportHandler)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request; got %v", rr.Code)
+	}
+}
+
+func TestGetHeatmapHandler(t *testing.T) {
+	mockDAO := &dao.MockStormDAO{
+		MockGetStormReports: func(query models.StormQuery) ([]models.StormReport, error) {
+			return matching(query,
+				models.StormReport{Lat: 35.2, Lon: -97.4, Type: models.TORNADO},
+				models.StormReport{Lat: 35.7, Lon: -97.9, Type: models.HAIL},
+				models.StormReport{Lat: 41.5, Lon: -90.2, Type: models.WIND},
+			), nil
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/heatmap?start=1733702400&shape=grid&cellSize=1&type=tornado,hail", nil)
+	rr := httptest.NewRecorder()
+	middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.GetHeatmapHandler)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", rr.Code)
+	}
+	var heatmap models.Heatmap
+	if err := json.Unmarshal(rr.Body.Bytes(), &heatmap); err != nil {
+		t.Fatalf("Could not parse response: %v", err)
+	}
+	if len(heatmap.Cells) != 1 || heatmap.Cells[0].Total != 2 {
+		t.Errorf("Unexpected response: %+v", heatmap)
+	}
+
+	req = httptest.NewRequest("GET", "/heatmap?cellSize=500", nil)
+	rr = httptest.NewRecorder()
+	middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.GetHeatmapHandler)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request; got %v", rr.Code)
+	}
+}
+
+func TestGetTileHandler(t *testing.T) {
+	var queried []models.StormQuery
+	mockDAO := &dao.MockStormDAO{
+		MockGetStormReports: func(query models.StormQuery) ([]models.StormReport, error) {
+			queried = append(queried, query)
+			return []models.StormReport{{Lat: 35.2, Lon: -97.4, Type: models.TORNADO}}, nil
+		},
+	}
+	handler := middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.GetTileHandler))
+
+	req := httptest.NewRequest("GET", "/tiles/4/3/6.mvt?start=1733702400", nil)
+	req.SetPathValue("z", "4")
+	req.SetPathValue("x", "3")
+	req.SetPathValue("y", "6.mvt")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/vnd.mapbox-vector-tile" {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	if cc := rr.Header().Get("Cache-Control"); cc != "public, max-age=86400" {
+		t.Errorf("Unexpected cache control %q", cc)
+	}
+	if rr.Body.Len() == 0 {
+		t.Error("Expected a non-empty tile")
+	}
+	// Only the tile's surroundings are fetched, not the whole map.
+	if len(queried) != 1 || queried[0].Filter.BBox == nil {
+		t.Fatalf("Expected one query limited to the tile; got %+v", queried)
+	}
+	tile, _ := geo.ParseTile(4, 3, 6)
+	bbox, tileBounds := *queried[0].Filter.BBox, geo.TileBounds(tile)
+	if bbox.MinLat > tileBounds.MinLat || bbox.MaxLat < tileBounds.MaxLat || bbox.MinLon > tileBounds.MinLon || bbox.MaxLon < tileBounds.MaxLon || bbox.MaxLon-bbox.MinLon > 2*(tileBounds.MaxLon-tileBounds.MinLon) {
+		t.Errorf("Expected the tile's bounds with a small buffer; got %+v for %+v", bbox, tileBounds)
+	}
+
+	// A client bbox narrows the query further, and one that misses the
+	// tile needs no query at all.
+	for _, bbox := range []string{"-98,35,-97,36", "-80,40,-79,41"} {
+		req := httptest.NewRequest("GET", "/tiles/4/3/6.mvt?start=1733702400&bbox="+bbox, nil)
+		req.SetPathValue("z", "4")
+		req.SetPathValue("x", "3")
+		req.SetPathValue("y", "6.mvt")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status OK for bbox %s; got %v", bbox, rr.Code)
+		}
+	}
+	if len(queried) != 2 {
+		t.Fatalf("Expected only the overlapping bbox to be queried; got %d queries", len(queried))
+	}
+	if got := *queried[1].Filter.BBox; got != (models.BoundingBox{MinLat: 35, MinLon: -98, MaxLat: 36, MaxLon: -97}) {
+		t.Errorf("Expected the client's bbox inside the tile; got %+v", got)
+	}
+
+	req = httptest.NewRequest("GET", "/tiles/4/16/6.mvt", nil)
+	req.SetPathValue("z", "4")
+	req.SetPathValue("x", "16")
+	req.SetPathValue("y", "6.mvt")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request; got %v", rr.Code)
+	}
+}
+
+func TestGetReportHandler(t *testing.T) {
+	mockDAO := &dao.MockStormDAO{
+		MockGetStormReport: func(id string) (*models.StormReport, error) {
+			if id != "abc123" {
+				return nil, models.ErrNotFound
+			}
+			return &models.StormReport{ID: id, Location: "Test City", Comments: "roof damage"}, nil
+		},
+		MockGetStormReportHistory: func(id string) ([]models.ReportRevision, error) {
+			return []models.ReportRevision{{
+				ReportID: id,
+				Previous: models.StormReport{ID: id, Location: "Test City"},
+				Changes:  map[string]models.FieldChange{"comments": {Old: "", New: "roof damage"}},
+				Source:   models.ChangeSource{Actor: models.ActorIngest, KafkaOffset: 42},
+			}}, nil
+		},
+	}
+	handler := middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.GetReportHandler))
+
+	req := httptest.NewRequest("GET", "/reports/abc123", nil)
+	req.SetPathValue("id", "abc123")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", rr.Code)
+	}
+	var body struct {
+		Report    models.StormReport      `json:"report"`
+		Revisions []models.ReportRevision `json:"revisions"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Could not parse response: %v", err)
+	}
+	if body.Report.ID != "abc123" || len(body.Revisions) != 1 || body.Revisions[0].Source.KafkaOffset != 42 {
+		t.Errorf("Unexpected response: %+v", body)
+	}
+
+	req = httptest.NewRequest("GET", "/reports/missing", nil)
+	req.SetPathValue("id", "missing")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status Not Found; got %v", rr.Code)
+	}
+}
+
+func TestDeletedReports(t *testing.T) {
+	deletedAt := time.Unix(1733710000, 0).UTC()
+	deleted := models.StormReport{ID: "abc123", Date: "1733702400", Time: 1530, Type: models.HAIL, State: "TX", Deleted: true, DeletedAt: &deletedAt}
+	var got models.StormQuery
+	mockDAO := &dao.MockStormDAO{
+		MockGetStormReport: func(id string) (*models.StormReport, error) {
+			report := deleted
+			return &report, nil
+		},
+		MockGetStormReportHistory: func(id string) ([]models.ReportRevision, error) {
+			return nil, nil
+		},
+		MockGetDeletedStormReports: func(query models.StormQuery) ([]models.StormReport, error) {
+			got = query
+			return []models.StormReport{deleted}, nil
+		},
+	}
+	as := func(scopes ...models.Scope) middleware.Authenticator {
+		return func(r *http.Request) (*models.Principal, error) {
+			return &models.Principal{Subject: "tester", Scopes: scopes}, nil
+		}
+	}
+	serve := func(handler http.HandlerFunc, auth middleware.Authenticator, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.SetPathValue("id", "abc123")
+		if auth != nil {
+			handler = middleware.RequireScope(auth, models.ScopeRead)(handler)
+		}
+		rr := httptest.NewRecorder()
+		middleware.WithDAOContext(mockDAO)(handler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve(routes.GetReportHandler, nil, "/reports/abc123"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status Not Found for an anonymous caller; got %v", rr.Code)
+	}
+	if rr := serve(routes.GetReportHandler, as(models.ScopeRead), "/reports/abc123"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status Not Found for a reader; got %v", rr.Code)
+	}
+	rr := serve(routes.GetReportHandler, as(models.ScopeRead, models.ScopeAdmin), "/reports/abc123")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK for an admin; got %v", rr.Code)
+	}
+	var body struct {
+		Report models.StormReport `json:"report"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || !body.Report.Deleted || body.Report.DeletedAt == nil {
+		t.Errorf("Unexpected response: %s", rr.Body.String())
+	}
+
+	rr = serve(routes.GetDeletedReportsHandler, nil, "/reports/deleted?start=1733702400&end=1733788800")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", rr.Code)
+	}
+	var reports []models.StormReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &reports); err != nil || len(reports) != 1 || got.Start.Unix() != 1733702400 || got.End.Unix() != 1733788800 {
+		t.Errorf("Unexpected deleted reports %s for %v-%v", rr.Body.String(), got.Start, got.End)
+	}
+	if rr := serve(routes.GetDeletedReportsHandler, nil, "/reports/deleted?start=yesterday&end=1733788800"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request; got %v", rr.Code)
+	}
+
+	// Deleted reports can't be patched, and reports can't be deleted by patching.
+	patch := func(body string) int {
+		req := httptest.NewRequest("PATCH", "/reports/abc123", strings.NewReader(body))
+		req.SetPathValue("id", "abc123")
+		rr := httptest.NewRecorder()
+		middleware.WithDAOContext(mockDAO)(routes.PatchReportHandler).ServeHTTP(rr, req)
+		return rr.Code
+	}
+	mockDAO.MockUpdateStormReport = func(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+		return models.UpsertResult{ID: report.ID, Report: report, Changed: true}, nil
+	}
+	if code := patch(`{"changes":{"size":100},"reason":"x","revision":1}`); code != http.StatusNotFound {
+		t.Errorf("Expected status Not Found patching a deleted report; got %v", code)
+	}
+	deleted.Deleted, deleted.DeletedAt = false, nil
+	for _, body := range []string{`{"changes":{"deleted":true},"reason":"x","revision":1}`, `{"changes":{"deletedAt":"2024-12-09T00:00:00Z"},"reason":"x","revision":1}`} {
+		if code := patch(body); code != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request for %s; got %v", body, code)
+		}
+	}
+	if code := patch(`{"changes":{"size":100},"reason":"x","revision":1}`); code != http.StatusOK {
+		t.Errorf("Expected status OK; got %v", code)
+	}
+}
+
+func TestAdminReportHandlers(t *testing.T) {
+	stored := models.StormReport{ID: "abc123", Date: "1733702400", Time: 1530, Type: models.HAIL, Size: 100, State: "TX", County: "Dallas", Location: "Plano", Lat: 33, Lon: -96.7}
+	var gotSource models.ChangeSource
+	var updated models.StormReport
+	var gotQuery models.AuditQuery
+	mockDAO := &dao.MockStormDAO{
+		MockGetStormReport: func(id string) (*models.StormReport, error) {
+			if id != stored.ID {
+				return nil, models.ErrNotFound
+			}
+			report := stored
+			return &report, nil
+		},
+		MockCreateStormReport: func(report models.StormReport, source models.ChangeSource) (models.StormReport, error) {
+			gotSource = source
+			report.ID = models.ReportID(report)
+			if report.ID == models.ReportID(stored) {
+				return report, models.ErrConflict
+			}
+			return report, nil
+		},
+		MockUpdateStormReport: func(report models.StormReport, source models.ChangeSource) (models.UpsertResult, error) {
+			gotSource, updated = source, report
+			if report.Comments == "raced" {
+				return models.UpsertResult{ID: report.ID}, models.ErrStaleRevision
+			}
+			return models.UpsertResult{ID: report.ID, Report: report, Changed: true}, nil
+		},
+		MockDeleteStormReport: func(id string, source models.ChangeSource) (models.StormReport, error) {
+			gotSource = source
+			if id != stored.ID {
+				return models.StormReport{}, models.ErrNotFound
+			}
+			return stored, nil
+		},
+		MockGetAuditLog: func(query models.AuditQuery) ([]models.AuditEntry, error) {
+			gotQuery = query
+			return []models.AuditEntry{{Action: models.AuditDelete, ReportID: stored.ID, Actor: "analyst", Reason: "duplicate"}}, nil
+		},
+	}
+	serve := func(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if parts := strings.Split(strings.Split(target, "?")[0], "/"); len(parts) == 3 {
+			req.SetPathValue("id", parts[2])
+		}
+		rr := httptest.NewRecorder()
+		middleware.WithDAOContext(mockDAO)(handler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Create
+	rr := serve(routes.CreateReportHandler, "POST", "/reports", `{"report":{"date":"1733702400","time":1200,"type":"wind","speed":70,"state":"OK","lat":35,"lon":-97},"reason":"missed by SPC feed"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status Created; got %v: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.HasPrefix(rr.Header().Get("Location"), "/reports/") || gotSource.Reason != "missed by SPC feed" || gotSource.Actor != "anonymous" {
+		t.Errorf("Unexpected create: Location %q, source %+v", rr.Header().Get("Location"), gotSource)
+	}
+	for body, want := range map[string]int{
+		`{"report":{"date":"1733702400","time":1200,"type":"wind","state":"OK"}}`:                                                   http.StatusBadRequest,
+		`{"report":{"date":"1733702400","time":1200,"type":"snow","state":"OK"},"reason":"x"}`:                                      http.StatusBadRequest,
+		`{"report":{"date":"1733702400","time":1575,"type":"wind","state":"OK"},"reason":"x"}`:                                      http.StatusBadRequest,
+		`{"report":{"date":"1733702400","time":1530,"type":"hail","state":"TX","county":"Dallas","location":"Plano"},"reason":"x"}`: http.StatusConflict,
+	} {
+		if rr := serve(routes.CreateReportHandler, "POST", "/reports", body); rr.Code != want {
+			t.Errorf("Expected status %d for %s; got %v", want, body, rr.Code)
+		}
+	}
+
+	// Patch
+	rr = serve(routes.PatchReportHandler, "PATCH", "/reports/abc123", `{"changes":{"size":175,"comments":"Corrected size"},"reason":"analyst review","revision":1}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v: %s", rr.Code, rr.Body.String())
+	}
+	if updated.Size != 175 || updated.Comments != "Corrected size" || updated.Location != "Plano" || updated.ID != "abc123" {
+		t.Errorf("Unexpected patched report: %+v", updated)
+	}
+	for _, body := range []string{
+		`{"changes":{"id":"other"},"reason":"x","revision":1}`,
+		`{"changes":{"location":"Frisco"},"reason":"x","revision":1}`,
+		`{"changes":{"time":1300},"reason":"x","revision":1}`,
+		`{"changes":{"type":"wind"},"reason":"x","revision":1}`,
+		`{"changes":{"bogus":1},"reason":"x","revision":1}`,
+		`{"changes":{"revision":7},"reason":"x","revision":1}`,
+		`{"changes":{"updatedAt":"2024-12-09T00:00:00Z"},"reason":"x","revision":1}`,
+		`{"changes":{"withdrawn":false},"reason":"x","revision":1}`,
+		`{"changes":{"withdrawnAt":null},"reason":"x","revision":1}`,
+		`{"changes":{"synthetic":false},"reason":"x","revision":1}`,
+		`{"changes":{"size":1},"revision":1}`,
+		`{"changes":{"size":1},"reason":"x"}`,
+		`{"reason":"x","revision":1}`,
+	} {
+		if rr := serve(routes.PatchReportHandler, "PATCH", "/reports/abc123", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request for %s; got %v", body, rr.Code)
+		}
+	}
+	if rr := serve(routes.PatchReportHandler, "PATCH", "/reports/missing", `{"changes":{"size":1},"reason":"x","revision":1}`); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status Not Found; got %v", rr.Code)
+	}
+	// A patch made against an older revision than the stored one is
+	// refused, whether the report moved on before it was read or after.
+	updated = models.StormReport{}
+	if rr := serve(routes.PatchReportHandler, "PATCH", "/reports/abc123", `{"changes":{"size":1},"reason":"x","revision":2}`); rr.Code != http.StatusConflict || updated.ID != "" {
+		t.Errorf("Expected status Conflict for a patch of another revision; got %v", rr.Code)
+	}
+	if rr := serve(routes.PatchReportHandler, "PATCH", "/reports/abc123", `{"changes":{"comments":"raced"},"reason":"x","revision":1}`); rr.Code != http.StatusConflict {
+		t.Errorf("Expected status Conflict for a stale update; got %v", rr.Code)
+	}
+
+	// Delete
+	if rr := serve(routes.DeleteReportHandler, "DELETE", "/reports/abc123", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request without a reason; got %v", rr.Code)
+	}
+	if rr := serve(routes.DeleteReportHandler, "DELETE", "/reports/abc123?reason=duplicate", ""); rr.Code != http.StatusNoContent || gotSource.Reason != "duplicate" {
+		t.Errorf("Unexpected delete: status %v, source %+v", rr.Code, gotSource)
+	}
+	if rr := serve(routes.DeleteReportHandler, "DELETE", "/reports/missing?reason=x", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status Not Found; got %v", rr.Code)
+	}
+
+	// Audit log
+	rr = serve(routes.GetAuditHandler, "GET", "/audit?reportId=abc123&action=delete&since=1733702400&limit=10", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", rr.Code)
+	}
+	if gotQuery.ReportID != "abc123" || gotQuery.Action != models.AuditDelete || gotQuery.Since.Unix() != 1733702400 || gotQuery.Limit != 10 {
+		t.Errorf("Unexpected audit query: %+v", gotQuery)
+	}
+	var entries []models.AuditEntry
+	if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil || len(entries) != 1 || entries[0].Actor != "analyst" {
+		t.Errorf("Unexpected audit response: %s", rr.Body.String())
+	}
+	for _, target := range []string{"/audit?action=rename", "/audit?limit=0", "/audit?since=yesterday"} {
+		if rr := serve(routes.GetAuditHandler, "GET", target, ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request for %s; got %v", target, rr.Code)
+		}
+	}
+}
+
+func TestPurgeReportsHandler(t *testing.T) {
+	matched := int64(3)
+	var purged *models.PurgeQuery
+	var gotSource models.ChangeSource
+	mockDAO := &dao.MockStormDAO{
+		MockPurgeStormReports: func(query models.PurgeQuery, dryRun bool, source models.ChangeSource) (models.PurgeResult, error) {
+			if dryRun {
+				return models.PurgeResult{Matched: matched}, nil
+			}
+			purged, gotSource = &query, source
+			return models.PurgeResult{Matched: matched, Purged: matched}, nil
+		},
+	}
+	serve := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/reports/purge", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.PurgeReportsHandler)).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(`{"synthetic":true,"filter":{"states":["tx"]},"dryRun":true}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v: %s", rr.Code, rr.Body.String())
+	}
+	var dryRun struct {
+		Matched           int64  `json:"matched"`
+		ConfirmationToken string `json:"confirmationToken"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &dryRun); err != nil || dryRun.Matched != 3 || dryRun.ConfirmationToken == "" {
+		t.Fatalf("Unexpected dry run response: %s", rr.Body.String())
+	}
+	if purged != nil {
+		t.Fatal("Dry run purged reports")
+	}
+
+	for body, want := range map[string]int{
+		`{"dryRun":true}`: http.StatusBadRequest,
+		`{"synthetic":true,"filter":{"states":["TX"]},"reason":"cleanup"}`:                                             http.StatusBadRequest,
+		`{"synthetic":true,"filter":{"states":["TX"]},"confirmationToken":"` + dryRun.ConfirmationToken + `"}`:         http.StatusBadRequest,
+		`{"synthetic":true,"mode":"delete","reason":"cleanup","confirmationToken":"` + dryRun.ConfirmationToken + `"}`: http.StatusConflict,
+	} {
+		if rr := serve(body); rr.Code != want {
+			t.Errorf("Expected status %d for %s; got %v", want, body, rr.Code)
+		}
+	}
+
+	confirm := `{"synthetic":true,"filter":{"states":["TX"]},"reason":"cleanup","confirmationToken":"` + dryRun.ConfirmationToken + `"}`
+	matched = 4
+	if rr := serve(confirm); rr.Code != http.StatusConflict || purged != nil {
+		t.Errorf("Expected status Conflict once the match count changed; got %v", rr.Code)
+	}
+	matched = 3
+	rr = serve(confirm)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v: %s", rr.Code, rr.Body.String())
+	}
+	if purged == nil || purged.Mode != models.PurgeSoftDelete || !purged.Synthetic || purged.Filter.States[0] != "TX" || gotSource.Reason != "cleanup" {
+		t.Errorf("Unexpected purge: %+v from %+v", purged, gotSource)
+	}
+	if rr.Body.String() != "{\"matched\":3,\"purged\":3}\n" {
+		t.Errorf("Unexpected response: %s", rr.Body.String())
+	}
+}
+
+func TestGetMessagesHandler_Search(t *testing.T) {
+	var gotQuery string
+	mockDAO := &dao.MockStormDAO{
+		MockSearchStormReports: func(query models.StormQuery, q string) ([]models.SearchResult, error) {
+			gotQuery = q
+			var results []models.SearchResult
+			for _, result := range []models.SearchResult{
+				{StormReport: models.StormReport{Location: "Test City", Type: "wind", Comments: "roof off"}, Score: 2, Highlights: map[string]string{"comments": "<mark>roof</mark> off"}},
+				{StormReport: models.StormReport{Location: "Other City", Type: "hail", Comments: "roof dented"}, Score: 1},
+			} {
+				if query.Filter.Matches(result.StormReport) {
+					results = append(results, result)
+				}
+			}
+			return results, nil
+		},
+	}
+	handler := middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.GetMessagesHandler))
+
+	req := httptest.NewRequest("GET", "/messages?date=1733775461&type=wind&q=roof+-tree", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", rr.Code)
+	}
+	if gotQuery != "roof -tree" {
+		t.Errorf("Unexpected query %q", gotQuery)
+	}
+	var results []models.SearchResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatalf("Could not parse response: %v", err)
+	}
+	if len(results) != 1 || results[0].Location != "Test City" || results[0].Highlights["comments"] != "<mark>roof</mark> off" {
+		t.Errorf("Unexpected response: %+v", results)
+	}
+
+	req = httptest.NewRequest("GET", "/messages?q=-tree", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request; got %v", rr.Code)
+	}
+}
+
+func TestStreamMessagesHandler(t *testing.T) {
+	b := broadcast.New(10)
+	b.Publish(models.StormReport{ID: "old", Type: models.HAIL})
+	b.Publish(models.StormReport{ID: "missed", Type: models.HAIL})
+
+	interval := routes.HeartbeatInterval
+	routes.HeartbeatInterval = 20 * time.Millisecond
+	t.Cleanup(func() { routes.HeartbeatInterval = interval })
+	server := httptest.NewServer(middleware.WithBroadcasterContext(b)(routes.StreamMessagesHandler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"?type=hail", nil)
+	req.Header.Set("Last-Event-ID", "old:1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not open stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected content type %q", ct)
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	next := func(prefix string) string {
+		for {
+			select {
+			case line := <-lines:
+				if strings.HasPrefix(line, prefix) {
+					return line
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Timed out waiting for %q", prefix)
+			}
+		}
+	}
+
+	if id := next("id:"); id != "id: missed:1" {
+		t.Errorf("Expected replay of missed report; got %q", id)
+	}
+	next(": heartbeat")
+
+	for b.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	b.Publish(models.StormReport{ID: "filtered", Type: models.WIND})
+	b.Publish(models.StormReport{ID: "live", Type: models.HAIL, Location: "Test City"})
+	if id := next("id:"); id != "id: live:1" {
+		t.Errorf("Expected live report; got %q", id)
+	}
+	if data := next("data:"); !strings.Contains(data, `"location":"Test City"`) {
+		t.Errorf("Unexpected event data %q", data)
+	}
+}
+
+func TestSubscribeHandler(t *testing.T) {
+	b := broadcast.New(0)
+	server := httptest.NewServer(middleware.WithBroadcasterContext(b)(routes.SubscribeHandler))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	type message struct {
+		Type          string             `json:"type"`
+		ID            string             `json:"id"`
+		Subscriptions []string           `json:"subscriptions"`
+		Report        models.StormReport `json:"report"`
+		Error         string             `json:"error"`
+	}
+	send := func(req string) message {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(req)); err != nil {
+			t.Fatalf("Could not send: %v", err)
+		}
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Could not read: %v", err)
+		}
+		return msg
+	}
+
+	if msg := send(`{"action":"subscribe","id":"ok","filter":{"states":["OK"]}}`); msg.Type != "subscribed" || msg.ID != "ok" {
+		t.Errorf("Unexpected reply: %+v", msg)
+	}
+	if msg := send(`{"action":"subscribe","id":"hail","filter":{"types":["hail"]}}`); msg.Type != "subscribed" {
+		t.Errorf("Unexpected reply: %+v", msg)
+	}
+	if msg := send(`{"action":"explode","id":"x"}`); msg.Type != "error" {
+		t.Errorf("Expected error; got %+v", msg)
+	}
+	if msg := send(`not json`); msg.Type != "error" {
+		t.Errorf("Expected error; got %+v", msg)
+	}
+
+	b.Publish(models.StormReport{ID: "skipped", State: "TX", Type: models.WIND})
+	b.Publish(models.StormReport{ID: "both", State: "OK", Type: models.HAIL})
+	var msg message
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("Could not read: %v", err)
+	}
+	if msg.Type != "report" || msg.Report.ID != "both" || strings.Join(msg.Subscriptions, ",") != "hail,ok" {
+		t.Errorf("Unexpected report: %+v", msg)
+	}
+
+	if msg := send(`{"action":"unsubscribe","id":"hail"}`); msg.Type != "unsubscribed" {
+		t.Errorf("Unexpected reply: %+v", msg)
+	}
+	b.Publish(models.StormReport{ID: "hail-only", State: "TX", Type: models.HAIL})
+	b.Publish(models.StormReport{ID: "ok-only", State: "OK", Type: models.WIND})
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("Could not read: %v", err)
+	}
+	if msg.Report.ID != "ok-only" {
+		t.Errorf("Unexpected report: %+v", msg)
+	}
+
+	b.Close()
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected going-away close; got %v", err)
+	}
+}
+
+func TestETag(t *testing.T) {
+	mockDAO := &dao.MockStormDAO{
+		MockGetStormReports: func(query models.StormQuery) ([]models.StormReport, error) {
+			return []models.StormReport{{Location: "Test City", Type: "tornado"}}, nil
+		},
+	}
+	handler := middleware.WithDAOContext(mockDAO)(http.HandlerFunc(routes.GetMessagesHandler))
+
+	req := httptest.NewRequest("GET", "/messages?date=1733775461", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("Expected a strong ETag; got %q (status %v)", etag, rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/messages?date=1733775461", nil)
+	req.Header.Set("If-None-Match", `"other", `+etag)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("Expected empty 304; got %v with %q", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/messages?date=1733775461", nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status OK; got %v", rr.Code)
+	}
+}
+
+// matching returns the reports that pass a query's filter, as a DAO would.
+func matching(query models.StormQuery, reports ...models.StormReport) []models.StormReport {
+	matched := []models.StormReport{}
+	for _, report := range reports {
+		if query.Filter.Matches(report) {
+			matched = append(matched, report)
+		}
+	}
+	return matched
+}
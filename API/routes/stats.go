@@ -0,0 +1,51 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jonathanface/storm-reporter/API/middleware"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+// GetStatsHandler returns report counts grouped by the dimensions listed in
+// 'groupBy' (type, state, county, day, hour) over a start/end range.
+func GetStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	dao := middleware.GetDAO(r.Context())
+	params := r.URL.Query()
+
+	selected, err := parseStormQuery(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := models.StatsQuery{Start: selected.Start, End: selected.End, Filter: selected.Filter}
+	seen := map[models.StatsDimension]bool{}
+	for _, g := range splitParam(params.Get("groupBy")) {
+		dim, err := models.ParseStatsDimension(g)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid 'groupBy' query parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		if !seen[dim] {
+			seen[dim] = true
+			query.GroupBy = append(query.GroupBy, dim)
+		}
+	}
+
+	if err := query.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := dao.GetStormStats(r.Context(), query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to retrieve storm stats: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, rows)
+}
@@ -0,0 +1,91 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/broadcast"
+	"github.com/jonathanface/storm-reporter/API/middleware"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+const streamBuffer = 64
+
+// HeartbeatInterval is how often an idle stream sends a comment line so
+// proxies don't close the connection.
+var HeartbeatInterval = 15 * time.Second
+
+// StreamMessagesHandler pushes newly ingested reports as Server-Sent Events.
+// It honours the same type/state/county/bbox filters as /messages. Each
+// event's ID is the report ID; reconnecting clients that send it back in
+// Last-Event-ID are replayed what they missed, or sent a "reset" event when
+// it is too old to resume from and they should reload the list.
+func StreamMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := filter.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	broadcaster := middleware.GetBroadcaster(r.Context())
+	sub, replay, found := broadcaster.Subscribe(streamBuffer, r.Header.Get("Last-Event-ID"))
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !found {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, report := range replay {
+		if filter.Matches(report) {
+			writeReportEvent(w, report)
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case report, ok := <-sub.C:
+			if !ok {
+				// Dropped by the broadcaster; the client reconnects with
+				// Last-Event-ID and catches up from the history.
+				return
+			}
+			if !filter.Matches(report) {
+				continue
+			}
+			writeReportEvent(w, report)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeReportEvent(w http.ResponseWriter, report models.StormReport) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %s\nevent: report\ndata: %s\n\n", broadcast.EventID(report), data)
+}
@@ -0,0 +1,83 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/geo"
+	"github.com/jonathanface/storm-reporter/API/middleware"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+const (
+	// Tiles for windows that closed before today are effectively immutable.
+	pastTileMaxAge = 24 * time.Hour
+	liveTileMaxAge = time.Minute
+)
+
+// GetTileHandler serves /tiles/{z}/{x}/{y}.mvt as a Mapbox Vector Tile of
+// the reports in the start/end window, fetching only those around the tile.
+func GetTileHandler(w http.ResponseWriter, r *http.Request) {
+	dao := middleware.GetDAO(r.Context())
+	params := r.URL.Query()
+
+	yParam, ok := strings.CutSuffix(r.PathValue("y"), ".mvt")
+	if !ok {
+		http.Error(w, "Tile path must end in .mvt", http.StatusNotFound)
+		return
+	}
+	var coords [3]uint32
+	for i, s := range []string{r.PathValue("z"), r.PathValue("x"), yParam} {
+		v, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid tile coordinates", http.StatusBadRequest)
+			return
+		}
+		coords[i] = uint32(v)
+	}
+	tile, err := geo.ParseTile(coords[0], coords[1], coords[2])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query, err := parseStormQuery(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only the reports around the tile are fetched, within any bbox the
+	// client asked for; a bbox that misses the tile leaves it empty.
+	bounds, overlaps := geo.TileQueryBounds(tile), true
+	if query.Filter.BBox != nil {
+		bounds, overlaps = bounds.Intersect(*query.Filter.BBox)
+	}
+	query.Filter.BBox = &bounds
+	var reports []models.StormReport
+	if overlaps {
+		reports, err = dao.GetStormReports(r.Context(), query)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to retrieve storm reports: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	data, err := geo.EncodeTile(reports, tile)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode tile: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	maxAge := liveTileMaxAge
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if query.End.Before(today) {
+		maxAge = pastTileMaxAge
+	}
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	writeWithETag(w, r, data)
+}
@@ -0,0 +1,170 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jonathanface/storm-reporter/API/broadcast"
+	"github.com/jonathanface/storm-reporter/API/middleware"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+const (
+	wsBuffer         = 256
+	wsMaxMessageSize = 64 * 1024
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = wsPongWait * 9 / 10
+	maxSubscriptions = 32
+)
+
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 4096}
+
+// wsRequest is a client message. Action is "subscribe" or "unsubscribe";
+// subscribing with an ID that is already in use replaces its filter.
+type wsRequest struct {
+	Action string             `json:"action"`
+	ID     string             `json:"id"`
+	Filter models.StormFilter `json:"filter"`
+
+	err error
+}
+
+// wsMessage is a server message. Type is "subscribed", "unsubscribed",
+// "report" or "error".
+type wsMessage struct {
+	Type          string              `json:"type"`
+	ID            string              `json:"id,omitempty"`
+	Subscriptions []string            `json:"subscriptions,omitempty"`
+	Report        *models.StormReport `json:"report,omitempty"`
+	Error         string              `json:"error,omitempty"`
+}
+
+// SubscribeHandler upgrades to a WebSocket over which clients manage named
+// subscriptions, each with its own filter, and receive matching reports as
+// they are ingested. A report matching several subscriptions is sent once,
+// listing all of them. Clients that can't keep up are disconnected with a
+// 1013 (try again later) close instead of holding up ingestion.
+func SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	broadcaster := middleware.GetBroadcaster(r.Context())
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an error status.
+		return
+	}
+	defer conn.Close()
+
+	sub, _, _ := broadcaster.Subscribe(wsBuffer, "")
+	defer sub.Close()
+
+	requests := make(chan wsRequest)
+	readErr := make(chan error, 1)
+	go func() {
+		conn.SetReadLimit(wsMaxMessageSize)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			var req wsRequest
+			if err := json.Unmarshal(data, &req); err != nil {
+				req = wsRequest{err: err}
+			}
+			select {
+			case requests <- req:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+
+	filters := map[string]models.StormFilter{}
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		var out *wsMessage
+		select {
+		case <-readErr:
+			return
+
+		case req := <-requests:
+			out = handleWSRequest(filters, req)
+
+		case report, ok := <-sub.C:
+			if !ok {
+				reason := "server shutting down"
+				code := websocket.CloseGoingAway
+				if errors.Is(sub.Err(), broadcast.ErrSlowConsumer) {
+					reason, code = "client too slow", websocket.CloseTryAgainLater
+				}
+				closeWebSocket(conn, code, reason)
+				return
+			}
+			var matched []string
+			for id, filter := range filters {
+				if filter.Matches(report) {
+					matched = append(matched, id)
+				}
+			}
+			if len(matched) == 0 {
+				continue
+			}
+			sort.Strings(matched)
+			out = &wsMessage{Type: "report", Subscriptions: matched, Report: &report}
+
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+			continue
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err := conn.WriteJSON(out); err != nil {
+			log.Printf("Dropping WebSocket client: %v", err)
+			return
+		}
+	}
+}
+
+func handleWSRequest(filters map[string]models.StormFilter, req wsRequest) *wsMessage {
+	if req.err != nil {
+		return &wsMessage{Type: "error", Error: "invalid message: " + req.err.Error()}
+	}
+	if req.ID == "" {
+		return &wsMessage{Type: "error", Error: "subscription id is required"}
+	}
+	switch req.Action {
+	case "subscribe":
+		if _, exists := filters[req.ID]; !exists && len(filters) >= maxSubscriptions {
+			return &wsMessage{Type: "error", ID: req.ID, Error: "too many subscriptions"}
+		}
+		if err := req.Filter.Validate(); err != nil {
+			return &wsMessage{Type: "error", ID: req.ID, Error: "invalid filter: " + err.Error()}
+		}
+		filters[req.ID] = req.Filter
+		return &wsMessage{Type: "subscribed", ID: req.ID}
+	case "unsubscribe":
+		delete(filters, req.ID)
+		return &wsMessage{Type: "unsubscribed", ID: req.ID}
+	}
+	return &wsMessage{Type: "error", ID: req.ID, Error: "unknown action " + req.Action}
+}
+
+func closeWebSocket(conn *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jonathanface/storm-reporter/API/dao"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+var (
+	// storage selects where reports are kept: "mongo" (the default),
+	// "postgres", which is reached at postgresURL, "sqlite", a file at
+	// sqlitePath, or "memory", seeded from the fixture at seedFile.
+	storage     = os.Getenv("STORAGE")
+	postgresURL = os.Getenv("POSTGRES_URL")
+	sqlitePath  = os.Getenv("SQLITE_PATH")
+	seedFile    = os.Getenv("SEED_FILE")
+)
+
+// storageBackend is a storm DAO that also keeps API keys and usage counts,
+// and can be polled for reports written by other replicas.
+type storageBackend interface {
+	models.StormDAOInterface
+	models.APIKeyStore
+	models.UsageStore
+	PollReports(ctx context.Context, interval time.Duration, publish func(models.StormReport)) error
+}
+
+// reportWatcher is a backend that can also push writes as they happen.
+type reportWatcher interface {
+	WatchReports(ctx context.Context, consumer string, publish func(models.StormReport)) error
+}
+
+// openStorage connects to the backend selected by STORAGE and prepares its
+// schema. command is the maintenance command being run, or "" for the
+// server. The keys command only touches the API keys, so it doesn't need
+// MONGO_COLL, and the migrate command plans and applies MongoDB's
+// migrations itself.
+func openStorage(command string) (storageBackend, error) {
+	switch storage {
+	case "", "mongo":
+		if mongoURI == "" || mongoDBName == "" {
+			log.Fatal("Environment variables MONGO_URI and MONGO_DB must be set")
+		}
+		if command == "keys" {
+			return dao.NewStormDAO(mongoURI, mongoDBName, mongoColl)
+		}
+		if mongoColl == "" {
+			log.Fatal("Environment variable MONGO_COLL must be set")
+		}
+		mongoDAO, err := dao.NewStormDAO(mongoURI, mongoDBName, mongoColl)
+		if err != nil {
+			return nil, err
+		}
+		if err := mongoDAO.EnsureIndexes(); err != nil {
+			log.Printf("Failed to ensure MongoDB indexes: %v", err)
+		}
+		if command != "migrate" {
+			steps, err := mongoDAO.Migrator(migrationOwner()).Migrate(context.TODO(), dao.LatestMigration)
+			for _, step := range steps {
+				fmt.Printf("Migrated MongoDB: %s\n", step)
+			}
+			if err != nil {
+				mongoDAO.Disconnect()
+				return nil, err
+			}
+		}
+		fmt.Printf("Connected to MongoDB collection: %s\n", mongoColl)
+		return mongoDAO, nil
+	case "postgres":
+		if postgresURL == "" {
+			log.Fatal("Environment variable POSTGRES_URL must be set")
+		}
+		pgDAO, err := dao.NewPostgresStormDAO(postgresURL)
+		if err != nil {
+			return nil, err
+		}
+		if err := pgDAO.Migrate(); err != nil {
+			pgDAO.Disconnect()
+			return nil, err
+		}
+		fmt.Println("Connected to PostgreSQL")
+		return pgDAO, nil
+	case "sqlite":
+		if sqlitePath == "" {
+			sqlitePath = "storm-reporter.db"
+		}
+		sqliteDAO, err := dao.NewSQLiteStormDAO(sqlitePath)
+		if err != nil {
+			return nil, err
+		}
+		if err := sqliteDAO.Migrate(); err != nil {
+			sqliteDAO.Disconnect()
+			return nil, err
+		}
+		fmt.Printf("Opened SQLite database: %s\n", sqlitePath)
+		return sqliteDAO, nil
+	case "memory":
+		memoryDAO := dao.NewMemoryStormDAO()
+		if seedFile != "" {
+			reports, err := dao.LoadFixture(seedFile)
+			if err != nil {
+				return nil, err
+			}
+			memoryDAO.Seed(reports)
+			fmt.Printf("Seeded %d reports from %s\n", len(reports), seedFile)
+		}
+		return memoryDAO, nil
+	}
+	log.Fatalf("STORAGE must be one of mongo, postgres, sqlite or memory; got %q", storage)
+	return nil, nil
+}
+
+// migrationOwner names this process in the MongoDB migration lock.
+func migrationOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "api-service"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
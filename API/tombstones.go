@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/IBM/sarama"
+	"github.com/jonathanface/storm-reporter/API/models"
+)
+
+// tombstoneDAO publishes a tombstone, a message keyed by report ID with no
+// value, to the processed topic for every report deleted through it. Other
+// consumers of the topic drop the report too, and compaction can remove it
+// from the topic. The deletion itself stands if publishing fails.
+type tombstoneDAO struct {
+	models.StormDAOInterface
+	topic       string
+	newProducer func() (sarama.SyncProducer, error)
+
+	mu       sync.Mutex
+	producer sarama.SyncProducer
+}
+
+func newTombstoneDAO(next models.StormDAOInterface, topic string, newProducer func() (sarama.SyncProducer, error)) *tombstoneDAO {
+	return &tombstoneDAO{StormDAOInterface: next, topic: topic, newProducer: newProducer}
+}
+
+func (d *tombstoneDAO) DeleteStormReport(id string, source models.ChangeSource) (models.StormReport, error) {
+	report, err := d.StormDAOInterface.DeleteStormReport(id, source)
+	if report.Deleted {
+		d.publish([]string{report.ID})
+	}
+	return report, err
+}
+
+func (d *tombstoneDAO) PurgeStormReports(query models.PurgeQuery, dryRun bool, source models.ChangeSource) (models.PurgeResult, error) {
+	result, err := d.StormDAOInterface.PurgeStormReports(query, dryRun, source)
+	if len(result.IDs) > 0 {
+		d.publish(result.IDs)
+	}
+	return result, err
+}
+
+func (d *tombstoneDAO) publish(ids []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The producer is made on first use so the API can start without Kafka.
+	if d.producer == nil {
+		producer, err := d.newProducer()
+		if err != nil {
+			log.Printf("Failed to publish tombstones for %d reports: %v", len(ids), err)
+			return
+		}
+		d.producer = producer
+	}
+
+	messages := make([]*sarama.ProducerMessage, len(ids))
+	for i, id := range ids {
+		messages[i] = &sarama.ProducerMessage{Topic: d.topic, Key: sarama.StringEncoder(id)}
+	}
+	if err := d.producer.SendMessages(messages); err != nil {
+		log.Printf("Failed to publish tombstones for %d reports: %v", len(ids), err)
+	}
+}
+
+// Close closes the producer, leaving the wrapped DAO connected.
+func (d *tombstoneDAO) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.producer == nil {
+		return nil
+	}
+	err := d.producer.Close()
+	d.producer = nil
+	return err
+}
+
+// applyTombstone soft-deletes the report a tombstone on the processed topic
+// names. Tombstones for reports already deleted, or never stored, are
+// ignored.
+func applyTombstone(stormDAO models.StormDAOInterface, msg *sarama.ConsumerMessage) error {
+	id := string(msg.Key)
+	_, err := stormDAO.DeleteStormReport(id, models.ChangeSource{
+		Actor:          models.ActorIngest,
+		Reason:         "tombstone",
+		KafkaPartition: msg.Partition,
+		KafkaOffset:    msg.Offset,
+	})
+	if errors.Is(err, models.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply tombstone for %s: %w", id, err)
+	}
+	fmt.Printf("Message deleted from MongoDB: %s\n", id)
+	return nil
+}
@@ -7,6 +7,7 @@ toolchain go1.22.5
 require (
 	github.com/IBM/sarama v1.43.3
 	github.com/stretchr/testify v1.9.0
+	go.etcd.io/bbolt v1.3.11
 )
 
 require (
@@ -31,5 +32,6 @@ require (
 	github.com/rogpeppe/go-internal v1.13.1 // indirect
 	golang.org/x/crypto v0.26.0 // indirect
 	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"expvar"
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -17,12 +22,51 @@ var (
 	brokers        = os.Getenv("KAFKA_BROKERS")
 	rawTopic       = os.Getenv("RAW_TOPIC")
 	processedTopic = os.Getenv("PROCESSED_TOPIC")
+	statePath      = os.Getenv("STATE_PATH")
+	metricsAddr    = os.Getenv("METRICS_ADDR")
+)
+
+// stateRetention is how long a report's hash is kept after it was last
+// seen. SPC only republishes the current day's reports.
+const stateRetention = 7 * 24 * time.Hour
+
+// statePruneInterval is how often reports past the retention are dropped
+// from the state store.
+const statePruneInterval = time.Hour
+
+var (
+	forwardedReports = expvar.NewInt("reportsForwarded")
+	skippedReports   = expvar.NewInt("reportsSkipped")
 )
 
 func main() {
+	forceReemit := flag.Bool("force-reemit", os.Getenv("FORCE_REEMIT") == "true", "forward every report, even those unchanged since they were last forwarded")
+	flag.Parse()
+
 	if brokers == "" || rawTopic == "" || processedTopic == "" {
 		log.Fatal("KAFKA_BROKERS, RAW_TOPIC, and PROCESSED_TOPIC environment variables must be set")
 	}
+	if statePath == "" {
+		statePath = "etl-state.db"
+	}
+	state, err := openStateStore(statePath, stateRetention)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer state.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go state.pruneEvery(ctx, statePruneInterval)
+
+	if metricsAddr != "" {
+		// expvar serves the counters at /debug/vars.
+		go func() {
+			log.Printf("Serving metrics on %s", metricsAddr)
+			if err := http.ListenAndServe(metricsAddr, nil); err != nil {
+				log.Printf("Error serving metrics: %v", err)
+			}
+		}()
+	}
 
 	config := sarama.NewConfig()
 	config.Producer.MaxMessageBytes = 209715200 // 200 MB
@@ -32,10 +76,10 @@ func main() {
 	config.Producer.Return.Successes = true
 
 	log.Println("Starting ETL service...")
-	runETL(brokers, rawTopic, processedTopic, config)
+	runETL(brokers, rawTopic, processedTopic, config, state, *forceReemit)
 }
 
-func runETL(brokers, rawTopic, processedTopic string, config *sarama.Config) {
+func runETL(brokers, rawTopic, processedTopic string, config *sarama.Config, state *stateStore, forceReemit bool) {
 	consumerGroup, err := sarama.NewConsumerGroup([]string{brokers}, "etl-consumer-group", config)
 	if err != nil {
 		log.Fatalf("Error creating consumer group: %v", err)
@@ -53,6 +97,9 @@ func runETL(brokers, rawTopic, processedTopic string, config *sarama.Config) {
 		producer:       producer,
 		rawTopic:       rawTopic,
 		processedTopic: processedTopic,
+		snapshots:      newSnapshotTracker(),
+		state:          state,
+		forceReemit:    forceReemit,
 	}
 
 	log.Println("Listening for messages...")
@@ -68,6 +115,11 @@ type ETLHandler struct {
 	producer       sarama.SyncProducer
 	rawTopic       string
 	processedTopic string
+	snapshots      *snapshotTracker
+	// state, when set, holds the hash of every report forwarded, so
+	// unchanged reports are skipped unless forceReemit is set.
+	state       *stateStore
+	forceReemit bool
 }
 
 // Setup is called before consuming messages
@@ -84,27 +136,102 @@ func (h *ETLHandler) Cleanup(_ sarama.ConsumerGroupSession) error {
 func (h *ETLHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
 	for message := range claim.Messages() {
 		log.Printf("Received message: %s", string(message.Value))
-		transformedMessage, err := transformData(string(message.Value))
+		snapshot := parseSnapshotMeta(message.Value)
+		if snapshot.isEnd() {
+			if err := h.retract(h.snapshots.complete(snapshot)); err != nil {
+				log.Printf("Error sending retractions: %v", err)
+				continue
+			}
+			session.MarkMessage(message, "")
+			continue
+		}
+
+		transformedMessage, id, err := transformData(string(message.Value))
 		if err != nil {
 			log.Printf("Error transforming data: %v", err)
 			continue
 		}
 		log.Printf("Transformed message: %s", transformedMessage)
-		partition, offset, err := h.producer.SendMessage(&sarama.ProducerMessage{
-			Topic: h.processedTopic,
-			Value: sarama.StringEncoder(transformedMessage),
-		})
+		hash, err := contentHash(transformedMessage)
 		if err != nil {
-			log.Printf("Error sending message: %v", err)
+			log.Printf("Error hashing data: %v", err)
 			continue
 		}
 
-		log.Printf("Message sent to topic %s: %s (partition=%d, offset=%d)", h.processedTopic, transformedMessage, partition, offset)
+		if h.unchanged(id, hash) {
+			skippedReports.Add(1)
+			log.Printf("Skipping unchanged report %s", id)
+		} else {
+			// Keying by report ID lets the topic be compacted and lets
+			// tombstones for deleted reports replace them.
+			partition, offset, err := h.producer.SendMessage(&sarama.ProducerMessage{
+				Topic: h.processedTopic,
+				Key:   sarama.StringEncoder(id),
+				Value: sarama.StringEncoder(transformedMessage),
+			})
+			if err != nil {
+				log.Printf("Error sending message: %v", err)
+				continue
+			}
+			forwardedReports.Add(1)
+			log.Printf("Message sent to topic %s: %s (partition=%d, offset=%d)", h.processedTopic, transformedMessage, partition, offset)
+		}
+
+		if h.state != nil {
+			if err := h.state.put(id, hash, time.Now()); err != nil {
+				log.Print(err)
+			}
+		}
+		if snapshot.ID != "" {
+			h.snapshots.add(snapshot.ID, id)
+		}
 		session.MarkMessage(message, "")
 	}
 	return nil
 }
 
+// unchanged reports whether a report was last forwarded with the same
+// content hash.
+func (h *ETLHandler) unchanged(id, hash string) bool {
+	if h.state == nil || h.forceReemit {
+		return false
+	}
+	stored, err := h.state.hash(id)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	return stored == hash
+}
+
+// retract sends a retraction for each report to the processed topic. The
+// reports' hashes are forgotten, so they are forwarded again if SPC brings
+// them back unchanged.
+func (h *ETLHandler) retract(retractions []Retraction) error {
+	for _, r := range retractions {
+		value, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, _, err = h.producer.SendMessage(&sarama.ProducerMessage{
+			Topic:   h.processedTopic,
+			Key:     sarama.StringEncoder(r.ID),
+			Value:   sarama.ByteEncoder(value),
+			Headers: []sarama.RecordHeader{{Key: []byte(EventHeader), Value: []byte(RetractionEvent)}},
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Retracted report %s, missing from snapshot %s", r.ID, r.SnapshotID)
+		if h.state != nil {
+			if err := h.state.forget(r.ID); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	return nil
+}
+
 type StormType string
 
 const (
@@ -126,6 +253,8 @@ type StormReport struct {
 	Lon      float64   `json:"lon"`
 	Comments string    `json:"comments"`
 	Type     StormType `json:"type"`
+	// Synthetic marks reports made up by the producer's generator.
+	Synthetic bool `json:"synthetic,omitempty"`
 }
 
 func (sr *StormReport) UnmarshalJSON(data []byte) error {
@@ -143,6 +272,8 @@ func (sr *StormReport) UnmarshalJSON(data []byte) error {
 		Lon      string `json:"Lon"`
 		Comments string `json:"Comments"`
 		Type     string `json:"Type"`
+		// Only set by the producer's generator
+		Synthetic string `json:"synthetic"`
 	}
 
 	var temp tempStormReport
@@ -188,21 +319,78 @@ func (sr *StormReport) UnmarshalJSON(data []byte) error {
 	sr.State = temp.State
 	sr.Comments = temp.Comments
 	sr.Type = StormType(temp.Type)
+	sr.Synthetic = temp.Synthetic == "true"
 	return nil
 }
 
-func transformData(data string) (string, error) {
+// reportID derives a report's stable identifier from the fields SPC doesn't
+// revise. It must match models.ReportID in the API, which stores reports
+// under the same ID.
+func reportID(r StormReport) string {
+	day := r.Date
+	if fetched, ok := fetchTime(r.Date); ok {
+		day = convectiveDay(fetched, r.Time)
+	}
+	key := strings.Join([]string{
+		day,
+		string(r.Type),
+		strconv.Itoa(int(r.Time)),
+		strings.ToUpper(strings.TrimSpace(r.State)),
+		strings.ToUpper(strings.TrimSpace(r.County)),
+		strings.ToUpper(strings.TrimSpace(r.Location)),
+	}, "|")
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:12])
+}
+
+// fetchTime parses the producer's fetch timestamp, which it sends in seconds
+// or milliseconds.
+func fetchTime(date string) (time.Time, bool) {
+	ts, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if ts > 1e11 {
+		return time.UnixMilli(ts).UTC(), true
+	}
+	return time.Unix(ts, 0).UTC(), true
+}
+
+// convectiveDay returns the SPC convective day, which runs from 12Z to 12Z,
+// of a report at hhmm UTC in a file fetched at fetched. Reports are never
+// later than their fetch, which tells a file fetched just after 12Z apart
+// from the next day's.
+func convectiveDay(fetched time.Time, hhmm int32) string {
+	day := fileDay(fetched)
+	at := day.Add(time.Duration(hhmm/100)*time.Hour + time.Duration(hhmm%100)*time.Minute)
+	if hhmm < 1200 {
+		at = at.Add(24 * time.Hour)
+	}
+	if at.After(fetched) {
+		day = day.AddDate(0, 0, -1)
+	}
+	return day.Format("2006-01-02")
+}
+
+// fileDay returns the start of the convective day whose file SPC serves as
+// today's at t.
+func fileDay(t time.Time) time.Time {
+	return t.Add(-12 * time.Hour).Truncate(24 * time.Hour)
+}
+
+// transformData normalises a raw report and returns it along with its ID.
+func transformData(data string) (string, string, error) {
 
 	var raw map[string]interface{}
 	err := json.Unmarshal([]byte(data), &raw)
 	if err != nil {
 		fmt.Printf("Error unmarshaling raw JSON: %v\n", err)
-		return "", err
+		return "", "", err
 	}
 
 	// Validate the "Time" field
 	if timeValue, ok := raw["Time"].(string); ok && strings.ToLower(timeValue) == "time" {
-		return "", fmt.Errorf("invalid data: header field detected")
+		return "", "", fmt.Errorf("invalid data: header field detected")
 	}
 
 	// Now unmarshal into StormReport struct
@@ -210,15 +398,15 @@ func transformData(data string) (string, error) {
 	err = json.Unmarshal([]byte(data), &report)
 	if err != nil {
 		fmt.Printf("Error unmarshaling JSON into StormReport: %v\n", err)
-		return "", err
+		return "", "", err
 	}
 
 	// Marshal the validated and transformed StormReport back to JSON
 	transformedData, err := json.Marshal(report)
 	if err != nil {
 		fmt.Printf("Error marshaling JSON: %v\n", err)
-		return "", err
+		return "", "", err
 	}
 
-	return string(transformedData), nil
+	return string(transformedData), reportID(report), nil
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/IBM/sarama/mocks"
@@ -26,7 +30,7 @@ func TestTransformData_ValidData(t *testing.T) {
 		"Type": "hail"
 	}`
 
-	_, err := transformData(rawJSON)
+	_, _, err := transformData(rawJSON)
 	assert.NoError(t, err, "transformData should not return an error for valid input")
 
 	var result StormReport
@@ -56,7 +60,7 @@ func TestTransformData_InvalidHeader(t *testing.T) {
 		"Type": "hail"
 	}`
 
-	transformed, err := transformData(rawJSON)
+	transformed, _, err := transformData(rawJSON)
 	assert.Error(t, err, "transformData should return an error for invalid header field")
 	assert.Empty(t, transformed, "Transformed data should be empty for invalid input")
 }
@@ -137,3 +141,240 @@ func TestETLHandler_ConsumeClaim(t *testing.T) {
 	assert.NoError(t, err, "ConsumeClaim should not return an error")
 
 }
+
+func TestTransformData_Synthetic(t *testing.T) {
+	generated := `{"date":"1733773195","time":"1200","type":"hail","location":"Dallas","county":"Some County","state":"TX","size":"1.5","lat":"32.7","lon":"-96.8","comments":"Generated storm","synthetic":"true"}`
+	transformed, _, err := transformData(generated)
+	assert.NoError(t, err)
+	assert.Contains(t, transformed, `"synthetic":true`)
+
+	real := strings.Replace(generated, `,"synthetic":"true"`, "", 1)
+	transformed, _, err = transformData(real)
+	assert.NoError(t, err)
+	assert.NotContains(t, transformed, "synthetic")
+}
+
+func TestReportID(t *testing.T) {
+	// The API stores this report under the same ID.
+	report := StormReport{Date: "1733773195000", Time: 1200, Type: HAIL, Location: "Boston", County: "Suffolk", State: "ma"}
+	assert.Equal(t, "5f3e83d4087ffeddefbb96e8", reportID(report))
+
+	_, id, err := transformData(`{"date":"1733773195","Time":"1200","Type":"hail","Location":" boston","County":"SUFFOLK","State":"MA","Lat":"42.3","Lon":"-71.0"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "5f3e83d4087ffeddefbb96e8", id)
+
+	// SPC days run from 12Z to 12Z, so the same row fetched either side of
+	// 00Z keeps its ID.
+	late := StormReport{Date: "1733787000", Time: 2330, Type: WIND, Location: "Plano", State: "TX"} // 2024-12-09 23:30Z
+	refetched := late
+	refetched.Date = "1733790600000" // 2024-12-10 00:30Z
+	assert.Equal(t, reportID(late), reportID(refetched))
+	assert.Equal(t, "2024-12-09", snapshotMeta{Date: refetched.Date}.day())
+}
+
+// reportIDVectors pins report IDs. The API's models tests hold the same table, as
+// the API and the ETL must give a report the same ID; change both together.
+var reportIDVectors = []struct {
+	date                    string
+	time                    int32
+	stormType               StormType
+	location, county, state string
+	id                      string
+}{
+	{"1733773195", 1200, HAIL, "Boston", "Suffolk", "MA", "5f3e83d4087ffeddefbb96e8"},
+	{"1733773195000", 1200, HAIL, " boston", "SUFFOLK", "ma", "5f3e83d4087ffeddefbb96e8"}, // milliseconds, untidy case
+	{"1733787000", 2330, WIND, "Plano", "", "TX", "85bd67abc63f7076e04b4774"},             // 2024-12-09 23:30Z
+	{"1733790600000", 2330, WIND, "Plano", "", "TX", "85bd67abc63f7076e04b4774"},          // refetched after 00Z
+	{"1733832120", 2330, WIND, "Plano", "", "TX", "85bd67abc63f7076e04b4774"},             // refetched after 12Z
+	{"1733832120", 1205, HAIL, "Plano", "", "TX", "730ddc515edce40d5144589b"},             // the new day's file
+	{"1733801400", 300, TORNADO, "Moore", "Cleveland", "OK", "32cb883fc954ca4ad26bd5f1"},
+	{"not-a-date", 1200, HAIL, "Boston", "", "MA", "b382220fac2d94c8bb975b3e"},
+}
+
+func TestReportIDVectors(t *testing.T) {
+	for _, v := range reportIDVectors {
+		report := StormReport{Date: v.date, Time: v.time, Type: v.stormType, Location: v.location, County: v.county, State: v.state}
+		assert.Equal(t, v.id, reportID(report), "%+v", v)
+	}
+}
+
+func TestSnapshotTracker(t *testing.T) {
+	tracker := newSnapshotTracker()
+	end := func(id, count string) snapshotMeta {
+		return snapshotMeta{ID: id, End: "true", Count: count, Type: HAIL, Date: "1733773195000"}
+	}
+
+	tracker.add("hail-1", "a")
+	tracker.add("hail-1", "b")
+	tracker.add("hail-1", "c")
+	assert.Empty(t, tracker.complete(end("hail-1", "3")), "the first snapshot has nothing to compare with")
+
+	// b was dropped and d added
+	tracker.add("hail-2", "a")
+	tracker.add("hail-2", "c")
+	tracker.add("hail-2", "d")
+	assert.Equal(t, []Retraction{{ID: "b", Type: HAIL, Day: "2024-12-09", SnapshotID: "hail-2"}}, tracker.complete(end("hail-2", "3")))
+
+	// An incomplete snapshot retracts nothing and isn't compared against
+	tracker.add("hail-3", "a")
+	assert.Empty(t, tracker.complete(end("hail-3", "3")))
+	tracker.add("hail-4", "a")
+	tracker.add("hail-4", "c")
+	retractions := tracker.complete(end("hail-4", "2"))
+	assert.Len(t, retractions, 1)
+	assert.Equal(t, "d", retractions[0].ID)
+
+	// An empty file retracts everything
+	assert.Len(t, tracker.complete(end("hail-5", "0")), 2)
+
+	// A new day starts afresh
+	tracker.add("hail-6", "x")
+	next := end("hail-6", "1")
+	next.Date = "1733860000"
+	assert.Empty(t, tracker.complete(next))
+}
+
+func TestETLHandler_Retractions(t *testing.T) {
+	mockProducer := mocks.NewSyncProducer(t, nil)
+	defer mockProducer.Close()
+
+	row := func(location, snapshot string) *sarama.ConsumerMessage {
+		return &sarama.ConsumerMessage{Value: []byte(fmt.Sprintf(`{"date":"1733773195000","Time":"1200","type":"hail","Location":%q,"State":"TX","Lat":"32.7","Lon":"-96.8","snapshotId":%q}`, location, snapshot))}
+	}
+	end := func(snapshot, count string) *sarama.ConsumerMessage {
+		return &sarama.ConsumerMessage{Value: []byte(fmt.Sprintf(`{"snapshotId":%q,"snapshotEnd":"true","snapshotCount":%q,"type":"hail","date":"1733773195000"}`, snapshot, count))}
+	}
+	messages := []*sarama.ConsumerMessage{
+		row("Dallas", "hail-1"), row("Plano", "hail-1"), end("hail-1", "2"),
+		row("Dallas", "hail-2"), end("hail-2", "1"),
+	}
+	claim := &MockConsumerGroupClaim{MessagesChannel: make(chan *sarama.ConsumerMessage, len(messages))}
+	for _, msg := range messages {
+		claim.MessagesChannel <- msg
+	}
+	close(claim.MessagesChannel)
+
+	for i := 0; i < 3; i++ {
+		mockProducer.ExpectSendMessageAndSucceed()
+	}
+	plano := reportID(StormReport{Date: "1733773195000", Time: 1200, Type: HAIL, Location: "Plano", State: "TX"})
+	mockProducer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		key, _ := msg.Key.Encode()
+		assert.Equal(t, plano, string(key))
+		assert.Equal(t, []sarama.RecordHeader{{Key: []byte("event"), Value: []byte("retraction")}}, msg.Headers)
+		value, _ := msg.Value.Encode()
+		assert.JSONEq(t, fmt.Sprintf(`{"id":%q,"type":"hail","day":"2024-12-09","snapshotId":"hail-2"}`, plano), string(value))
+		return nil
+	})
+
+	handler := &ETLHandler{producer: mockProducer, processedTopic: "test-processed-topic", snapshots: newSnapshotTracker()}
+	assert.NoError(t, handler.ConsumeClaim(&MockConsumerGroupSession{}, claim))
+}
+
+func TestStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	state, err := openStateStore(path, time.Hour)
+	assert.NoError(t, err)
+
+	hash, err := state.hash("a")
+	assert.NoError(t, err)
+	assert.Empty(t, hash)
+
+	now := time.Now()
+	assert.NoError(t, state.put("a", "hash-a", now))
+	assert.NoError(t, state.put("b", "hash-b", now.Add(-2*time.Hour)))
+	assert.NoError(t, state.put("c", "hash-c", now))
+	assert.NoError(t, state.forget("c"))
+	assert.NoError(t, state.Close())
+
+	// Reopening keeps what was stored, less what's past the retention.
+	state, err = openStateStore(path, time.Hour)
+	assert.NoError(t, err)
+	defer state.Close()
+	for id, want := range map[string]string{"a": "hash-a", "b": "", "c": ""} {
+		hash, err := state.hash(id)
+		assert.NoError(t, err)
+		assert.Equal(t, want, hash, id)
+	}
+}
+
+func TestStateStore_PruneEvery(t *testing.T) {
+	state, err := openStateStore(filepath.Join(t.TempDir(), "state.db"), time.Hour)
+	assert.NoError(t, err)
+	defer state.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.NoError(t, state.put("a", "hash-a", time.Now()))
+	assert.NoError(t, state.put("b", "hash-b", time.Now().Add(-2*time.Hour)))
+	go state.pruneEvery(ctx, time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		hash, err := state.hash("b")
+		return err == nil && hash == ""
+	}, time.Second, time.Millisecond, "reports past the retention are pruned while running")
+	hash, err := state.hash("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "hash-a", hash)
+}
+
+func TestContentHash(t *testing.T) {
+	first, _, err := transformData(`{"date":"1733773195000","Time":"1200","Type":"hail","Location":"Boston","State":"MA","Lat":"42.3","Lon":"-71.0","Size":"1.00"}`)
+	assert.NoError(t, err)
+	rerun, _, err := transformData(`{"date":"1733859595000","Time":"1200","Type":"hail","Location":"Boston","State":"MA","Lat":"42.3","Lon":"-71.0","Size":"1.00"}`)
+	assert.NoError(t, err)
+	revised, _, err := transformData(`{"date":"1733773195000","Time":"1200","Type":"hail","Location":"Boston","State":"MA","Lat":"42.3","Lon":"-71.0","Size":"1.75"}`)
+	assert.NoError(t, err)
+
+	a, _ := contentHash(first)
+	b, _ := contentHash(rerun)
+	c, _ := contentHash(revised)
+	assert.Equal(t, a, b, "the fetch date isn't content")
+	assert.NotEqual(t, a, c)
+}
+
+func TestETLHandler_SkipsUnchanged(t *testing.T) {
+	state, err := openStateStore(filepath.Join(t.TempDir(), "state.db"), time.Hour)
+	assert.NoError(t, err)
+	defer state.Close()
+
+	row := func(size string) *sarama.ConsumerMessage {
+		return &sarama.ConsumerMessage{Value: []byte(fmt.Sprintf(`{"date":"1733773195000","Time":"1200","type":"hail","Location":"Dallas","State":"TX","Lat":"32.7","Lon":"-96.8","Size":%q}`, size))}
+	}
+	consume := func(handler *ETLHandler, messages ...*sarama.ConsumerMessage) {
+		claim := &MockConsumerGroupClaim{MessagesChannel: make(chan *sarama.ConsumerMessage, len(messages))}
+		for _, msg := range messages {
+			claim.MessagesChannel <- msg
+		}
+		close(claim.MessagesChannel)
+		assert.NoError(t, handler.ConsumeClaim(&MockConsumerGroupSession{}, claim))
+	}
+
+	mockProducer := mocks.NewSyncProducer(t, nil)
+	defer mockProducer.Close()
+	handler := &ETLHandler{producer: mockProducer, processedTopic: "test-processed-topic", snapshots: newSnapshotTracker(), state: state}
+	forwarded, skipped := forwardedReports.Value(), skippedReports.Value()
+
+	// The repeat is skipped; the revision isn't.
+	mockProducer.ExpectSendMessageAndSucceed()
+	mockProducer.ExpectSendMessageAndSucceed()
+	consume(handler, row("1.00"), row("1.00"), row("1.75"))
+	assert.Equal(t, int64(2), forwardedReports.Value()-forwarded)
+	assert.Equal(t, int64(1), skippedReports.Value()-skipped)
+
+	// Forcing a re-emit forwards it anyway.
+	mockProducer.ExpectSendMessageAndSucceed()
+	handler.forceReemit = true
+	consume(handler, row("1.75"))
+	assert.Equal(t, int64(3), forwardedReports.Value()-forwarded)
+
+	// A retracted report is forwarded again when it comes back.
+	handler.forceReemit = false
+	id := reportID(StormReport{Date: "1733773195000", Time: 1200, Type: HAIL, Location: "Dallas", State: "TX"})
+	mockProducer.ExpectSendMessageAndSucceed()
+	assert.NoError(t, handler.retract([]Retraction{{ID: id, Type: HAIL, Day: "2024-12-09", SnapshotID: "hail-2"}}))
+	mockProducer.ExpectSendMessageAndSucceed()
+	consume(handler, row("1.75"))
+	assert.Equal(t, int64(4), forwardedReports.Value()-forwarded)
+	assert.Equal(t, int64(1), skippedReports.Value()-skipped)
+}
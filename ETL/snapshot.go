@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+)
+
+// EventHeader is the Kafka header that marks processed-topic messages that
+// aren't reports. Its value is the event type.
+const EventHeader = "event"
+
+// RetractionEvent is the event type of a Retraction.
+const RetractionEvent = "retraction"
+
+// Retraction says a report has been dropped from its source's data. It is
+// sent to the processed topic keyed by the report's ID.
+type Retraction struct {
+	ID         string    `json:"id"`
+	Type       StormType `json:"type"`
+	Day        string    `json:"day"`
+	SnapshotID string    `json:"snapshotId"`
+}
+
+// snapshotMeta is the snapshot tagging the producer adds to raw messages.
+// Rows carry the snapshot ID; the end marker also carries the row count.
+type snapshotMeta struct {
+	ID    string    `json:"snapshotId"`
+	End   string    `json:"snapshotEnd"`
+	Count string    `json:"snapshotCount"`
+	Type  StormType `json:"type"`
+	Date  string    `json:"date"`
+}
+
+func parseSnapshotMeta(data []byte) snapshotMeta {
+	var meta snapshotMeta
+	json.Unmarshal(data, &meta)
+	return meta
+}
+
+func (m snapshotMeta) isEnd() bool {
+	return m.ID != "" && m.End == "true"
+}
+
+// day returns the convective day of the file the snapshot was fetched
+// from, going by its date.
+func (m snapshotMeta) day() string {
+	fetched, ok := fetchTime(m.Date)
+	if !ok {
+		return m.Date
+	}
+	return fileDay(fetched).Format("2006-01-02")
+}
+
+// snapshotTracker reconciles snapshots, the complete sets of a day's reports
+// of one type. Each completed snapshot is compared with the last one for
+// the same type and day, and the reports missing from it are retracted.
+// Only the latest day is kept for each type, since SPC only revises the
+// current day's files.
+type snapshotTracker struct {
+	mu   sync.Mutex
+	open map[string]*openSnapshot
+	last map[StormType]completedSnapshot
+}
+
+type openSnapshot struct {
+	rows int
+	ids  map[string]bool
+}
+
+type completedSnapshot struct {
+	day string
+	ids map[string]bool
+}
+
+func newSnapshotTracker() *snapshotTracker {
+	return &snapshotTracker{
+		open: map[string]*openSnapshot{},
+		last: map[StormType]completedSnapshot{},
+	}
+}
+
+// add records a report received as part of a snapshot.
+func (t *snapshotTracker) add(snapshotID, reportID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.open[snapshotID]
+	if !ok {
+		s = &openSnapshot{ids: map[string]bool{}}
+		t.open[snapshotID] = s
+	}
+	s.rows++
+	s.ids[reportID] = true
+}
+
+// complete closes a snapshot and returns the retractions it implies. A
+// snapshot missing rows, because they failed to transform or were consumed
+// before a restart, can't say what was dropped, so it retracts nothing and
+// leaves the last complete snapshot in place.
+func (t *snapshotTracker) complete(meta snapshotMeta) []Retraction {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.open[meta.ID]
+	delete(t.open, meta.ID)
+	if s == nil {
+		s = &openSnapshot{ids: map[string]bool{}}
+	}
+	count, err := strconv.Atoi(meta.Count)
+	if err != nil || s.rows != count {
+		log.Printf("Snapshot %s is incomplete (%d of %s rows); not reconciling it", meta.ID, s.rows, meta.Count)
+		return nil
+	}
+
+	day := meta.day()
+	previous, ok := t.last[meta.Type]
+	t.last[meta.Type] = completedSnapshot{day: day, ids: s.ids}
+	if !ok || previous.day != day {
+		return nil
+	}
+
+	var retractions []Retraction
+	for id := range previous.ids {
+		if !s.ids[id] {
+			retractions = append(retractions, Retraction{ID: id, Type: meta.Type, Day: day, SnapshotID: meta.ID})
+		}
+	}
+	return retractions
+}
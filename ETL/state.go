@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var hashesBucket = []byte("hashes")
+
+// stateStore remembers the content hash of every report forwarded to the
+// processed topic, so reports the producer resends unchanged can be
+// skipped. Only the latest hash of each report is kept, with when it was
+// last seen; reports unseen for longer than the retention are dropped when
+// the store is opened and by pruneEvery.
+type stateStore struct {
+	db        *bolt.DB
+	retention time.Duration
+}
+
+func openStateStore(path string, retention time.Duration) (*stateStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(hashesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open state store %s: %w", path, err)
+	}
+	s := &stateStore{db: db, retention: retention}
+	if _, err := s.prune(time.Now().Add(-retention)); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *stateStore) Close() error {
+	return s.db.Close()
+}
+
+// hash returns the stored hash of a report, or "" if there is none.
+func (s *stateStore) hash(id string) (string, error) {
+	var hash string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(hashesBucket).Get([]byte(id)); len(v) > 8 {
+			hash = string(v[8:])
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read state for %s: %w", id, err)
+	}
+	return hash, nil
+}
+
+// put stores a report's hash, seen at the given time.
+func (s *stateStore) put(id, hash string, seen time.Time) error {
+	v := make([]byte, 8, 8+len(hash))
+	binary.BigEndian.PutUint64(v, uint64(seen.Unix()))
+	v = append(v, hash...)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(hashesBucket).Put([]byte(id), v)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write state for %s: %w", id, err)
+	}
+	return nil
+}
+
+// forget drops a report's hash, so it is forwarded next time it's seen.
+func (s *stateStore) forget(id string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(hashesBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete state for %s: %w", id, err)
+	}
+	return nil
+}
+
+// prune drops the reports last seen before the given time and returns how
+// many there were.
+func (s *stateStore) prune(before time.Time) (int, error) {
+	var stale [][]byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(hashesBucket)
+		// Deleting while iterating makes the cursor skip keys.
+		err := b.ForEach(func(k, v []byte) error {
+			if len(v) < 8 || int64(binary.BigEndian.Uint64(v)) < before.Unix() {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune state store: %w", err)
+	}
+	return len(stale), nil
+}
+
+// pruneEvery drops the reports past the retention every interval until ctx
+// is done, so a long-running ETL doesn't keep every report it has seen.
+func (s *stateStore) pruneEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if n, err := s.prune(time.Now().Add(-s.retention)); err != nil {
+			log.Printf("Error pruning state store: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d reports from the state store", n)
+		}
+	}
+}
+
+// contentHash hashes a transformed report. The date is left out: the
+// producer sets it to the time of each run, and the API keeps the first.
+func contentHash(transformed string) (string, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(transformed), &fields); err != nil {
+		return "", err
+	}
+	delete(fields, "date")
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -1,4 +1,5 @@
-import { fetchStormReports, closeProducer } from '../index';
+import { fetchStormReports, closeProducer, snapshotMessages } from '../index';
+import { StormType } from '../types';
 import axios from 'axios';
 import { Readable } from 'stream';
 
@@ -94,3 +95,30 @@ describe('fetchStormReports', () => {
     }
   });
 });
+
+describe('snapshotMessages', () => {
+  it('should tag rows and end with a marker', () => {
+    const messages = snapshotMessages(
+      [{ Location: 'Denver' }, { Location: 'Provo' }],
+      StormType.HAIL,
+      '1733773195000',
+    );
+    expect(messages).toEqual([
+      { Location: 'Denver', type: 'hail', snapshotId: 'hail-1733773195000' },
+      { Location: 'Provo', type: 'hail', snapshotId: 'hail-1733773195000' },
+      {
+        snapshotId: 'hail-1733773195000',
+        snapshotEnd: 'true',
+        snapshotCount: '2',
+        type: 'hail',
+        date: '1733773195000',
+      },
+    ]);
+  });
+
+  it('should send a marker for an empty file', () => {
+    expect(snapshotMessages([], StormType.WIND, '1733773195000')).toEqual([
+      expect.objectContaining({ snapshotEnd: 'true', snapshotCount: '0' }),
+    ]);
+  });
+});
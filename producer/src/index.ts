@@ -99,9 +99,11 @@ const processQueue = async (topic: string) => {
   while (messageQueue.length > 0) {
     const message = messageQueue.shift();
     try {
+      // Keying by snapshot keeps a snapshot's rows and its end marker in
+      // order on one partition.
       await producer.send({
         topic,
-        messages: [{ value: JSON.stringify(message) }],
+        messages: [{ key: message!.snapshotId, value: JSON.stringify(message) }],
       });
     } catch (err) {
       console.error('Failed to send message, re-queuing:', err);
@@ -151,6 +153,28 @@ export const fetchStormReports = async (
   });
 };
 
+// Each type's file is the complete set of that day's reports, so it is
+// published as a snapshot: every row is tagged with the snapshot ID, and an
+// end marker gives the row count. The ETL retracts reports that disappear
+// from one snapshot to the next.
+export const snapshotMessages = (
+  reports: StormReport[],
+  type: StormType,
+  date: string,
+): StormReport[] => {
+  const snapshotId = `${type}-${date}`;
+  return [
+    ...reports.map((report) => ({ ...report, type, snapshotId })),
+    {
+      snapshotId,
+      snapshotEnd: 'true',
+      snapshotCount: reports.length.toString(),
+      type,
+      date,
+    },
+  ];
+};
+
 // Generate storms for testing
 export const generateStormsToday = () => {
   const types = [StormType.TORNADO, StormType.HAIL, StormType.WIND];
@@ -194,6 +218,7 @@ export const generateStormsToday = () => {
       comments: 'Generated storm',
       county: 'Some County',
       state: state,
+      synthetic: 'true',
     };
 
     if (type === StormType.TORNADO) {
@@ -220,17 +245,19 @@ export const runProducer = async () => {
 
   try {
     console.log('Fetching storm reports...');
+    const fetchedAt = new Date().getTime().toString();
     const [tornados, hail, wind] = await Promise.all([
-      fetchStormReports(tornadoURL),
-      fetchStormReports(hailURL),
-      fetchStormReports(windURL),
+      fetchStormReports(tornadoURL, fetchedAt),
+      fetchStormReports(hailURL, fetchedAt),
+      fetchStormReports(windURL, fetchedAt),
     ]);
     const allReports = [
-      ...tornados.map((report) => ({ ...report, type: StormType.TORNADO })),
-      ...hail.map((report) => ({ ...report, type: StormType.HAIL })),
-      ...wind.map((report) => ({ ...report, type: StormType.WIND })),
+      ...snapshotMessages(tornados, StormType.TORNADO, fetchedAt),
+      ...snapshotMessages(hail, StormType.HAIL, fetchedAt),
+      ...snapshotMessages(wind, StormType.WIND, fetchedAt),
     ];
-    console.log(`Fetched ${allReports.length} reports. Publishing to Kafka...`);
+    const count = tornados.length + hail.length + wind.length;
+    console.log(`Fetched ${count} reports. Publishing to Kafka...`);
 
     await publishToKafka(allReports, topic);
     console.log('Published storm reports to Kafka.');